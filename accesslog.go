@@ -0,0 +1,109 @@
+package canid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessLogCLF  = "clf"
+	AccessLogJSON = "json"
+)
+
+// accessLogEntry is an access log line in JSON format.
+
+type accessLogEntry struct {
+	Time    time.Time
+	Client  string
+	Method  string
+	Path    string
+	Query   string `json:",omitempty"`
+	Status  int
+	Bytes   int64
+	Latency float64
+}
+
+// statusRecorder records the status and length of a response.
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// AccessLog returns middleware writing a line per request to out, with the
+// client address, method, path and query, response status and length, and
+// latency, either in Common Log Format (with the latency in seconds
+// appended), or as a JSON object. Add it first, so that requests refused by
+// other middleware are logged too.
+func AccessLog(out io.Writer, format string) (func(http.Handler) http.Handler, error) {
+	if format != AccessLogCLF && format != AccessLogJSON {
+		return nil, fmt.Errorf("unknown access log format %s", format)
+	}
+	var lock sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, req)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			client, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				client = req.RemoteAddr
+			}
+			var line []byte
+			if format == AccessLogJSON {
+				line, _ = json.Marshal(accessLogEntry{
+					Time:    start.UTC(),
+					Client:  client,
+					Method:  req.Method,
+					Path:    req.URL.Path,
+					Query:   req.URL.RawQuery,
+					Status:  rec.status,
+					Bytes:   rec.bytes,
+					Latency: time.Since(start).Seconds(),
+				})
+				line = append(line, '\n')
+			} else {
+				line = []byte(fmt.Sprintf("%s - - [%s] %q %d %d %.6f\n",
+					client, start.Format("02/Jan/2006:15:04:05 -0700"),
+					req.Method+" "+req.URL.RequestURI()+" "+req.Proto,
+					rec.status, rec.bytes, time.Since(start).Seconds()))
+			}
+			lock.Lock()
+			out.Write(line)
+			lock.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,52 @@
+package canid
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ParseAddress parses an IPv4 or IPv6 address, which may be given as a
+// socket address with a port (203.0.113.7:443 or [2001:db8::1]:8080) or an
+// IPv6 address in brackets, as commonly found in logs; the port is ignored.
+// It returns nil if s is not an address.
+func ParseAddress(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return net.ParseIP(s[1 : len(s)-1])
+	}
+	return nil
+}
+
+// sortAddresses sorts addresses in place, IPv4 before IPv6, and otherwise in
+// numerical order, so that responses don't depend on the order in which the
+// resolver returned them.
+func sortAddresses(addrs []net.IP) {
+	sort.Slice(addrs, func(i, j int) bool {
+		v4i, v4j := addrs[i].To4() != nil, addrs[j].To4() != nil
+		if v4i != v4j {
+			return v4i
+		}
+		return bytes.Compare(addrs[i].To16(), addrs[j].To16()) < 0
+	})
+}
+
+// splitAddresses returns the IPv4 and IPv6 addresses among addrs, in order,
+// or nil for a family without any.
+func splitAddresses(addrs []net.IP) (v4 []net.IP, v6 []net.IP) {
+	for _, addr := range addrs {
+		if addr.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	return
+}
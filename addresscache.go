@@ -1,83 +1,478 @@
 package canid
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Query types supported by the address cache
+const (
+	QueryTypeAny  = "ANY"
+	QueryTypeA    = "A"
+	QueryTypeAAAA = "AAAA"
+	QueryTypePTR  = "PTR"
+)
+
+// Resolver name for the Go standard library's default resolver
+const SystemResolver = "system"
+
+// AddressKey identifies an entry in the address cache by name, query type
+// and resolver, so that lookups for different record types of the same name
+// do not share an entry.
+
+type AddressKey struct {
+	Name     string
+	Type     string
+	Resolver string
+}
+
+// NewAddressKey returns the canonical key for a name and query type: the name
+// is lowercased and stripped of any trailing dot, and the type is uppercased,
+// defaulting to ANY.
+func NewAddressKey(name string, qtype string, resolver string) AddressKey {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	qtype = strings.ToUpper(qtype)
+	if len(qtype) == 0 {
+		qtype = QueryTypeAny
+	}
+	return AddressKey{name, qtype, resolver}
+}
+
+// String returns the key as used in the cache's data map.
+func (key AddressKey) String() string {
+	return key.Name + "/" + key.Type + "@" + key.Resolver
+}
+
+// network returns the network name to pass to net.Resolver for this key's
+// query type.
+func (key AddressKey) network() (string, error) {
+	switch key.Type {
+	case QueryTypeAny:
+		return "ip", nil
+	case QueryTypeA:
+		return "ip4", nil
+	case QueryTypeAAAA:
+		return "ip6", nil
+	case QueryTypePTR:
+		// reverse lookups don't take a network
+		return "", nil
+	default:
+		return "", fmt.Errorf("unsupported query type %s", key.Type)
+	}
+}
+
+// Classification of DNS lookup failures, stored in AddressInfo.Error
+const (
+	DNSErrorNotFound = "NXDOMAIN"
+	DNSErrorTimeout  = "TIMEOUT"
+	DNSErrorServFail = "SERVFAIL"
+)
+
+// Expiry in seconds for negative cache entries. Timeouts are retried soon;
+// nonexistent names are cached longer, but never longer than the cache
+// expiry. Other failures are not cached at all.
+const (
+	timeoutExpiry  = 30
+	notFoundExpiry = 3600
+)
+
+// classifyDNSError maps an error from the resolver to one of the DNSError
+// constants. Anything that is neither a timeout nor a nonexistent name is
+// treated as a server failure.
+func classifyDNSError(err error) string {
+	if dnserr, ok := err.(*net.DNSError); ok {
+		if dnserr.IsNotFound {
+			return DNSErrorNotFound
+		} else if dnserr.IsTimeout {
+			return DNSErrorTimeout
+		}
+	}
+	return DNSErrorServFail
+}
+
 type AddressInfo struct {
-	Name      string
-	Addresses []net.IP
-	Cached    time.Time
+	Name       string              `source:"canid" doc:"Name looked up, lowercased without a trailing dot; an address for PTR queries"`
+	Type       string              `source:"canid" doc:"Query type: ANY, A, AAAA, or PTR"`
+	Resolver   string              `source:"canid" doc:"Resolver used for the lookup"`
+	Addresses  []net.IP            `source:"dns" doc:"Addresses of the name; empty on failure and for PTR queries"`
+	A          []net.IP            `json:",omitempty" source:"dns" doc:"IPv4 addresses of the name, from A records"`
+	AAAA       []net.IP            `json:",omitempty" source:"dns" doc:"IPv6 addresses of the name, from AAAA records"`
+	CNAMEs     []string            `json:",omitempty" source:"dns" doc:"Chain of aliases from the name to its canonical name, in order, for resolvers queried directly"`
+	Validated  bool                `json:",omitempty" source:"dns" doc:"True if the resolver validated the answer with DNSSEC, for resolvers queried directly"`
+	Names      []string            `json:",omitempty" source:"dns" doc:"Names the address maps to, for PTR queries"`
+	Truncated  bool                `json:",omitempty" source:"canid" doc:"True if the name had more addresses than the cache keeps per name"`
+	Reputation map[string][]string `json:",omitempty" source:"blocklist" doc:"Names of the blocklists listing each listed address"`
+	Error      string              `json:",omitempty" source:"canid" doc:"Class of lookup failure: NXDOMAIN, TIMEOUT, or SERVFAIL"`
+	TTL        int                 `json:",omitempty" source:"dns" doc:"Lowest TTL of the records of the answer, or negative TTL of a nonexistent name, in seconds, if the resolver gave one; the entry expires after it, unless the cache expiry is shorter"`
+	Cached     time.Time           `source:"canid" doc:"Time the entry was looked up, in UTC"`
 }
 
 type AddressCache struct {
-	Data            map[string]AddressInfo
-	lock            sync.RWMutex
-	prefixes        *PrefixCache
-	expiry          int
-	backend_limiter chan struct{}
+	Data         map[string]AddressInfo
+	lock         sync.RWMutex
+	prefixes     *PrefixCache
+	expiry       int
+	pipeline     *lookupPipeline
+	clock        Clock
+	stats        cacheCounters
+	publishers   publishers
+	callbacks    CacheCallbacks
+	capacity     int
+	eviction     EvictionPolicy
+	admission    AdmissionPolicy
+	transforms   []AddressTransform
+	reputation   *Reputation
+	shared       SharedStore
+	maxAddresses int
+	maxPrecache  int
+	resolver     *DNSResolver
 }
 
 func NewAddressCache(expiry int, concurrency_limit int, prefixcache *PrefixCache) *AddressCache {
 	c := new(AddressCache)
 	c.Data = make(map[string]AddressInfo)
 	c.expiry = expiry
-	c.backend_limiter = make(chan struct{}, concurrency_limit)
+	c.stats = newCacheCounters(SystemClock{})
+	c.pipeline = newLookupPipeline("address", concurrency_limit, &c.stats, &c.callbacks)
 	c.prefixes = prefixcache
+	c.clock = SystemClock{}
+	c.resolver = &DNSResolver{Name: SystemResolver, Resolver: net.DefaultResolver}
 	return c
 }
 
+// SetResolver replaces the host's default resolver with the given one for
+// all lookups. Entries from other resolvers, e.g. loaded from a backing
+// store, are not used. It must be called before the cache is used.
+func (cache *AddressCache) SetResolver(resolver *DNSResolver) {
+	cache.resolver = resolver
+}
+
+// Lookup looks up all addresses for a name.
 func (cache *AddressCache) Lookup(name string) (out AddressInfo) {
+	out, _ = cache.LookupType(name, QueryTypeAny)
+	return
+}
+
+// LookupContext looks up all addresses for a name, returning the context's
+// error if the context is done before the resolver answers.
+func (cache *AddressCache) LookupContext(ctx context.Context, name string) (out AddressInfo, err error) {
+	return cache.LookupTypeContext(ctx, name, QueryTypeAny)
+}
+
+// LookupType looks up addresses of the given query type (A, AAAA, or ANY)
+// for a name. It returns an error only if the query type is not supported.
+func (cache *AddressCache) LookupType(name string, qtype string) (out AddressInfo, err error) {
+	return cache.LookupTypeContext(context.Background(), name, qtype)
+}
+
+// LookupTypeContext looks up addresses of the given query type for a name,
+// returning the context's error if the context is done before the resolver
+// answers. For PTR queries, the name is an address, and the names it maps to
+// are returned in Names.
+func (cache *AddressCache) LookupTypeContext(ctx context.Context, name string, qtype string) (out AddressInfo, err error) {
+	key := NewAddressKey(name, qtype, cache.resolver.Name)
+	network, err := key.network()
+	if err != nil {
+		return
+	}
+	if key.Type == QueryTypePTR {
+		ip := ParseAddress(key.Name)
+		if ip == nil {
+			err = fmt.Errorf("PTR query for %s, which is not an address", key.Name)
+			return
+		}
+		key.Name = ip.String()
+	}
+
 	// Cache lookup
 	var ok bool
+	probe_start := time.Now()
 	cache.lock.RLock()
-	out, ok = cache.Data[name]
+	out, ok = cache.Data[key.String()]
+	if cache.admission != nil {
+		cache.admission.Record(key.String())
+	}
 	cache.lock.RUnlock()
+	cache.stats.timings.observe(TimingCacheProbe, probe_start)
 	if ok {
 		// check for expiry
-		if int(time.Since(out.Cached).Seconds()) > cache.expiry {
-			log.Printf("entry expired for name %s", name)
+		if age(cache.clock, out.Cached) > cache.entryExpiry(out) {
+			slog.Debug("entry expired", "cache", "address", "name", key.String())
+			cache.stats.expired()
 			cache.lock.Lock()
-			delete(cache.Data, name)
+			cache.remove(key.String())
 			cache.lock.Unlock()
+			cache.callbacks.expired("address", key.String(), out)
 		} else {
-			log.Printf("cache hit for name %s", name)
+			slog.Debug("cache hit", "cache", "address", "name", key.String(), "cache_hit", true)
+			cache.stats.hit()
+			if cache.eviction != nil {
+				cache.eviction.Accessed(key.String())
+			}
 			return
 		}
 	}
 
-	// Cache miss. Lookup.
-	out.Name = name
-	cache.backend_limiter <- struct{}{}
-	addrs, err := net.LookupIP(name)
-	_ = <-cache.backend_limiter
-	if err == nil {
-		// we have addresses. precache prefix information.
+	// Cache miss, go ask the resolver, sharing any query already in flight
+	// for the same key
+	slog.Debug("cache miss", "cache", "address", "name", key.String(), "cache_hit", false)
+	cache.stats.miss()
+	res, err := cache.pipeline.fetch(ctx, key.String(), lookupStages{
+		shared: func(ctx context.Context) (interface{}, bool) {
+			return cache.fetchShared(ctx, key)
+		},
+		backend: func(ctx context.Context) (interface{}, error) {
+			return cache.resolve(ctx, key, network)
+		},
+		store: func(ctx context.Context, result interface{}) (interface{}, error) {
+			return cache.storeFetched(ctx, key, result.(AddressInfo)), nil
+		},
+	})
+	if err != nil {
+		return out, err
+	}
+	return res.(AddressInfo), nil
+}
+
+// resolve asks the resolver about a key. Resolver failures are classified in
+// Error rather than returned; it returns an error only if the context is done.
+func (cache *AddressCache) resolve(ctx context.Context, key AddressKey, network string) (out AddressInfo, err error) {
+	out.Name = key.Name
+	out.Type = key.Type
+	out.Resolver = key.Resolver
+	var addrs []net.IP
+	var names []string
+	var lerr error
+	lookup_ctx := ctx
+	if cache.resolver.Timeout > 0 {
+		var cancel context.CancelFunc
+		lookup_ctx, cancel = context.WithTimeout(ctx, cache.resolver.Timeout)
+		defer cancel()
+	}
+	if cache.resolver.dial != nil {
+		// direct queries, which give TTLs
+		var answer dnsAnswer
+		answer, lerr = cache.resolver.lookup(lookup_ctx, key.Type, key.Name)
+		addrs, names, out.TTL = answer.addrs, answer.names, answer.ttl
+		out.CNAMEs, out.Validated = answer.cnames, answer.validated
+	} else if key.Type == QueryTypePTR {
+		names, lerr = cache.resolver.Resolver.LookupAddr(lookup_ctx, key.Name)
+	} else {
+		addrs, lerr = cache.resolver.Resolver.LookupIP(lookup_ctx, network, key.Name)
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if lerr == nil && key.Type == QueryTypePTR {
+		out.Addresses = make([]net.IP, 0)
+		out.Names = make([]string, len(names))
+		for i := range names {
+			out.Names[i] = strings.TrimSuffix(names[i], ".")
+		}
+		sort.Strings(out.Names)
+	} else if lerr == nil {
+		sortAddresses(addrs)
 		out.Addresses = addrs
-		// precache prefixes, ignoring results
+	} else {
+		out.Addresses = make([]net.IP, 0)
+		out.Error = classifyDNSError(lerr)
+		slog.Debug("resolution failed", "name", key.String(), "error", out.Error, "err", lerr)
+	}
+	return
+}
+
+// storeFetched precaches prefix information for the addresses of an entry
+// fetched from the resolver, within the backend call budget of the context,
+// and caches it unless the server failed, returning the entry to answer with.
+func (cache *AddressCache) storeFetched(ctx context.Context, key AddressKey, out AddressInfo) AddressInfo {
+	if out.Error == "" && key.Type != QueryTypePTR {
+		// we have addresses. precache prefix information.
+		if cache.maxAddresses > 0 && len(out.Addresses) > cache.maxAddresses {
+			slog.Debug("truncating addresses", "name", key.String(), "kept", cache.maxAddresses, "addresses", len(out.Addresses))
+			out.Addresses = out.Addresses[:cache.maxAddresses]
+			out.Truncated = true
+		}
+		out.A, out.AAAA = splitAddresses(out.Addresses)
+		// precache prefixes, ignoring results, until the budget runs out
 		if cache.prefixes != nil {
-			for _, addr := range addrs {
-				_, _ = cache.prefixes.Lookup(addr)
+			precache_start := time.Now()
+			precache := out.Addresses
+			if cache.maxPrecache > 0 && len(precache) > cache.maxPrecache {
+				precache = precache[:cache.maxPrecache]
 			}
+			precache_ctx := detachBudget(ctx)
+			for _, addr := range precache {
+				if _, err := cache.prefixes.LookupContext(precache_ctx, addr); err == ErrBudgetExhausted {
+					break
+				}
+			}
+			cache.stats.timings.observe(TimingPrecache, precache_start)
 		}
-	} else {
-		out.Addresses = make([]net.IP, 0)
-		log.Printf("error looking up %s: %s", name, err.Error())
-		err = nil
 	}
 
-	// cache and return
-	out.Cached = time.Now().UTC()
+	// cache and return, unless the server failed
+	out.Cached = cache.now()
+	if out.Error == DNSErrorServFail || out.Error == DNSErrorTimeout {
+		cache.stats.backendError()
+		cache.callbacks.backendFailed("address", key.String(), errors.New(out.Error))
+	}
+	if out.Error == DNSErrorServFail {
+		return out
+	}
 	cache.lock.Lock()
-	cache.Data[out.Name] = out
+	// a concurrent miss for the same key may have beaten us to it; if so,
+	// keep its entry as the canonical one
+	if existing, ok := cache.Data[key.String()]; ok && age(cache.clock, existing.Cached) <= cache.entryExpiry(existing) {
+		cache.lock.Unlock()
+		slog.Debug("duplicate fetch, keeping existing entry", "cache", "address", "name", key.String())
+		cache.stats.duplicateFetch()
+		return existing
+	}
+	stored := cache.store(key.String(), out)
 	cache.lock.Unlock()
-	log.Printf("cached name %s -> %v", out.Name, out)
-	return
+	putShared(cache.shared, "address", key.String(), out, cache.entryExpiry(out))
+	if !stored {
+		slog.Debug("not admitting entry", "cache", "address", "name", key.String())
+		return out
+	}
+	slog.Debug("cached", "cache", "address", "name", key.String(), "addresses", len(out.Addresses), "error", out.Error)
+	cache.publishers.publish("address", key.String(), out)
+	cache.callbacks.inserted("address", key.String(), out)
+	return out
+}
+
+// store adds an entry to the cache, evicting entries as necessary to stay
+// within capacity. If the cache is full and the admission policy prefers the
+// entry that would be evicted, the new entry is not stored, and store returns
+// false. The caller must hold the write lock.
+func (cache *AddressCache) store(key string, info AddressInfo) bool {
+	_, exists := cache.Data[key]
+	if !exists && cache.eviction != nil && cache.admission != nil && len(cache.Data) >= cache.capacity {
+		if victim, ok := cache.eviction.Victim(); ok && !cache.admission.Admit(key, victim) {
+			cache.stats.rejected()
+			return false
+		}
+	}
+
+	cache.Data[key] = info
+	if cache.eviction != nil {
+		if !exists {
+			cache.eviction.Added(key)
+		}
+		cache.evict()
+	}
+	return true
+}
+
+// remove deletes an entry from the cache. The caller must hold the write lock.
+func (cache *AddressCache) remove(key string) {
+	delete(cache.Data, key)
+	if cache.eviction != nil {
+		cache.eviction.Removed(key)
+	}
+}
+
+// evict removes entries chosen by the eviction policy until the cache is
+// within capacity. The caller must hold the write lock.
+func (cache *AddressCache) evict() {
+	for len(cache.Data) > cache.capacity {
+		key, ok := cache.eviction.Victim()
+		if !ok {
+			break
+		}
+		slog.Debug("evicting", "cache", "address", "name", key)
+		entry := cache.Data[key]
+		cache.remove(key)
+		cache.stats.evicted()
+		cache.callbacks.evicted("address", key, entry)
+	}
+}
+
+// SetEviction limits the cache to the given number of entries, evicting
+// entries chosen by the given policy when it is full. Entries already in the
+// cache (e.g. loaded from a backing store) are registered with the policy,
+// and evicted if over capacity. A capacity of 0 removes the limit.
+func (cache *AddressCache) SetEviction(capacity int, policy EvictionPolicy) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if capacity <= 0 {
+		cache.capacity = 0
+		cache.eviction = nil
+		cache.admission = nil
+		return
+	}
+	cache.capacity = capacity
+	cache.eviction = policy
+	cached := make(map[string]time.Time, len(cache.Data))
+	for key, info := range cache.Data {
+		cached[key] = info.Cached
+	}
+	registerEntries(policy, cached)
+	cache.evict()
+}
+
+// SetAdmission filters new entries through the given admission policy when
+// the cache is at capacity; see AdmissionPolicy. It has no effect unless a
+// capacity has been set with SetEviction. A nil policy admits every entry.
+func (cache *AddressCache) SetAdmission(policy AdmissionPolicy) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.admission = policy
+}
+
+// SetFanout limits the number of addresses kept per name to maxAddresses,
+// and the number of those whose prefixes are precached per lookup to
+// maxPrecache, so that names with huge address sets (e.g. wildcard CDN
+// names) don't flood the cache and the prefix backend. 0 means no limit. It
+// must be called before the cache is used.
+func (cache *AddressCache) SetFanout(maxAddresses int, maxPrecache int) {
+	cache.maxAddresses = maxAddresses
+	cache.maxPrecache = maxPrecache
+}
+
+// entryExpiry returns the expiry in seconds for a given entry, taking
+// negative caching and the TTL of its records into account.
+func (cache *AddressCache) entryExpiry(info AddressInfo) int {
+	return dnsEntryExpiry(cache.expiry, info.Error, info.TTL)
+}
+
+// dnsEntryExpiry returns the expiry in seconds for an entry of a DNS cache
+// with the given expiry, lookup failure class, and TTL: timeouts are retried
+// soon, nonexistent names without a negative TTL are cached for up to an
+// hour, and any TTL is honored if it is shorter.
+func dnsEntryExpiry(expiry int, dnserror string, ttl int) int {
+	switch dnserror {
+	case DNSErrorTimeout:
+		if timeoutExpiry < expiry {
+			expiry = timeoutExpiry
+		}
+	case DNSErrorNotFound:
+		if ttl == 0 && notFoundExpiry < expiry {
+			expiry = notFoundExpiry
+		}
+	}
+	if ttl > 0 && ttl < expiry {
+		expiry = ttl
+	}
+	return expiry
+}
+
+// ttl returns the number of seconds until an entry expires, or 0 if it
+// already has.
+func (cache *AddressCache) ttl(info AddressInfo) int {
+	if ttl := cache.entryExpiry(info) - age(cache.clock, info.Cached); ttl > 0 {
+		return ttl
+	}
+	return 0
 }
 
 func (cache *AddressCache) LookupServer(w http.ResponseWriter, req *http.Request) {
@@ -88,8 +483,106 @@ func (cache *AddressCache) LookupServer(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	addr_info := cache.Lookup(name)
+	addr_info, err := cache.LookupTypeContext(req.Context(), name, req.URL.Query().Get("type"))
+	if req.Context().Err() != nil {
+		// client went away, nobody to answer
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		error_struct := struct{ Error string }{err.Error()}
+		error_body, _ := json.Marshal(error_struct)
+		w.Write(error_body)
+		return
+	}
 
+	cache.annotate(req.Context(), &addr_info)
+	cache.transform(&addr_info)
 	addr_body, _ := json.Marshal(addr_info)
+
+	// nonexistent names are a valid answer; other failures are the backend's
+	switch addr_info.Error {
+	case DNSErrorTimeout:
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case DNSErrorServFail:
+		w.WriteHeader(http.StatusBadGateway)
+	default:
+		writeCacheable(w, req, addr_body, cache.ttl(addr_info))
+		return
+	}
 	w.Write(addr_body)
 }
+
+// AddPublisher arranges for every new entry in the cache to be passed to the
+// given publisher. It must be called before the cache is used.
+func (cache *AddressCache) AddPublisher(publisher Publisher) {
+	cache.publishers = append(cache.publishers, publisher)
+}
+
+// SetClock replaces the clock used to timestamp and expire entries, and to
+// time statistics. It must be called before the cache is used.
+func (cache *AddressCache) SetClock(clock Clock) {
+	cache.clock = clock
+	cache.stats.since = clock.Now().UTC()
+}
+
+// Clock returns the clock used to timestamp and expire entries.
+func (cache *AddressCache) Clock() Clock {
+	return cache.clock
+}
+
+// now returns the current time according to the cache's clock, in UTC, for
+// timestamping entries.
+func (cache *AddressCache) now() time.Time {
+	return cache.clock.Now().UTC()
+}
+
+// Stats returns a snapshot of the address cache's size and activity.
+func (cache *AddressCache) Stats() CacheStats {
+	cache.lock.RLock()
+	entries := len(cache.Data)
+	cache.lock.RUnlock()
+	return cache.stats.snapshot("address", entries)
+}
+
+// MarshalJSON encodes the cache's entries while holding its lock, so the
+// cache can be dumped while it is in use.
+func (cache *AddressCache) MarshalJSON() ([]byte, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return json.Marshal(struct {
+		Data map[string]AddressInfo
+	}{cache.Data})
+}
+
+// Flush removes all entries from the address cache, as Purge, and from its
+// shared store and publishers keeping entries, returning the number of
+// entries removed from the cache.
+func (cache *AddressCache) Flush() int {
+	n := cache.Purge()
+	forget(cache.shared, cache.publishers, "address", nil)
+	return n
+}
+
+// Purge removes all entries from the address cache, returning the number of
+// entries removed. The linked prefix cache, the shared store and publishers
+// are not affected.
+func (cache *AddressCache) Purge() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	n := len(cache.Data)
+	if cache.eviction != nil {
+		for key := range cache.Data {
+			cache.eviction.Removed(key)
+		}
+	}
+	cache.Data = make(map[string]AddressInfo)
+	return n
+}
+
+func (cache *AddressCache) StatsServer(w http.ResponseWriter, req *http.Request) {
+	writeStats(w, cache.Stats())
+}
+
+func (cache *AddressCache) PurgeServer(w http.ResponseWriter, req *http.Request) {
+	purgeServer(w, req, "address", cache.Flush)
+}
@@ -0,0 +1,154 @@
+package canid
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// cacheAdminPaths are the cache management resources outside /admin/, which
+// change the caches or the backing store, or export them.
+var cacheAdminPaths = map[string]bool{
+	"/cache/prefix":      true,
+	"/cache/address":     true,
+	"/cache/flush":       true,
+	"/cache/save":        true,
+	"/cache/import":      true,
+	"/cache/keys.json":   true,
+	"/cache/search.json": true,
+	"/dump.json":         true,
+}
+
+// IsAdminPath returns true for the paths of administrative resources, which
+// change canid's state or expose its internals: those under /admin/, the
+// cache management resources under /cache/ (including the key listing and
+// search, which reveal every name looked up and what it resolved to), and
+// the cache dump.
+func IsAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/admin/") || cacheAdminPaths[path]
+}
+
+// AdminAuth returns middleware requiring requests for administrative
+// resources to carry the given token as a bearer token in an Authorization
+// header, answering others with status 401. Without a token, administrative
+// resources are not served at all, as with DenyAdmin, so that they are never
+// open to anyone by default.
+func AdminAuth(token string) func(http.Handler) http.Handler {
+	if len(token) == 0 {
+		return DenyAdmin
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if IsAdminPath(req.URL.Path) {
+				given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+				if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="canid"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					error_struct := struct{ Error string }{"admin token required"}
+					error_body, _ := json.Marshal(error_struct)
+					w.Write(error_body)
+					return
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// RemoveName removes the address cache entries for a name, of every query
+// type and resolver, returning the number of entries removed. They are also
+// removed from the shared store and publishers keeping entries, along with
+// the entries another instance may have stored for the name with the
+// cache's resolver.
+func (cache *AddressCache) RemoveName(name string) int {
+	name = NewAddressKey(name, "", "").Name
+	var keys []string
+	for _, qtype := range []string{QueryTypeAny, QueryTypeA, QueryTypeAAAA, QueryTypePTR} {
+		keys = append(keys, NewAddressKey(name, qtype, cache.resolver.Name).String())
+	}
+	cache.lock.Lock()
+	n := 0
+	for key, info := range cache.Data {
+		if info.Name == name {
+			cache.remove(key)
+			keys = append(keys, key)
+			n++
+		}
+	}
+	cache.lock.Unlock()
+	forget(cache.shared, cache.publishers, "address", keys)
+	return n
+}
+
+// removeServer writes the number of entries removed from a cache, rejecting
+// anything but DELETE, and requests without the given parameter.
+func removeServer(w http.ResponseWriter, req *http.Request, name string, param string, remove func(string) (int, bool)) {
+	if req.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	removed, ok := remove(req.URL.Query().Get(param))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		error_struct := struct{ Error string }{"missing or invalid " + param}
+		error_body, _ := json.Marshal(error_struct)
+		w.Write(error_body)
+		return
+	}
+
+	remove_struct := struct {
+		Cache   string
+		Removed int
+	}{name, removed}
+	remove_body, _ := json.Marshal(remove_struct)
+	w.Write(remove_body)
+}
+
+// RemoveServer removes the entry for the prefix given by the prefix
+// parameter, so that it is looked up afresh when next used.
+func (cache *PrefixCache) RemoveServer(w http.ResponseWriter, req *http.Request) {
+	removeServer(w, req, "prefix", "prefix", func(prefix string) (int, bool) {
+		pfx, ok := parsePrefixKey(prefix)
+		if !ok {
+			return 0, false
+		}
+		return cache.Remove(pfx.String()), true
+	})
+}
+
+// RemoveServer removes the entries for the name given by the name parameter,
+// so that it is resolved afresh when next used.
+func (cache *AddressCache) RemoveServer(w http.ResponseWriter, req *http.Request) {
+	removeServer(w, req, "address", "name", func(name string) (int, bool) {
+		if len(name) == 0 {
+			return 0, false
+		}
+		return cache.RemoveName(name), true
+	})
+}
+
+// FlushServer returns an HTTP handler purging the caches, and writing the
+// number of entries removed from each, keyed by cache name. Either of the
+// prefix and address caches may be nil. It rejects anything but POST.
+func FlushServer(prefixes *PrefixCache, addresses *AddressCache, records ...*RecordCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		purged := make(map[string]int)
+		if prefixes != nil {
+			purged["prefix"] = prefixes.Flush()
+		}
+		if addresses != nil {
+			purged["address"] = addresses.Flush()
+		}
+		for _, cache := range records {
+			purged[cache.name] = cache.Flush()
+		}
+		flush_struct := struct{ Purged map[string]int }{purged}
+		flush_body, _ := json.Marshal(flush_struct)
+		w.Write(flush_body)
+	}
+}
@@ -0,0 +1,69 @@
+package canid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		auth   string
+		status int
+	}{
+		{"no token, admin path", "", "/admin/purge/prefix", "", http.StatusNotFound},
+		{"no token, cache management", "", "/cache/flush", "", http.StatusNotFound},
+		{"no token, dump", "", "/dump.json", "Bearer ", http.StatusNotFound},
+		{"no token, keys", "", "/cache/keys.json", "", http.StatusNotFound},
+		{"no token, search", "", "/cache/search.json", "", http.StatusNotFound},
+		{"no token, lookup", "", "/prefix.json", "", http.StatusOK},
+		{"missing header", "secret", "/cache/save", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "/cache/import", "Bearer wrong", http.StatusUnauthorized},
+		{"not bearer", "secret", "/admin/selftest", "secret", http.StatusUnauthorized},
+		{"empty bearer", "secret", "/cache/prefix", "Bearer ", http.StatusUnauthorized},
+		{"right token", "secret", "/cache/address", "Bearer secret", http.StatusOK},
+		{"lookup without header", "secret", "/address.json", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, test.path, nil)
+			if len(test.auth) > 0 {
+				req.Header.Set("Authorization", test.auth)
+			}
+			w := httptest.NewRecorder()
+			AdminAuth(test.token)(ok).ServeHTTP(w, req)
+			if w.Code != test.status {
+				t.Errorf("status %d, want %d", w.Code, test.status)
+			}
+			if w.Code == http.StatusUnauthorized && len(w.Header().Get("WWW-Authenticate")) == 0 {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+func TestDenyAdmin(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for path, status := range map[string]int{
+		"/admin/debug/backend.json": http.StatusNotFound,
+		"/cache/import":             http.StatusNotFound,
+		"/cache/keys.json":          http.StatusNotFound,
+		"/cache/quality.json":       http.StatusOK,
+		"/prefix.json":              http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		DenyAdmin(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != status {
+			t.Errorf("%s: status %d, want %d", path, w.Code, status)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package canid
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// AdmissionPolicy decides whether a new entry should displace an existing
+// one when a cache is at capacity. It sees every key looked up, hit or miss,
+// so it can keep entries which are never requested again from pushing out
+// hot ones. Implementations must be safe for concurrent use.
+
+type AdmissionPolicy interface {
+	// Record notes a lookup of the given key.
+	Record(key string)
+	// Admit returns true if the candidate should replace the victim.
+	Admit(candidate string, victim string) bool
+}
+
+// Names of the built-in admission policies
+const (
+	AdmitAll     = "all"
+	AdmitTinyLFU = "tinylfu"
+)
+
+// NewAdmissionPolicy returns a new instance of a built-in admission policy by
+// name, sized for a cache of the given capacity. The all policy returns nil,
+// which admits every entry.
+func NewAdmissionPolicy(name string, capacity int) (AdmissionPolicy, error) {
+	switch name {
+	case AdmitAll:
+		return nil, nil
+	case AdmitTinyLFU:
+		return newTinyLFU(capacity), nil
+	default:
+		return nil, fmt.Errorf("unknown admission policy %s", name)
+	}
+}
+
+// tinyLFU admits a candidate only if it has been looked up more often than
+// the victim, estimating lookup frequency with a count-min sketch of 4-bit
+// counters. All counters are halved every sampleSize lookups so that the
+// estimate follows changes in popularity.
+
+const (
+	tinyLFUDepth      = 4
+	tinyLFUMaxCount   = 15
+	tinyLFUSampleRate = 10
+)
+
+type tinyLFU struct {
+	lock       sync.Mutex
+	counters   [tinyLFUDepth][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newTinyLFU(capacity int) *tinyLFU {
+	width := 64
+	for width < capacity {
+		width <<= 1
+	}
+
+	t := new(tinyLFU)
+	for i := range t.counters {
+		t.counters[i] = make([]uint8, width)
+	}
+	t.mask = uint64(width - 1)
+	t.sampleSize = tinyLFUSampleRate * width
+	return t
+}
+
+// indices returns the counter index in each row for a key, by double
+// hashing a single 64-bit FNV hash.
+func (t *tinyLFU) indices(key string) (out [tinyLFUDepth]uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	for i := range out {
+		out[i] = (h1 + uint64(i)*h2) & t.mask
+	}
+	return
+}
+
+func (t *tinyLFU) estimate(key string) uint8 {
+	min := uint8(tinyLFUMaxCount)
+	for i, idx := range t.indices(key) {
+		if t.counters[i][idx] < min {
+			min = t.counters[i][idx]
+		}
+	}
+	return min
+}
+
+func (t *tinyLFU) Record(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i, idx := range t.indices(key) {
+		if t.counters[i][idx] < tinyLFUMaxCount {
+			t.counters[i][idx]++
+		}
+	}
+
+	t.additions++
+	if t.additions >= t.sampleSize {
+		for i := range t.counters {
+			for j := range t.counters[i] {
+				t.counters[i][j] >>= 1
+			}
+		}
+		t.additions /= 2
+	}
+}
+
+func (t *tinyLFU) Admit(candidate string, victim string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.estimate(candidate) > t.estimate(victim)
+}
@@ -0,0 +1,64 @@
+package canid
+
+// WellKnownASLabels are friendly labels for the ASes of large cloud, hosting,
+// and content delivery providers, crawlers, and research scanners, which
+// account for much of the traffic human readers would otherwise have to look
+// up by number.
+var WellKnownASLabels = map[int]string{
+	714:    "Apple",
+	8075:   "Microsoft",
+	13335:  "Cloudflare",
+	14061:  "DigitalOcean",
+	14618:  "Amazon AWS",
+	15169:  "Google",
+	16276:  "OVHcloud",
+	16509:  "Amazon AWS",
+	20473:  "Vultr",
+	20940:  "Akamai",
+	24940:  "Hetzner",
+	32934:  "Meta",
+	36351:  "IBM Cloud",
+	45102:  "Alibaba Cloud",
+	54113:  "Fastly",
+	63949:  "Akamai Linode",
+	132203: "Tencent Cloud",
+	211298: "Driftnet scanner",
+	396982: "Google Cloud",
+	398324: "Censys scanner",
+	398705: "Censys scanner",
+}
+
+// ASLabels maps AS numbers to friendly labels, so that human-facing
+// interfaces needn't show bare AS numbers.
+
+type ASLabels struct {
+	byASN map[int]string
+}
+
+// NewASLabels creates AS labels from the given maps of AS numbers to labels,
+// later maps overriding earlier ones; an empty label removes an AS's label.
+func NewASLabels(labels ...map[int]string) *ASLabels {
+	out := &ASLabels{byASN: make(map[int]string)}
+	for _, m := range labels {
+		for asn, label := range m {
+			if len(label) > 0 {
+				out.byASN[asn] = label
+			} else {
+				delete(out.byASN, asn)
+			}
+		}
+	}
+	return out
+}
+
+// Label returns the label of an AS, or an empty string if it has none.
+func (labels *ASLabels) Label(asn int) string {
+	return labels.byASN[asn]
+}
+
+// Transform sets ASLabel from ASN. Use it as a PrefixTransform.
+func (labels *ASLabels) Transform(info *PrefixInfo) {
+	if label := labels.Label(info.ASN); len(label) > 0 {
+		info.ASLabel = label
+	}
+}
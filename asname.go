@@ -0,0 +1,139 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ASNamer looks up the name (e.g. GOOGLE) and holder (the organization) of an
+// AS.
+
+type ASNamer interface {
+	ASName(ctx context.Context, asn int) (name string, holder string, err error)
+}
+
+// ASNames is the ASNamer used to fill in ASName and Holder for new prefix
+// cache entries, whatever the prefix backend. Set it before any lookups; nil
+// (the default) disables AS name lookups.
+var ASNames ASNamer
+
+// nameAS fills in the AS name and holder of an entry, if AS name lookups are
+// enabled and the entry has an origin AS. If the lookup fails, the entry is
+// marked Partial, with the reason in Warnings.
+func nameAS(ctx context.Context, out *PrefixInfo) {
+	namer := ASNames
+	if namer == nil || out.ASN == 0 {
+		return
+	}
+	name, holder, err := namer.ASName(ctx, out.ASN)
+	if err != nil {
+		slog.Warn("AS name lookup failed", "asn", out.ASN, "err", err)
+		out.Partial = true
+		out.Warnings = append(out.Warnings, "AS name lookup failed: "+err.Error())
+		return
+	}
+	out.ASName = name
+	out.Holder = holder
+}
+
+// Expiry and size limit of the AS name cache. AS names rarely change, and
+// there are few enough ASes in use that the cache can hold most of them.
+const (
+	asNameExpiry     = 24 * time.Hour
+	asNameCacheLimit = 100000
+)
+
+// RipestatASNamer looks up AS names using RIPEstat's AS overview API, and
+// caches them by AS number, since many prefixes share an origin AS.
+
+type RipestatASNamer struct {
+	lock  sync.Mutex
+	cache map[int]asNameEntry
+	clock Clock
+}
+
+type asNameEntry struct {
+	name    string
+	holder  string
+	expires time.Time
+}
+
+const ripeStatASOverviewCall = "as-overview"
+
+func NewRipestatASNamer() *RipestatASNamer {
+	return &RipestatASNamer{cache: make(map[int]asNameEntry), clock: SystemClock{}}
+}
+
+// SetClock replaces the clock used to expire cached names. It must be called
+// before the namer is used.
+func (namer *RipestatASNamer) SetClock(clock Clock) {
+	namer.clock = clock
+}
+
+func (namer *RipestatASNamer) ASName(ctx context.Context, asn int) (string, string, error) {
+	namer.lock.Lock()
+	entry, ok := namer.cache[asn]
+	namer.lock.Unlock()
+	if ok && namer.clock.Now().Before(entry.expires) {
+		return entry.name, entry.holder, nil
+	}
+
+	v := make(url.Values)
+	v.Add("resource", "AS"+strconv.Itoa(asn))
+	body, err := fetchRipestatQuery(ctx, ripeStatASOverviewCall, v)
+	if err != nil {
+		return "", "", err
+	}
+
+	checkRipestatSchema(ripeStatASOverviewCall, body)
+
+	var doc struct {
+		Status string
+		Data   struct {
+			Holder string
+		}
+	}
+	parse_start := time.Now()
+	err = json.Unmarshal(body, &doc)
+	observeTiming(ctx, TimingParse, parse_start)
+	if err != nil {
+		return "", "", err
+	}
+	if doc.Status != "ok" {
+		return "", "", errors.New("RIPEstat request failed with status " + doc.Status)
+	}
+
+	// the holder is given as "NAME - Organization"
+	entry.name, entry.holder = doc.Data.Holder, ""
+	if i := strings.Index(doc.Data.Holder, " - "); i >= 0 {
+		entry.name, entry.holder = doc.Data.Holder[:i], doc.Data.Holder[i+3:]
+	}
+
+	namer.lock.Lock()
+	defer namer.lock.Unlock()
+	now := namer.clock.Now()
+	if len(namer.cache) >= asNameCacheLimit {
+		// drop expired entries, or failing that, an arbitrary one
+		for key, old := range namer.cache {
+			if now.After(old.expires) {
+				delete(namer.cache, key)
+			}
+		}
+		for key := range namer.cache {
+			if len(namer.cache) < asNameCacheLimit {
+				break
+			}
+			delete(namer.cache, key)
+		}
+	}
+	entry.expires = now.Add(asNameExpiry)
+	namer.cache[asn] = entry
+	return entry.name, entry.holder, nil
+}
@@ -0,0 +1,74 @@
+package canid
+
+import (
+	"net"
+)
+
+// PrefixMismatch is a cached prefix entry which disagrees with a routing
+// table: either the table routes the prefix's first address through a
+// different prefix, or from a different origin AS, or not at all.
+
+type PrefixMismatch struct {
+	Prefix       string
+	ASN          int
+	RoutedPrefix string `json:",omitempty"`
+	RoutedASN    int    `json:",omitempty"`
+}
+
+// Route returns the longest prefix in the table containing an address, and
+// the origin AS announcing it, without geolocating it.
+func (backend *MRTBackend) Route(addr net.IP) (prefix string, asn int, ok bool) {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	trie, ip := backend.table.trieFor(addr)
+	pfx, origin, ok := trie.Find(ip)
+	if !ok {
+		return "", 0, false
+	}
+	return pfx.String(), int(origin.(uint32)), true
+}
+
+// Audit compares the cached prefix to ASN mappings against a routing table,
+// returning the entries which disagree with it, in key order.
+func (cache *PrefixCache) Audit(table *MRTBackend) []PrefixMismatch {
+	out := make([]PrefixMismatch, 0)
+	for _, key := range cache.Keys() {
+		cache.lock.RLock()
+		info, ok := cache.Data[key]
+		cache.lock.RUnlock()
+		if !ok {
+			continue
+		}
+		pfx, ok := parsePrefixKey(key)
+		if !ok {
+			continue
+		}
+		routed, asn, ok := table.Route(pfx.IP)
+		if ok && routed == key && asn == info.ASN {
+			continue
+		}
+		out = append(out, PrefixMismatch{Prefix: key, ASN: info.ASN, RoutedPrefix: routed, RoutedASN: asn})
+	}
+	return out
+}
+
+// Remove removes the entries for the given prefixes from the cache, its
+// shared store and publishers keeping entries, so that they are looked up
+// afresh when next used, returning the number of entries removed from the
+// cache.
+func (cache *PrefixCache) Remove(prefixes ...string) int {
+	if len(prefixes) == 0 {
+		return 0
+	}
+	cache.lock.Lock()
+	n := 0
+	for _, prefix := range prefixes {
+		if _, ok := cache.Data[prefix]; ok {
+			cache.remove(prefix)
+			n++
+		}
+	}
+	cache.lock.Unlock()
+	forget(cache.shared, cache.publishers, "prefix", prefixes)
+	return n
+}
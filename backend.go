@@ -0,0 +1,67 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// PrefixBackend looks up information about the prefix containing an address,
+// on a prefix cache miss. Implementations must be safe for concurrent use;
+// the cache limits the number of concurrent lookups.
+
+type PrefixBackend interface {
+	Lookup(ctx context.Context, addr net.IP) (PrefixInfo, error)
+}
+
+// RawBackend is implemented by backends which can return the raw upstream
+// responses for an address, keyed by upstream request, for debugging.
+
+type RawBackend interface {
+	LookupRaw(ctx context.Context, addr net.IP) (map[string]json.RawMessage, error)
+}
+
+// backendName returns a backend's name for reporting, from its Name method
+// if it has one, or its type otherwise.
+func backendName(backend interface{}) string {
+	if named, ok := backend.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", backend)
+}
+
+// Default timeout for HTTP backend requests, including reading the response
+const DefaultBackendTimeout = 30 * time.Second
+
+// HTTPClient is the client used for all requests to HTTP backends (RIPEstat,
+// IPinfo, and Routinator). Replace it before any lookups, e.g. with one from
+// NewHTTPClient.
+var HTTPClient = &http.Client{Timeout: DefaultBackendTimeout}
+
+// NewHTTPClient returns a client for HTTP backends with the given request
+// timeout (0 for none), keeping up to maxIdle idle connections open per
+// backend host, which should be at least the backend concurrency limit. If
+// proxy is given, requests go through the proxy at that URL; otherwise, the
+// proxy is taken from the environment (HTTPS_PROXY, etc.).
+func NewHTTPClient(timeout time.Duration, proxy string, maxIdle int) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(proxy) > 0 {
+		proxyurl, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %s: %s", proxy, err.Error())
+		}
+		transport.Proxy = http.ProxyURL(proxyurl)
+	}
+	transport.MaxIdleConnsPerHost = maxIdle
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// CloseIdleConnections closes idle connections kept open to HTTP backends,
+// e.g. on shutdown.
+func CloseIdleConnections() {
+	HTTPClient.CloseIdleConnections()
+}
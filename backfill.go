@@ -0,0 +1,54 @@
+package canid
+
+import (
+	"net"
+)
+
+// Size of the PTR backfill queue, and number of workers resolving it.
+// Addresses served while the queue is full are not backfilled.
+const (
+	ptrBackfillQueue   = 1024
+	ptrBackfillWorkers = 4
+)
+
+// SetPTRBackfill arranges for the PTR names of addresses served by
+// LookupServer to be looked up in the background through the given address
+// cache, without delaying the response, so that later combined lookups of the
+// same address include its names. It must be called before the cache is used.
+func (cache *PrefixCache) SetPTRBackfill(addresses *AddressCache) {
+	cache.backfill = make(chan net.IP, ptrBackfillQueue)
+	for i := 0; i < ptrBackfillWorkers; i++ {
+		go func() {
+			for addr := range cache.backfill {
+				if _, ok := addresses.cachedNames(addr); !ok {
+					addresses.LookupType(addr.String(), QueryTypePTR)
+				}
+			}
+		}()
+	}
+}
+
+// backfillPTR queues an address for PTR backfill, if enabled and the queue is
+// not full.
+func (cache *PrefixCache) backfillPTR(addr net.IP) {
+	if cache.backfill == nil {
+		return
+	}
+	select {
+	case cache.backfill <- addr:
+	default:
+	}
+}
+
+// cachedNames returns the names an address maps to, if its PTR lookup is
+// cached and not expired, without looking it up otherwise.
+func (cache *AddressCache) cachedNames(addr net.IP) ([]string, bool) {
+	key := NewAddressKey(addr.String(), QueryTypePTR, cache.resolver.Name)
+	cache.lock.RLock()
+	info, ok := cache.Data[key.String()]
+	cache.lock.RUnlock()
+	if !ok || age(cache.clock, info.Cached) > cache.entryExpiry(info) {
+		return nil, false
+	}
+	return info.Names, true
+}
@@ -0,0 +1,128 @@
+package canid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy determines how failed backend calls are retried: up to
+// MaxAttempts calls in all, waiting Backoff before the first retry and twice
+// as long before each further one. Jitter, between 0 and 1, is the fraction
+// of each delay which is randomized, so that the retries of many lookups
+// failing at once are spread out. Only network errors and server errors
+// (status 5xx) are retried, after at least the delay given by a Retry-After
+// header; the zero policy doesn't retry. Lookups give up their backend slot
+// while their calls wait to be retried.
+
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	Jitter      float64
+}
+
+// RipestatRetry is the retry policy for RIPEstat calls. Replace it before any
+// lookups.
+var RipestatRetry RetryPolicy
+
+// errServerStatus is returned for responses with a server error status,
+// with the delay asked for by their Retry-After header, if any.
+
+type errServerStatus struct {
+	host       string
+	status     int
+	retryAfter time.Duration
+}
+
+// newErrServerStatus returns the error for a response with a server error
+// status.
+func newErrServerStatus(resp *http.Response) errServerStatus {
+	return errServerStatus{resp.Request.URL.Host, resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as an HTTP
+// date, into a delay from now; 0 if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if len(header) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func (err errServerStatus) Error() string {
+	return fmt.Sprintf("%s returned status %d %s", err.host, err.status, http.StatusText(err.status))
+}
+
+// retryable returns true if a failed call may succeed when retried.
+func retryable(err error) bool {
+	var status errServerStatus
+	var neterr net.Error
+	return errors.As(err, &status) || errors.As(err, &neterr)
+}
+
+// delay returns the delay before the given retry, counting from 1, after a
+// call failed with err.
+func (policy RetryPolicy) delay(retry int, err error) time.Duration {
+	delay := policy.Backoff << (retry - 1)
+	delay -= time.Duration(policy.Jitter * rand.Float64() * float64(delay))
+	var status errServerStatus
+	if errors.As(err, &status) && status.retryAfter > delay {
+		delay = status.retryAfter
+	}
+	return delay
+}
+
+// do calls call until it succeeds, fails with an error which isn't
+// retryable, the policy's attempts are used up, or the context is done, or
+// would be before the next attempt. If call was retried, its final error is
+// returned with the number of attempts. While waiting, the backend slot of
+// the lookup making the call, if any, is released.
+func (policy RetryPolicy) do(ctx context.Context, what string, call func() error) error {
+	attempt := 1
+	for {
+		err := call()
+		delay := policy.delay(attempt, err)
+		deadline, ok := ctx.Deadline()
+		if err == nil || attempt >= policy.MaxAttempts || !retryable(err) || ctx.Err() != nil ||
+			(ok && time.Now().Add(delay).After(deadline)) {
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return err
+		}
+
+		slog.Warn("backend call failed, retrying", "call", what, "attempt", attempt, "delay", delay.String(), "err", err)
+		slot := backendSlotFrom(ctx)
+		if slot != nil {
+			slot.release()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (after %d attempts)", ctx.Err(), attempt)
+		}
+		if slot != nil {
+			if err := slot.take(ctx); err != nil {
+				return fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+		}
+		attempt++
+	}
+}
@@ -0,0 +1,111 @@
+package canid
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"0":                             0,
+		"5":                             5 * time.Second,
+		"-5":                            0,
+		"soon":                          0,
+		"Thu, 01 Jan 2026 00:00:30 GMT": 30 * time.Second,
+		"Wed, 31 Dec 2025 23:59:00 GMT": 0,
+	}
+	for header, want := range tests {
+		if got := parseRetryAfter(header, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Second}
+	tests := []struct {
+		retry int
+		err   error
+		want  time.Duration
+	}{
+		{1, errServerStatus{"example.net", http.StatusInternalServerError, 0}, time.Second},
+		{2, errServerStatus{"example.net", http.StatusInternalServerError, 0}, 2 * time.Second},
+		// Retry-After extends the delay, but doesn't shorten it
+		{1, errServerStatus{"example.net", http.StatusServiceUnavailable, 10 * time.Second}, 10 * time.Second},
+		{3, errServerStatus{"example.net", http.StatusServiceUnavailable, time.Second}, 4 * time.Second},
+	}
+	for _, test := range tests {
+		if got := policy.delay(test.retry, test.err); got != test.want {
+			t.Errorf("delay of retry %d after %v = %s, want %s", test.retry, test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryAfterPastDeadline(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+	err := policy.do(ctx, "test", func() error {
+		attempts++
+		return errServerStatus{"example.net", http.StatusServiceUnavailable, time.Minute}
+	})
+	var status errServerStatus
+	if !errors.As(err, &status) || attempts != 1 {
+		t.Errorf("got %v after %d attempts, want the 503 after 1", err, attempts)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("waited %s for a retry past the deadline", time.Since(start))
+	}
+}
+
+// A lookup waiting to retry a call doesn't hold its backend slot.
+func TestRetryReleasesSlot(t *testing.T) {
+	stats := newCacheCounters(SystemClock{})
+	p := newLookupPipeline("test", 1, &stats, new(CacheCallbacks))
+	policy := RetryPolicy{MaxAttempts: 2, Backoff: 500 * time.Millisecond}
+
+	failed := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		attempts := 0
+		_, err := p.run(context.Background(), "retried", lookupStages{
+			backend: func(ctx context.Context) (interface{}, error) {
+				return nil, policy.do(ctx, "test", func() error {
+					attempts++
+					if attempts == 1 {
+						close(failed)
+						return errServerStatus{"example.net", http.StatusServiceUnavailable, 0}
+					}
+					return nil
+				})
+			},
+		})
+		done <- err
+	}()
+
+	<-failed
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	if _, err := p.run(ctx, "other", lookupStages{
+		backend: func(ctx context.Context) (interface{}, error) {
+			return nil, nil
+		},
+	}); err != nil {
+		t.Errorf("other lookup waited for the slot of a retrying one: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("retried lookup failed: %v", err)
+	}
+	if len(p.limiter) != 0 {
+		t.Errorf("%d backend slots still held", len(p.limiter))
+	}
+}
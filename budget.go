@@ -0,0 +1,65 @@
+package canid
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrBudgetExhausted is returned by lookups which would need a backend call
+// after the backend call budget of their request is used up.
+var ErrBudgetExhausted = errors.New("backend call budget exhausted")
+
+// backendBudget counts the backend calls a request may still make.
+
+type backendBudget struct {
+	remaining int64
+}
+
+type budgetKey struct{}
+
+// WithBackendBudget returns a context allowing lookups made with it, in any
+// cache, at most n backend calls between them. Lookups answered from the
+// cache or the shared store don't count.
+func WithBackendBudget(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, budgetKey{}, &backendBudget{int64(n)})
+}
+
+// spendBudget takes a backend call from the context's budget, returning false
+// if none is left. Contexts without a budget are not limited.
+func spendBudget(ctx context.Context) bool {
+	budget, ok := ctx.Value(budgetKey{}).(*backendBudget)
+	if !ok {
+		return true
+	}
+	return atomic.AddInt64(&budget.remaining, -1) >= 0
+}
+
+// budgetExhausted returns true if the context's budget is used up.
+func budgetExhausted(ctx context.Context) bool {
+	budget, ok := ctx.Value(budgetKey{}).(*backendBudget)
+	return ok && atomic.LoadInt64(&budget.remaining) <= 0
+}
+
+// detachBudget returns a context carrying only the budget of ctx, if any, for
+// lookups which should not be cancelled with ctx.
+func detachBudget(ctx context.Context) context.Context {
+	if budget, ok := ctx.Value(budgetKey{}).(*backendBudget); ok {
+		return context.WithValue(context.Background(), budgetKey{}, budget)
+	}
+	return context.Background()
+}
+
+// BackendBudget returns middleware limiting each request to n backend calls,
+// so that a single request to a resource which fans out (a combined or bulk
+// lookup, or a name with many addresses to precache) can't issue an unbounded
+// number of them. Lookups over budget are left out of the response, which is
+// marked as truncated.
+func BackendBudget(n int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(w, req.WithContext(WithBackendBudget(req.Context(), n)))
+		})
+	}
+}
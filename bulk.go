@@ -0,0 +1,167 @@
+package canid
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Limits on bulk requests
+const (
+	maxBulkBody      = 16 << 20
+	maxBulkAddresses = 100000
+	bulkWorkers      = 64
+)
+
+// BulkPrefixResult is the result of looking up one address in a bulk
+// request: the address as given, and either prefix information or an error.
+
+type BulkPrefixResult struct {
+	Address string `source:"canid" doc:"Address as given in the request"`
+	PrefixInfo
+	Error string `json:",omitempty" source:"canid" doc:"Reason the lookup failed, in which case the prefix information fields are empty"`
+
+	Truncated bool `json:",omitempty" source:"canid" doc:"True if the address was not looked up because the request's backend call budget was used up, in which case the prefix information fields are empty"`
+}
+
+// parseBulkAddresses parses a request body which is either a JSON array of
+// address strings or newline-delimited text.
+func parseBulkAddresses(body []byte) ([]string, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var addrs []string
+		err := json.Unmarshal(body, &addrs)
+		return addrs, err
+	}
+
+	addrs := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, scanner.Err()
+}
+
+// BulkLookupServer looks up all addresses in a POST body, concurrently,
+// and returns a JSON array of BulkPrefixResult in the order given. If the
+// request accepts application/x-ndjson, each result is instead written as a
+// line of JSON as soon as its lookup completes, so that large requests
+// needn't be buffered. Backend requests are limited by the cache's
+// concurrency limit as usual.
+func (cache *PrefixCache) BulkLookupServer(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBulkBody))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	addrs, err := parseBulkAddresses(body)
+	if err != nil || len(addrs) > maxBulkAddresses {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// with NDJSON, results are written as they complete rather than
+	// collected, so their order is that of completion
+	stream := acceptsNDJSON(req)
+	var results []BulkPrefixResult
+	streamed := make(chan BulkPrefixResult, bulkWorkers)
+	if !stream {
+		results = make([]BulkPrefixResult, len(addrs))
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < bulkWorkers && i < len(addrs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range indices {
+				result := cache.bulkLookup(req.Context(), addrs[j])
+				if stream {
+					streamed <- result
+				} else {
+					results[j] = result
+				}
+			}
+		}()
+	}
+	go func() {
+		for i := range addrs {
+			indices <- i
+		}
+		close(indices)
+		wg.Wait()
+		close(streamed)
+	}()
+
+	if stream {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		for result := range streamed {
+			result_body, _ := json.Marshal(result)
+			w.Write(append(result_body, '\n'))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return
+	}
+	// streamed is closed once all lookups are done
+	for range streamed {
+	}
+
+	if req.Context().Err() != nil {
+		// client went away, nobody to answer
+		return
+	}
+
+	results_body, _ := json.Marshal(results)
+	w.Write(results_body)
+}
+
+// bulkLookup looks up one address of a bulk request.
+func (cache *PrefixCache) bulkLookup(ctx context.Context, addr string) (out BulkPrefixResult) {
+	out.Address = addr
+	ip := ParseAddress(addr)
+	if ip == nil {
+		out.Error = "invalid address"
+		return
+	}
+	prefix_info, err := cache.LookupContext(ctx, ip)
+	if err == ErrBudgetExhausted {
+		out.Truncated = true
+		return
+	} else if err != nil {
+		out.Error = err.Error()
+		return
+	}
+	prefix_info.BackendMeta = nil
+	cache.annotate(ctx, ip, &prefix_info)
+	cache.transform(&prefix_info)
+	out.PrefixInfo = prefix_info
+	return
+}
+
+// acceptsNDJSON returns true if a request accepts newline-delimited JSON.
+func acceptsNDJSON(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediatype, _, _ := strings.Cut(strings.TrimSpace(accept), ";")
+		if strings.EqualFold(mediatype, "application/x-ndjson") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/britram/canid"
+)
+
+// auditMain implements the audit subcommand, which compares the prefix
+// cache of a backing store against an MRT RIB dump, prints the entries
+// which disagree with it, and optionally removes them from the store. It
+// exits with status 1 if there are mismatches left.
+func auditMain(args []string) {
+	cmd := flag.NewFlagSet("audit", flag.ExitOnError)
+	fileflag := cmd.String("file", "", "backing store to audit (JSON file)")
+	ribflag := cmd.String("rib", "", "MRT RIB dump to audit against (optionally .bz2 or .gz)")
+	fixflag := cmd.Bool("fix", false, "remove mismatched entries from the backing store, so they are looked up afresh")
+	jsonflag := cmd.Bool("json", false, "print mismatches as JSON, one object per line")
+	cmd.Parse(args)
+
+	if len(*fileflag) == 0 || len(*ribflag) == 0 {
+		log.Fatal("audit requires -file and -rib")
+	}
+
+	rib, err := canid.NewMRTBackend(*ribflag)
+	if err != nil {
+		log.Fatalf("unable to load MRT dump: %s", err.Error())
+	}
+
+	if *fixflag {
+		lockfile, err := lockBackingFile(*fileflag)
+		if err != nil {
+			log.Fatalf("unable to lock backing store %s: %s", *fileflag, err.Error())
+		}
+		if lockfile != nil {
+			defer lockfile.Close()
+		}
+	}
+	storage, err := readStorage(*fileflag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mismatches := storage.Prefixes.Audit(rib)
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if !*jsonflag {
+		fmt.Fprintln(table, "PREFIX\tASN\tROUTED PREFIX\tROUTED ASN")
+	}
+	for _, mismatch := range mismatches {
+		if *jsonflag {
+			mismatch_body, _ := json.Marshal(mismatch)
+			fmt.Println(string(mismatch_body))
+			continue
+		}
+		routed, routed_asn := "-", "-"
+		if len(mismatch.RoutedPrefix) > 0 {
+			routed, routed_asn = mismatch.RoutedPrefix, fmt.Sprintf("%d", mismatch.RoutedASN)
+		}
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", mismatch.Prefix, mismatch.ASN, routed, routed_asn)
+	}
+	table.Flush()
+	fmt.Fprintf(os.Stderr, "%d of %d cached prefixes disagree with %s\n",
+		len(mismatches), len(storage.Prefixes.Data), *ribflag)
+
+	if len(mismatches) == 0 {
+		return
+	}
+	if !*fixflag {
+		os.Exit(1)
+	}
+	keys := make([]string, len(mismatches))
+	for i, mismatch := range mismatches {
+		keys[i] = mismatch.Prefix
+	}
+	removed := storage.Prefixes.Remove(keys...)
+	if err := storage.save(*fileflag); err != nil {
+		log.Fatalf("unable to write backing store: %s", err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "removed %d entries from %s\n", removed, *fileflag)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/britram/canid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets in a bolt store
+var (
+	boltMetaBucket      = []byte("meta")
+	boltPrefixesBucket  = []byte("prefixes")
+	boltAddressesBucket = []byte("addresses")
+	boltVersionKey      = []byte("version")
+)
+
+// Record types with a bucket in a bolt store, whether or not their caches
+// are enabled
+var boltRecordTypes = []string{canid.QueryTypeMX, canid.QueryTypeNS, canid.QueryTypeTXT}
+
+// boltRecordsBucket returns the bucket of the record cache of a type, named
+// as the cache, e.g. mx for MX.
+func boltRecordsBucket(qtype string) []byte {
+	return []byte(strings.ToLower(qtype))
+}
+
+// How long to wait for another instance to release the store
+const boltOpenTimeout = 1 * time.Second
+
+// boltStore is a backing store in a bbolt database, with a bucket per cache
+// keyed by cache key. Entries are written through as they are cached, by
+// adding the store to each cache as a publisher, so nothing is lost on a
+// crash and nothing needs to be saved on termination. Entries removed from
+// a cache on request are deleted from the store likewise.
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens (or creates, unless readonly) a bolt store. bbolt locks
+// the database file itself: exclusively when writable, shared when readonly.
+func openBoltStore(path string, readonly bool) (*boltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: readonly})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("%s is in use by another instance", path)
+		}
+		return nil, err
+	}
+	store := &boltStore{db: db}
+
+	if readonly {
+		return store, nil
+	}
+
+	// create buckets and stamp the version on first use
+	err = db.Update(func(tx *bolt.Tx) error {
+		names := [][]byte{boltMetaBucket, boltPrefixesBucket, boltAddressesBucket}
+		for _, qtype := range boltRecordTypes {
+			names = append(names, boltRecordsBucket(qtype))
+		}
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(boltMetaBucket)
+		if meta.Get(boltVersionKey) == nil {
+			return meta.Put(boltVersionKey, []byte(strconv.Itoa(canidStorageVersion)))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads all entries for enabled caches into the caches, dropping (when
+// writable) any older than the expiry of their cache, in seconds.
+func (store *boltStore) load(storage *canidStorage, prefix_expiry int, address_expiry int, readonly bool) error {
+	load := func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(boltMetaBucket); meta != nil {
+			version, err := strconv.Atoi(string(meta.Get(boltVersionKey)))
+			if err != nil {
+				return fmt.Errorf("invalid storage version: %s", err.Error())
+			}
+			storage.Version = version
+			if err := storage.checkVersion(); err != nil {
+				return err
+			}
+		}
+
+		expired := 0
+		if storage.Prefixes != nil {
+			n, err := loadBoltBucket(tx, boltPrefixesBucket, prefix_expiry, storage.Prefixes.Clock(), readonly, func(key string, value []byte, cutoff time.Time) (bool, error) {
+				var info canid.PrefixInfo
+				if err := json.Unmarshal(value, &info); err != nil {
+					return false, err
+				}
+				if info.Cached.Before(cutoff) {
+					return true, nil
+				}
+				storage.Prefixes.Data[key] = info
+				return false, nil
+			})
+			if err != nil {
+				return err
+			}
+			expired += n
+		}
+		if storage.Addresses != nil {
+			n, err := loadBoltBucket(tx, boltAddressesBucket, address_expiry, storage.Addresses.Clock(), readonly, func(key string, value []byte, cutoff time.Time) (bool, error) {
+				var info canid.AddressInfo
+				if err := json.Unmarshal(value, &info); err != nil {
+					return false, err
+				}
+				if info.Cached.Before(cutoff) {
+					return true, nil
+				}
+				storage.Addresses.Data[key] = info
+				return false, nil
+			})
+			if err != nil {
+				return err
+			}
+			expired += n
+		}
+		for _, cache := range storage.recordCaches() {
+			n, err := loadBoltBucket(tx, boltRecordsBucket(cache.Type()), address_expiry, cache.Clock(), readonly, func(key string, value []byte, cutoff time.Time) (bool, error) {
+				var info canid.RecordInfo
+				if err := json.Unmarshal(value, &info); err != nil {
+					return false, err
+				}
+				if info.Cached.Before(cutoff) {
+					return true, nil
+				}
+				cache.Data[key] = info
+				return false, nil
+			})
+			if err != nil {
+				return err
+			}
+			expired += n
+		}
+		if expired > 0 {
+			slog.Info("dropped expired entries from store", "entries", expired)
+		}
+		return nil
+	}
+
+	if readonly {
+		return store.db.View(load)
+	}
+	return store.db.Update(load)
+}
+
+// loadBoltBucket passes each entry in a bucket to add, which decodes it and
+// adds it to a cache, unless it was cached before the cutoff (expiry seconds
+// ago, by the cache's clock), in which case it returns true. Expired entries
+// are deleted when writable. Returns the number of expired entries.
+func loadBoltBucket(tx *bolt.Tx, name []byte, expiry int, clock canid.Clock, readonly bool, add func(key string, value []byte, cutoff time.Time) (bool, error)) (int, error) {
+	bucket := tx.Bucket(name)
+	if bucket == nil {
+		return 0, nil
+	}
+
+	expired := make([][]byte, 0)
+	cutoff := clock.Now().Add(-time.Duration(expiry) * time.Second)
+	err := bucket.ForEach(func(k, v []byte) error {
+		isExpired, err := add(string(k), v, cutoff)
+		if err != nil {
+			return fmt.Errorf("bucket %s entry %s: %s", name, k, err.Error())
+		}
+		if isExpired {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// can't modify a bucket while iterating over it, so drop the expired
+	// entries afterward
+	if !readonly {
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(expired), nil
+}
+
+// Publish writes a new or refreshed cache entry to the store. Concurrent
+// writes are batched into a single transaction, so Publish returns once the
+// entry is durable.
+func (store *boltStore) Publish(event canid.CacheEvent) {
+	value, err := json.Marshal(event.Entry)
+	if err != nil {
+		slog.Error("error encoding entry for store", "cache", event.Cache, "key", event.Key, "err", err)
+		return
+	}
+
+	name := boltCacheBucket(event.Cache)
+	if name == nil {
+		return
+	}
+	err = store.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).Put([]byte(event.Key), value)
+	})
+	if err != nil {
+		slog.Error("error writing entry to store", "cache", event.Cache, "key", event.Key, "err", err)
+	}
+}
+
+// Delete removes entries removed from a cache on request from the store, so
+// that they aren't loaded again on restart; every entry of the cache if keys
+// is nil.
+func (store *boltStore) Delete(cache string, keys []string) {
+	name := boltCacheBucket(cache)
+	if name == nil {
+		return
+	}
+	err := store.db.Batch(func(tx *bolt.Tx) error {
+		if keys == nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			_, err := tx.CreateBucket(name)
+			return err
+		}
+		bucket := tx.Bucket(name)
+		for _, key := range keys {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("error deleting entries from store", "cache", cache, "keys", len(keys), "err", err)
+	}
+}
+
+// boltCacheBucket returns the bucket of the cache of the given name, or nil
+// if the cache has none.
+func boltCacheBucket(cache string) []byte {
+	switch cache {
+	case "prefix":
+		return boltPrefixesBucket
+	case "address":
+		return boltAddressesBucket
+	}
+	// record caches are named for their type
+	for _, qtype := range boltRecordTypes {
+		if bucket := boltRecordsBucket(qtype); string(bucket) == cache {
+			return bucket
+		}
+	}
+	return nil
+}
+
+func (store *boltStore) Close() error {
+	return store.db.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/britram/canid"
+	"github.com/britram/canid/client"
+)
+
+// How long the lookup subcommand waits for each query
+const clientTimeout = 60 * time.Second
+
+// lookupMain implements the lookup subcommand, which looks up addresses,
+// names, or URLs given as arguments, either through a running daemon or
+// directly from the backends, and prints the results as a table or JSON.
+func lookupMain(args []string) {
+	cmd := flag.NewFlagSet("lookup", flag.ExitOnError)
+	serverflag := cmd.String("server", "", "URL of a running canid to query, e.g. http://localhost:8043 (default: query backends directly)")
+	jsonflag := cmd.Bool("json", false, "print results as JSON, one object per line, as returned by /lookup.json")
+	backendflag := cmd.String("backend", "ripestat", "prefix backend for direct lookups (ripestat, cymru)")
+	verboseflag := cmd.Bool("v", false, "log backend requests for direct lookups")
+	cmd.Parse(args)
+
+	if cmd.NArg() == 0 {
+		log.Fatal("lookup requires at least one address, name, or URL")
+	}
+
+	var lookup func(ctx context.Context, query string) (canid.LookupResult, error)
+	if len(*serverflag) > 0 {
+		lookup = func(ctx context.Context, query string) (canid.LookupResult, error) {
+			return remoteLookup(ctx, *serverflag, query)
+		}
+	} else {
+		var backend canid.PrefixBackend
+		switch *backendflag {
+		case "ripestat":
+			backend = canid.RipestatBackend{}
+		case "cymru":
+			backend = canid.CymruBackend{}
+		default:
+			log.Fatalf("unknown prefix backend %s", *backendflag)
+		}
+		if !*verboseflag {
+			log.SetOutput(ioutil.Discard)
+		}
+		prefixes := canid.NewPrefixCache(86400, 4, backend)
+		addresses := canid.NewAddressCache(86400, 4, prefixes)
+		lookup = func(ctx context.Context, query string) (canid.LookupResult, error) {
+			return canid.LookupQuery(ctx, prefixes, addresses, query)
+		}
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if !*jsonflag {
+		fmt.Fprintln(table, "QUERY\tADDRESS\tPREFIX\tASN\tCC\tAS NAME")
+	}
+	failed := false
+	for _, query := range cmd.Args() {
+		ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+		result, err := lookup(ctx, query)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", query, err.Error())
+			failed = true
+			continue
+		}
+		if *jsonflag {
+			result_body, _ := json.Marshal(result)
+			fmt.Println(string(result_body))
+		} else {
+			writeLookupRows(table, result)
+		}
+		for addr, lerr := range result.Errors {
+			fmt.Fprintf(os.Stderr, "%s: %s: %s\n", query, addr, lerr)
+			failed = true
+		}
+	}
+	table.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// writeLookupRows writes a table row per address of a lookup result.
+func writeLookupRows(table *tabwriter.Writer, result canid.LookupResult) {
+	addrs := []string{result.Host}
+	if result.Address != nil {
+		addrs = make([]string, len(result.Address.Addresses))
+		for i, addr := range result.Address.Addresses {
+			addrs[i] = addr.String()
+		}
+		if len(addrs) == 0 {
+			fmt.Fprintf(table, "%s\t%s\t\t\t\t\n", result.Query, "["+strings.ToLower(result.Address.Error)+"]")
+			return
+		}
+	}
+	for _, addr := range addrs {
+		prefix_info, ok := result.Prefixes[addr]
+		if !ok {
+			fmt.Fprintf(table, "%s\t%s\t\t\t\t\n", result.Query, addr)
+			continue
+		}
+		as_name := prefix_info.ASName
+		if len(as_name) == 0 {
+			as_name = prefix_info.ASLabel
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", result.Query, addr, prefix_info.Prefix,
+			strconv.Itoa(prefix_info.ASN), prefix_info.CountryCode, as_name)
+	}
+}
+
+// remoteLookup queries the /lookup.json resource of a running daemon.
+func remoteLookup(ctx context.Context, server string, query string) (canid.LookupResult, error) {
+	return client.New(server).Lookup(ctx, query)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/britram/canid"
+)
+
+// loadConfig sets flags from a configuration file, except those given on the
+// command line, which override the file. The file is a flat YAML mapping of
+// flag names (without the dash) to values, e.g.
+//
+//	port: 8043
+//	expiry: 86400
+//	store: bolt:/var/lib/canid/canid.db
+//	dnsbl: [zen.spamhaus.org, bl.spamcop.net]
+//
+// Lists are joined with commas, for flags taking comma-separated values.
+func loadConfig(filename string) error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	return readMapping(filename, func(name string, value string) error {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %s", name)
+		}
+		if given[name] {
+			return nil
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %s", name, err.Error())
+		}
+		return nil
+	})
+}
+
+// loadPolicyTags reads policy tags from a file, a flat YAML mapping of tag
+// names to lists of country codes, e.g.
+//
+//	BENELUX: [BE, LU, NL]
+//	DACH: [AT, CH, DE]
+func loadPolicyTags(filename string) (*canid.PolicyTags, error) {
+	groups := make(map[string][]string)
+	err := readMapping(filename, func(name string, value string) error {
+		if len(value) == 0 {
+			return fmt.Errorf("no countries for tag %s", name)
+		}
+		groups[name] = strings.Split(value, ",")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return canid.NewPolicyTags(groups), nil
+}
+
+// loadASLabels reads AS labels from a file, a flat YAML mapping of AS numbers
+// (with or without an AS prefix) to labels, e.g.
+//
+//	3333: RIPE NCC
+//	AS15169: "Google"
+//
+// over the well-known labels; an empty label removes a well-known one.
+func loadASLabels(filename string) (*canid.ASLabels, error) {
+	labels := make(map[int]string)
+	err := readMapping(filename, func(name string, value string) error {
+		asn, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(name), "AS"))
+		if err != nil || asn < 0 {
+			return fmt.Errorf("invalid AS number %s", name)
+		}
+		labels[asn] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return canid.NewASLabels(canid.WellKnownASLabels, labels), nil
+}
+
+// loadSyntheticEntries reads synthetic test entries from a file, a flat YAML
+// mapping of addresses or prefixes to an AS number, optionally followed by a
+// country code, e.g.
+//
+//	192.0.2.1: 64496
+//	2001:db8::/32: [64496, ZZ]
+func loadSyntheticEntries(filename string) ([]canid.PrefixInfo, error) {
+	entries := make([]canid.PrefixInfo, 0)
+	err := readMapping(filename, func(name string, value string) error {
+		fields := strings.Split(value, ",")
+		if len(fields) > 2 {
+			return fmt.Errorf("expected AS number and country code for %s", name)
+		}
+		asn, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(fields[0]), "AS"))
+		if err != nil || asn < 0 {
+			return fmt.Errorf("invalid AS number %s", fields[0])
+		}
+		entry := canid.PrefixInfo{Prefix: name, ASN: asn}
+		if len(fields) == 2 {
+			entry.CountryCode = strings.ToUpper(fields[1])
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// readMapping reads a flat YAML mapping of names, possibly quoted, to scalars
+// or lists, calling f with each name and value in turn; lists are joined with
+// commas. Errors are reported with the file name and line number.
+func readMapping(filename string, f func(name string, value string) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if len(line) == 0 || line == "---" {
+			continue
+		}
+
+		// names may contain colons (e.g. IPv6 addresses), so split at the
+		// first colon followed by a space, if there is one, after the name
+		// if it is quoted
+		start := 0
+		if quoted := configQuoted(line); quoted > 0 {
+			start = quoted
+		}
+		colon := strings.Index(line[start:], ": ")
+		if colon < 0 {
+			colon = strings.Index(line[start:], ":")
+		}
+		if colon >= 0 {
+			colon += start
+		}
+		if colon < 0 {
+			return fmt.Errorf("%s:%d: expected name: value", filename, lineno)
+		}
+		name, err := configScalar(strings.TrimSpace(line[:colon]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineno, err.Error())
+		}
+		value, err := configValue(strings.TrimSpace(line[colon+1:]))
+		if err == nil {
+			err = f(name, value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, lineno, err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+// stripConfigComment removes a comment from a line, ignoring # within quotes.
+func stripConfigComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// configValue parses a scalar, possibly quoted, or a flow list of scalars,
+// which it joins with commas.
+func configValue(value string) (string, error) {
+	if strings.HasPrefix(value, "[") {
+		if !strings.HasSuffix(value, "]") {
+			return "", fmt.Errorf("unterminated list %s", value)
+		}
+		var items []string
+		for _, item := range strings.Split(value[1:len(value)-1], ",") {
+			item, err := configScalar(strings.TrimSpace(item))
+			if err != nil {
+				return "", err
+			}
+			if len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		return strings.Join(items, ","), nil
+	}
+	return configScalar(value)
+}
+
+// configQuoted returns the length of the quoted string at the start of a
+// line, including its quotes, or 0 if the line doesn't start with one.
+func configQuoted(line string) int {
+	switch {
+	case strings.HasPrefix(line, "\""):
+		for i := 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+	case strings.HasPrefix(line, "'"):
+		for i := 1; i < len(line); i++ {
+			if line[i] != '\'' {
+				continue
+			}
+			if i+1 < len(line) && line[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// configScalar parses a scalar, unquoting it if it is quoted.
+func configScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "\""):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMapping writes a mapping file, and returns the names and values read
+// from it, in order.
+func testMapping(t *testing.T, content string) ([][2]string, error) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "test.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var pairs [][2]string
+	err := readMapping(filename, func(name string, value string) error {
+		pairs = append(pairs, [2]string{name, value})
+		return nil
+	})
+	return pairs, err
+}
+
+func TestReadMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    [][2]string
+	}{
+		{"scalars", "port: 8043\nexpiry:86400\n",
+			[][2]string{{"port", "8043"}, {"expiry", "86400"}}},
+		{"document marker and blank lines", "---\n\nport: 8043\n\n",
+			[][2]string{{"port", "8043"}}},
+		{"empty value", "as-labels:\n",
+			[][2]string{{"as-labels", ""}}},
+		{"double quoted", `label: "RIPE NCC"` + "\n" + `escaped: "a \"b\" c"` + "\n",
+			[][2]string{{"label", "RIPE NCC"}, {"escaped", `a "b" c`}}},
+		{"single quoted", "label: 'RIPE NCC'\nescaped: 'it''s'\n",
+			[][2]string{{"label", "RIPE NCC"}, {"escaped", "it's"}}},
+		{"quoted name", `"AS3333": RIPE NCC` + "\n" + `'a: b': c` + "\n" + `"x\": y": z` + "\n",
+			[][2]string{{"AS3333", "RIPE NCC"}, {"a: b", "c"}, {`x": y`, "z"}}},
+		{"flow list", "dnsbl: [zen.spamhaus.org, bl.spamcop.net]\nempty: []\nspaced: [ a ,b,, c ]\n",
+			[][2]string{{"dnsbl", "zen.spamhaus.org,bl.spamcop.net"}, {"empty", ""}, {"spaced", "a,b,c"}}},
+		{"quoted list items", `tags: ["BE", 'LU', NL]` + "\n",
+			[][2]string{{"tags", "BE,LU,NL"}}},
+		{"comments", "# config\nport: 8043 # the port\nlabel: \"#1\" # first\nurl: http://example.com/#anchor\n  # indented\n",
+			[][2]string{{"port", "8043"}, {"label", "#1"}, {"url", "http://example.com/#anchor"}}},
+		{"comment after escaped quote", `label: "a \" # b" # c` + "\n",
+			[][2]string{{"label", `a " # b`}}},
+		{"value containing colon space", "syslog: udp://localhost: 514\nlabel: \"RIPE: NCC\"\n",
+			[][2]string{{"syslog", "udp://localhost: 514"}, {"label", "RIPE: NCC"}}},
+		{"value containing colons", "store: bolt:/var/lib/canid/canid.db\n",
+			[][2]string{{"store", "bolt:/var/lib/canid/canid.db"}}},
+		{"IPv6 names", "2001:db8::/32: [64496, ZZ]\n2001:db8::1: 64496\n",
+			[][2]string{{"2001:db8::/32", "64496,ZZ"}, {"2001:db8::1", "64496"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := testMapping(t, test.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadMappingErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		line    string
+	}{
+		{"no colon", "port: 8043\nexpiry\n", ":2:"},
+		{"unterminated list", "dnsbl: [a, b\n", ":1:"},
+		{"unterminated double quote", "label: \"RIPE\n", ":1:"},
+		{"unterminated single quote", "\n\nlabel: 'RIPE\n", ":3:"},
+		{"invalid list item", "tags: [\"BE, NL]\n", ":1:"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := testMapping(t, test.content)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if !strings.Contains(err.Error(), "test.yaml"+test.line) {
+				t.Errorf("error %q doesn't give file and line %s", err.Error(), test.line)
+			}
+		})
+	}
+}
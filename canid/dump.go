@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Entries written between flushes of a streamed dump
+const dumpFlushEntries = 1000
+
+// stream writes the caches to out in the format of a backing file, encoding
+// one entry at a time in key order, so that large caches can be exported
+// while in use without encoding them in memory all at once. Entries removed
+// while streaming are skipped. flush, if not nil, is called every
+// dumpFlushEntries entries.
+func (storage *canidStorage) stream(out io.Writer, flush func()) error {
+	w := bufio.NewWriter(out)
+	header, _ := json.Marshal(storageMeta{storage.Version, storage.Instance})
+	// reopen the metadata object to add the caches to it
+	w.Write(header[:len(header)-1])
+
+	n := 0
+	writeEntry := func(i int, key string, info interface{}) error {
+		if i > 0 {
+			w.WriteString(",")
+		}
+		key_body, _ := json.Marshal(key)
+		info_body, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		w.Write(key_body)
+		w.WriteString(":")
+		w.Write(info_body)
+		if n++; flush != nil && n%dumpFlushEntries == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			flush()
+		}
+		return nil
+	}
+
+	if storage.Prefixes != nil {
+		w.WriteString(`,"Prefixes":{"Data":{`)
+		i := 0
+		for _, key := range storage.Prefixes.Keys() {
+			if info, ok := storage.Prefixes.Entry(key); ok {
+				if err := writeEntry(i, key, info); err != nil {
+					return err
+				}
+				i++
+			}
+		}
+		w.WriteString("}}")
+	}
+	if storage.Addresses != nil {
+		w.WriteString(`,"Addresses":{"Data":{`)
+		i := 0
+		for _, key := range storage.Addresses.Keys() {
+			if info, ok := storage.Addresses.Entry(key); ok {
+				if err := writeEntry(i, key, info); err != nil {
+					return err
+				}
+				i++
+			}
+		}
+		w.WriteString("}}")
+	}
+	if len(storage.Records) > 0 {
+		w.WriteString(`,"Records":{`)
+		for j, cache := range storage.recordCaches() {
+			if j > 0 {
+				w.WriteString(",")
+			}
+			type_body, _ := json.Marshal(cache.Type())
+			w.Write(type_body)
+			w.WriteString(`:{"Data":{`)
+			i := 0
+			for _, key := range cache.Keys() {
+				if info, ok := cache.Entry(key); ok {
+					if err := writeEntry(i, key, info); err != nil {
+						return err
+					}
+					i++
+				}
+			}
+			w.WriteString("}}")
+		}
+		w.WriteString("}")
+	}
+	w.WriteString("}\n")
+	return w.Flush()
+}
+
+// dumpServer streams the contents of the caches over HTTP, in the format of a
+// backing file.
+func (storage *canidStorage) dumpServer(w http.ResponseWriter, req *http.Request) {
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := storage.stream(w, flush); err != nil {
+		// too late to change the status; the truncated body will not parse
+		slog.Error("unable to dump caches", "err", err)
+	}
+}
+
+// Columns of CSV dumps: prefix entries fill the prefix columns, address
+// entries the name columns, with one row per address
+var dumpCSVHeader = []string{"cache", "key", "prefix", "asn", "country_code", "name", "type", "resolver", "address", "error", "cached"}
+
+// writeCSV writes the caches to out as CSV, in key order.
+func (storage *canidStorage) writeCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	w.Write(dumpCSVHeader)
+	if storage.Prefixes != nil {
+		for _, key := range storage.Prefixes.Keys() {
+			info := storage.Prefixes.Data[key]
+			w.Write([]string{"prefix", key, info.Prefix, strconv.Itoa(info.ASN), info.CountryCode,
+				"", "", "", "", "", info.Cached.Format(time.RFC3339)})
+		}
+	}
+	if storage.Addresses != nil {
+		for _, key := range storage.Addresses.Keys() {
+			info := storage.Addresses.Data[key]
+			row := []string{"address", key, "", "", "", info.Name, info.Type, info.Resolver,
+				"", info.Error, info.Cached.Format(time.RFC3339)}
+			if len(info.Addresses) == 0 {
+				w.Write(row)
+			}
+			for _, addr := range info.Addresses {
+				row[8] = addr.String()
+				w.Write(row)
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// dumpMain implements the dump subcommand, which prints the contents of a
+// backing store, as JSON or converted to CSV.
+func dumpMain(args []string) {
+	cmd := flag.NewFlagSet("dump", flag.ExitOnError)
+	fileflag := cmd.String("file", "", "backing store to dump (JSON file)")
+	formatflag := cmd.String("format", "json", "output format: json, or csv for one row per prefix and per address of each name")
+	outflag := cmd.String("out", "", "write the dump to this file (default: standard output)")
+	cmd.Parse(args)
+
+	if len(*fileflag) == 0 {
+		log.Fatal("dump requires -file")
+	}
+	storage, err := readStorage(*fileflag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := os.Stdout
+	if len(*outflag) > 0 {
+		if out, err = os.Create(*outflag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch *formatflag {
+	case "json":
+		err = storage.stream(out, nil)
+	case "csv":
+		err = storage.writeCSV(out)
+	default:
+		log.Fatalf("unsupported dump format %s", *formatflag)
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/britram/canid"
+)
+
+// Columns appended to each row by the enrich subcommand
+var enrichColumns = []string{"prefix", "asn", "country_code"}
+
+// enrichMain implements the enrich subcommand, which reads a CSV or TSV file
+// with an address in one column, looks up each distinct address, and writes
+// the file with prefix, ASN, and country code columns appended.
+func enrichMain(args []string) {
+	cmd := flag.NewFlagSet("enrich", flag.ExitOnError)
+	inflag := cmd.String("in", "-", "CSV or TSV file to read (- for standard input)")
+	outflag := cmd.String("out", "-", "file to write (- for standard output)")
+	columnflag := cmd.Int("column", 1, "column containing addresses, counting from 1")
+	tsvflag := cmd.Bool("tsv", false, "read and write tab-separated values (default if -in ends in .tsv)")
+	headerflag := cmd.Bool("header", false, "the first row is a header, to which the names of the new columns are appended")
+	serverflag := cmd.String("server", "", "URL of a running canid to query, e.g. http://localhost:8043 (default: query backends directly)")
+	fileflag := cmd.String("file", "", "backing store (JSON file) to use as cache for direct lookups, and update afterwards")
+	backendflag := cmd.String("backend", "ripestat", "prefix backend for direct lookups (ripestat, cymru)")
+	concurrencyflag := cmd.Int("concurrency", 8, "maximum number of concurrent lookups")
+	verboseflag := cmd.Bool("v", false, "log backend requests for direct lookups")
+	cmd.Parse(args)
+
+	if *columnflag < 1 {
+		log.Fatal("enrich requires -column of at least 1")
+	}
+	if *concurrencyflag < 1 {
+		log.Fatal("enrich requires -concurrency of at least 1")
+	}
+
+	// read all rows first, so that each distinct address is looked up once
+	in := os.Stdin
+	if *inflag != "-" {
+		infile, err := os.Open(*inflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer infile.Close()
+		in = infile
+	}
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	tsv := *tsvflag || strings.HasSuffix(*inflag, ".tsv")
+	if tsv {
+		reader.Comma = '\t'
+		reader.LazyQuotes = true
+	}
+	rows, err := reader.ReadAll()
+	if err != nil {
+		log.Fatalf("error reading %s: %s", *inflag, err.Error())
+	}
+
+	var storage *canidStorage
+	var lookup func(ctx context.Context, addr net.IP) (canid.PrefixInfo, error)
+	if len(*serverflag) > 0 {
+		lookup = func(ctx context.Context, addr net.IP) (canid.PrefixInfo, error) {
+			result, err := remoteLookup(ctx, *serverflag, addr.String())
+			if err != nil {
+				return canid.PrefixInfo{}, err
+			}
+			if lerr, ok := result.Errors[addr.String()]; ok {
+				return canid.PrefixInfo{}, errors.New(lerr)
+			}
+			return result.Prefixes[addr.String()], nil
+		}
+	} else {
+		var backend canid.PrefixBackend
+		switch *backendflag {
+		case "ripestat":
+			backend = canid.RipestatBackend{}
+		case "cymru":
+			backend = canid.CymruBackend{}
+		default:
+			log.Fatalf("unknown prefix backend %s", *backendflag)
+		}
+		if !*verboseflag {
+			log.SetOutput(ioutil.Discard)
+		}
+		storage = newStorage(defaultInstanceID(), 86400, 86400, *concurrencyflag, backend, true)
+		if len(*fileflag) > 0 {
+			if err := storage.load(*fileflag); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				os.Exit(1)
+			}
+		}
+		lookup = func(ctx context.Context, addr net.IP) (canid.PrefixInfo, error) {
+			return storage.Prefixes.LookupContext(ctx, addr)
+		}
+	}
+
+	first := 0
+	if *headerflag && len(rows) > 0 {
+		rows[0] = append(rows[0], enrichColumns...)
+		first = 1
+	}
+
+	// look up distinct addresses, at most concurrencyflag at a time
+	results := make(map[string]canid.PrefixInfo)
+	var results_lock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, *concurrencyflag)
+	failed := false
+	seen := make(map[string]bool)
+	for _, row := range rows[first:] {
+		if len(row) < *columnflag || seen[row[*columnflag-1]] {
+			continue
+		}
+		value := row[*columnflag-1]
+		seen[value] = true
+		addr := canid.ParseAddress(value)
+		if addr == nil {
+			results_lock.Lock()
+			fmt.Fprintf(os.Stderr, "%s: not an address\n", value)
+			failed = true
+			results_lock.Unlock()
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+			defer cancel()
+			prefix_info, err := lookup(ctx, addr)
+			results_lock.Lock()
+			defer results_lock.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", value, err.Error())
+				failed = true
+				return
+			}
+			results[value] = prefix_info
+		}()
+	}
+	wg.Wait()
+
+	out := os.Stdout
+	if *outflag != "-" {
+		outfile, err := os.Create(*outflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer outfile.Close()
+		out = outfile
+	}
+	if err := writeEnriched(out, rows, first, *columnflag-1, results, tsv); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s: %s\n", *outflag, err.Error())
+		os.Exit(1)
+	}
+
+	if storage != nil && len(*fileflag) > 0 {
+		if err := storage.save(*fileflag); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// writeEnriched writes rows with the prefix information for the address in
+// the given column appended, leaving the new columns empty for addresses
+// without results. Rows before first are written as they are.
+func writeEnriched(out io.Writer, rows [][]string, first int, column int, results map[string]canid.PrefixInfo, tsv bool) error {
+	writer := csv.NewWriter(out)
+	if tsv {
+		writer.Comma = '\t'
+	}
+	for i, row := range rows {
+		if i >= first {
+			extra := make([]string, len(enrichColumns))
+			if column < len(row) {
+				if prefix_info, ok := results[row[column]]; ok {
+					extra = []string{prefix_info.Prefix, strconv.Itoa(prefix_info.ASN), prefix_info.CountryCode}
+				}
+			}
+			row = append(row, extra...)
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/britram/canid"
+)
+
+// Curated addresses for fixtures: RIPE NCC's own, well-known anycast
+// resolvers, and a documentation address with no routed prefix.
+var fixtureAddresses = []string{
+	"193.0.0.1",
+	"2001:67c:2e8::1",
+	"8.8.8.8",
+	"2001:4860:4860::8888",
+	"1.1.1.1",
+	"2606:4700:4700::1111",
+	"192.0.2.1",
+}
+
+var fixtureDataCalls = []string{"prefix-overview", "geoloc"}
+
+// Top-level and data keys which vary from call to call, and are removed from
+// fixtures so that refreshing them only shows real changes.
+var fixtureVolatileKeys = []string{"time", "query_id", "server_id", "process_time", "cached", "build_version"}
+var fixtureVolatileDataKeys = []string{"query_time"}
+
+// sanitizeFixture removes volatile keys from a RIPEstat response and
+// re-encodes it with stable indentation.
+func sanitizeFixture(raw []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	for _, key := range fixtureVolatileKeys {
+		delete(doc, key)
+	}
+	if data, ok := doc["data"].(map[string]interface{}); ok {
+		for _, key := range fixtureVolatileDataKeys {
+			delete(data, key)
+		}
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// readAddressList reads one address per line, ignoring blank lines and
+// comments starting with #.
+func readAddressList(filename string) ([]string, error) {
+	infile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
+
+	out := make([]string, 0)
+	scanner := bufio.NewScanner(infile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			out = append(out, line)
+		}
+	}
+	return out, scanner.Err()
+}
+
+// fixturesMain implements the fixtures subcommand, which queries RIPEstat
+// for a list of addresses and writes sanitized responses as fixtures for a
+// mock backend.
+func fixturesMain(args []string) {
+	cmd := flag.NewFlagSet("fixtures", flag.ExitOnError)
+	outflag := cmd.String("out", "testdata", "directory to write fixtures to")
+	addrsflag := cmd.String("addrs", "", "file with addresses to query, one per line (default: built-in list)")
+	cmd.Parse(args)
+
+	addrs := fixtureAddresses
+	if len(*addrsflag) > 0 {
+		var err error
+		if addrs, err = readAddressList(*addrsflag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(*outflag, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, addrstr := range addrs {
+		addr := canid.ParseAddress(addrstr)
+		if addr == nil {
+			log.Fatalf("invalid address %s", addrstr)
+		}
+		for _, dataCall := range fixtureDataCalls {
+			raw, err := canid.RipestatRaw(context.Background(), dataCall, addr)
+			if err != nil {
+				log.Fatalf("error fetching %s for %s: %s", dataCall, addr, err.Error())
+			}
+			fixture, err := sanitizeFixture(raw)
+			if err != nil {
+				log.Fatalf("error sanitizing %s for %s: %s", dataCall, addr, err.Error())
+			}
+			outpath := filepath.Join(*outflag, canid.FixtureName(dataCall, addr))
+			if err := ioutil.WriteFile(outpath, append(fixture, '\n'), 0644); err != nil {
+				log.Fatal(err)
+			}
+			slog.Info("wrote fixture", "path", outpath)
+		}
+	}
+}
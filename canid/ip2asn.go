@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+)
+
+// exportIP2ASNMain implements the export-ip2asn subcommand, which loads a
+// backing store and writes its prefix cache as an ip2asn-combined TSV table.
+func exportIP2ASNMain(args []string) {
+	cmd := flag.NewFlagSet("export-ip2asn", flag.ExitOnError)
+	fileflag := cmd.String("file", "", "backing store to export (JSON file)")
+	outflag := cmd.String("out", "", "file to write the table to (default: standard output)")
+	cmd.Parse(args)
+
+	if len(*fileflag) == 0 {
+		log.Fatal("export-ip2asn requires -file")
+	}
+
+	storage, err := readStorage(*fileflag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if len(*outflag) > 0 {
+		outfile, err := os.Create(*outflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer outfile.Close()
+		out = outfile
+	}
+	if err := storage.Prefixes.WriteIP2ASN(out); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	"github.com/britram/canid"
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaPublisher writes every new cache entry to a Kafka topic as a JSON
+// encoded canid.CacheEvent, keyed by cache key so that updates to the same
+// entry land in the same partition.
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func newKafkaPublisher(brokers string, topic string) *kafkaPublisher {
+	p := new(kafkaPublisher)
+	p.writer = &kafka.Writer{
+		Addr:     kafka.TCP(strings.Split(brokers, ",")...),
+		Topic:    topic,
+		Balancer: &kafka.Hash{},
+		Async:    true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				slog.Error("error publishing entries to kafka", "entries", len(messages), "err", err)
+			}
+		},
+	}
+	return p
+}
+
+func (p *kafkaPublisher) Publish(event canid.CacheEvent) {
+	event_body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("error encoding entry for kafka", "cache", event.Cache, "key", event.Key, "err", err)
+		return
+	}
+
+	// async writer: this only fails if the writer is closed
+	err = p.writer.WriteMessages(context.Background(), kafka.Message{
+		Key:   []byte(event.Cache + ":" + event.Key),
+		Value: event_body,
+	})
+	if err != nil {
+		slog.Error("error publishing entry to kafka", "cache", event.Cache, "key", event.Key, "err", err)
+	}
+}
+
+// Close flushes pending messages and closes the connection to the brokers.
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// lockBackingFile does nothing on platforms without flock; concurrent
+// instances sharing a backing store are not detected.
+func lockBackingFile(filename string) (*os.File, error) {
+	slog.Warn("backing store locking not supported on this platform")
+	return nil, nil
+}
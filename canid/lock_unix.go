@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockBackingFile takes an exclusive advisory lock on a lock file next to
+// the backing store, failing immediately if another process holds it. The
+// lock is held until the returned file is closed or the process exits.
+func lockBackingFile(filename string) (*os.File, error) {
+	lockfile, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lockfile.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is in use by another instance", filename)
+		}
+		return nil, err
+	}
+
+	return lockfile, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogging configures the default logger to log messages at or above the
+// given level (debug, info, warn, error), as text or as JSON objects, one per
+// line, for log aggregation. Fatal errors, which are logged through the log
+// package, are logged at level error in JSON.
+func setupLogging(format string, level string) error {
+	var min slog.Level
+	if err := min.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %s", level)
+	}
+	switch format {
+	case "text":
+		// keep log's line format, with the level and fields appended
+		slog.SetLogLoggerLevel(min)
+	case "json":
+		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: min})
+		slog.SetDefault(slog.New(handler))
+		slog.SetLogLoggerLevel(slog.LevelError)
+	default:
+		return fmt.Errorf("unknown log format %s", format)
+	}
+	return nil
+}
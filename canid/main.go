@@ -1,301 +1,891 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/britram/canid"
 )
 
-// WelcomePage contains the Canid welcome page, which explains what Canid is,
-// and gives a simple web interface to the service.
-const WelcomePage = `
-<!DOCTYPE html>
-<html>
-  <head>
-    <meta charset="utf8">
-    <title>Canid, the Caching Additional Network Information Daemon</title>
-
-    <link href='https://fonts.googleapis.com/css?family=Lato' rel='stylesheet'>
-
-    <style>
-
-      body {
-        background: #cccccc;
-        font-family: "Lato";
-      }
-
-      div.content {        
-        background: #eeeeee;
-        width: 600px;
-        padding: 40px;
-        margin: auto;
-        border: 3px solid grey;
-      }
-
-      div.output {
-        width: 80%;
-        border: 1px solid grey;
-        margin-left: auto;
-        margin-right: auto;
-        margin-bottom: 4px;
-        padding: 2px;  
-        background: white;    
-      }
-
-      div#result {
-        height: 400px;
-      }
-
-      div#status {
-        height: 40px;
-      }
-
-      input#content-url {
-        width: 75%;
-      }
-
-      span.paper-title {
-        font-style: italic;
-      }
-      
-      h1 {
-        border-bottom: 2px solid #333333;
-      }
-
-      h2 {
-        border-bottom: 1px solid #666666;
-      }
-
-      img#mami-logo {
-        display: block;
-        margin-left: auto;
-        margin-right: auto;
-        width: 50%;
-      }
-
-      label, input {
-        display: inline-block;
-      }
-
-      label {
-        width: 25%;
-        text-align: right;
-      }
-
-      label + input {
-        width: 40%;
-        margin: 0 15% 0 4%;
-      }
-
-      input + input {
-        float: right;
-      }
-    </style>
-    
-    <script>
-
-      async function canidLookupPrefix() {
-
-        const inputElement = document.getElementById('input')
-        const statusElement = document.getElementById('status')
-        const addressElement = document.getElementById('address')
-        const prefixElement = document.getElementById('prefix')
-        const asElement = document.getElementById('as')
-        const ccElement = document.getElementById('cc')
-
-        try {
-          let response = await fetch("/prefix.json?addr="+encodeURIComponent(inputElement.value))
-          let result = await response.json()
-
-          statusElement.value = "prefix lookup "+inputElement.value+" OK"
-          addressElement.value = ""
-          prefixElement.value = result.Prefix 
-          asElement.value = result.ASN 
-          ccElement.value = result.CountryCode 
-        } catch (error) {
-          statusElement.value = "prefix lookup "+inputElement.value+" failed; see console"
-          console.log(error)
-        }
-      }
-
-      async function canidLookupAddress() {
-
-        const inputElement = document.getElementById('input')
-        const statusElement = document.getElementById('status')
-        const addressElement = document.getElementById('address')
-        const prefixElement = document.getElementById('prefix')
-        const asElement = document.getElementById('as')
-        const ccElement = document.getElementById('cc')
-
-        try {
-          let response = await fetch("/address.json?name="+encodeURIComponent(inputElement.value))
-          let result = await response.json()
-
-          statusElement.value = "address lookup "+inputElement.value+" OK"
-          if (result.Addresses.length < 1) {
-            addressElement.value = "[none]"
-          } else {
-            addressElement.value = result.Addresses[0]
-          }
-          prefixElement.value = ""
-          asElement.value = ""
-          ccElement.value = "" 
-        } catch (error) {
-          statusElement.value = "address lookup "+inputElement.value+" failed; see console"
-          console.log(error)
-        }
-}
+func main() {
+	// dispatch subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "audit":
+			auditMain(os.Args[2:])
+			return
+		case "dump":
+			dumpMain(os.Args[2:])
+			return
+		case "enrich":
+			enrichMain(os.Args[2:])
+			return
+		case "export-ip2asn":
+			exportIP2ASNMain(os.Args[2:])
+			return
+		case "export-parquet":
+			exportParquetMain(os.Args[2:])
+			return
+		case "fixtures":
+			fixturesMain(os.Args[2:])
+			return
+		case "lookup":
+			lookupMain(os.Args[2:])
+			return
+		case "merge":
+			mergeMain(os.Args[2:])
+			return
+		case "prune":
+			pruneMain(os.Args[2:])
+			return
+		}
+	}
 
-    </script>
-  </head>
-  <body>
+	configflag := flag.String("config", "", "read options from this YAML file; options on the command line override it")
+	presetflag := flag.String("preset", "", "apply a preset set of options: public-demo")
+	fileflag := flag.String("file", "", "backing store for caches (JSON file, or gob if named .gob; gzipped if named .gz)")
+	filedirflag := flag.String("file-dir", "", "backing store directory, with a separate file per cache")
+	storeflag := flag.String("store", "", "backing store instead of -file: bolt:<path>, or redis://<host>:<port> to share caches between instances")
+	readonlyflag := flag.Bool("readonly", false, "load backing store without locking it, and never write it")
+	saveintervalflag := flag.Int("save-interval", 0, "save caches to the backing store every n sec (0 to save only on termination)")
+	expiryflag := flag.Int("expiry", 86400, "expire cache entries after n sec")
+	prefixexpiryflag := flag.Int("prefix-expiry", 0, "expire prefix cache entries after n sec (0 for -expiry)")
+	addressexpiryflag := flag.Int("address-expiry", 0, "expire address cache entries, and those of -records, after n sec (0 for -expiry)")
+	limitflag := flag.Int("concurrency", 16, "simultaneous backend request limit")
+	portflag := flag.Int("port", 8043, "port to listen on")
+	tlscertflag := flag.String("tls-cert", "", "serve HTTPS with the certificate (chain) in this PEM file")
+	tlskeyflag := flag.String("tls-key", "", "private key for -tls-cert, in PEM")
+	acmedomainflag := flag.String("acme-domain", "", "serve HTTPS with certificates from Let's Encrypt for these domains (comma-separated)")
+	acmecacheflag := flag.String("acme-cache", "canid-acme", "directory to cache ACME certificates in")
+	adminportflag := flag.String("admin-port", "0", "[host:]port to listen on for admin resources such as /debug/vars, on localhost unless a host is given (0 to disable)")
+	debugportflag := flag.String("debug-port", "0", "[host:]port to listen on for profiling with /debug/pprof/ and for /debug/vars, on localhost unless a host is given (0 to disable)")
+	admintokenflag := flag.String("admin-token", "", "require this bearer token for admin resources on -port (default: admin resources are not served)")
+	noadminflag := flag.Bool("no-admin", false, "don't serve /admin/ resources on -port")
+	ratelimitflag := flag.Float64("rate-limit", 0, "limit each client address to n requests/sec on average (0 for no limit)")
+	rateburstflag := flag.Int("rate-burst", 20, "allow bursts of up to n requests per client address over -rate-limit")
+	requestbudgetflag := flag.Int("request-budget", 0, "allow each request at most n backend calls, truncating responses over budget (0 for no limit)")
+	accesslogflag := flag.String("access-log", "", "log each HTTP request to standard output, in clf (Common Log Format) or json format (default: don't log)")
+	corsoriginflag := flag.String("cors-origin", "", "allow cross-origin requests from this origin (* for any)")
+	instanceflag := flag.String("instance-id", defaultInstanceID(), "identify this instance in responses (X-Canid-Instance header) and dumps, to trace answers in federated deployments")
+	memcacheportflag := flag.Int("memcache-port", 0, "port to listen on for read-only memcached protocol (0 to disable)")
+	dnsportflag := flag.Int("dns-port", 0, "UDP and TCP port to answer DNS TXT prefix queries on (0 to disable)")
+	dnszoneflag := flag.String("dns-zone", canid.DefaultDNSZone, "zone to answer DNS TXT prefix queries for")
+	prefixcapflag := flag.Int("prefix-capacity", 0, "maximum number of prefix cache entries (0 for unlimited)")
+	prefixevictflag := flag.String("prefix-eviction", canid.EvictLRU, "prefix cache eviction policy (ttl, lru, lfu, random)")
+	prefixadmitflag := flag.String("prefix-admission", canid.AdmitAll, "prefix cache admission policy when full (all, tinylfu)")
+	addresscapflag := flag.Int("address-capacity", 0, "maximum number of address cache entries (0 for unlimited)")
+	addressevictflag := flag.String("address-eviction", canid.EvictLRU, "address cache eviction policy (ttl, lru, lfu, random)")
+	addressmaxflag := flag.Int("address-max-addresses", 64, "maximum number of addresses to keep per name (0 for unlimited)")
+	addressprecacheflag := flag.Int("address-max-precache", 16, "maximum number of prefixes to precache per name lookup (0 for unlimited)")
+	addressadmitflag := flag.String("address-admission", canid.AdmitAll, "address cache admission policy when full (all, tinylfu)")
+	resolverflag := flag.String("resolver", canid.SystemResolver, "DNS resolver for the address cache: system, resolv.conf, host[:port], udp://, tcp://, or tls://host[:port], or an https:// DNS over HTTPS URL; all but system honor record TTLs (system entries expire after -address-expiry)")
+	recordsflag := flag.String("records", "MX,NS,TXT", "serve cached lookups of these DNS record types (comma-separated MX, NS, TXT; empty for none)")
+	recordcapflag := flag.Int("record-capacity", 100000, "maximum number of entries of each -records cache (0 for unlimited)")
+	recordevictflag := flag.String("record-eviction", canid.EvictLRU, "-records cache eviction policy (ttl, lru, lfu, random)")
+	recordadmitflag := flag.String("record-admission", canid.AdmitAll, "-records cache admission policy when full (all, tinylfu)")
+	resolvertimeoutflag := flag.Int("resolver-timeout", 0, "give up on DNS lookups after n sec, including retries (0 for the resolver's own timeouts)")
+	sampleintervalflag := flag.Int("sample-interval", 0, "re-query a sample of cached prefixes every n sec to measure drift (0 to disable)")
+	refreshintervalflag := flag.Int("refresh-interval", 0, "every n sec, refresh frequently hit prefixes which would expire before the next refresh (0 to disable)")
+	refreshtopflag := flag.Int("refresh-top", 100, "number of most frequently hit prefixes to consider for refresh")
+	servestaleflag := flag.Int("serve-stale", 0, "answer prefix entries expired up to n sec ago, marked Stale, while refreshing them in the background (0 to disable)")
+	samplesizeflag := flag.Int("sample-size", 10, "number of cached prefixes to re-query per sample")
+	backendflag := flag.String("backend", "ripestat", "prefix backend (ripestat, cymru)")
+	backendtimeoutflag := flag.Int("backend-timeout", 30, "give up on HTTP backend requests after n sec (0 for no timeout)")
+	backendproxyflag := flag.String("backend-proxy", "", "send HTTP backend requests through this proxy URL (default from environment)")
+	ripestatattemptsflag := flag.Int("ripestat-attempts", 3, "call RIPEstat up to n times on network and server errors (1 to not retry)")
+	ripestatbackoffflag := flag.Float64("ripestat-backoff", 1, "wait n sec before retrying a failed RIPEstat call, doubling for each further retry")
+	ripestatjitterflag := flag.Float64("ripestat-jitter", 0.5, "randomize this fraction (0 to 1) of each -ripestat-backoff delay")
+	mrtflag := flag.String("mrt", "", "answer prefix lookups from this MRT RIB dump (optionally .bz2 or .gz) instead of -backend")
+	mrtreloadflag := flag.Int("mrt-reload", 600, "reload the -mrt dump every n sec if it has changed (0 to disable)")
+	risliveflag := flag.Bool("ris-live", false, "answer prefix lookups from BGP updates streamed from RIPE RIS Live where possible, falling back to -backend or -mrt")
+	rislivehostflag := flag.String("ris-live-host", "", "stream updates from this RIS route collector only, e.g. rrc00 (default: all)")
+	rislivewarmupflag := flag.Int("ris-live-warmup", int(canid.DefaultLiveWarmup/time.Second), "without -mrt, answer from the RIS Live table only after streaming for n sec without interruption")
+	backendfixturesflag := flag.String("backend-fixtures", "", "answer RIPEstat requests from fixtures in this directory instead of the network, for testing")
+	nogeolocflag := flag.Bool("no-geoloc", false, "don't geolocate prefixes")
+	geolocflag := flag.String("geoloc", "ripestat", "geolocation backend (ripestat, ipinfo)")
+	ipinfotokenflag := flag.String("ipinfo-token", "", "IPinfo access token for -geoloc ipinfo")
+	asnamesflag := flag.Bool("as-names", false, "look up AS names and holders from RIPEstat")
+	rpkiflag := flag.String("rpki", "", "RPKI validation backend (ripestat, routinator; default none)")
+	rpkiurlflag := flag.String("rpki-url", "http://localhost:8323/", "Routinator HTTP API URL for -rpki routinator")
+	ptrbackfillflag := flag.Bool("ptr-backfill", false, "look up PTR names of addresses served by /prefix.json in the background, for /lookup.json")
+	aslabelsflag := flag.String("as-labels", "", "label well-known origin ASes: builtin, or a YAML file mapping AS numbers to labels, overriding the built-in ones")
+	pluginflag := flag.String("plugin", "", "apply the transforms and middleware exported by these Go plugins (comma-separated .so files)")
+	syntheticflag := flag.String("synthetic", "", "answer prefix lookups from synthetic test entries in this YAML file, mapping addresses or prefixes to an AS number and optional country code")
+	policytagsflag := flag.String("policy-tags", "", "tag prefixes by country with groupings from this YAML file, mapping tags to lists of country codes")
+	speciallocalflag := flag.Bool("special-local", false, "answer prefix lookups of special-purpose (private, loopback, documentation) addresses locally")
+	vantageflag := flag.String("vantage", "", "vantage point location as lat,lon for distance estimation")
+	dnsblflag := flag.String("dnsbl", "", "annotate responses with listings on these DNSBL zones (comma-separated)")
+	blocklistflag := flag.String("blocklist", "", "annotate responses with listings on these blocklist files (comma-separated)")
+	blocklistrefreshflag := flag.Int("blocklist-refresh", 3600, "reload blocklist files every n sec (0 to disable)")
+	nodnsflag := flag.Bool("no-dns", false, "disable address cache and DNS lookups")
+	noprefixflag := flag.Bool("no-prefix", false, "disable prefix cache and RIPEstat lookups")
+	kafkabrokersflag := flag.String("kafka-brokers", "", "publish new cache entries to these Kafka brokers (comma-separated host:port)")
+	kafkatopicflag := flag.String("kafka-topic", "canid", "Kafka topic to publish cache entries to")
+	syslogflag := flag.String("syslog", "", "send new cache entries to this syslog collector (network://address)")
+	logformatflag := flag.String("log-format", "text", "log format: text, or json for log aggregation")
+	loglevelflag := flag.String("log-level", "info", "log messages at or above this level: debug, info, warn, error")
+	shutdowngraceflag := flag.Int("shutdown-grace", 0, "keep serving for n sec after SIGINT/SIGTERM, reporting Drained at /healthz, before shutting down")
+
+	// parse command line, then fill in the rest from the config file, then
+	// from the preset
+	flag.Parse()
+	if len(*configflag) > 0 {
+		if err := loadConfig(*configflag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*presetflag) > 0 {
+		if err := applyPreset(*presetflag); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-    <div class="content">
+	if err := setupLogging(*logformatflag, *loglevelflag); err != nil {
+		log.Fatal(err)
+	}
 
-      <h1>Canid<sup>beta</sup></h1>
+	if *nodnsflag && *noprefixflag {
+		log.Fatal("nothing to do with both -no-dns and -no-prefix")
+	}
 
-      <p>Canid, the Caching Additional Network Information Daemon, provides a
-      simple HTTP API for getting information about Internet names and
-      numbers. See <a href="https://github.com/britram/canid">the GitHub
-      repository</a> for source code and more information</p>
+	if *noprefixflag && *dnsportflag > 0 {
+		log.Fatal("-dns-port requires the prefix cache, but -no-prefix is given")
+	}
 
-      <p>This landing page provides a browser-based interface to this instance
-      of the cache, backed by <a href="https://stat.ripe.net">RIPEstat</a>. You
-      can perform prefix lookups using the form below.</p>
+	// set up sigint handling
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
-      <div class="tool"><form>
+	// closed on shutdown, to stop background workers
+	stopping := make(chan struct{})
 
-        <div>
-          <label>Address to query:</label> <input type="text" id="input">
-        </div>
-       <hr>
-        <div>
-            <label>Status:</label> <input type="text" disabled id="status" value="Ready">
-        </div>
+	// configure client for HTTP backends
+	client, err := canid.NewHTTPClient(time.Duration(*backendtimeoutflag)*time.Second, *backendproxyflag, *limitflag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*backendfixturesflag) > 0 {
+		client.Transport = canid.FixtureTransport{Dir: *backendfixturesflag}
+	}
+	canid.HTTPClient = client
 
-        <div>
-          <label>(First) Address:</label> <input type="text" disabled id="address">
-        </div>
+	// retry transient RIPEstat failures
+	if *ripestatjitterflag < 0 || *ripestatjitterflag > 1 {
+		log.Fatal("-ripestat-jitter must be between 0 and 1")
+	}
+	canid.RipestatRetry = canid.RetryPolicy{
+		MaxAttempts: *ripestatattemptsflag,
+		Backoff:     time.Duration(*ripestatbackoffflag * float64(time.Second)),
+		Jitter:      *ripestatjitterflag,
+	}
 
-        <div>
-            <label>Prefix:</label> <input type="text" disabled id="prefix">
-        </div>
-  
-        <div>
-            <label>BGP ASN:</label> <input type="text" disabled id="as">
-        </div>
+	// select geolocation backend
+	switch {
+	case *nogeolocflag:
+		canid.Geolocation = nil
+	case *geolocflag == "ripestat":
+		canid.Geolocation = canid.RipestatGeolocator{}
+	case *geolocflag == "ipinfo":
+		canid.Geolocation = canid.IPinfoGeolocator{Token: *ipinfotokenflag}
+	default:
+		log.Fatalf("unknown geolocation backend %s", *geolocflag)
+	}
 
-        <div>
-            <label>Country:</label> <input type="text" disabled id="cc">
-        </div>
+	if *asnamesflag {
+		canid.ASNames = canid.NewRipestatASNamer()
+	}
 
-        <input type="button" id="pfxGoButton" onclick="canidLookupPrefix()" value="Look up prefix">
-        <input type="button" id="pfxGoButton" onclick="canidLookupAddress()" value="Look up name">
+	// select RPKI validation backend
+	switch *rpkiflag {
+	case "":
+		canid.RPKIValidation = nil
+	case "ripestat":
+		canid.RPKIValidation = canid.RipestatRPKIValidator{}
+	case "routinator":
+		canid.RPKIValidation = canid.RoutinatorValidator{URL: *rpkiurlflag}
+	default:
+		log.Fatalf("unknown RPKI validation backend %s", *rpkiflag)
+	}
 
-      </form></div>
-    </div>
-  </body>
-</html>
+	// allocate and link cache
+	var backend canid.PrefixBackend
+	if !*noprefixflag {
+		switch {
+		case len(*mrtflag) > 0:
+			mrtbackend, err := canid.NewMRTBackend(*mrtflag)
+			if err != nil {
+				log.Fatalf("unable to load MRT dump: %s", err.Error())
+			}
+			backend = mrtbackend
+			if *mrtreloadflag > 0 {
+				go every(stopping, *mrtreloadflag, func() {
+					if err := mrtbackend.Refresh(); err != nil {
+						slog.Error("unable to reload MRT dump", "err", err)
+					}
+				})
+			}
+		case *backendflag == "ripestat":
+			backend = canid.RipestatBackend{}
+		case *backendflag == "cymru":
+			backend = canid.CymruBackend{}
+		default:
+			log.Fatalf("unknown prefix backend %s", *backendflag)
+		}
+	}
+	var liveroutes *canid.LiveRoutes
+	if backend != nil && *risliveflag {
+		liveroutes = canid.NewLiveRoutes(canid.LiveStreamURL(*rislivehostflag))
+		liveroutes.Warmup = time.Duration(*rislivewarmupflag) * time.Second
+		livectx, stoplive := context.WithCancel(context.Background())
+		go func() {
+			<-stopping
+			stoplive()
+		}()
+		go liveroutes.Run(livectx)
+		backend = canid.LiveBackend{Routes: liveroutes, Fallback: backend}
+	}
 
-`
+	// BGP data changes slowly, DNS answers quickly; each cache may have its
+	// own expiry
+	prefix_expiry, address_expiry := *expiryflag, *expiryflag
+	if *prefixexpiryflag > 0 {
+		prefix_expiry = *prefixexpiryflag
+	}
+	if *addressexpiryflag > 0 {
+		address_expiry = *addressexpiryflag
+	}
+	storage := newStorage(*instanceflag, prefix_expiry, address_expiry, *limitflag, backend, !*nodnsflag)
 
-const canidStorageVersion = 1
+	// cache other record types for clients wanting DNS metadata
+	if !*nodnsflag && len(*recordsflag) > 0 {
+		for _, qtype := range strings.Split(*recordsflag, ",") {
+			if _, err := storage.addRecords(strings.TrimSpace(qtype), address_expiry, *limitflag); err != nil {
+				log.Fatalf("invalid -records: %s", err.Error())
+			}
+		}
+	}
 
-type canidStorage struct {
-	Version   int
-	Prefixes  *canid.PrefixCache
-	Addresses *canid.AddressCache
-}
+	if len(*fileflag) > 0 && len(*filedirflag) > 0 {
+		log.Fatal("-file and -file-dir are mutually exclusive")
+	}
 
-func (storage *canidStorage) undump(in io.Reader) error {
-	dec := json.NewDecoder(in)
-	return dec.Decode(storage)
-}
+	// open an embedded or shared store if requested
+	var boltstore *boltStore
+	var redisstore *redisStore
+	if len(*storeflag) > 0 {
+		if len(*fileflag) > 0 || len(*filedirflag) > 0 {
+			log.Fatal("-store is mutually exclusive with -file and -file-dir")
+		}
+		if strings.HasPrefix(*storeflag, "redis://") || strings.HasPrefix(*storeflag, "rediss://") {
+			var err error
+			if redisstore, err = openRedisStore(*storeflag, *readonlyflag); err != nil {
+				log.Fatalf("unable to connect to redis store: %s", err.Error())
+			}
+			if storage.Prefixes != nil {
+				storage.Prefixes.SetSharedStore(redisstore)
+			}
+			if storage.Addresses != nil {
+				storage.Addresses.SetSharedStore(redisstore)
+			}
+			slog.Info("sharing caches through redis")
+		} else {
+			kind, path, ok := strings.Cut(*storeflag, ":")
+			if !ok || kind != "bolt" || len(path) == 0 {
+				log.Fatalf("unsupported store %s (use bolt:<path> or redis://<host>:<port>)", *storeflag)
+			}
+			// bbolt locks the store itself
+			var err error
+			if boltstore, err = openBoltStore(path, *readonlyflag); err != nil {
+				log.Fatalf("unable to open store %s: %s", path, err.Error())
+			}
+			if err := boltstore.load(storage, prefix_expiry, address_expiry, *readonlyflag); err != nil {
+				log.Fatalf("unable to load store %s: %s", path, err.Error())
+			}
+			slog.Info("loaded caches", "path", path)
+
+			// write entries through as they are cached
+			if !*readonlyflag {
+				if storage.Prefixes != nil {
+					storage.Prefixes.AddPublisher(boltstore)
+				}
+				if storage.Addresses != nil {
+					storage.Addresses.AddPublisher(boltstore)
+				}
+				for _, cache := range storage.recordCaches() {
+					cache.AddPublisher(boltstore)
+				}
+			}
+		}
+	}
 
-func (storage *canidStorage) dump(out io.Writer) error {
-	enc := json.NewEncoder(out)
-	return enc.Encode(*storage)
-}
+	// lock backing store, so two instances don't clobber each other's dumps
+	lockname := *fileflag
+	if len(*filedirflag) > 0 {
+		lockname = filepath.Join(*filedirflag, "canid")
+	}
+	if len(lockname) > 0 && !*readonlyflag {
+		lockfile, err := lockBackingFile(lockname)
+		if err != nil {
+			log.Fatalf("unable to lock backing store %s: %s (use -readonly to share it)", lockname, err.Error())
+		}
+		if lockfile != nil {
+			defer lockfile.Close()
+		}
+	}
 
-func newStorage(expiry int, limit int) *canidStorage {
-	storage := new(canidStorage)
-	storage.Version = canidStorageVersion
-	storage.Prefixes = canid.NewPrefixCache(expiry, limit)
-	storage.Addresses = canid.NewAddressCache(expiry, limit, storage.Prefixes)
-	return storage
-}
+	// load caches from backing store if given
+	if len(*filedirflag) > 0 {
+		if err := storage.loadDir(*filedirflag); err != nil {
+			log.Fatal(err)
+		}
+	} else if len(*fileflag) > 0 {
+		if err := storage.load(*fileflag); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-func welcomeServer(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(WelcomePage))
-}
+	if storage.Prefixes != nil && *speciallocalflag {
+		storage.Prefixes.SetSpecialAddresses(true)
+	}
 
-func main() {
-	fileflag := flag.String("file", "", "backing store for caches (JSON file)")
-	expiryflag := flag.Int("expiry", 86400, "expire cache entries after n sec")
-	limitflag := flag.Int("concurrency", 16, "simultaneous backend request limit")
-	portflag := flag.Int("port", 8043, "port to listen on")
+	// answer synthetic test entries locally, for monitoring
+	if storage.Prefixes != nil && len(*syntheticflag) > 0 {
+		entries, err := loadSyntheticEntries(*syntheticflag)
+		if err == nil {
+			err = storage.Prefixes.SetSyntheticEntries(entries)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// parse command line
-	flag.Parse()
+	if *ptrbackfillflag {
+		if storage.Prefixes == nil || storage.Addresses == nil {
+			log.Fatal("-ptr-backfill requires both caches, but -no-dns or -no-prefix is given")
+		}
+		storage.Prefixes.SetPTRBackfill(storage.Addresses)
+	}
 
-	// set up sigint handling
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	// tag prefixes with operator-defined country groupings
+	if storage.Prefixes != nil && len(*policytagsflag) > 0 {
+		tags, err := loadPolicyTags(*policytagsflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage.Prefixes.AddTransform(tags.Transform)
+	}
 
-	// allocate and link cache
-	storage := newStorage(*expiryflag, *limitflag)
-
-	// undump cache if filename given
-	if len(*fileflag) > 0 {
-		infile, ferr := os.Open(*fileflag)
-		if ferr == nil {
-			cerr := storage.undump(infile)
-			infile.Close()
-			if cerr != nil {
-				log.Fatal(cerr)
+	// label well-known origin ASes
+	if storage.Prefixes != nil && len(*aslabelsflag) > 0 {
+		labels := canid.NewASLabels(canid.WellKnownASLabels)
+		if *aslabelsflag != "builtin" {
+			var err error
+			if labels, err = loadASLabels(*aslabelsflag); err != nil {
+				log.Fatal(err)
+			}
+		}
+		storage.Prefixes.AddTransform(labels.Transform)
+	}
+
+	// install hooks from Go plugins, after the built-in transforms
+	var plugins []*canidPlugin
+	if len(*pluginflag) > 0 {
+		for _, path := range strings.Split(*pluginflag, ",") {
+			p, err := loadPlugin(path)
+			if err != nil {
+				log.Fatalf("unable to load plugin: %s", err.Error())
+			}
+			if storage.Prefixes != nil && p.transformPrefix != nil {
+				storage.Prefixes.AddTransform(p.transformPrefix)
+			}
+			if storage.Addresses != nil && p.transformAddress != nil {
+				storage.Addresses.AddTransform(p.transformAddress)
+			}
+			plugins = append(plugins, p)
+			slog.Info("loaded plugin", "path", path)
+		}
+	}
+
+	// set vantage point for distance estimation
+	if storage.Prefixes != nil && len(*vantageflag) > 0 {
+		var lat, lon float64
+		if _, err := fmt.Sscanf(*vantageflag, "%g,%g", &lat, &lon); err != nil {
+			log.Fatalf("invalid vantage point %s: %s", *vantageflag, err.Error())
+		}
+		storage.Prefixes.SetVantage(lat, lon)
+	}
+
+	// limit cache sizes if requested
+	if storage.Prefixes != nil && *prefixcapflag > 0 {
+		policy, err := canid.NewEvictionPolicy(*prefixevictflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage.Prefixes.SetEviction(*prefixcapflag, policy)
+		admission, err := canid.NewAdmissionPolicy(*prefixadmitflag, *prefixcapflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage.Prefixes.SetAdmission(admission)
+	}
+	if storage.Addresses != nil && *addresscapflag > 0 {
+		policy, err := canid.NewEvictionPolicy(*addressevictflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage.Addresses.SetEviction(*addresscapflag, policy)
+		admission, err := canid.NewAdmissionPolicy(*addressadmitflag, *addresscapflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage.Addresses.SetAdmission(admission)
+	}
+	if *recordcapflag > 0 {
+		for _, cache := range storage.recordCaches() {
+			policy, err := canid.NewEvictionPolicy(*recordevictflag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cache.SetEviction(*recordcapflag, policy)
+			admission, err := canid.NewAdmissionPolicy(*recordadmitflag, *recordcapflag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cache.SetAdmission(admission)
+		}
+	}
+
+	// limit fan-out of names with many addresses
+	if storage.Addresses != nil {
+		storage.Addresses.SetFanout(*addressmaxflag, *addressprecacheflag)
+	}
+
+	// pin the DNS resolver if requested
+	var resolver *canid.DNSResolver
+	if !*nodnsflag {
+		resolver, err = canid.NewDNSResolver(*resolverflag, time.Duration(*resolvertimeoutflag)*time.Second)
+		if err != nil {
+			log.Fatalf("invalid -resolver: %s", err.Error())
+		}
+		storage.Addresses.SetResolver(resolver)
+		for _, cache := range storage.recordCaches() {
+			cache.SetResolver(resolver)
+		}
+		if *resolverflag == canid.SystemResolver {
+			slog.Info("the system resolver doesn't give record TTLs, so DNS entries expire after -address-expiry; use -resolver resolv.conf to honor TTLs")
+		}
+	}
+
+	// annotate responses with blocklist listings if requested
+	if len(*dnsblflag) > 0 || len(*blocklistflag) > 0 {
+		lists := make([]canid.Blocklist, 0)
+		if len(*dnsblflag) > 0 {
+			for _, zone := range strings.Split(*dnsblflag, ",") {
+				lists = append(lists, canid.NewDNSBL(zone))
+			}
+		}
+		if len(*blocklistflag) > 0 {
+			for _, path := range strings.Split(*blocklistflag, ",") {
+				list, err := canid.NewFileBlocklist(path)
+				if err != nil {
+					log.Fatalf("unable to load blocklist: %s", err.Error())
+				}
+				lists = append(lists, list)
 			}
-			log.Printf("loaded caches from %s", *fileflag)
+		}
+		reputation := canid.NewReputation(lists...)
+		if storage.Prefixes != nil {
+			storage.Prefixes.SetReputation(reputation)
+		}
+		if storage.Addresses != nil {
+			storage.Addresses.SetReputation(reputation)
+		}
+		if len(*blocklistflag) > 0 && *blocklistrefreshflag > 0 {
+			go every(stopping, *blocklistrefreshflag, reputation.Refresh)
+		}
+	}
+
+	// refresh hot prefixes before they expire if requested; anything which
+	// would expire before the refresh after next is refreshed now
+	if storage.Prefixes != nil && *refreshintervalflag > 0 {
+		storage.Prefixes.TrackHits()
+		within := 2 * *refreshintervalflag
+		go every(stopping, *refreshintervalflag, func() {
+			storage.Prefixes.RefreshHot(context.Background(), *refreshtopflag, within)
+		})
+	}
+
+	// answer recently expired prefixes rather than wait for the backend if
+	// requested
+	if storage.Prefixes != nil && *servestaleflag > 0 {
+		storage.Prefixes.SetServeStale(*servestaleflag)
+	}
+
+	// sample prefix cache drift in the background if requested
+	if storage.Prefixes != nil && *sampleintervalflag > 0 {
+		go every(stopping, *sampleintervalflag, func() {
+			storage.Prefixes.Sample(context.Background(), *samplesizeflag)
+		})
+	}
+
+	// publish new entries to kafka if requested
+	var kafkapub *kafkaPublisher
+	if len(*kafkabrokersflag) > 0 {
+		kafkapub = newKafkaPublisher(*kafkabrokersflag, *kafkatopicflag)
+		if storage.Prefixes != nil {
+			storage.Prefixes.AddPublisher(kafkapub)
+		}
+		if storage.Addresses != nil {
+			storage.Addresses.AddPublisher(kafkapub)
+		}
+		slog.Info("publishing cache entries to kafka", "topic", *kafkatopicflag, "brokers", *kafkabrokersflag)
+	}
+
+	// and/or to syslog
+	var syslogpub *syslogPublisher
+	if len(*syslogflag) > 0 {
+		var err error
+		syslogpub, err = newSyslogPublisher(*syslogflag)
+		if err != nil {
+			log.Fatalf("unable to connect to syslog %s: %s", *syslogflag, err.Error())
+		}
+		if storage.Prefixes != nil {
+			storage.Prefixes.AddPublisher(syslogpub)
+		}
+		if storage.Addresses != nil {
+			storage.Addresses.AddPublisher(syslogpub)
+		}
+		slog.Info("sending cache entries to syslog", "target", *syslogflag)
+	}
+
+	// check backends in the background, so we can start serving immediately
+	selftests := make([]func() canid.SelfTestResult, 0)
+	if storage.Prefixes != nil {
+		selftests = append(selftests, storage.Prefixes.SelfTest)
+	}
+	if storage.Addresses != nil {
+		selftests = append(selftests, storage.Addresses.SelfTest)
+	}
+	go func() {
+		for _, test := range selftests {
+			result := test()
+			if result.OK {
+				slog.Info("self-test OK", "backend", result.Backend, "query", result.Query, "backend_latency", float64(result.Milliseconds)/1000)
+			} else {
+				slog.Error("self-test FAILED", "backend", result.Backend, "query", result.Query, "err", result.Error)
+			}
+		}
+	}()
+
+	server := canid.NewServer()
+	if len(*accesslogflag) > 0 {
+		accesslog, err := canid.AccessLog(os.Stdout, *accesslogflag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Use(accesslog)
+	}
+	if len(*instanceflag) > 0 {
+		server.Use(canid.Instance(*instanceflag))
+	}
+	if *ratelimitflag > 0 {
+		server.Use(canid.RateLimit(*ratelimitflag, *rateburstflag))
+	}
+	if *requestbudgetflag > 0 {
+		server.Use(canid.BackendBudget(*requestbudgetflag))
+	}
+	if len(*corsoriginflag) > 0 {
+		server.Use(canid.CORS(*corsoriginflag))
+	}
+	// administrative resources are only served to holders of the admin
+	// token, and not at all without one
+	if *noadminflag {
+		server.Use(canid.DenyAdmin)
+	} else {
+		server.Use(canid.AdminAuth(*admintokenflag))
+	}
+	for _, p := range plugins {
+		if p.middleware != nil {
+			server.Use(p.middleware)
+		}
+	}
+	handleUI(server)
+	server.HandleCaches(storage.Prefixes, storage.Addresses, storage.recordCaches()...)
+	// dumping gives away the whole cache, and importing writes arbitrary
+	// entries into it, so they are only offered to holders of the admin
+	// token
+	if len(*admintokenflag) > 0 && !*noadminflag {
+		server.HandleFunc("/dump.json", storage.dumpServer)
+		server.HandleFunc("/cache/import", storage.importServer)
+	}
+	server.HandleFunc("/cache/save", storage.saveServer(*fileflag, *filedirflag, *readonlyflag))
+	// with -ris-live, RIPEstat is the fallback of the live backend
+	if _, ok := baseBackend(backend).(canid.RipestatBackend); ok {
+		server.HandleFunc("/stats/ripestat.json", canid.RipestatSchemaDriftServer)
+	}
+	httpserver := &http.Server{Addr: ":" + strconv.Itoa(*portflag), Handler: server}
+	usetls, err := configureTLS(httpserver, *tlscertflag, *tlskeyflag, *acmedomainflag, *acmecacheflag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		var err error
+		if usetls {
+			// certificates are in the TLS config
+			err = httpserver.ListenAndServeTLS("", "")
 		} else {
-			log.Printf("unable to read cache file %s : %s", *fileflag, ferr.Error())
+			err = httpserver.ListenAndServe()
 		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// listeners other than the http server's, closed after it
+	var listeners []io.Closer
+
+	// serve counters via expvar on a separate listener, which can be kept
+	// private
+	if listening(*adminportflag) || listening(*debugportflag) {
+		canid.PublishExpvars(storage.Prefixes, storage.Addresses, storage.recordCaches()...)
+	}
+	if listening(*adminportflag) {
+		adminmux := http.NewServeMux()
+		adminmux.Handle("/debug/vars", expvar.Handler())
+		listeners = append(listeners, servePrivate(*adminportflag, adminmux))
 	}
 
-	// check for cache version mismatch
-	if storage.Version != canidStorageVersion {
-		log.Fatalf("storage version mismatch for cache file %s: delete and try again", *fileflag)
+	// serve profiles on another listener, which must be kept private: they
+	// reveal the internals of the process, and profiling costs CPU
+	if listening(*debugportflag) {
+		debugmux := http.NewServeMux()
+		debugmux.HandleFunc("/debug/pprof/", pprof.Index)
+		debugmux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		debugmux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		debugmux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		debugmux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		debugmux.Handle("/debug/vars", expvar.Handler())
+		listeners = append(listeners, servePrivate(*debugportflag, debugmux))
 	}
 
+	if *memcacheportflag > 0 {
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(*memcacheportflag))
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		server := &canid.MemcacheServer{Prefixes: storage.Prefixes, Addresses: storage.Addresses}
+		go serveUntilClosed(func() error { return server.Serve(l) })
+	}
+
+	if *dnsportflag > 0 {
+		server := &canid.DNSServer{Prefixes: storage.Prefixes, Zone: *dnszoneflag}
+		conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(*dnsportflag))
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, conn)
+		go serveUntilClosed(func() error { return server.ServeUDP(conn) })
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(*dnsportflag))
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		go serveUntilClosed(func() error { return server.ServeTCP(l) })
+	}
+
+	// dump caches on demand, without stopping
+	snapshot := make(chan os.Signal, 1)
+	notifySnapshot(snapshot)
 	go func() {
-		http.HandleFunc("/", welcomeServer)
-		http.HandleFunc("/prefix.json", storage.Prefixes.LookupServer)
-		http.HandleFunc("/address.json", storage.Addresses.LookupServer)
-		log.Fatal(http.ListenAndServe(":"+strconv.Itoa(*portflag), nil))
+		for range snapshot {
+			slog.Info("dumping caches on signal")
+			if err := storage.snapshot(*fileflag, *filedirflag, *readonlyflag); err != nil {
+				slog.Error("unable to dump caches", "err", err)
+			}
+		}
 	}()
 
-	_ = <-interrupt
-	log.Printf("terminating on interrupt")
-
-	// dump cache if filename given
-	if len(*fileflag) > 0 {
-		outfile, ferr := os.Create(*fileflag)
-		if ferr == nil {
-			cerr := storage.dump(outfile)
-			outfile.Close()
-			if cerr != nil {
-				log.Fatal(cerr)
+	// save caches in the background if requested
+	if (len(*fileflag) > 0 || len(*filedirflag) > 0) && !*readonlyflag && *saveintervalflag > 0 {
+		go every(stopping, *saveintervalflag, func() {
+			if err := storage.persist(*fileflag, *filedirflag); err != nil {
+				slog.Error("unable to save caches", "err", err)
 			}
-			log.Printf("dumped cache to %s", *fileflag)
-		} else {
-			log.Fatalf("unable to write backing file %s : %s", *fileflag, ferr.Error())
+		})
+	}
+
+	sig := <-interrupt
+	slog.Info("terminating", "signal", sig.String())
+
+	// keep serving while load balancers notice we're draining, unless
+	// interrupted again
+	server.Drain()
+	if *shutdowngraceflag > 0 {
+		slog.Info("draining", "seconds", *shutdowngraceflag)
+		select {
+		case <-time.After(time.Duration(*shutdowngraceflag) * time.Second):
+		case sig := <-interrupt:
+			slog.Info("stopped draining", "signal", sig.String())
+		}
+	}
+
+	// then stop accepting requests, and finish those in flight
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := httpserver.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down http server", "err", err)
+	}
+	cancel()
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			slog.Error("error closing listener", "err", err)
+		}
+	}
+
+	// stop background work, so nothing touches the caches or publishers
+	// from here on
+	close(stopping)
+	if storage.Prefixes != nil {
+		storage.Prefixes.Close()
+	}
+	canid.CloseIdleConnections()
+
+	// flush publishers
+	if kafkapub != nil {
+		if err := kafkapub.Close(); err != nil {
+			slog.Error("error closing kafka publisher", "err", err)
+		}
+	}
+
+	if syslogpub != nil {
+		if err := syslogpub.Close(); err != nil {
+			slog.Error("error closing syslog publisher", "err", err)
+		}
+	}
+
+	// log final statistics, which are otherwise lost
+	if storage.Prefixes != nil {
+		logStats(storage.Prefixes.Stats())
+	}
+	if storage.Addresses != nil {
+		logStats(storage.Addresses.Stats())
+	}
+	for _, cache := range storage.recordCaches() {
+		logStats(cache.Stats())
+	}
+	if liveroutes != nil {
+		prefixes, updates := liveroutes.Len()
+		slog.Info("RIS Live stats", "prefixes", prefixes, "updates", updates)
+	}
+
+	// dump caches to backing store if given
+	if !*readonlyflag {
+		if err := storage.persist(*fileflag, *filedirflag); err != nil {
+			log.Fatalf("unable to write backing store: %s", err.Error())
+		}
+	}
+
+	// and close stores last, once nothing writes to them
+	if boltstore != nil {
+		if err := boltstore.Close(); err != nil {
+			slog.Error("error closing store", "err", err)
 		}
 	}
+	if redisstore != nil {
+		if err := redisstore.Close(); err != nil {
+			slog.Error("error closing redis store", "err", err)
+		}
+	}
+}
+
+// How long to wait for requests in flight on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// baseBackend returns the backend a LiveBackend falls back on, or the
+// backend itself if it isn't live.
+func baseBackend(backend canid.PrefixBackend) canid.PrefixBackend {
+	if live, ok := backend.(canid.LiveBackend); ok {
+		return live.Fallback
+	}
+	return backend
+}
+
+// listening returns true if a private listener is given as [host:]port,
+// rather than disabled with 0.
+func listening(hostport string) bool {
+	return len(hostport) > 0 && hostport != "0"
+}
+
+// servePrivate serves HTTP on a private listener given as [host:]port,
+// returning the listener, and exits if it cannot listen.
+func servePrivate(hostport string, handler http.Handler) net.Listener {
+	l, err := net.Listen("tcp", listenAddr(hostport))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go serveUntilClosed(func() error { return http.Serve(l, handler) })
+	return l
+}
+
+// listenAddr returns the address to listen on for a private listener given
+// as [host:]port: a port alone is on localhost only.
+func listenAddr(hostport string) string {
+	if !strings.Contains(hostport, ":") {
+		return net.JoinHostPort("127.0.0.1", hostport)
+	}
+	return hostport
+}
+
+// serveUntilClosed runs serve, which returns once its listener is closed,
+// and exits if it fails otherwise.
+func serveUntilClosed(serve func() error) {
+	if err := serve(); !errors.Is(err, net.ErrClosed) {
+		log.Fatal(err)
+	}
+}
+
+// defaultInstanceID returns the host name, to identify this instance by
+// default.
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
+
+// every calls f every interval seconds, until stopping is closed.
+func every(stopping <-chan struct{}, interval int, f func()) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f()
+		case <-stopping:
+			return
+		}
+	}
+}
+
+// logStats logs a summary of a cache's statistics.
+func logStats(stats canid.CacheStats) {
+	slog.Info("cache stats", "cache", stats.Cache, "entries", stats.Entries,
+		"hits", stats.Hits, "misses", stats.Misses, "backend_errors", stats.BackendErrors)
 }
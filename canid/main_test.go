@@ -0,0 +1,521 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/britram/canid"
+)
+
+// Integration tests run the daemon as a separate process, so that it can be
+// given any flags and stopped with signals: with CANID_TEST_DAEMON set, the
+// test binary runs main instead of the tests. The daemon listens on a random
+// port, and answers prefix lookups from the RIPEstat fixtures in testdata.
+
+const testFixtures = "testdata/fixtures"
+
+// Admin token of test daemons
+const testToken = "test-token"
+
+func TestMain(m *testing.M) {
+	if os.Getenv("CANID_TEST_DAEMON") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testDaemon is a canid process started by a test.
+
+type testDaemon struct {
+	t    *testing.T
+	cmd  *exec.Cmd
+	url  string
+	log  *syncBuffer
+	done chan error
+}
+
+// syncBuffer collects the daemon's log, written and read concurrently.
+
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// freePort returns a TCP port which was free a moment ago.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startDaemon starts canid on a random port with the given flags, in addition
+// to those answering from fixtures, and waits until it serves requests. The
+// daemon is killed when the test ends, if it is still running.
+func startDaemon(t *testing.T, args ...string) *testDaemon {
+	t.Helper()
+	fixtures, err := filepath.Abs(testFixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	args = append([]string{
+		"-port", strconv.Itoa(port),
+		"-backend-fixtures", fixtures,
+		"-admin-token", testToken,
+		"-special-local",
+		"-resolver-timeout", "2",
+		"-ripestat-attempts", "1",
+	}, args...)
+
+	d := &testDaemon{t: t, url: "http://127.0.0.1:" + strconv.Itoa(port), log: new(syncBuffer), done: make(chan error, 1)}
+	d.cmd = exec.Command(os.Args[0], args...)
+	d.cmd.Env = append(os.Environ(), "CANID_TEST_DAEMON=1")
+	// snapshots without a backing store are written to the working directory
+	d.cmd.Dir = t.TempDir()
+	d.cmd.Stdout = d.log
+	d.cmd.Stderr = d.log
+	if err := d.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { d.done <- d.cmd.Wait() }()
+	t.Cleanup(func() {
+		if d.cmd.ProcessState == nil {
+			d.cmd.Process.Kill()
+			<-d.done
+		}
+		if t.Failed() {
+			t.Logf("daemon log:\n%s", d.log.String())
+		}
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := http.Get(d.url + "/healthz"); err == nil {
+			resp.Body.Close()
+			return d
+		}
+		select {
+		case err := <-d.done:
+			t.Fatalf("daemon exited on startup: %v\n%s", err, d.log.String())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatalf("daemon not serving after 10s:\n%s", d.log.String())
+	return nil
+}
+
+// request makes a request of the daemon, with the admin token for admin
+// resources, and returns the status and body of the response.
+func (d *testDaemon) request(method string, path string, body string) (int, []byte) {
+	d.t.Helper()
+	req, err := http.NewRequest(method, d.url+path, strings.NewReader(body))
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		d.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	resp_body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		d.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp.StatusCode, resp_body
+}
+
+// stop sends the daemon a signal, and waits for it to exit successfully.
+func (d *testDaemon) stop(sig os.Signal) {
+	d.t.Helper()
+	if err := d.cmd.Process.Signal(sig); err != nil {
+		d.t.Fatal(err)
+	}
+	d.wait()
+}
+
+// wait waits for the daemon to exit successfully.
+func (d *testDaemon) wait() {
+	d.t.Helper()
+	select {
+	case err := <-d.done:
+		if err != nil {
+			d.t.Fatalf("daemon exited with %v", err)
+		}
+	case <-time.After(20 * time.Second):
+		d.t.Fatal("daemon didn't exit 20s after signal")
+	}
+}
+
+// lookupPrefix looks up an address, failing the test unless it is answered
+// with the given prefix.
+func (d *testDaemon) lookupPrefix(addr string, prefix string) {
+	d.t.Helper()
+	status, body := d.request(http.MethodGet, "/prefix.json?addr="+addr, "")
+	var info struct {
+		Prefix string
+		ASN    int
+	}
+	if err := json.Unmarshal(body, &info); status != http.StatusOK || err != nil {
+		d.t.Fatalf("/prefix.json?addr=%s: status %d, %s", addr, status, body)
+	}
+	if info.Prefix != prefix || info.ASN != 3333 {
+		d.t.Errorf("/prefix.json?addr=%s: got %s AS%d, want %s AS3333", addr, info.Prefix, info.ASN, prefix)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	d := startDaemon(t)
+	d.lookupPrefix("193.0.0.1", "193.0.0.0/21")
+	d.lookupPrefix("2001:67c:2e8::1", "2001:67c:2e8::/48")
+
+	// DNS results depend on the host, so resources resolving names are only
+	// checked for answering with JSON without failing
+	dns := []int{http.StatusOK, http.StatusBadGateway, http.StatusGatewayTimeout}
+	ok := []int{http.StatusOK}
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status []int
+		want   string
+	}{
+		{"GET", "/", "", ok, "<html"},
+		{"GET", "/prefix.json?addr=193.0.0.7", "", ok, `"193.0.0.0/21"`},
+		{"GET", "/prefix.json?addr=193.0.0.1:443&debug=1", "", ok, `"BackendMeta"`},
+		{"GET", "/prefix.json?addr=10.1.2.3", "", ok, `"Private-Use"`},
+		{"GET", "/prefix.json?addr=bogus", "", []int{http.StatusBadRequest}, ""},
+		{"GET", "/prefix.json?addr=8.8.8.8", "", []int{http.StatusInternalServerError}, `"Error"`},
+		{"POST", "/prefixes.json", `["193.0.0.1","2001:67c:2e8::1"]`, ok, `"2001:67c:2e8::/48"`},
+		{"GET", "/address.json?name=localhost", "", dns, `"Name":"localhost"`},
+		{"GET", "/address.json?name=127.0.0.1&type=PTR", "", dns, `"Type":"PTR"`},
+		{"GET", "/lookup.json?q=193.0.0.1", "", ok, `"193.0.0.0/21"`},
+		{"GET", "/lookup.json?q=https://localhost/", "", ok, `"localhost"`},
+		{"GET", "/verify.json?addr=127.0.0.1", "", dns, "{"},
+		{"GET", "/mx.json?name=localhost", "", dns, `"Type":"MX"`},
+		{"GET", "/ns.json?name=localhost", "", dns, `"Type":"NS"`},
+		{"GET", "/txt.json?name=localhost", "", dns, `"Type":"TXT"`},
+		{"GET", "/stats.json", "", ok, `"prefix"`},
+		{"GET", "/stats/prefix.json", "", ok, `"Hits"`},
+		{"GET", "/stats/address.json", "", ok, `"Cache":"address"`},
+		{"GET", "/stats/mx.json", "", ok, `"Cache":"mx"`},
+		{"GET", "/stats/ripestat.json", "", ok, "{"},
+		{"GET", "/schema.json", "", ok, `"PrefixInfo"`},
+		{"GET", "/openapi.json", "", ok, `"/prefix.json"`},
+		{"GET", "/healthz", "", ok, `"OK"`},
+		{"GET", "/cache/keys.json", "", ok, `"prefix/193.0.0.0/21"`},
+		{"GET", "/cache/search.json?q=asn:3333", "", ok, `"2001:67c:2e8::/48"`},
+		{"GET", "/cache/quality.json", "", ok, "{"},
+		{"GET", "/dump.json", "", ok, `"193.0.0.0/21"`},
+		{"GET", "/admin/debug/backend.json?addr=193.0.0.1", "", ok, `"prefix-overview"`},
+		{"GET", "/admin/selftest", "", []int{http.StatusOK, http.StatusServiceUnavailable}, `"ripestat"`},
+		{"POST", "/cache/save", "", ok, `"Saved":true`},
+		{"POST", "/cache/import", `{"Version":3,"Prefixes":{"Data":{"198.51.100.0/24":{"Prefix":"198.51.100.0/24","ASN":64496,"Cached":"2020-01-01T00:00:00Z"}}}}`, ok, `"Prefixes":1`},
+		{"POST", "/cache/import", `not a dump`, []int{http.StatusBadRequest}, `"Error"`},
+		{"GET", "/cache/import", "", []int{http.StatusMethodNotAllowed}, ""},
+		{"DELETE", "/cache/prefix?prefix=2001:67c:2e8::/48", "", ok, `"Removed":1`},
+		{"DELETE", "/cache/address?name=localhost", "", ok, `"Cache":"address"`},
+		{"POST", "/admin/purge/mx", "", ok, `"Purged"`},
+		{"POST", "/admin/purge/address", "", ok, `"Purged"`},
+		{"POST", "/cache/flush", "", ok, `"prefix"`},
+		{"POST", "/admin/purge/prefix", "", ok, `"Purged":0`},
+	}
+	for _, test := range tests {
+		status, body := d.request(test.method, test.path, test.body)
+		found := false
+		for _, s := range test.status {
+			found = found || status == s
+		}
+		if !found {
+			t.Errorf("%s %s: status %d, want one of %v; body %s", test.method, test.path, status, test.status, body)
+		} else if !bytes.Contains(body, []byte(test.want)) {
+			t.Errorf("%s %s: body %s doesn't contain %s", test.method, test.path, body, test.want)
+		}
+	}
+
+	// admin resources need the token
+	resp, err := http.Post(d.url+"/cache/flush", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/cache/flush without token: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	d := startDaemon(t, "-admin-token", "")
+	for _, path := range []string{"/cache/flush", "/cache/import", "/cache/keys.json", "/cache/search.json", "/dump.json", "/admin/selftest"} {
+		resp, err := http.Post(d.url+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s without -admin-token: status %d, want 404", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	for _, name := range []string{"cache.json", "cache.json.gz", "cache.gob.gz"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), name)
+			d := startDaemon(t, "-file", file)
+			d.lookupPrefix("193.0.0.1", "193.0.0.0/21")
+			d.lookupPrefix("2001:67c:2e8::1", "2001:67c:2e8::/48")
+			d.stop(syscall.SIGTERM)
+			if _, err := os.Stat(file); err != nil {
+				t.Fatalf("backing store not saved: %v", err)
+			}
+
+			// without fixtures, lookups can only be answered from the file
+			d = startDaemon(t, "-file", file, "-backend-fixtures", t.TempDir())
+			d.lookupPrefix("193.0.0.1", "193.0.0.0/21")
+			d.lookupPrefix("2001:67c:2e8::1", "2001:67c:2e8::/48")
+			status, body := d.request(http.MethodGet, "/stats/prefix.json", "")
+			var stats struct{ Hits, Misses uint64 }
+			if err := json.Unmarshal(body, &stats); status != http.StatusOK || err != nil {
+				t.Fatalf("/stats/prefix.json: status %d, %s", status, body)
+			}
+			if stats.Hits != 2 || stats.Misses != 0 {
+				t.Errorf("after reload: %d hits and %d misses, want 2 and 0", stats.Hits, stats.Misses)
+			}
+			d.stop(syscall.SIGINT)
+		})
+	}
+}
+
+func TestSnapshotSignal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.json")
+	d := startDaemon(t, "-file", file)
+	d.lookupPrefix("193.0.0.1", "193.0.0.0/21")
+	if err := d.cmd.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the daemon keeps running, and writes the file in the background
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if body, err := ioutil.ReadFile(file); err == nil && bytes.Contains(body, []byte("193.0.0.0/21")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no snapshot 10s after SIGUSR1")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	d.lookupPrefix("193.0.0.1", "193.0.0.0/21")
+	d.stop(syscall.SIGTERM)
+}
+
+func TestShutdownDrains(t *testing.T) {
+	d := startDaemon(t, "-shutdown-grace", "2")
+	if err := d.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	// still serving while draining, but reported as drained
+	time.Sleep(500 * time.Millisecond)
+	status, body := d.request(http.MethodGet, "/healthz", "")
+	if status != http.StatusServiceUnavailable || !bytes.Contains(body, []byte(`"Drained"`)) {
+		t.Errorf("/healthz while draining: status %d, %s", status, body)
+	}
+	d.lookupPrefix("193.0.0.1", "193.0.0.0/21")
+
+	d.wait()
+	if !strings.Contains(d.log.String(), "terminating") {
+		t.Error("termination not logged")
+	}
+	if _, err := http.Get(d.url + "/healthz"); err == nil {
+		t.Error("still serving after shutdown")
+	}
+}
+
+func TestShutdownClosesListeners(t *testing.T) {
+	memcacheport, dnsport := freePort(t), freePort(t)
+	d := startDaemon(t, "-memcache-port", strconv.Itoa(memcacheport), "-dns-port", strconv.Itoa(dnsport))
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(memcacheport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 64)
+	if n, err := conn.Read(reply); err != nil || !bytes.HasPrefix(reply[:n], []byte("VERSION")) {
+		t.Fatalf("memcache version: %q, %v", reply[:n], err)
+	}
+
+	// closing the listeners on shutdown doesn't fail the daemon
+	d.stop(syscall.SIGTERM)
+	if strings.Contains(d.log.String(), "use of closed network connection") {
+		t.Errorf("closed listener reported as an error:\n%s", d.log.String())
+	}
+}
+
+func TestBaseBackend(t *testing.T) {
+	ripestat := canid.RipestatBackend{}
+	tests := []struct {
+		backend canid.PrefixBackend
+		want    canid.PrefixBackend
+	}{
+		{ripestat, ripestat},
+		{canid.LiveBackend{Fallback: ripestat}, ripestat},
+		{canid.CymruBackend{}, canid.CymruBackend{}},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		if got := baseBackend(test.backend); got != test.want {
+			t.Errorf("baseBackend(%T) = %T, want %T", test.backend, got, test.want)
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := map[string]string{
+		"9043":           "127.0.0.1:9043",
+		":9043":          ":9043",
+		"0.0.0.0:9043":   "0.0.0.0:9043",
+		"[::1]:9043":     "[::1]:9043",
+		"localhost:9043": "localhost:9043",
+	}
+	for hostport, want := range tests {
+		if got := listenAddr(hostport); got != want {
+			t.Errorf("listenAddr(%q) = %q, want %q", hostport, got, want)
+		}
+	}
+}
+
+func TestPrivateListeners(t *testing.T) {
+	tests := []struct {
+		flag  string
+		pprof bool
+	}{
+		{"-admin-port", false},
+		{"-debug-port", true},
+	}
+	for _, test := range tests {
+		port := strconv.Itoa(freePort(t))
+		d := startDaemon(t, test.flag, port)
+		private := "http://127.0.0.1:" + port
+		if resp, err := http.Get(private + "/debug/vars"); err != nil {
+			t.Errorf("%s /debug/vars: %v", test.flag, err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%s /debug/vars: status %d", test.flag, resp.StatusCode)
+			}
+		}
+		if resp, err := http.Get(private + "/debug/pprof/"); err != nil {
+			t.Errorf("%s /debug/pprof/: %v", test.flag, err)
+		} else {
+			resp.Body.Close()
+			if served := resp.StatusCode == http.StatusOK; served != test.pprof {
+				t.Errorf("%s /debug/pprof/: status %d", test.flag, resp.StatusCode)
+			}
+		}
+		d.stop(syscall.SIGTERM)
+	}
+}
+
+// Options given on the command line override the config file.
+func TestConfigFile(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "canid.yaml")
+	content := "# test config\ninstance-id: \"from config\" # quoted\nport: 1\n"
+	if err := os.WriteFile(config, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := startDaemon(t, "-config", config)
+	resp, err := http.Get(d.url + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Canid-Instance"); id != "from config" {
+		t.Errorf("instance id %q, want from config", id)
+	}
+	d.stop(syscall.SIGTERM)
+}
+
+func TestEnrichSubcommand(t *testing.T) {
+	d := startDaemon(t)
+	in := filepath.Join(t.TempDir(), "in.csv")
+	rows := "addr,port\n193.0.0.1:443,443\n[2001:67c:2e8::1]:80,80\n 193.0.0.1 ,0\nnot-an-address,0\n"
+	if err := os.WriteFile(in, []byte(rows), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "enrich", "-in", in, "-header", "-server", d.url, "-concurrency", "2")
+	cmd.Env = append(os.Environ(), "CANID_TEST_DAEMON=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// invalid addresses fail the command, after writing the rest
+	if err := cmd.Run(); err == nil {
+		t.Error("enrich succeeded despite an invalid address")
+	}
+	if !strings.Contains(stderr.String(), "not-an-address: not an address") {
+		t.Errorf("invalid address not reported: %s", stderr.String())
+	}
+	want := "addr,port,prefix,asn,country_code\n" +
+		"193.0.0.1:443,443,193.0.0.0/21,3333,NL\n" +
+		"[2001:67c:2e8::1]:80,80,2001:67c:2e8::/48,3333,NL\n" +
+		"\" 193.0.0.1 \",0,193.0.0.0/21,3333,NL\n" +
+		"not-an-address,0,,,\n"
+	if stdout.String() != want {
+		t.Errorf("enriched:\n%s\nwant:\n%s", stdout.String(), want)
+	}
+}
+
+// Subcommands run on the files the daemon writes.
+func TestDumpSubcommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.gob")
+	d := startDaemon(t, "-file", file)
+	d.lookupPrefix("193.0.0.1", "193.0.0.0/21")
+	d.stop(syscall.SIGTERM)
+
+	cmd := exec.Command(os.Args[0], "dump", "-file", file, "-format", "csv")
+	cmd.Env = append(os.Environ(), "CANID_TEST_DAEMON=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("dump: %v\n%s", err, out)
+	}
+	if want := "prefix,193.0.0.0/21,193.0.0.0/21,3333,NL,"; !bytes.Contains(out, []byte(want)) {
+		t.Errorf("dump doesn't contain %s:\n%s", want, out)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/britram/canid"
+)
+
+// merge merges the caches of another storage into this one, keeping the
+// freshest entry per key, and returns the number of prefix and address
+// entries added. Caches disabled in either storage are skipped.
+func (storage *canidStorage) merge(in *canidStorage) (prefixes int, addresses int) {
+	if storage.Prefixes != nil && in.Prefixes != nil {
+		prefixes = storage.Prefixes.Merge(in.Prefixes.Data)
+	}
+	if storage.Addresses != nil && in.Addresses != nil {
+		addresses = storage.Addresses.Merge(in.Addresses.Data)
+	}
+	return
+}
+
+// Largest dump accepted by importServer; larger stores can be merged offline
+// with the merge subcommand
+const importMaxBody = 256 << 20
+
+// importServer merges a dump of another instance's caches, in the format of a
+// backing file (e.g. from /dump.json), into the live caches on POST,
+// rejecting anything else.
+func (storage *canidStorage) importServer(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	in := newStorage("", 0, 0, 1, canid.RipestatBackend{}, true)
+	if err := in.undump(http.MaxBytesReader(w, req.Body, importMaxBody)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		error_struct := struct{ Error string }{err.Error()}
+		error_body, _ := json.Marshal(error_struct)
+		w.Write(error_body)
+		return
+	}
+
+	import_struct := struct {
+		Prefixes  int
+		Addresses int
+	}{}
+	import_struct.Prefixes, import_struct.Addresses = storage.merge(in)
+	slog.Info("imported caches", "dumped_by", in.Instance, "prefixes", import_struct.Prefixes, "addresses", import_struct.Addresses)
+	import_body, _ := json.Marshal(import_struct)
+	w.Write(import_body)
+}
+
+// mergeMain implements the merge subcommand, which merges backing stores,
+// e.g. of several instances, into a new one, keeping the freshest entry per
+// key.
+func mergeMain(args []string) {
+	cmd := flag.NewFlagSet("merge", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintf(cmd.Output(), "usage: canid merge <out> <in>...\n")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(args)
+	if cmd.NArg() < 2 {
+		cmd.Usage()
+		os.Exit(2)
+	}
+	outpath := cmd.Arg(0)
+
+	lockfile, err := lockBackingFile(outpath)
+	if err != nil {
+		log.Fatalf("unable to lock backing store %s: %s", outpath, err.Error())
+	}
+	if lockfile != nil {
+		defer lockfile.Close()
+	}
+
+	storage := newStorage("", 0, 0, 1, canid.RipestatBackend{}, true)
+	for _, inpath := range cmd.Args()[1:] {
+		in, err := readStorage(inpath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		prefixes, addresses := storage.merge(in)
+		fmt.Fprintf(os.Stderr, "%s: took %d of %d prefix entries and %d of %d address entries\n",
+			inpath, prefixes, len(in.Prefixes.Data), addresses, len(in.Addresses.Data))
+	}
+	if err := storage.save(outpath); err != nil {
+		log.Fatalf("unable to write backing store: %s", err.Error())
+	}
+}
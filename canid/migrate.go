@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/britram/canid"
+)
+
+// storageMigrations upgrade a backing store from each storage version to the
+// next: storageMigrations[v] upgrades version v to v+1. They work on the
+// undecoded JSON object of a backing file, keyed by field, since old versions
+// may not decode into the current types.
+var storageMigrations = []func(raw map[string]json.RawMessage) error{
+	migrateStorageV0,
+	migrateStorageV1,
+	migrateStorageV2,
+}
+
+// migrateStorage upgrades the JSON object of a backing store of any earlier
+// version to the current version, in place, returning the version it had.
+// Files without a Version are version 0.
+func migrateStorage(raw map[string]json.RawMessage) (int, error) {
+	version := 0
+	if v, ok := raw["Version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return 0, fmt.Errorf("invalid storage version: %s", err.Error())
+		}
+	}
+	if err := checkStorageVersion(version); err != nil {
+		return version, err
+	}
+	for v := version; v < canidStorageVersion; v++ {
+		slog.Info("upgrading storage version", "from", v, "to", v+1)
+		if err := storageMigrations[v](raw); err != nil {
+			return version, fmt.Errorf("unable to upgrade storage version %d: %s", v, err.Error())
+		}
+	}
+	raw["Version"], _ = json.Marshal(canidStorageVersion)
+	return version, nil
+}
+
+// checkStorageVersion returns an error unless a storage version can be
+// upgraded to the current version.
+func checkStorageVersion(version int) error {
+	if version > canidStorageVersion {
+		return fmt.Errorf("storage version %d is newer than this canid supports (%d)", version, canidStorageVersion)
+	}
+	if version < 0 {
+		return fmt.Errorf("invalid storage version %d", version)
+	}
+	return nil
+}
+
+// migrateStorageV0 upgrades unversioned files from before canid had a
+// storage version, which hold the caches as bare maps of entries by key, or
+// only a bare map of prefix entries, to version 1, which wraps each map as
+// its cache's Data.
+func migrateStorageV0(raw map[string]json.RawMessage) error {
+	_, prefixes := raw["Prefixes"]
+	_, addresses := raw["Addresses"]
+	if !prefixes && !addresses {
+		entries, _ := json.Marshal(raw)
+		for key := range raw {
+			delete(raw, key)
+		}
+		raw["Prefixes"] = entries
+	}
+
+	for _, name := range []string{"Prefixes", "Addresses"} {
+		cache, ok := raw[name]
+		if !ok || string(cache) == "null" {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(cache, &fields); err != nil {
+			return err
+		}
+		if _, ok := fields["Data"]; !ok {
+			raw[name], _ = json.Marshal(map[string]json.RawMessage{"Data": cache})
+		}
+	}
+	return nil
+}
+
+// migrateStorageV1 upgrades version 1, which keys address entries by name
+// alone, to version 2, which keys them by name, query type, and resolver:
+// version 1 entries are ANY queries through the system resolver.
+func migrateStorageV1(raw map[string]json.RawMessage) error {
+	cache, ok := raw["Addresses"]
+	if !ok || string(cache) == "null" {
+		return nil
+	}
+	var addresses struct {
+		Data map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(cache, &addresses); err != nil {
+		return err
+	}
+	rekeyed := make(map[string]map[string]json.RawMessage, len(addresses.Data))
+	for name, entry := range addresses.Data {
+		if entry == nil {
+			continue
+		}
+		key := canid.NewAddressKey(name, canid.QueryTypeAny, canid.SystemResolver)
+		entry["Name"], _ = json.Marshal(key.Name)
+		entry["Type"], _ = json.Marshal(key.Type)
+		entry["Resolver"], _ = json.Marshal(key.Resolver)
+		rekeyed[key.String()] = entry
+	}
+	addresses.Data = rekeyed
+	raw["Addresses"], _ = json.Marshal(addresses)
+	return nil
+}
+
+// migrateStorageV2 upgrades version 2 to version 3, which only added
+// optional fields to prefix entries, so needs no changes.
+func migrateStorageV2(raw map[string]json.RawMessage) error {
+	return nil
+}
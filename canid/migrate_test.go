@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/britram/canid"
+)
+
+// Backing files of each storage version, holding the prefix and (except the
+// bare map) address in the storage test files
+const testStorageFixtures = "testdata/storage"
+
+// testStorageFile reads a backing file fixture.
+func testStorageFile(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(testStorageFixtures, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMigrateStorage(t *testing.T) {
+	tests := []struct {
+		file      string
+		version   int
+		addresses int
+	}{
+		{"v0-bare.json", 0, 0},
+		{"v0.json", 0, 1},
+		{"v1.json", 1, 1},
+		{"v2.json", 2, 1},
+		{"v3.json", 3, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal(testStorageFile(t, test.file), &raw); err != nil {
+				t.Fatal(err)
+			}
+			version, err := migrateStorage(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != test.version {
+				t.Errorf("migrated from version %d, want %d", version, test.version)
+			}
+
+			// the upgraded file decodes into the current types
+			var upgraded struct {
+				Version  int
+				Prefixes struct {
+					Data map[string]canid.PrefixInfo
+				}
+				Addresses struct {
+					Data map[string]canid.AddressInfo
+				}
+			}
+			data, _ := json.Marshal(raw)
+			if err := json.Unmarshal(data, &upgraded); err != nil {
+				t.Fatalf("upgraded file doesn't decode: %v\n%s", err, data)
+			}
+			if upgraded.Version != canidStorageVersion {
+				t.Errorf("upgraded to version %d, want %d", upgraded.Version, canidStorageVersion)
+			}
+			if info, ok := upgraded.Prefixes.Data["193.0.0.0/21"]; !ok || info.ASN != 3333 {
+				t.Errorf("prefix not upgraded: %s", data)
+			}
+			if n := len(upgraded.Addresses.Data); n != test.addresses {
+				t.Errorf("%d addresses upgraded, want %d: %s", n, test.addresses, data)
+			}
+			if test.addresses > 0 {
+				info, ok := upgraded.Addresses.Data[testAddressKey]
+				if !ok || info.Type != canid.QueryTypeAny || info.Resolver != canid.SystemResolver {
+					t.Errorf("address not rekeyed as %s: %s", testAddressKey, data)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateStorageErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"Version":99}`:                           "newer than this canid supports",
+		`{"Version":-1}`:                           "invalid storage version -1",
+		`{"Version":"3"}`:                          "invalid storage version",
+		`{"Version":1,"Addresses":[]}`:             "unable to upgrade storage version 1",
+		`{"Prefixes":{"Data":{}},"Addresses":"x"}`: "unable to upgrade storage version 0",
+	}
+	for file, want := range tests {
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(file), &raw); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := migrateStorage(raw); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %s", file, err, want)
+		}
+	}
+}
+
+func TestUndumpVersions(t *testing.T) {
+	for _, file := range []string{"v0.json", "v1.json", "v2.json", "v3.json"} {
+		t.Run(file, func(t *testing.T) {
+			storage := newStorage("test", 86400, 86400, 1, canid.RipestatBackend{}, true)
+			if err := storage.undump(bytes.NewReader(testStorageFile(t, file))); err != nil {
+				t.Fatal(err)
+			}
+			if info, ok := storage.Prefixes.Data["193.0.0.0/21"]; !ok || info.ASN != 3333 {
+				t.Errorf("prefix not loaded: %v", storage.Prefixes.Data)
+			}
+			if _, ok := storage.Addresses.Data[testAddressKey]; !ok || len(storage.Addresses.Data) != 1 {
+				t.Errorf("address not loaded as %s: %v", testAddressKey, storage.Addresses.Data)
+			}
+			if storage.Version != canidStorageVersion || storage.Instance != "test" {
+				t.Errorf("loaded as version %d of %s, want %d of test", storage.Version, storage.Instance, canidStorageVersion)
+			}
+		})
+	}
+
+	storage := newStorage("test", 86400, 86400, 1, canid.RipestatBackend{}, true)
+	if err := storage.undump(bytes.NewReader(testStorageFile(t, "v99.json"))); err == nil {
+		t.Error("newer version loaded")
+	}
+}
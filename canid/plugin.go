@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"plugin"
+
+	"github.com/britram/canid"
+)
+
+// canidPlugin holds the hooks exported by a Go plugin, any of which may be
+// nil: TransformPrefix and TransformAddress, applied to every response as
+// PrefixTransform and AddressTransform, and Middleware, wrapped around
+// every HTTP request as with Server.Use. Each may be exported as a function
+// or as a variable of the function type.
+
+type canidPlugin struct {
+	transformPrefix  canid.PrefixTransform
+	transformAddress canid.AddressTransform
+	middleware       func(http.Handler) http.Handler
+}
+
+// loadPlugin opens a Go plugin, built with go build -buildmode=plugin against
+// the same version of canid, and looks up its hooks. It is an error for a
+// plugin to export none.
+func loadPlugin(path string) (*canidPlugin, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	out := new(canidPlugin)
+	found := false
+	lookup := func(name string, set func(sym plugin.Symbol) bool) error {
+		sym, err := p.Lookup(name)
+		if err != nil {
+			return nil
+		}
+		if !set(sym) {
+			return fmt.Errorf("plugin %s: %s has type %T", path, name, sym)
+		}
+		found = true
+		return nil
+	}
+
+	if err := lookup("TransformPrefix", func(sym plugin.Symbol) bool {
+		switch f := sym.(type) {
+		case func(*canid.PrefixInfo):
+			out.transformPrefix = f
+		case *canid.PrefixTransform:
+			out.transformPrefix = *f
+		case *func(*canid.PrefixInfo):
+			out.transformPrefix = *f
+		default:
+			return false
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if err := lookup("TransformAddress", func(sym plugin.Symbol) bool {
+		switch f := sym.(type) {
+		case func(*canid.AddressInfo):
+			out.transformAddress = f
+		case *canid.AddressTransform:
+			out.transformAddress = *f
+		case *func(*canid.AddressInfo):
+			out.transformAddress = *f
+		default:
+			return false
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	if err := lookup("Middleware", func(sym plugin.Symbol) bool {
+		switch f := sym.(type) {
+		case func(http.Handler) http.Handler:
+			out.middleware = f
+		case *func(http.Handler) http.Handler:
+			out.middleware = *f
+		default:
+			return false
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("plugin %s exports none of TransformPrefix, TransformAddress, or Middleware", path)
+	}
+	return out, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Presets are named sets of option values for common kinds of deployment,
+// selected with -preset. Options given on the command line or in the config
+// file override them.
+var presets = map[string]map[string]string{
+	// an instance open to the Internet: keep backend load low enough not to
+	// get the instance banned, answer what can be answered locally, and
+	// don't let strangers purge the cache
+	"public-demo": {
+		"concurrency":           "4",
+		"backend-timeout":       "10",
+		"address-max-addresses": "16",
+		"address-max-precache":  "4",
+		"sample-interval":       "0",
+		"rate-limit":            "2",
+		"rate-burst":            "10",
+		"request-budget":        "8",
+		"admin-port":            "0",
+		"debug-port":            "0",
+		"no-admin":              "true",
+		"special-local":         "true",
+		"cors-origin":           "*",
+	},
+}
+
+// applyPreset sets the options of the named preset, except those already
+// set on the command line or by the config file.
+func applyPreset(name string) error {
+	preset, ok := presets[name]
+	if !ok {
+		names := make([]string, 0, len(presets))
+		for name := range presets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown preset %s (known: %s)", name, strings.Join(names, ", "))
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for option, value := range preset {
+		if given[option] {
+			continue
+		}
+		if err := flag.Set(option, value); err != nil {
+			return fmt.Errorf("preset %s: invalid value for %s: %s", name, option, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/britram/canid"
+)
+
+// parseAge parses a duration as for time.ParseDuration, additionally
+// accepting whole days, e.g. 7d.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// pruneMain implements the prune subcommand, which removes entries selected
+// by age and content from a backing store offline, writing the cleaned
+// store in place or to another file.
+func pruneMain(args []string) {
+	cmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	fileflag := cmd.String("file", "", "backing store to prune (JSON file)")
+	outflag := cmd.String("out", "", "write the pruned store to this file (default: replace -file)")
+	olderthanflag := cmd.String("older-than", "", "remove entries cached longer ago than this, e.g. 7d or 36h")
+	dropprivateflag := cmd.Bool("drop-private", false, "remove entries for special-purpose (private, loopback, documentation) addresses")
+	dropemptyflag := cmd.Bool("drop-empty", false, "remove entries without information: prefixes without ASN or country, names without addresses")
+	cmd.Parse(args)
+
+	if len(*fileflag) == 0 {
+		log.Fatal("prune requires -file")
+	}
+	var policy canid.PrunePolicy
+	if len(*olderthanflag) > 0 {
+		var err error
+		if policy.OlderThan, err = parseAge(*olderthanflag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	policy.DropPrivate = *dropprivateflag
+	policy.DropEmpty = *dropemptyflag
+
+	outpath := *outflag
+	if len(outpath) == 0 {
+		outpath = *fileflag
+	}
+	lockfile, err := lockBackingFile(outpath)
+	if err != nil {
+		log.Fatalf("unable to lock backing store %s: %s", outpath, err.Error())
+	}
+	if lockfile != nil {
+		defer lockfile.Close()
+	}
+
+	storage, err := readStorage(*fileflag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	prefixes, addresses := len(storage.Prefixes.Data), len(storage.Addresses.Data)
+	pruned_prefixes := storage.Prefixes.Prune(policy)
+	pruned_addresses := storage.Addresses.Prune(policy)
+	if err := storage.save(outpath); err != nil {
+		log.Fatalf("unable to write backing store: %s", err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "pruned %d of %d prefix entries and %d of %d address entries\n",
+		pruned_prefixes, prefixes, pruned_addresses, addresses)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// How long to wait for the Redis server to answer on startup
+const redisPingTimeout = 5 * time.Second
+
+// redisStore is a canid.SharedStore in a Redis server, so that several
+// instances share one cache. Entries are stored as JSON under
+// canid:<version>:<cache>:<key>, and expire in Redis when they would expire
+// in the cache.
+
+type redisStore struct {
+	client   *redis.Client
+	readonly bool
+}
+
+// openRedisStore connects to the Redis server at the given redis:// or
+// rediss:// URL. A readonly store never writes entries.
+func openRedisStore(url string, readonly bool) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &redisStore{client: client, readonly: readonly}, nil
+}
+
+func redisKey(cache string, key string) string {
+	return fmt.Sprintf("canid:%d:%s:%s", canidStorageVersion, cache, key)
+}
+
+func (store *redisStore) Get(ctx context.Context, cache string, keys []string) ([][]byte, error) {
+	rkeys := make([]string, len(keys))
+	for i, key := range keys {
+		rkeys[i] = redisKey(cache, key)
+	}
+
+	values, err := store.client.MGet(ctx, rkeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			out[i] = []byte(s)
+		}
+	}
+	return out, nil
+}
+
+func (store *redisStore) Put(ctx context.Context, cache string, key string, value []byte, expiry time.Duration) error {
+	if store.readonly {
+		return nil
+	}
+	return store.client.Set(ctx, redisKey(cache, key), value, expiry).Err()
+}
+
+// Number of keys to delete per request when deleting every entry of a cache
+const redisDeleteBatch = 1000
+
+func (store *redisStore) Delete(ctx context.Context, cache string, keys []string) error {
+	if store.readonly {
+		return nil
+	}
+	if keys != nil {
+		rkeys := make([]string, len(keys))
+		for i, key := range keys {
+			rkeys[i] = redisKey(cache, key)
+		}
+		return store.client.Del(ctx, rkeys...).Err()
+	}
+
+	// every entry of the cache, found by scanning rather than KEYS so as
+	// not to block the server
+	batch := make([]string, 0, redisDeleteBatch)
+	iter := store.client.Scan(ctx, 0, redisKey(cache, "*"), redisDeleteBatch).Iterator()
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == redisDeleteBatch {
+			if err := store.client.Del(ctx, batch...).Err(); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return store.client.Del(ctx, batch...).Err()
+	}
+	return nil
+}
+
+func (store *redisStore) Close() error {
+	return store.client.Close()
+}
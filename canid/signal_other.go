@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// notifySnapshot does nothing on platforms without SIGUSR1; caches are only
+// dumped on termination.
+func notifySnapshot(c chan<- os.Signal) {
+	slog.Warn("on-demand dumps not supported on this platform")
+}
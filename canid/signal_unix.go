@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySnapshot relays SIGUSR1, which requests an immediate dump of the
+// caches, to the given channel.
+func notifySnapshot(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
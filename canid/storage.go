@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/britram/canid"
+)
+
+// Storage version. Backing stores of earlier versions are upgraded when
+// loaded (see migrateStorage), and saved as the current version.
+const canidStorageVersion = 3
+
+type canidStorage struct {
+	Version   int
+	Instance  string              `json:",omitempty"`
+	Prefixes  *canid.PrefixCache  `json:",omitempty"`
+	Addresses *canid.AddressCache `json:",omitempty"`
+	// record caches, by record type
+	Records map[string]*canid.RecordCache `json:",omitempty"`
+
+	// serializes writes to the backing store
+	saving sync.Mutex
+}
+
+// File names for per-cache storage in a directory
+const (
+	storageMetaFile      = "meta.json"
+	storagePrefixesFile  = "prefixes.json"
+	storageAddressesFile = "addresses.json"
+)
+
+// storageRecordsFile returns the name of the file of a record cache in a
+// storage directory, e.g. mx.json.
+func storageRecordsFile(cache *canid.RecordCache) string {
+	return cache.Name() + ".json"
+}
+
+// Backing files in gob rather than JSON start with this magic string, so
+// that their format can be detected on load. Either format may additionally
+// be compressed with gzip, detected by its own magic number.
+const storageGobMagic = "canid-gob\n"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// storageFormat returns the format of a backing file by its name: gob for
+// names ending in .gob, JSON otherwise, compressed with gzip if the name
+// additionally ends in .gz, e.g. cache.gob.gz.
+func storageFormat(filename string) (gobfile bool, compressed bool) {
+	name := strings.TrimSuffix(filename, ".gz")
+	return strings.HasSuffix(name, ".gob"), name != filename
+}
+
+// storageMeta is the metadata file of a storage directory: the storage
+// version, and the instance which wrote it.
+
+type storageMeta struct {
+	Version  int
+	Instance string `json:",omitempty"`
+}
+
+// checkVersion returns an error unless the storage is of the current
+// version, for bolt stores, which are loaded entry by entry, and gob files,
+// which only decode into the current types, so neither can be migrated. Both
+// were introduced at the current version.
+func (storage *canidStorage) checkVersion() error {
+	if storage.Version != canidStorageVersion {
+		return fmt.Errorf("storage version mismatch (%d, expected %d): delete and try again", storage.Version, canidStorageVersion)
+	}
+	return nil
+}
+
+// undump loads the caches from a backing file in any format, as detected
+// from its contents.
+func (storage *canidStorage) undump(in io.Reader) error {
+	// remember which caches are disabled, so decoding doesn't enable them,
+	// and which instance we are, so later dumps are attributed to it; offline
+	// tools, which are no instance, keep the dump's
+	prefixes, addresses := storage.Prefixes != nil, storage.Addresses != nil
+	records := storage.Records
+	storage.Records = nil
+	instance := storage.Instance
+
+	r := bufio.NewReader(in)
+	if magic, _ := r.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = bufio.NewReader(gz)
+	}
+
+	if magic, _ := r.Peek(len(storageGobMagic)); string(magic) == storageGobMagic {
+		r.Discard(len(storageGobMagic))
+		if err := gob.NewDecoder(r).Decode(storage); err != nil {
+			return err
+		}
+		if err := storage.checkVersion(); err != nil {
+			return err
+		}
+	} else {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		var header struct {
+			Version int
+		}
+		if err := json.Unmarshal(data, &header); err != nil {
+			return err
+		}
+		// upgrade older versions before decoding, since they may not
+		// decode into the current types
+		if header.Version != canidStorageVersion {
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal(data, &raw); err != nil {
+				return err
+			}
+			if _, err := migrateStorage(raw); err != nil {
+				return err
+			}
+			data, _ = json.Marshal(raw)
+		}
+		if err := json.Unmarshal(data, storage); err != nil {
+			return err
+		}
+	}
+	if len(instance) > 0 {
+		if storage.Instance != instance && len(storage.Instance) > 0 {
+			slog.Info("caches were dumped by another instance", "dumped_by", storage.Instance)
+		}
+		storage.Instance = instance
+	}
+
+	if !prefixes {
+		storage.Prefixes = nil
+	}
+	if !addresses {
+		storage.Addresses = nil
+	}
+
+	// decoding replaces record caches rather than filling them, so fill the
+	// enabled ones with the dump's entries; offline tools keep all of the
+	// dump's
+	dumped := storage.Records
+	storage.Records = records
+	for qtype, in := range dumped {
+		if in == nil || in.Data == nil {
+			continue
+		}
+		cache, ok := storage.Records[strings.ToUpper(qtype)]
+		if !ok {
+			if len(instance) > 0 {
+				// disabled
+				continue
+			}
+			var err error
+			if cache, err = storage.addRecords(qtype, 0, 1); err != nil {
+				return err
+			}
+		}
+		cache.Data = in.Data
+	}
+	return nil
+}
+
+// addRecords adds a record cache of the given type, with the given expiry and
+// concurrency limit, and returns it.
+func (storage *canidStorage) addRecords(qtype string, expiry int, limit int) (*canid.RecordCache, error) {
+	cache, err := canid.NewRecordCache(qtype, expiry, limit)
+	if err != nil {
+		return nil, err
+	}
+	if storage.Records == nil {
+		storage.Records = make(map[string]*canid.RecordCache)
+	}
+	storage.Records[cache.Type()] = cache
+	return cache, nil
+}
+
+// recordCaches returns the record caches, in order of record type.
+func (storage *canidStorage) recordCaches() []*canid.RecordCache {
+	out := make([]*canid.RecordCache, 0, len(storage.Records))
+	for _, cache := range storage.Records {
+		out = append(out, cache)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Type() < out[j].Type()
+	})
+	return out
+}
+
+func (storage *canidStorage) dump(out io.Writer) error {
+	enc := json.NewEncoder(out)
+	return enc.Encode(storage)
+}
+
+// write writes the caches to out as a backing file in the given format.
+func (storage *canidStorage) write(out io.Writer, gobfile bool, compressed bool) error {
+	if compressed {
+		gz := gzip.NewWriter(out)
+		if err := storage.write(gz, gobfile, false); err != nil {
+			return err
+		}
+		return gz.Close()
+	}
+	if gobfile {
+		io.WriteString(out, storageGobMagic)
+		return gob.NewEncoder(out).Encode(storage)
+	}
+	return storage.dump(out)
+}
+
+// load loads all caches from a single backing file. A missing file is not an
+// error.
+func (storage *canidStorage) load(filename string) error {
+	infile, err := os.Open(filename)
+	if err != nil {
+		slog.Warn("unable to read cache file", "path", filename, "err", err)
+		return nil
+	}
+	defer infile.Close()
+
+	if err := storage.undump(infile); err != nil {
+		return fmt.Errorf("cache file %s: %s", filename, err.Error())
+	}
+	slog.Info("loaded caches", "path", filename)
+	return nil
+}
+
+// readStorage loads all caches from a single backing file, for offline
+// tools.
+func readStorage(filename string) (*canidStorage, error) {
+	storage := newStorage("", 0, 0, 1, canid.RipestatBackend{}, true)
+	infile, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cache file %s : %s", filename, err.Error())
+	}
+	defer infile.Close()
+	if err := storage.undump(infile); err != nil {
+		return nil, fmt.Errorf("cache file %s: %s", filename, err.Error())
+	}
+	return storage, nil
+}
+
+// save saves all caches to a single backing file, in the format given by
+// its name (see storageFormat).
+func (storage *canidStorage) save(filename string) error {
+	storage.saving.Lock()
+	defer storage.saving.Unlock()
+
+	gobfile, compressed := storageFormat(filename)
+	err := writeFile(filename, func(out io.Writer) error {
+		return storage.write(out, gobfile, compressed)
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("dumped caches", "path", filename)
+	return nil
+}
+
+// readJSONFile decodes a JSON file into v.
+func readJSONFile(filename string, v interface{}) error {
+	infile, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer infile.Close()
+	return json.NewDecoder(infile).Decode(v)
+}
+
+// writeJSONFile encodes v into a JSON file, as writeFile.
+func writeJSONFile(filename string, v interface{}) error {
+	return writeFile(filename, func(out io.Writer) error {
+		return json.NewEncoder(out).Encode(v)
+	})
+}
+
+// writeFile writes a file with the given function, writing to a temporary
+// file first so that a failed write leaves the previous file intact.
+func writeFile(filename string, write func(out io.Writer) error) error {
+	tmpfile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := write(tmpfile); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	return os.Rename(tmpfile.Name(), filename)
+}
+
+// loadDir loads caches from separate files in a directory, upgrading each
+// from older versions as a backing file holding only that cache. A missing
+// or unreadable cache file leaves that cache empty, without affecting the
+// others, and missing or unreadable metadata is taken to be of the current
+// version; only an unsupported storage version is an error.
+func (storage *canidStorage) loadDir(dir string) error {
+	var meta storageMeta
+	if err := readJSONFile(filepath.Join(dir, storageMetaFile), &meta); err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("unable to read storage metadata, assuming current version", "path", dir, "err", err)
+		}
+		meta = storageMeta{Version: canidStorageVersion}
+	}
+	if err := checkStorageVersion(meta.Version); err != nil {
+		return fmt.Errorf("storage directory %s: %s", dir, err.Error())
+	}
+	if meta.Instance != storage.Instance && len(meta.Instance) > 0 {
+		slog.Info("caches were dumped by another instance", "path", dir, "dumped_by", meta.Instance)
+	}
+	storage.Version = canidStorageVersion
+
+	load := func(name string, file string, cache interface{}, purge func() int) {
+		filename := filepath.Join(dir, file)
+		var data json.RawMessage
+		if err := readJSONFile(filename, &data); err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("unable to read cache file", "path", filename, "err", err)
+			}
+			return
+		}
+		// the file holds the cache itself, upgraded as the field of a
+		// backing file
+		raw := map[string]json.RawMessage{name: data}
+		raw["Version"], _ = json.Marshal(meta.Version)
+		if _, err := migrateStorage(raw); err != nil {
+			slog.Warn("unable to upgrade cache file", "path", filename, "err", err)
+			return
+		}
+		if err := json.Unmarshal(raw[name], cache); err != nil {
+			slog.Warn("unable to load cache file", "path", filename, "err", err)
+			purge()
+			return
+		}
+		slog.Info("loaded cache", "path", filename)
+	}
+	if storage.Prefixes != nil {
+		load("Prefixes", storagePrefixesFile, storage.Prefixes, storage.Prefixes.Purge)
+	}
+	if storage.Addresses != nil {
+		load("Addresses", storageAddressesFile, storage.Addresses, storage.Addresses.Purge)
+	}
+
+	// record cache files are only written at the current version, so need
+	// no upgrade
+	for _, cache := range storage.recordCaches() {
+		filename := filepath.Join(dir, storageRecordsFile(cache))
+		if err := readJSONFile(filename, cache); err != nil {
+			if !os.IsNotExist(err) {
+				slog.Warn("unable to load cache file", "path", filename, "err", err)
+				cache.Purge()
+			}
+			continue
+		}
+		slog.Info("loaded cache", "path", filename)
+	}
+	return nil
+}
+
+// saveDir saves caches to separate files in a directory, each independently
+// of the others. Returns the first error encountered, after trying all
+// files.
+func (storage *canidStorage) saveDir(dir string) (err error) {
+	storage.saving.Lock()
+	defer storage.saving.Unlock()
+
+	save := func(name string, v interface{}) {
+		filename := filepath.Join(dir, name)
+		if werr := writeJSONFile(filename, v); werr != nil {
+			slog.Error("unable to write cache file", "path", filename, "err", werr)
+			if err == nil {
+				err = werr
+			}
+		} else {
+			slog.Info("dumped cache", "path", filename)
+		}
+	}
+
+	if storage.Prefixes != nil {
+		save(storagePrefixesFile, storage.Prefixes)
+	}
+	if storage.Addresses != nil {
+		save(storageAddressesFile, storage.Addresses)
+	}
+	for _, cache := range storage.recordCaches() {
+		save(storageRecordsFile(cache), cache)
+	}
+	save(storageMetaFile, storageMeta{storage.Version, storage.Instance})
+	return
+}
+
+// persist saves the caches to the backing store, a directory if dir is given
+// or a single file otherwise. It does nothing if neither is given.
+func (storage *canidStorage) persist(filename string, dir string) error {
+	switch {
+	case len(dir) > 0:
+		return storage.saveDir(dir)
+	case len(filename) > 0:
+		return storage.save(filename)
+	default:
+		return nil
+	}
+}
+
+// snapshot saves the caches while they are in use: to the backing store if
+// one is given and writable, otherwise to a timestamped file in the current
+// directory.
+func (storage *canidStorage) snapshot(filename string, dir string, readonly bool) error {
+	if (len(filename) > 0 || len(dir) > 0) && !readonly {
+		return storage.persist(filename, dir)
+	}
+	return storage.save(fmt.Sprintf("canid-%s.json", time.Now().UTC().Format("20060102T150405Z")))
+}
+
+// saveServer returns an HTTP handler taking a snapshot of the caches on
+// POST, as on SIGUSR1, rejecting anything else.
+func (storage *canidStorage) saveServer(filename string, dir string, readonly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		slog.Info("dumping caches on request")
+		if err := storage.snapshot(filename, dir, readonly); err != nil {
+			slog.Error("unable to dump caches", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			error_struct := struct{ Error string }{err.Error()}
+			error_body, _ := json.Marshal(error_struct)
+			w.Write(error_body)
+			return
+		}
+		save_body, _ := json.Marshal(struct{ Saved bool }{true})
+		w.Write(save_body)
+	}
+}
+
+func newStorage(instance string, prefix_expiry int, address_expiry int, limit int, backend canid.PrefixBackend, addresses bool) *canidStorage {
+	storage := new(canidStorage)
+	storage.Version = canidStorageVersion
+	storage.Instance = instance
+	if backend != nil {
+		storage.Prefixes = canid.NewPrefixCache(prefix_expiry, limit, backend)
+	}
+	if addresses {
+		storage.Addresses = canid.NewAddressCache(address_expiry, limit, storage.Prefixes)
+	}
+	return storage
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/britram/canid"
+)
+
+// Caches of the storage test files
+const (
+	testPrefixesFile  = `{"Data":{"193.0.0.0/21":{"Prefix":"193.0.0.0/21","ASN":3333,"CountryCode":"NL","Cached":"2026-01-01T00:00:00Z"}}}`
+	testAddressesFile = `{"Data":{"example.com/ANY@system":{"Name":"example.com","Type":"ANY","Resolver":"system","Addresses":["192.0.2.1"],"Cached":"2026-01-01T00:00:00Z"}}}`
+)
+
+// Key of the address in the storage test files, as of the current version
+var testAddressKey = canid.NewAddressKey("example.com", canid.QueryTypeAny, canid.SystemResolver).String()
+
+// testStorageDir writes the given files to a storage directory, and loads
+// it.
+func testStorageDir(t *testing.T, files map[string]string) (*canidStorage, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage := newStorage("test", 86400, 86400, 1, canid.RipestatBackend{}, true)
+	return storage, storage.loadDir(dir)
+}
+
+func TestLoadDir(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		prefixes  int
+		addresses int
+	}{
+		{"current version", map[string]string{
+			storageMetaFile:      `{"Version":3,"Instance":"other"}`,
+			storagePrefixesFile:  testPrefixesFile,
+			storageAddressesFile: testAddressesFile,
+		}, 1, 1},
+		{"no metadata", map[string]string{
+			storagePrefixesFile:  testPrefixesFile,
+			storageAddressesFile: testAddressesFile,
+		}, 1, 1},
+		{"unreadable metadata", map[string]string{
+			storageMetaFile:     `{"Version":`,
+			storagePrefixesFile: testPrefixesFile,
+		}, 1, 0},
+		{"only addresses", map[string]string{
+			storageMetaFile:      `{"Version":3}`,
+			storageAddressesFile: testAddressesFile,
+		}, 0, 1},
+		{"unreadable prefixes", map[string]string{
+			storageMetaFile:      `{"Version":3}`,
+			storagePrefixesFile:  `{"Data":`,
+			storageAddressesFile: testAddressesFile,
+		}, 0, 1},
+		{"undecodable addresses", map[string]string{
+			storageMetaFile:      `{"Version":3}`,
+			storagePrefixesFile:  testPrefixesFile,
+			storageAddressesFile: `{"Data":[]}`,
+		}, 1, 0},
+		{"version 1", map[string]string{
+			storageMetaFile:      `{"Version":1}`,
+			storagePrefixesFile:  testPrefixesFile,
+			storageAddressesFile: `{"Data":{"example.com":{"Name":"example.com","Addresses":["192.0.2.1"],"Cached":"2026-01-01T00:00:00Z"}}}`,
+		}, 1, 1},
+		{"empty", nil, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage, err := testStorageDir(t, test.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(storage.Prefixes.Data); n != test.prefixes {
+				t.Errorf("loaded %d prefixes, want %d", n, test.prefixes)
+			}
+			if n := len(storage.Addresses.Data); n != test.addresses {
+				t.Errorf("loaded %d addresses, want %d", n, test.addresses)
+			}
+			for key := range storage.Addresses.Data {
+				if key != testAddressKey {
+					t.Errorf("address loaded as %s, want %s", key, testAddressKey)
+				}
+			}
+			if storage.Version != canidStorageVersion {
+				t.Errorf("version %d after loading, want %d", storage.Version, canidStorageVersion)
+			}
+		})
+	}
+}
+
+func TestLoadDirUnsupportedVersion(t *testing.T) {
+	_, err := testStorageDir(t, map[string]string{
+		storageMetaFile:     `{"Version":99}`,
+		storagePrefixesFile: testPrefixesFile,
+	})
+	if err == nil || !strings.Contains(err.Error(), "storage version 99") {
+		t.Errorf("got error %v, want unsupported version", err)
+	}
+}
+
+func TestStorageRecords(t *testing.T) {
+	key := canid.NewAddressKey("example.com", canid.QueryTypeMX, canid.SystemResolver).String()
+	saved := newStorage("test", 86400, 86400, 1, canid.RipestatBackend{}, true)
+	mx, err := saved.addRecords("mx", 86400, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mx.Data[key] = canid.RecordInfo{Name: "example.com", Type: canid.QueryTypeMX, Resolver: canid.SystemResolver,
+		MX: []canid.MXRecord{{Host: "mx.example.com", Pref: 10}}}
+
+	// loaded checks that a storage has the MX entry, and no other records
+	loaded := func(t *testing.T, storage *canidStorage) {
+		t.Helper()
+		cache, ok := storage.Records[canid.QueryTypeMX]
+		if !ok || len(storage.Records) != 1 {
+			t.Fatalf("record caches %v, want MX only", storage.Records)
+		}
+		if info, ok := cache.Entry(key); !ok || len(info.MX) != 1 {
+			t.Errorf("MX entry not loaded: %v", cache.Keys())
+		}
+	}
+	// enabled returns a storage with the MX and TXT caches enabled
+	enabled := func(t *testing.T) *canidStorage {
+		storage := newStorage("test", 86400, 86400, 1, canid.RipestatBackend{}, true)
+		for _, qtype := range []string{canid.QueryTypeMX, canid.QueryTypeTXT} {
+			if _, err := storage.addRecords(qtype, 86400, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return storage
+	}
+
+	for _, name := range []string{"cache.json", "cache.gob.gz"} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), name)
+			if err := saved.save(filename); err != nil {
+				t.Fatal(err)
+			}
+
+			storage := enabled(t)
+			if err := storage.load(filename); err != nil {
+				t.Fatal(err)
+			}
+			if len(storage.Records) != 2 || len(storage.Records[canid.QueryTypeTXT].Data) != 0 {
+				t.Errorf("record caches %v after loading, want empty TXT cache kept", storage.Records)
+			}
+			delete(storage.Records, canid.QueryTypeTXT)
+			loaded(t, storage)
+
+			// caches which aren't enabled aren't loaded
+			storage = newStorage("test", 86400, 86400, 1, canid.RipestatBackend{}, true)
+			if err := storage.load(filename); err != nil {
+				t.Fatal(err)
+			}
+			if len(storage.Records) != 0 {
+				t.Errorf("disabled record caches loaded: %v", storage.Records)
+			}
+
+			// offline tools keep them all
+			storage, err := readStorage(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded(t, storage)
+		})
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := saved.saveDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "mx.json")); err != nil {
+			t.Fatal(err)
+		}
+		storage := enabled(t)
+		if err := storage.loadDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		delete(storage.Records, canid.QueryTypeTXT)
+		loaded(t, storage)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := saved.stream(&buf, nil); err != nil {
+			t.Fatal(err)
+		}
+		storage := enabled(t)
+		if err := storage.undump(&buf); err != nil {
+			t.Fatalf("%v\n%s", err, buf.String())
+		}
+		delete(storage.Records, canid.QueryTypeTXT)
+		loaded(t, storage)
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/britram/canid"
+)
+
+// syslogPublisher writes every new cache entry to a syslog collector as an
+// RFC 5424 message with structured data, so SIEMs can ingest annotations
+// without polling the API. Messages are queued and sent by a separate
+// goroutine; if the queue is full, messages are dropped rather than blocking
+// lookups.
+
+type syslogPublisher struct {
+	conn     net.Conn
+	framed   bool
+	hostname string
+	queue    chan string
+	done     chan struct{}
+}
+
+// Priority: facility local0 (16), severity informational (6)
+const syslogPriority = 16*8 + 6
+
+// SD-ID for canid's structured data. 32473 is the private enterprise number
+// reserved for documentation (RFC 5612); there is no registered one for canid.
+const syslogSDID = "canid@32473"
+
+const syslogQueueLength = 1024
+
+// newSyslogPublisher connects to a collector given as network://address,
+// e.g. udp://localhost:514, tcp://collector:601 or unixgram:///dev/log.
+func newSyslogPublisher(target string) (*syslogPublisher, error) {
+	parts := strings.SplitN(target, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("syslog target %s not of the form network://address", target)
+	}
+
+	conn, err := net.Dial(parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	p := new(syslogPublisher)
+	p.conn = conn
+	// stream transports need octet-counting framing (RFC 6587)
+	p.framed = strings.HasPrefix(parts[0], "tcp") || parts[0] == "unix"
+	p.hostname, _ = os.Hostname()
+	if len(p.hostname) == 0 {
+		p.hostname = "-"
+	}
+	p.queue = make(chan string, syslogQueueLength)
+	p.done = make(chan struct{})
+
+	go p.run()
+	return p, nil
+}
+
+func (p *syslogPublisher) run() {
+	defer close(p.done)
+	for msg := range p.queue {
+		if p.framed {
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		}
+		if _, err := p.conn.Write([]byte(msg)); err != nil {
+			slog.Error("error writing to syslog", "err", err)
+		}
+	}
+}
+
+// escapeSDParam escapes a structured data parameter value per RFC 5424
+// section 6.3.3.
+func escapeSDParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+func (p *syslogPublisher) format(event canid.CacheEvent) (string, bool) {
+	var params []string
+	var text string
+
+	switch entry := event.Entry.(type) {
+	case canid.PrefixInfo:
+		params = []string{
+			"prefix", entry.Prefix,
+			"asn", strconv.Itoa(entry.ASN),
+			"cc", entry.CountryCode,
+		}
+		text = fmt.Sprintf("prefix %s = AS%d / %s at %s", entry.Prefix, entry.ASN, entry.CountryCode, entry.Cached.Format(time.RFC3339))
+	case canid.AddressInfo:
+		addrs := make([]string, len(entry.Addresses))
+		for i, addr := range entry.Addresses {
+			addrs[i] = addr.String()
+		}
+		params = []string{
+			"name", entry.Name,
+			"type", entry.Type,
+			"addrs", strings.Join(addrs, " "),
+		}
+		if len(entry.Error) > 0 {
+			params = append(params, "error", entry.Error)
+		}
+		text = fmt.Sprintf("name %s %s = [%s] at %s", entry.Name, entry.Type, strings.Join(addrs, " "), entry.Cached.Format(time.RFC3339))
+	default:
+		return "", false
+	}
+
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSDID + ` cache="` + escapeSDParam(event.Cache) + `"`)
+	for i := 0; i < len(params); i += 2 {
+		sd.WriteString(" " + params[i] + `="` + escapeSDParam(params[i+1]) + `"`)
+	}
+	sd.WriteString("]")
+
+	return fmt.Sprintf("<%d>1 %s %s canid %d %s %s %s",
+		syslogPriority, time.Now().UTC().Format(time.RFC3339Nano), p.hostname,
+		os.Getpid(), event.Cache, sd.String(), text), true
+}
+
+func (p *syslogPublisher) Publish(event canid.CacheEvent) {
+	msg, ok := p.format(event)
+	if !ok {
+		return
+	}
+
+	select {
+	case p.queue <- msg:
+	default:
+		slog.Warn("syslog queue full, dropping entry", "cache", event.Cache, "key", event.Key)
+	}
+}
+
+// Close sends any queued messages and closes the connection to the collector.
+func (p *syslogPublisher) Close() error {
+	close(p.queue)
+	<-p.done
+	return p.conn.Close()
+}
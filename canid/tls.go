@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// configureTLS sets up the HTTP server to serve HTTPS, with a certificate and
+// key from files, or with certificates for the given (comma-separated) domains
+// obtained from Let's Encrypt via ACME and cached in acmecache. It returns
+// false if neither is given, leaving the server serving plain HTTP.
+func configureTLS(httpserver *http.Server, certfile string, keyfile string, acmedomains string, acmecache string) (bool, error) {
+	switch {
+	case len(acmedomains) > 0 && (len(certfile) > 0 || len(keyfile) > 0):
+		return false, errors.New("-acme-domain is mutually exclusive with -tls-cert and -tls-key")
+	case len(acmedomains) > 0:
+		// certificates are requested on first use, answering the CA's
+		// challenge over TLS on the same port, which must therefore be 443
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(acmedomains, ",")...),
+			Cache:      autocert.DirCache(acmecache),
+		}
+		httpserver.TLSConfig = manager.TLSConfig()
+		return true, nil
+	case len(certfile) > 0 && len(keyfile) > 0:
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return false, err
+		}
+		httpserver.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		return true, nil
+	case len(certfile) > 0 || len(keyfile) > 0:
+		return false, errors.New("-tls-cert and -tls-key must be given together")
+	default:
+		return false, nil
+	}
+}
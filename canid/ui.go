@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/britram/canid"
+)
+
+// The web interface: index.html, served at /, and the assets it uses (CSS,
+// JavaScript, icons), served under /ui/.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiAsset is an embedded asset, with its content type and a hash of its
+// content.
+
+type uiAsset struct {
+	body        []byte
+	contentType string
+	hash        string
+}
+
+// loadUI reads the embedded web interface. References to assets in the index,
+// as "/ui/<name>", are rewritten to include a hash of the asset's content, so
+// that browsers may cache assets indefinitely, yet fetch them again as soon
+// as they change.
+func loadUI() ([]byte, map[string]uiAsset, error) {
+	assets := make(map[string]uiAsset)
+	err := fs.WalkDir(uiFiles, "ui", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || name == "ui/index.html" {
+			return err
+		}
+		body, err := uiFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(body)
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if len(contentType) == 0 {
+			contentType = "application/octet-stream"
+		}
+		assets[strings.TrimPrefix(name, "ui/")] = uiAsset{body, contentType, hex.EncodeToString(sum[:8])}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index, err := uiFiles.ReadFile("ui/index.html")
+	if err != nil {
+		return nil, nil, err
+	}
+	page := string(index)
+	for name, asset := range assets {
+		page = strings.Replace(page, `"/ui/`+name+`"`, `"/ui/`+name+`?v=`+asset.hash+`"`, -1)
+	}
+	return []byte(page), assets, nil
+}
+
+// handleUI registers the web interface: the index at / (and any path not
+// otherwise handled), and its assets under /ui/.
+func handleUI(server *canid.Server) {
+	index, assets, err := loadUI()
+	if err != nil {
+		log.Fatalf("error loading web interface: %s", err.Error())
+	}
+
+	server.HandleFunc("/ui/", func(w http.ResponseWriter, req *http.Request) {
+		asset, ok := assets[strings.TrimPrefix(req.URL.Path, "/ui/")]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if req.URL.Query().Get("v") == asset.hash {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		w.Header().Set("Content-Type", asset.contentType)
+		w.Write(asset.body)
+	})
+
+	server.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Write(index)
+	})
+}
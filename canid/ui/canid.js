@@ -0,0 +1,85 @@
+// asText returns the ASN of a prefix, with its label if it has one
+function asText(prefix) {
+  return prefix.ASLabel ? prefix.ASN+" ("+prefix.ASLabel+")" : String(prefix.ASN)
+}
+
+async function canidLookupPrefix() {
+
+  const inputElement = document.getElementById('input')
+  const statusElement = document.getElementById('status')
+  const addressElement = document.getElementById('address')
+  const prefixElement = document.getElementById('prefix')
+  const asElement = document.getElementById('as')
+  const ccElement = document.getElementById('cc')
+
+  try {
+    let response = await fetch("/prefix.json?addr="+encodeURIComponent(inputElement.value))
+    let result = await response.json()
+
+    statusElement.value = "prefix lookup "+inputElement.value+" OK"
+    addressElement.value = ""
+    prefixElement.value = result.Prefix
+    asElement.value = asText(result)
+    ccElement.value = result.CountryCode
+  } catch (error) {
+    statusElement.value = "prefix lookup "+inputElement.value+" failed; see console"
+    console.log(error)
+  }
+}
+
+async function canidLookupAddress() {
+
+  const inputElement = document.getElementById('input')
+  const statusElement = document.getElementById('status')
+  const addressElement = document.getElementById('address')
+  const prefixElement = document.getElementById('prefix')
+  const asElement = document.getElementById('as')
+  const ccElement = document.getElementById('cc')
+
+  try {
+    let response = await fetch("/address.json?name="+encodeURIComponent(inputElement.value))
+    let result = await response.json()
+
+    statusElement.value = "address lookup "+inputElement.value+" OK"
+    if (result.Addresses.length < 1) {
+      addressElement.value = "[none]"
+    } else {
+      addressElement.value = result.Addresses[0]
+    }
+    prefixElement.value = ""
+    asElement.value = ""
+    ccElement.value = ""
+  } catch (error) {
+    statusElement.value = "address lookup "+inputElement.value+" failed; see console"
+    console.log(error)
+  }
+}
+
+async function canidLookupQuery() {
+
+  const inputElement = document.getElementById('input')
+  const statusElement = document.getElementById('status')
+  const addressElement = document.getElementById('address')
+  const prefixElement = document.getElementById('prefix')
+  const asElement = document.getElementById('as')
+  const ccElement = document.getElementById('cc')
+
+  try {
+    let response = await fetch("/lookup.json?q="+encodeURIComponent(inputElement.value))
+    let result = await response.json()
+
+    statusElement.value = "lookup "+result.Host+" OK"
+    let address = result.Host
+    if (result.Address) {
+      address = result.Address.Addresses.length < 1 ? "" : result.Address.Addresses[0]
+    }
+    addressElement.value = address || "[none]"
+    let prefix = (result.Prefixes || {})[address]
+    prefixElement.value = prefix ? prefix.Prefix : ""
+    asElement.value = prefix ? asText(prefix) : ""
+    ccElement.value = prefix ? prefix.CountryCode : ""
+  } catch (error) {
+    statusElement.value = "lookup "+inputElement.value+" failed; see console"
+    console.log(error)
+  }
+}
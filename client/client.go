@@ -0,0 +1,90 @@
+// Package client is a Go client for the HTTP API of a running canid, as
+// described by its /openapi.json resource.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/britram/canid"
+)
+
+// Largest response body accepted
+const maxResponseBody = 16 << 20
+
+// Client queries a canid server at a base URL, e.g. http://localhost:8043.
+
+type Client struct {
+	URL string
+	// HTTP client used for requests; http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// New creates a client for the canid server at the given base URL.
+func New(url string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/")}
+}
+
+// LookupPrefix returns information about the prefix associated with an
+// address, from /prefix.json.
+func (c *Client) LookupPrefix(ctx context.Context, addr net.IP) (out canid.PrefixInfo, err error) {
+	err = c.get(ctx, "/prefix.json", url.Values{"addr": {addr.String()}}, &out)
+	return
+}
+
+// LookupAddress returns the addresses of a name, from /address.json. Failed
+// DNS lookups are not errors: the result's Error field gives the class of
+// failure.
+func (c *Client) LookupAddress(ctx context.Context, name string) (out canid.AddressInfo, err error) {
+	err = c.get(ctx, "/address.json", url.Values{"name": {name}}, &out)
+	return
+}
+
+// Lookup resolves an address, name, or URL, and returns the prefixes of its
+// addresses, from /lookup.json.
+func (c *Client) Lookup(ctx context.Context, query string) (out canid.LookupResult, err error) {
+	err = c.get(ctx, "/lookup.json", url.Values{"q": {query}}, &out)
+	return
+}
+
+// get requests a resource and decodes its JSON response into out. Resolver
+// failures are reported in the response, with a gateway status; other error
+// statuses are returned as errors, with the server's message if any.
+func (c *Client) get(ctx context.Context, path string, params url.Values, out interface{}) error {
+	requrl := c.URL + path + "?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requrl, nil)
+	if err != nil {
+		return err
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusBadGateway, http.StatusGatewayTimeout:
+	default:
+		var error_struct struct{ Error string }
+		if json.Unmarshal(body, &error_struct) == nil && len(error_struct.Error) > 0 {
+			return errors.New(error_struct.Error)
+		}
+		return fmt.Errorf("%s returned %s", c.URL, resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,23 @@
+package canid
+
+import "time"
+
+// Clock provides the current time to a cache, for timestamping and expiring
+// entries. Replacing the clock allows expiry to be controlled, e.g. in tests.
+
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the default Clock, returning the system time.
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// age returns the age of a timestamp in whole seconds according to a clock.
+func age(clock Clock, t time.Time) int {
+	return int(clock.Now().Sub(t).Seconds())
+}
@@ -0,0 +1,30 @@
+package canid
+
+import (
+	"sync"
+	"time"
+)
+
+// fakeClock is a Clock standing still until advanced, for tests.
+
+type fakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.t
+}
+
+// advance moves the clock forward by d.
+func (clock *fakeClock) advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.t = clock.t.Add(d)
+}
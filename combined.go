@@ -0,0 +1,162 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// LookupResult combines address and prefix information for a query, which
+// may be an address, a host name, or a URL.
+
+type LookupResult struct {
+	Query    string                `source:"canid" doc:"Query as given"`
+	Host     string                `source:"canid" doc:"Host name or address extracted from the query"`
+	Address  *AddressInfo          `json:",omitempty" source:"dns" doc:"Addresses of the host, if it is a name"`
+	Names    []string              `json:",omitempty" source:"dns" doc:"Names the host maps to, if it is an address whose PTR lookup is already cached"`
+	Prefixes map[string]PrefixInfo `json:",omitempty" source:"backend" doc:"Prefix information for the host's addresses, by address"`
+	Errors   map[string]string     `json:",omitempty" source:"canid" doc:"Prefix lookup failures, by address"`
+
+	Truncated bool `json:",omitempty" source:"canid" doc:"True if the prefixes of some addresses were not looked up because the request's backend call budget was used up"`
+}
+
+// extractHost returns the host part of a query: the query itself if it is an
+// address (with or without a port), otherwise the host of the query parsed
+// as a URL, with or without a scheme. It returns an empty string if the query
+// has no host.
+func extractHost(query string) string {
+	query = strings.TrimSpace(query)
+	if ip := ParseAddress(query); ip != nil {
+		return ip.String()
+	}
+	if !strings.Contains(query, "://") {
+		query = "//" + query
+	}
+	u, err := url.Parse(query)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// LookupQuery resolves the host in a query, if it is a name, through the
+// address cache, and looks up the prefix of each of its addresses through the
+// prefix cache. Either cache may be nil, in which case that part of the
+// lookup is skipped. It returns an error only if the query has no host, or
+// the context is done.
+func LookupQuery(ctx context.Context, prefixes *PrefixCache, addresses *AddressCache, query string) (out LookupResult, err error) {
+	out.Query = query
+	out.Host = extractHost(query)
+	if len(out.Host) == 0 {
+		err = errors.New("no host in query")
+		return
+	}
+
+	var addrs []net.IP
+	if ip := net.ParseIP(out.Host); ip != nil {
+		addrs = []net.IP{ip}
+		// names are only included if already known, e.g. by PTR backfill
+		if addresses != nil {
+			out.Names, _ = addresses.cachedNames(ip)
+		}
+	} else if addresses != nil {
+		addr_info, lerr := addresses.LookupContext(ctx, out.Host)
+		if lerr != nil {
+			return out, lerr
+		}
+		addresses.annotate(ctx, &addr_info)
+		addresses.transform(&addr_info)
+		out.Address = &addr_info
+		addrs = addr_info.Addresses
+	}
+
+	if prefixes == nil {
+		return
+	}
+	for _, addr := range addrs {
+		prefix_info, lerr := prefixes.LookupContext(ctx, addr)
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if lerr == ErrBudgetExhausted {
+			out.Truncated = true
+			continue
+		} else if lerr != nil {
+			if out.Errors == nil {
+				out.Errors = make(map[string]string)
+			}
+			out.Errors[addr.String()] = lerr.Error()
+			continue
+		}
+		prefix_info.BackendMeta = nil
+		prefixes.annotate(ctx, addr, &prefix_info)
+		prefixes.transform(&prefix_info)
+		if out.Prefixes == nil {
+			out.Prefixes = make(map[string]PrefixInfo)
+		}
+		out.Prefixes[addr.String()] = prefix_info
+	}
+	return
+}
+
+// LookupServer returns an HTTP handler for the q parameter, which may be an
+// address, a host name, or a URL, returning a LookupResult. Either cache may
+// be nil.
+func LookupServer(prefixes *PrefixCache, addresses *AddressCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		lookup_result, err := LookupQuery(req.Context(), prefixes, addresses, req.URL.Query().Get("q"))
+		if req.Context().Err() != nil {
+			// client went away, nobody to answer
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			error_struct := struct{ Error string }{err.Error()}
+			error_body, _ := json.Marshal(error_struct)
+			w.Write(error_body)
+			return
+		}
+
+		lookup_body, _ := json.Marshal(lookup_result)
+
+		// as for /address.json, resolver failures are the backend's
+		if lookup_result.Address != nil {
+			switch lookup_result.Address.Error {
+			case DNSErrorTimeout:
+				w.WriteHeader(http.StatusGatewayTimeout)
+				w.Write(lookup_body)
+				return
+			case DNSErrorServFail:
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write(lookup_body)
+				return
+			}
+		}
+		writeCacheable(w, req, lookup_body, lookup_result.ttl(prefixes, addresses))
+	}
+}
+
+// ttl returns the number of seconds until the first of the entries a result
+// was built from expires. An incomplete result, with failed or skipped
+// prefix lookups, expires immediately, so that it is fetched afresh.
+func (result *LookupResult) ttl(prefixes *PrefixCache, addresses *AddressCache) int {
+	if result.Truncated || len(result.Errors) > 0 {
+		return 0
+	}
+	ttl := -1
+	if result.Address != nil {
+		ttl = addresses.ttl(*result.Address)
+	}
+	for _, prefix_info := range result.Prefixes {
+		if prefix_ttl := prefixes.ttl(prefix_info); ttl < 0 || prefix_ttl < ttl {
+			ttl = prefix_ttl
+		}
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
@@ -0,0 +1,139 @@
+package canid
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CymruBackend is a PrefixBackend using the Team Cymru IP-to-ASN whois
+// service. The country code it returns is that of the registry allocation,
+// not a geolocation.
+
+type CymruBackend struct{}
+
+const cymruWhoisAddr = "whois.cymru.com:43"
+
+// Timeout for whois queries when the context has no deadline
+const cymruTimeout = 30 * time.Second
+
+func (CymruBackend) Name() string {
+	return "cymru"
+}
+
+func (backend CymruBackend) Lookup(ctx context.Context, addr net.IP) (out PrefixInfo, err error) {
+	results, err := backend.LookupBulk(ctx, []net.IP{addr})
+	if err != nil {
+		return
+	}
+	out, ok := results[addr.String()]
+	if !ok {
+		err = fmt.Errorf("no Team Cymru result for %s", addr)
+	}
+	return
+}
+
+// LookupRaw returns the raw whois response for an address, as a JSON string
+// under the key "whois".
+func (CymruBackend) LookupRaw(ctx context.Context, addr net.IP) (map[string]json.RawMessage, error) {
+	lines, err := queryCymru(ctx, []net.IP{addr})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(strings.Join(lines, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]json.RawMessage{"whois": raw}, nil
+}
+
+// LookupBulk looks up many addresses in a single whois query, returning
+// results keyed by address string. Addresses without a routed prefix are
+// omitted from the results.
+func (CymruBackend) LookupBulk(ctx context.Context, addrs []net.IP) (map[string]PrefixInfo, error) {
+	lines, err := queryCymru(ctx, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	// response is a banner, then a header, then one line per address:
+	// AS | IP | BGP Prefix | CC | Registry | Allocated | AS Name
+	defer observeTiming(ctx, TimingParse, time.Now())
+	out := make(map[string]PrefixInfo)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Bulk mode") || strings.HasPrefix(line, "AS ") {
+			continue
+		}
+		if strings.HasPrefix(line, "Error") {
+			return nil, errors.New("Team Cymru query failed: " + line)
+		}
+
+		fields := strings.Split(line, "|")
+		if len(fields) < 4 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		asn, err := strconv.Atoi(fields[0])
+		if err != nil {
+			// NA: not routed
+			continue
+		}
+
+		var info PrefixInfo
+		info.ASN = asn
+		info.Prefix = fields[2]
+		info.CountryCode = fields[3]
+		out[fields[1]] = info
+	}
+
+	return out, nil
+}
+
+// queryCymru makes a bulk whois query, and returns the response lines.
+func queryCymru(ctx context.Context, addrs []net.IP) ([]string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", cymruWhoisAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(cymruTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	// bulk query, with AS names
+	slog.Debug("calling cymru", "addresses", len(addrs))
+	w := bufio.NewWriter(conn)
+	w.WriteString("begin\nverbose\n")
+	for _, addr := range addrs {
+		w.WriteString(addr.String() + "\n")
+	}
+	w.WriteString("end\n")
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, len(addrs)+2)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,68 @@
+package canid
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// BackendDebugResult is the result of an uncached backend query, with both
+// the raw upstream responses and canid's interpretation of them.
+
+type BackendDebugResult struct {
+	Backend    string
+	Address    string
+	Parsed     *PrefixInfo                `json:",omitempty"`
+	ParseError string                     `json:",omitempty"`
+	Raw        map[string]json.RawMessage `json:",omitempty"`
+	RawError   string                     `json:",omitempty"`
+}
+
+// DebugBackendServer queries the backend for the addr parameter, bypassing
+// and not updating the cache, and returns the raw upstream responses
+// alongside the parsed result. The raw and parsed results come from separate
+// upstream requests. Returns 501 Not Implemented if the backend is not a
+// RawBackend.
+func (cache *PrefixCache) DebugBackendServer(w http.ResponseWriter, req *http.Request) {
+
+	ip := ParseAddress(req.URL.Query().Get("addr"))
+	if ip == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	raw_backend, ok := cache.backend.(RawBackend)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	ctx := req.Context()
+	if err := cache.pipeline.limiter.acquire(ctx); err != nil {
+		return
+	}
+	defer cache.pipeline.limiter.release()
+
+	result := BackendDebugResult{Backend: backendName(cache.backend), Address: ip.String()}
+
+	raw, err := raw_backend.LookupRaw(ctx, ip)
+	if err != nil {
+		result.RawError = err.Error()
+	} else {
+		result.Raw = raw
+	}
+
+	parsed, err := cache.backend.Lookup(ctx, ip)
+	if err != nil {
+		result.ParseError = err.Error()
+	} else {
+		result.Parsed = &parsed
+	}
+
+	if ctx.Err() != nil {
+		// client went away, nobody to answer
+		return
+	}
+
+	result_body, _ := json.Marshal(result)
+	w.Write(result_body)
+}
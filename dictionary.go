@@ -0,0 +1,169 @@
+package canid
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Data dictionary of canid's responses, generated from the source and doc
+// tags of the response types, for downstream consumers to validate against.
+
+// SchemaField describes a field of a response type.
+
+type SchemaField struct {
+	Name string
+	// JSON type (string, integer, number, boolean, array, or object), or the
+	// name of another type in the dictionary
+	Type string
+	// Element type of arrays, or value type of objects
+	Items string `json:",omitempty"`
+	// Format of strings: date-time or ip
+	Format string `json:",omitempty"`
+	// Origin of the value: backend (the prefix backend), geoloc (the
+	// geolocation backend), asname (the AS name backend), rpki (the RPKI
+	// validator), dns, blocklist, or canid (computed by canid)
+	Source      string
+	Description string
+	// True if the value may be null
+	Nullable bool
+	// True if the field is omitted when empty
+	Optional bool
+}
+
+// SchemaType describes a response type, and the resources returning it.
+
+type SchemaType struct {
+	Name      string
+	Resources []string `json:",omitempty"`
+	Fields    []SchemaField
+}
+
+// Response types in the dictionary, with the resources returning them.
+// Types only nested in these are added automatically.
+var schemaTypes = []struct {
+	value     interface{}
+	resources []string
+}{
+	{PrefixInfo{}, []string{"/prefix.json"}},
+	{BulkPrefixResult{}, []string{"/prefixes.json"}},
+	{AddressInfo{}, []string{"/address.json"}},
+	{RecordInfo{}, []string{"/mx.json", "/ns.json", "/txt.json"}},
+	{VerifyResult{}, []string{"/verify.json"}},
+	{LookupResult{}, []string{"/lookup.json"}},
+	{CacheStats{}, []string{"/stats.json", "/stats/prefix.json", "/stats/address.json", "/stats/mx.json", "/stats/ns.json", "/stats/txt.json"}},
+	{CacheQuality{}, []string{"/cache/quality.json"}},
+	{SearchResult{}, []string{"/cache/search.json"}},
+	{HealthStatus{}, []string{"/healthz"}},
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	ipType   = reflect.TypeOf(net.IP{})
+)
+
+// DataDictionary returns descriptions of all response types.
+func DataDictionary() []SchemaType {
+	out := make([]SchemaType, 0)
+	seen := make(map[string]bool)
+	for _, st := range schemaTypes {
+		out = describeType(reflect.TypeOf(st.value), st.resources, out, seen)
+	}
+	return out
+}
+
+// describeType appends a description of a struct type, and of any struct
+// types nested in it not yet seen, to out.
+func describeType(t reflect.Type, resources []string, out []SchemaType, seen map[string]bool) []SchemaType {
+	if seen[t.Name()] {
+		return out
+	}
+	seen[t.Name()] = true
+
+	desc := SchemaType{Name: t.Name(), Resources: resources}
+	nested := make([]reflect.Type, 0)
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Anonymous {
+				// embedded fields are flattened, as by encoding/json
+				addFields(field.Type)
+				continue
+			}
+			if len(field.PkgPath) > 0 {
+				continue
+			}
+			sf := SchemaField{
+				Name:        field.Name,
+				Source:      field.Tag.Get("source"),
+				Description: field.Tag.Get("doc"),
+				Optional:    strings.Contains(field.Tag.Get("json"), "omitempty"),
+			}
+			ft := field.Type
+			switch ft.Kind() {
+			case reflect.Ptr, reflect.Map:
+				sf.Nullable = true
+			case reflect.Slice:
+				sf.Nullable = ft != ipType
+			}
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			sf.Type, sf.Format = schemaTypeName(ft)
+			if ft != ipType && (ft.Kind() == reflect.Slice || ft.Kind() == reflect.Map) {
+				ft = ft.Elem()
+				sf.Items, _ = schemaTypeName(ft)
+			}
+			if ft.Kind() == reflect.Struct && ft != timeType {
+				nested = append(nested, ft)
+			}
+			desc.Fields = append(desc.Fields, sf)
+		}
+	}
+	addFields(t)
+
+	out = append(out, desc)
+	for _, nt := range nested {
+		out = describeType(nt, nil, out, seen)
+	}
+	return out
+}
+
+// schemaTypeName returns the JSON type and string format of a Go type.
+func schemaTypeName(t reflect.Type) (string, string) {
+	switch {
+	case t == timeType:
+		return "string", "date-time"
+	case t == ipType:
+		return "string", "ip"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string", ""
+	case reflect.Bool:
+		return "boolean", ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer", ""
+	case reflect.Float32, reflect.Float64:
+		return "number", ""
+	case reflect.Slice:
+		return "array", ""
+	case reflect.Map:
+		return "object", ""
+	case reflect.Struct:
+		return t.Name(), ""
+	}
+	return t.Kind().String(), ""
+}
+
+// DataDictionaryServer returns the data dictionary as a JSON array of
+// SchemaType objects.
+func DataDictionaryServer(w http.ResponseWriter, req *http.Request) {
+	schema_body, _ := json.Marshal(DataDictionary())
+	w.Write(schema_body)
+}
@@ -0,0 +1,377 @@
+package canid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Limits on direct DNS queries: the time to wait for each answer, unless the
+// context's deadline is sooner, and the UDP payload size advertised with
+// EDNS(0), which avoids fragmentation
+const (
+	dnsQueryTimeout = 5 * time.Second
+	dnsUDPSize      = 1232
+)
+
+// Records with a TTL of 0 are cached for this many seconds, rather than not
+// at all, so that popular names don't send every request to the resolver.
+const minDNSTTL = 1
+
+var errDNSTruncated = errors.New("truncated answer")
+
+// Record types of direct queries, by query type; PTR and ANY queries are
+// handled specially
+var dnsQueryTypes = map[string]dnsmessage.Type{
+	QueryTypeA:    dnsmessage.TypeA,
+	QueryTypeAAAA: dnsmessage.TypeAAAA,
+	QueryTypeMX:   dnsmessage.TypeMX,
+	QueryTypeNS:   dnsmessage.TypeNS,
+	QueryTypeTXT:  dnsmessage.TypeTXT,
+}
+
+// dnsAnswer is the answer to a direct query: the addresses, names, mail
+// exchangers, or texts of the queried type, the chain of aliases leading to
+// them, the lowest TTL of those records, or of a negative answer, and whether
+// the resolver validated the answer with DNSSEC.
+
+type dnsAnswer struct {
+	addrs     []net.IP
+	names     []string
+	mx        []MXRecord
+	texts     []string
+	cnames    []string
+	ttl       int
+	validated bool
+}
+
+// lookup resolves a name (or an address, for PTR queries) of the given query
+// type directly, rather than through a net.Resolver, so that the TTLs of the
+// answers are known. Failures are returned as *net.DNSError, as by
+// net.Resolver. ANY queries ask for A and AAAA records concurrently, and
+// succeed if either has records.
+func (resolver *DNSResolver) lookup(ctx context.Context, qtype string, name string) (dnsAnswer, error) {
+	if qtype == QueryTypePTR {
+		return resolver.query(ctx, reverseName(net.ParseIP(name)), dnsmessage.TypePTR)
+	} else if rrtype, ok := dnsQueryTypes[qtype]; ok {
+		return resolver.query(ctx, name, rrtype)
+	}
+
+	type result struct {
+		answer dnsAnswer
+		err    error
+	}
+	aaaa := make(chan result, 1)
+	go func() {
+		answer, err := resolver.query(ctx, name, dnsmessage.TypeAAAA)
+		aaaa <- result{answer, err}
+	}()
+	a4, err4 := resolver.query(ctx, name, dnsmessage.TypeA)
+	a6 := <-aaaa
+
+	// the entry combines both answers, so expires with the first of them;
+	// the name has addresses if either type has records, and is not found
+	// only if neither has
+	out := dnsAnswer{
+		addrs:     append(a4.addrs, a6.answer.addrs...),
+		cnames:    a4.cnames,
+		validated: a4.validated && a6.answer.validated,
+	}
+	if len(out.cnames) == 0 {
+		out.cnames = a6.answer.cnames
+	}
+	results := []result{{a4, err4}, a6}
+	for _, r := range results {
+		if r.answer.ttl > 0 && (out.ttl == 0 || r.answer.ttl < out.ttl) {
+			out.ttl = r.answer.ttl
+		}
+	}
+	if len(out.addrs) > 0 {
+		return out, nil
+	}
+	for _, r := range results {
+		if !dnsNotFound(r.err) {
+			return dnsAnswer{}, r.err
+		}
+	}
+	return out, err4
+}
+
+func dnsNotFound(err error) bool {
+	var dnserr *net.DNSError
+	return errors.As(err, &dnserr) && dnserr.IsNotFound
+}
+
+// query sends a query for one record type over UDP, or the resolver's
+// transport, retrying over TCP if a UDP answer is truncated.
+func (resolver *DNSResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) (out dnsAnswer, err error) {
+	dnserr := &net.DNSError{Name: name, Server: resolver.Name}
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		dnserr.Err = err.Error()
+		return out, dnserr
+	}
+
+	// unpredictable IDs make forged answers harder to get accepted
+	var idbytes [2]byte
+	if _, err := rand.Read(idbytes[:]); err != nil {
+		dnserr.Err = err.Error()
+		return out, dnserr
+	}
+	id := binary.BigEndian.Uint16(idbytes[:])
+	// AD asks the resolver to say whether it validated the answer (RFC 6840)
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, RecursionDesired: true, AuthenticData: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	msg, err := b.Finish()
+	if err != nil {
+		dnserr.Err = err.Error()
+		return out, dnserr
+	}
+
+	response, err := resolver.roundTrip(ctx, "udp", id, msg)
+	if err == errDNSTruncated {
+		response, err = resolver.roundTrip(ctx, "tcp", id, msg)
+	}
+	if err != nil {
+		dnserr.Err = err.Error()
+		var neterr net.Error
+		dnserr.IsTimeout = errors.As(err, &neterr) && neterr.Timeout() || ctx.Err() == context.DeadlineExceeded
+		return out, dnserr
+	}
+	return parseDNSAnswer(response, qname, qtype, dnserr)
+}
+
+// roundTrip sends a query over a connection dialed by the resolver for the
+// given network, and returns the answer with the same ID. Packet connections
+// carry bare messages, stream connections messages with a length prefix.
+func (resolver *DNSResolver) roundTrip(ctx context.Context, network string, id uint16, msg []byte) ([]byte, error) {
+	conn, err := resolver.dial(ctx, network, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(dnsQueryTimeout)
+	if ctx_deadline, ok := ctx.Deadline(); ok && ctx_deadline.Before(deadline) {
+		deadline = ctx_deadline
+	}
+	conn.SetDeadline(deadline)
+
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dnsUDPSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// ignore stray answers to earlier queries
+			if n < 12 || binary.BigEndian.Uint16(buf) != id {
+				continue
+			}
+			// the truncation flag is in the third byte of the header
+			if buf[2]&0x02 != 0 {
+				return nil, errDNSTruncated
+			}
+			return buf[:n], nil
+		}
+	}
+
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var prefix [2]byte
+	if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if len(response) < 12 || binary.BigEndian.Uint16(response) != id {
+		return nil, errors.New("answer does not match query")
+	}
+	return response, nil
+}
+
+// parseDNSAnswer returns the records of the queried type in an answer, with
+// the chain of CNAME records from the queried name, and the lowest TTL of
+// them all. An answer without records of the queried type is not found, with
+// the negative TTL of the SOA record in the authority section, if any (RFC
+// 2308).
+func parseDNSAnswer(response []byte, qname dnsmessage.Name, qtype dnsmessage.Type, dnserr *net.DNSError) (out dnsAnswer, err error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(response)
+	if err == nil {
+		err = p.SkipAllQuestions()
+	}
+	if err != nil {
+		dnserr.Err = err.Error()
+		return out, dnserr
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		dnserr.Err = "server answered " + header.RCode.String()
+		return out, dnserr
+	}
+	out.validated = header.AuthenticData
+
+	ttl := -1
+	found := false
+	aliases := make(map[string]string)
+	minTTL := func(rrttl uint32) {
+		if ttl < 0 || int(rrttl) < ttl {
+			ttl = int(rrttl)
+		}
+	}
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			dnserr.Err = err.Error()
+			return out, dnserr
+		}
+		switch {
+		case rh.Type == qtype && qtype == dnsmessage.TypeA:
+			var r dnsmessage.AResource
+			if r, err = p.AResource(); err == nil {
+				out.addrs = append(out.addrs, net.IP(append([]byte(nil), r.A[:]...)))
+			}
+		case rh.Type == qtype && qtype == dnsmessage.TypeAAAA:
+			var r dnsmessage.AAAAResource
+			if r, err = p.AAAAResource(); err == nil {
+				out.addrs = append(out.addrs, net.IP(append([]byte(nil), r.AAAA[:]...)))
+			}
+		case rh.Type == qtype && qtype == dnsmessage.TypePTR:
+			var r dnsmessage.PTRResource
+			if r, err = p.PTRResource(); err == nil {
+				out.names = append(out.names, r.PTR.String())
+			}
+		case rh.Type == qtype && qtype == dnsmessage.TypeNS:
+			var r dnsmessage.NSResource
+			if r, err = p.NSResource(); err == nil {
+				out.names = append(out.names, r.NS.String())
+			}
+		case rh.Type == qtype && qtype == dnsmessage.TypeMX:
+			var r dnsmessage.MXResource
+			if r, err = p.MXResource(); err == nil {
+				out.mx = append(out.mx, MXRecord{Host: r.MX.String(), Pref: r.Pref})
+			}
+		case rh.Type == qtype && qtype == dnsmessage.TypeTXT:
+			// the strings of a record are one text, split for length
+			var r dnsmessage.TXTResource
+			if r, err = p.TXTResource(); err == nil {
+				out.texts = append(out.texts, strings.Join(r.TXT, ""))
+			}
+		case rh.Type == dnsmessage.TypeCNAME:
+			// aliases leading to the records expire with them
+			var r dnsmessage.CNAMEResource
+			if r, err = p.CNAMEResource(); err == nil {
+				aliases[strings.ToLower(rh.Name.String())] = r.CNAME.String()
+				minTTL(rh.TTL)
+			}
+		default:
+			err = p.SkipAnswer()
+			continue
+		}
+		if err != nil {
+			dnserr.Err = err.Error()
+			return out, dnserr
+		}
+		if rh.Type == qtype {
+			found = true
+			minTTL(rh.TTL)
+		}
+	}
+	// follow the chain from the queried name, in case of extra records
+	alias := strings.ToLower(qname.String())
+	for len(out.cnames) < len(aliases) {
+		next, ok := aliases[alias]
+		if !ok {
+			break
+		}
+		out.cnames = append(out.cnames, strings.TrimSuffix(strings.ToLower(next), "."))
+		alias = strings.ToLower(next)
+	}
+
+	if found {
+		out.ttl = clampTTL(ttl)
+		return out, nil
+	}
+
+	// negative answers expire with the lower of the SOA record's TTL and
+	// minimum TTL, and with any aliases leading to them
+	alias_ttl := ttl
+	ttl = -1
+	for {
+		rh, err := p.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if rh.Type != dnsmessage.TypeSOA {
+			p.SkipAuthority()
+			continue
+		}
+		if r, err := p.SOAResource(); err == nil {
+			minTTL(rh.TTL)
+			minTTL(r.MinTTL)
+			if alias_ttl >= 0 {
+				minTTL(uint32(alias_ttl))
+			}
+		}
+		break
+	}
+	out.ttl = clampTTL(ttl)
+	dnserr.Err = "no such host"
+	dnserr.IsNotFound = true
+	return out, dnserr
+}
+
+// clampTTL returns a TTL raised to minDNSTTL, or 0 if it is unknown.
+func clampTTL(ttl int) int {
+	if ttl < 0 {
+		return 0
+	} else if ttl < minDNSTTL {
+		return minDNSTTL
+	}
+	return ttl
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of an address, for
+// PTR queries.
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." + strconv.Itoa(int(ip4[2])) + "." +
+			strconv.Itoa(int(ip4[1])) + "." + strconv.Itoa(int(ip4[0])) + ".in-addr.arpa."
+	}
+	const hexdigits = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexdigits[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexdigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
@@ -0,0 +1,160 @@
+package canid
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSResponse is a response to a test query, by section.
+
+type testDNSResponse struct {
+	rcode     dnsmessage.RCode
+	ad        bool
+	answers   []dnsmessage.Resource
+	authority []dnsmessage.Resource
+}
+
+// testDNSName parses a name, failing the test if it is invalid.
+func testDNSName(t *testing.T, name string) dnsmessage.Name {
+	t.Helper()
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// testRR returns a resource record for a test response.
+func testRR(t *testing.T, name string, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: testDNSName(t, name), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+}
+
+// pack encodes the response to a query for a name and type.
+func (r testDNSResponse) pack(t *testing.T, qname dnsmessage.Name, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: 1, Response: true, RecursionAvailable: true, AuthenticData: r.ad, RCode: r.rcode},
+		Questions:   []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+		Answers:     r.answers,
+		Authorities: r.authority,
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	soa := func(ttl uint32, minttl uint32) dnsmessage.Resource {
+		return testRR(t, "example.com.", ttl, &dnsmessage.SOAResource{
+			NS: testDNSName(t, "ns.example.com."), MBox: testDNSName(t, "hostmaster.example.com."),
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: minttl,
+		})
+	}
+	a := func(name string, ttl uint32, addr [4]byte) dnsmessage.Resource {
+		return testRR(t, name, ttl, &dnsmessage.AResource{A: addr})
+	}
+	cname := func(name string, ttl uint32, target string) dnsmessage.Resource {
+		return testRR(t, name, ttl, &dnsmessage.CNAMEResource{CNAME: testDNSName(t, target)})
+	}
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    dnsmessage.Type
+		response testDNSResponse
+		want     dnsAnswer
+		notFound bool
+		fails    bool
+	}{
+		{"addresses", "www.example.com.", dnsmessage.TypeA, testDNSResponse{answers: []dnsmessage.Resource{
+			a("www.example.com.", 300, [4]byte{192, 0, 2, 1}),
+			a("www.example.com.", 200, [4]byte{192, 0, 2, 2}),
+		}}, dnsAnswer{addrs: []net.IP{{192, 0, 2, 1}, {192, 0, 2, 2}}, ttl: 200}, false, false},
+		{"validated", "www.example.com.", dnsmessage.TypeA, testDNSResponse{ad: true, answers: []dnsmessage.Resource{
+			a("www.example.com.", 300, [4]byte{192, 0, 2, 1}),
+		}}, dnsAnswer{addrs: []net.IP{{192, 0, 2, 1}}, ttl: 300, validated: true}, false, false},
+		{"CNAME chain", "www.example.com.", dnsmessage.TypeA, testDNSResponse{answers: []dnsmessage.Resource{
+			cname("www.example.com.", 3600, "cdn.example.net."),
+			cname("CDN.example.net.", 60, "edge.example.org."),
+			a("edge.example.org.", 300, [4]byte{192, 0, 2, 1}),
+		}}, dnsAnswer{addrs: []net.IP{{192, 0, 2, 1}}, cnames: []string{"cdn.example.net", "edge.example.org"}, ttl: 60}, false, false},
+		{"CNAME not from queried name", "www.example.com.", dnsmessage.TypeA, testDNSResponse{answers: []dnsmessage.Resource{
+			cname("other.example.com.", 30, "www.example.com."),
+			a("www.example.com.", 300, [4]byte{192, 0, 2, 1}),
+		}}, dnsAnswer{addrs: []net.IP{{192, 0, 2, 1}}, ttl: 30}, false, false},
+		{"other types skipped", "www.example.com.", dnsmessage.TypeAAAA, testDNSResponse{answers: []dnsmessage.Resource{
+			a("www.example.com.", 10, [4]byte{192, 0, 2, 1}),
+			testRR(t, "www.example.com.", 300, &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}),
+		}}, dnsAnswer{addrs: []net.IP{net.ParseIP("2001:db8::1")}, ttl: 300}, false, false},
+		{"TTL 0", "www.example.com.", dnsmessage.TypeA, testDNSResponse{answers: []dnsmessage.Resource{
+			a("www.example.com.", 0, [4]byte{192, 0, 2, 1}),
+		}}, dnsAnswer{addrs: []net.IP{{192, 0, 2, 1}}, ttl: minDNSTTL}, false, false},
+		{"TXT", "example.com.", dnsmessage.TypeTXT, testDNSResponse{answers: []dnsmessage.Resource{
+			testRR(t, "example.com.", 300, &dnsmessage.TXTResource{TXT: []string{"v=spf1 ", "-all"}}),
+		}}, dnsAnswer{texts: []string{"v=spf1 -all"}, ttl: 300}, false, false},
+		{"MX", "example.com.", dnsmessage.TypeMX, testDNSResponse{answers: []dnsmessage.Resource{
+			testRR(t, "example.com.", 300, &dnsmessage.MXResource{Pref: 10, MX: testDNSName(t, "mx.example.com.")}),
+		}}, dnsAnswer{mx: []MXRecord{{Host: "mx.example.com.", Pref: 10}}, ttl: 300}, false, false},
+		{"NXDOMAIN with SOA", "missing.example.com.", dnsmessage.TypeA, testDNSResponse{rcode: dnsmessage.RCodeNameError, authority: []dnsmessage.Resource{
+			soa(3600, 900),
+		}}, dnsAnswer{ttl: 900}, true, false},
+		{"negative TTL from SOA record", "missing.example.com.", dnsmessage.TypeA, testDNSResponse{rcode: dnsmessage.RCodeNameError, authority: []dnsmessage.Resource{
+			soa(60, 900),
+		}}, dnsAnswer{ttl: 60}, true, false},
+		{"NODATA with SOA", "www.example.com.", dnsmessage.TypeAAAA, testDNSResponse{authority: []dnsmessage.Resource{
+			soa(3600, 300),
+		}}, dnsAnswer{ttl: 300}, true, false},
+		{"NODATA after CNAME", "www.example.com.", dnsmessage.TypeAAAA, testDNSResponse{answers: []dnsmessage.Resource{
+			cname("www.example.com.", 60, "edge.example.org."),
+		}, authority: []dnsmessage.Resource{
+			soa(3600, 300),
+		}}, dnsAnswer{cnames: []string{"edge.example.org"}, ttl: 60}, true, false},
+		{"negative without SOA", "missing.example.com.", dnsmessage.TypeA, testDNSResponse{rcode: dnsmessage.RCodeNameError},
+			dnsAnswer{}, true, false},
+		{"negative TTL 0", "missing.example.com.", dnsmessage.TypeA, testDNSResponse{rcode: dnsmessage.RCodeNameError, authority: []dnsmessage.Resource{
+			soa(0, 900),
+		}}, dnsAnswer{ttl: minDNSTTL}, true, false},
+		{"SERVFAIL", "www.example.com.", dnsmessage.TypeA, testDNSResponse{rcode: dnsmessage.RCodeServerFailure},
+			dnsAnswer{}, false, true},
+		{"REFUSED", "www.example.com.", dnsmessage.TypeA, testDNSResponse{rcode: dnsmessage.RCodeRefused},
+			dnsAnswer{}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			qname := testDNSName(t, test.qname)
+			dnserr := &net.DNSError{Name: test.qname}
+			got, err := parseDNSAnswer(test.response.pack(t, qname, test.qtype), qname, test.qtype, dnserr)
+			switch {
+			case test.notFound && !dnsNotFound(err):
+				t.Errorf("got error %v, want not found", err)
+			case test.fails && (err == nil || dnsNotFound(err)):
+				t.Errorf("got error %v, want failure", err)
+			case !test.notFound && !test.fails && err != nil:
+				t.Errorf("got error %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDNSAnswerMalformed(t *testing.T) {
+	qname := testDNSName(t, "www.example.com.")
+	response := testDNSResponse{answers: []dnsmessage.Resource{
+		testRR(t, "www.example.com.", 300, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}),
+	}}.pack(t, qname, dnsmessage.TypeA)
+	for _, n := range []int{0, 5, 12, len(response) - 2} {
+		if _, err := parseDNSAnswer(response[:n], qname, dnsmessage.TypeA, &net.DNSError{}); err == nil || dnsNotFound(err) {
+			t.Errorf("answer truncated to %d bytes: got error %v, want failure", n, err)
+		}
+	}
+}
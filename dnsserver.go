@@ -0,0 +1,228 @@
+package canid
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultDNSZone is the zone the DNS front-end answers for by default.
+const DefaultDNSZone = "asn.canid.local"
+
+// How long a DNS query may wait for a prefix lookup
+const dnsLookupTimeout = 10 * time.Second
+
+// DNS front-end for prefix lookups, in the style of Team Cymru's IP-to-ASN
+// DNS service, for tools which can get ASN data over DNS but not HTTP. A TXT
+// query for an address under the zone, with octets (IPv4) or nibbles (IPv6)
+// reversed as for in-addr.arpa, is answered with the origin AS, prefix and
+// country code, e.g. 4.3.2.1.asn.canid.local for 1.2.3.4 with
+// "AS64496 | 1.2.3.0/24 | CH".
+
+type DNSServer struct {
+	Prefixes *PrefixCache
+	Zone     string
+}
+
+// ServeUDP answers queries on the packet connection until it is closed.
+func (server *DNSServer) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if response, ok := server.answer(query); ok {
+				conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+// ServeTCP accepts connections on the listener until it is closed.
+func (server *DNSServer) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go server.serveConn(conn)
+	}
+}
+
+func (server *DNSServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		// each message is preceded by its length
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			if err != io.EOF {
+				slog.Warn("dns connection failed", "client", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			slog.Warn("dns connection failed", "client", conn.RemoteAddr().String(), "err", err)
+			return
+		}
+
+		response, ok := server.answer(query)
+		if !ok {
+			return
+		}
+		if err := binary.Write(conn, binary.BigEndian, uint16(len(response))); err != nil {
+			return
+		}
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+// answer builds the response to a query, or returns false if the query is
+// too malformed to answer at all.
+func (server *DNSServer) answer(query []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil, false
+	}
+
+	response := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		response.RCode = dnsmessage.RCodeFormatError
+		return buildDNSResponse(response, nil, nil)
+	}
+	if header.OpCode != 0 {
+		response.RCode = dnsmessage.RCodeNotImplemented
+		return buildDNSResponse(response, &question, nil)
+	}
+
+	addr, rcode := server.parseName(question.Name.String())
+	if rcode != dnsmessage.RCodeSuccess {
+		response.RCode = rcode
+		return buildDNSResponse(response, &question, nil)
+	}
+
+	// anything but TXT has no data
+	if question.Type != dnsmessage.TypeTXT && question.Type != dnsmessage.TypeALL {
+		return buildDNSResponse(response, &question, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	prefix_info, err := server.Prefixes.LookupContext(ctx, addr)
+	if err != nil {
+		slog.Warn("dns query failed", "addr", addr, "err", err)
+		response.RCode = dnsmessage.RCodeServerFailure
+		return buildDNSResponse(response, &question, nil)
+	}
+
+	ttl := server.Prefixes.ttl(prefix_info)
+	txt := fmt.Sprintf("AS%d | %s | %s", prefix_info.ASN, prefix_info.Prefix, prefix_info.CountryCode)
+	return buildDNSResponse(response, &question, &dnsTXTAnswer{uint32(ttl), txt})
+}
+
+type dnsTXTAnswer struct {
+	ttl uint32
+	txt string
+}
+
+// buildDNSResponse encodes a response with an optional question and TXT
+// answer.
+func buildDNSResponse(header dnsmessage.Header, question *dnsmessage.Question, answer *dnsTXTAnswer) ([]byte, bool) {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+	b.EnableCompression()
+	if question != nil {
+		if err := b.StartQuestions(); err != nil {
+			return nil, false
+		}
+		if err := b.Question(*question); err != nil {
+			return nil, false
+		}
+	}
+	if answer != nil {
+		if err := b.StartAnswers(); err != nil {
+			return nil, false
+		}
+		err := b.TXTResource(dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Class: dnsmessage.ClassINET,
+			TTL:   answer.ttl,
+		}, dnsmessage.TXTResource{TXT: []string{answer.txt}})
+		if err != nil {
+			return nil, false
+		}
+	}
+	out, err := b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// parseName returns the address a query name refers to. Names outside the
+// zone are refused; names in the zone which are not a reversed address do
+// not exist.
+func (server *DNSServer) parseName(name string) (net.IP, dnsmessage.RCode) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	zone := strings.ToLower(strings.TrimSuffix(server.Zone, "."))
+	if !strings.HasSuffix(name, "."+zone) {
+		return nil, dnsmessage.RCodeRefused
+	}
+	addr := reversedAddress(strings.Split(strings.TrimSuffix(name, "."+zone), "."))
+	if addr == nil {
+		return nil, dnsmessage.RCodeNameError
+	}
+	return addr, dnsmessage.RCodeSuccess
+}
+
+// reversedAddress parses labels as the reversed octets of an IPv4 address or
+// reversed nibbles of an IPv6 address, as generated by dnsblName. It returns
+// nil if they are neither.
+func reversedAddress(labels []string) net.IP {
+	switch len(labels) {
+	case net.IPv4len:
+		addr := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			addr[net.IPv4len-1-i] = byte(octet)
+		}
+		return addr
+	case 2 * net.IPv6len:
+		addr := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			j := len(labels) - 1 - i
+			addr[j/2] |= byte(nibble) << (4 * uint(1-j%2))
+		}
+		return addr
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,58 @@
+package canid
+
+// CacheCallbacks are optional functions called on changes to a cache, so
+// that embedders can keep their own metrics, replicate entries, or persist
+// them, without patching the cache. Callbacks are called synchronously on
+// the lookup path, OnEvict while holding the cache's lock, so they must not
+// block or use the cache. Any of them may be nil.
+
+type CacheCallbacks struct {
+	// OnInsert is called for every entry added to the cache, or replaced
+	// by a fresher one
+	OnInsert func(event CacheEvent)
+	// OnExpire is called for every entry removed because it expired
+	OnExpire func(event CacheEvent)
+	// OnEvict is called for every entry removed to keep the cache within
+	// capacity
+	OnEvict func(event CacheEvent)
+	// OnBackendError is called for every failed backend lookup, with the
+	// cache name, the address or name looked up, and the error; these are
+	// counted in BackendErrors
+	OnBackendError func(cache string, query string, err error)
+}
+
+func (c *CacheCallbacks) inserted(cache string, key string, entry interface{}) {
+	if c.OnInsert != nil {
+		c.OnInsert(CacheEvent{cache, key, entry})
+	}
+}
+
+func (c *CacheCallbacks) expired(cache string, key string, entry interface{}) {
+	if c.OnExpire != nil {
+		c.OnExpire(CacheEvent{cache, key, entry})
+	}
+}
+
+func (c *CacheCallbacks) evicted(cache string, key string, entry interface{}) {
+	if c.OnEvict != nil {
+		c.OnEvict(CacheEvent{cache, key, entry})
+	}
+}
+
+func (c *CacheCallbacks) backendFailed(cache string, query string, err error) {
+	if c.OnBackendError != nil {
+		c.OnBackendError(cache, query, err)
+	}
+}
+
+// SetCallbacks sets the functions called on changes to the cache. It must be
+// called before the cache is used.
+func (cache *PrefixCache) SetCallbacks(callbacks CacheCallbacks) {
+	cache.callbacks = callbacks
+}
+
+// SetCallbacks sets the functions called on changes to the cache. It must be
+// called before the cache is used.
+func (cache *AddressCache) SetCallbacks(callbacks CacheCallbacks) {
+	cache.callbacks = callbacks
+}
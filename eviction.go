@@ -0,0 +1,257 @@
+package canid
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy chooses which entry to evict when a cache is at capacity.
+// The cache notifies the policy when keys are added, accessed and removed;
+// implementations must be safe for concurrent use.
+
+type EvictionPolicy interface {
+	// Added is called when a new key is stored in the cache.
+	Added(key string)
+	// Accessed is called on every cache hit.
+	Accessed(key string)
+	// Removed is called when a key leaves the cache for any reason.
+	Removed(key string)
+	// Victim returns the key to evict next, or false if there is none.
+	Victim() (string, bool)
+}
+
+// Names of the built-in eviction policies
+const (
+	EvictTTL    = "ttl"
+	EvictLRU    = "lru"
+	EvictLFU    = "lfu"
+	EvictRandom = "random"
+)
+
+// NewEvictionPolicy returns a new instance of a built-in eviction policy by
+// name: ttl evicts the entry closest to expiry (i.e., the oldest), lru the
+// least recently used, lfu the least frequently used, and random an entry
+// chosen uniformly at random.
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case EvictTTL:
+		return newListPolicy(false), nil
+	case EvictLRU:
+		return newListPolicy(true), nil
+	case EvictLFU:
+		return newLFUPolicy(), nil
+	case EvictRandom:
+		return newRandomPolicy(), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %s", name)
+	}
+}
+
+// registerEntries registers the entries already in a cache with a policy,
+// given the time each was cached, oldest first (by key on a tie), so that
+// the ttl and lru policies evict them in the order they would have had they
+// been cached under the policy.
+func registerEntries(policy EvictionPolicy, cached map[string]time.Time) {
+	keys := make([]string, 0, len(cached))
+	for key := range cached {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !cached[keys[i]].Equal(cached[keys[j]]) {
+			return cached[keys[i]].Before(cached[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+	for _, key := range keys {
+		policy.Added(key)
+	}
+}
+
+// listPolicy keeps keys in a list with the next victim at the back. Keys are
+// added at the front; if touch is set, they are moved to the front on every
+// access (LRU), otherwise they stay in insertion order (TTL).
+
+type listPolicy struct {
+	lock     sync.Mutex
+	order    *list.List
+	elements map[string]*list.Element
+	touch    bool
+}
+
+func newListPolicy(touch bool) *listPolicy {
+	p := new(listPolicy)
+	p.order = list.New()
+	p.elements = make(map[string]*list.Element)
+	p.touch = touch
+	return p
+}
+
+func (p *listPolicy) Added(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+	} else {
+		p.elements[key] = p.order.PushFront(key)
+	}
+}
+
+func (p *listPolicy) Accessed(key string) {
+	if !p.touch {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *listPolicy) Removed(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.elements[key]; ok {
+		p.order.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *listPolicy) Victim() (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e := p.order.Back(); e != nil {
+		return e.Value.(string), true
+	}
+	return "", false
+}
+
+// lfuPolicy keeps keys in a min-heap by access count.
+
+type lfuEntry struct {
+	key   string
+	count uint64
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int           { return len(h) }
+func (h lfuHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+type lfuPolicy struct {
+	lock    sync.Mutex
+	heap    lfuHeap
+	entries map[string]*lfuEntry
+}
+
+func newLFUPolicy() *lfuPolicy {
+	p := new(lfuPolicy)
+	p.entries = make(map[string]*lfuEntry)
+	return p
+}
+
+func (p *lfuPolicy) Added(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.entries[key]; !ok {
+		e := &lfuEntry{key: key}
+		p.entries[key] = e
+		heap.Push(&p.heap, e)
+	}
+}
+
+func (p *lfuPolicy) Accessed(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.entries[key]; ok {
+		e.count++
+		heap.Fix(&p.heap, e.index)
+	}
+}
+
+func (p *lfuPolicy) Removed(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.entries[key]; ok {
+		heap.Remove(&p.heap, e.index)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.heap) > 0 {
+		return p.heap[0].key, true
+	}
+	return "", false
+}
+
+// randomPolicy keeps keys in a slice, indexed by a map for removal.
+
+type randomPolicy struct {
+	lock    sync.Mutex
+	keys    []string
+	indices map[string]int
+}
+
+func newRandomPolicy() *randomPolicy {
+	p := new(randomPolicy)
+	p.indices = make(map[string]int)
+	return p
+}
+
+func (p *randomPolicy) Added(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.indices[key]; !ok {
+		p.indices[key] = len(p.keys)
+		p.keys = append(p.keys, key)
+	}
+}
+
+func (p *randomPolicy) Accessed(key string) {}
+
+func (p *randomPolicy) Removed(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if i, ok := p.indices[key]; ok {
+		last := len(p.keys) - 1
+		p.keys[i] = p.keys[last]
+		p.indices[p.keys[i]] = i
+		p.keys = p.keys[:last]
+		delete(p.indices, key)
+	}
+}
+
+func (p *randomPolicy) Victim() (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.keys) > 0 {
+		return p.keys[rand.Intn(len(p.keys))], true
+	}
+	return "", false
+}
@@ -0,0 +1,123 @@
+package canid
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Key space and capacity of the eviction benchmarks: the cache holds a tenth
+// of the keys requested.
+const (
+	benchmarkEvictionKeys     = 10000
+	benchmarkEvictionCapacity = 1000
+)
+
+// evictionWorkload returns a reproducible sequence of n requests for keys
+// drawn from the benchmark key space, skewed like popular addresses (zipf)
+// or uniformly.
+func evictionWorkload(kind string, n int) []string {
+	r := rand.New(rand.NewSource(1))
+	var next func() uint64
+	switch kind {
+	case "zipf":
+		next = rand.NewZipf(r, 1.1, 1, benchmarkEvictionKeys-1).Uint64
+	case "uniform":
+		next = func() uint64 { return uint64(r.Intn(benchmarkEvictionKeys)) }
+	}
+	keys := make([]string, benchmarkEvictionKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("192.0.%d.%d/32", i/256, i%256)
+	}
+	workload := make([]string, n)
+	for i := range workload {
+		workload[i] = keys[next()]
+	}
+	return workload
+}
+
+// evictionSimulator replays requests through a policy the way the caches
+// use it: a hit is an access, a miss stores the key, evicting a victim first
+// if the cache is full.
+
+type evictionSimulator struct {
+	policy   EvictionPolicy
+	capacity int
+	cached   map[string]bool
+}
+
+// request replays a request for a key, and returns true on a hit.
+func (sim *evictionSimulator) request(key string) bool {
+	if sim.cached[key] {
+		sim.policy.Accessed(key)
+		return true
+	}
+	if len(sim.cached) >= sim.capacity {
+		if victim, ok := sim.policy.Victim(); ok {
+			sim.policy.Removed(victim)
+			delete(sim.cached, victim)
+		}
+	}
+	sim.cached[key] = true
+	sim.policy.Added(key)
+	return false
+}
+
+// BenchmarkEviction replays skewed and uniform workloads through each
+// built-in policy, reporting the hit rate after warming the cache up.
+func BenchmarkEviction(b *testing.B) {
+	workloads := make(map[string][]string)
+	for _, kind := range []string{"zipf", "uniform"} {
+		workloads[kind] = evictionWorkload(kind, 1<<18)
+	}
+	for _, name := range []string{EvictLRU, EvictLFU, EvictTTL, EvictRandom} {
+		for _, kind := range []string{"zipf", "uniform"} {
+			workload := workloads[kind]
+			b.Run(name+"/"+kind, func(b *testing.B) {
+				policy, err := NewEvictionPolicy(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				sim := &evictionSimulator{policy: policy, capacity: benchmarkEvictionCapacity, cached: make(map[string]bool)}
+				warmup := len(workload) / 4
+				for _, key := range workload[:warmup] {
+					sim.request(key)
+				}
+				b.ResetTimer()
+				hits := 0
+				for i := 0; i < b.N; i++ {
+					if sim.request(workload[warmup+i%(len(workload)-warmup)]) {
+						hits++
+					}
+				}
+				b.ReportMetric(100*float64(hits)/float64(b.N), "hit%")
+			})
+		}
+	}
+}
+
+func TestSetEvictionOrder(t *testing.T) {
+	clock := newFakeClock()
+	// cached in the opposite order to their keys, so that neither key nor
+	// map order gives the right answer by chance
+	prefixes := []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"}
+	for _, name := range []string{EvictTTL, EvictLRU} {
+		for run := 0; run < 20; run++ {
+			cache := NewPrefixCache(3600, 1, nil)
+			cache.SetClock(clock)
+			for i, prefix := range prefixes {
+				cache.Data[prefix] = PrefixInfo{Prefix: prefix, Cached: clock.Now().Add(-time.Duration(i) * time.Minute)}
+			}
+			policy, err := NewEvictionPolicy(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache.SetEviction(2, policy)
+			if _, ok := cache.Data["203.0.113.0/24"]; ok || len(cache.Data) != 2 {
+				t.Fatalf("%s: kept %v, want the oldest entry evicted", name, cache.Keys())
+			}
+			cache.Close()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// VerifyResult is the result of a forward-confirmed reverse DNS check for an
+// address.
+
+type VerifyResult struct {
+	Address   string   `source:"canid" doc:"Address checked"`
+	Names     []string `source:"dns" doc:"Names the address maps to by PTR lookup"`
+	Confirmed []string `source:"dns" doc:"Those of Names which map back to the address by forward lookup"`
+	Match     bool     `source:"canid" doc:"True if at least one name is confirmed"`
+	Error     string   `json:",omitempty" source:"canid" doc:"Class of PTR lookup failure: NXDOMAIN, TIMEOUT, or SERVFAIL"`
+}
+
+// Verify performs a forward-confirmed reverse DNS (FCrDNS) check for an
+// address: it looks up the names the address maps to, then the addresses of
+// each of those names, of the same family as the address. The address is
+// verified if any name maps back to it. All lookups go through the cache.
+func (cache *AddressCache) Verify(ctx context.Context, addr net.IP) (out VerifyResult, err error) {
+	out.Address = addr.String()
+	out.Names = make([]string, 0)
+	out.Confirmed = make([]string, 0)
+
+	ptr_info, err := cache.LookupTypeContext(ctx, out.Address, QueryTypePTR)
+	if err != nil {
+		return
+	}
+	if len(ptr_info.Error) > 0 {
+		out.Error = ptr_info.Error
+		return
+	}
+	out.Names = ptr_info.Names
+
+	qtype := QueryTypeAAAA
+	if addr.To4() != nil {
+		qtype = QueryTypeA
+	}
+
+	for _, name := range out.Names {
+		addr_info, lerr := cache.LookupTypeContext(ctx, name, qtype)
+		if lerr != nil {
+			return out, lerr
+		}
+		for _, forward := range addr_info.Addresses {
+			if forward.Equal(addr) {
+				out.Confirmed = append(out.Confirmed, name)
+				break
+			}
+		}
+	}
+	out.Match = len(out.Confirmed) > 0
+	return
+}
+
+func (cache *AddressCache) VerifyServer(w http.ResponseWriter, req *http.Request) {
+
+	ip := ParseAddress(req.URL.Query().Get("addr"))
+	if ip == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	verify_result, err := cache.Verify(req.Context(), ip)
+	if req.Context().Err() != nil {
+		// client went away, nobody to answer
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		error_struct := struct{ Error string }{err.Error()}
+		error_body, _ := json.Marshal(error_struct)
+		w.Write(error_body)
+		return
+	}
+
+	// nonexistent PTR records are a valid answer; other failures are the
+	// backend's
+	switch verify_result.Error {
+	case DNSErrorTimeout:
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case DNSErrorServFail:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	verify_body, _ := json.Marshal(verify_result)
+	w.Write(verify_body)
+}
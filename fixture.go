@@ -0,0 +1,75 @@
+package canid
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FixtureName returns the file name of the fixture for a RIPEstat data call
+// and address: <datacall>-<address>.json, with colons in IPv6 addresses
+// replaced by underscores.
+func FixtureName(dataCall string, addr net.IP) string {
+	return dataCall + "-" + strings.Replace(addr.String(), ":", "_", -1) + ".json"
+}
+
+// FixtureTransport is a mock RIPEstat, which answers data calls from fixtures
+// in Dir, as written by the fixtures subcommand, instead of the network. Use
+// it as the Transport of HTTPClient to run canid end to end without network
+// access. Requests with no matching fixture, or for other hosts, are answered
+// with status 404 and a RIPEstat error response.
+
+type FixtureTransport struct {
+	Dir string
+}
+
+func (transport FixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	// data calls are at https://stat.ripe.net/data/<call>/data.json
+	dataCall := path.Base(path.Dir(req.URL.Path))
+	addr := ParseAddress(req.URL.Query().Get("resource"))
+	if "https://"+req.URL.Host+req.URL.Path != ripeStatDataURL+dataCall+"/data.json" || addr == nil {
+		return fixtureResponse(req, http.StatusNotFound, fixtureError("no fixture for "+req.URL.String())), nil
+	}
+
+	filename := filepath.Join(transport.Dir, FixtureName(dataCall, addr))
+	body, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return fixtureResponse(req, http.StatusNotFound, fixtureError("no fixture "+filename)), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return fixtureResponse(req, http.StatusOK, body), nil
+}
+
+// fixtureError returns a RIPEstat-style error response body.
+func fixtureError(message string) []byte {
+	body, _ := json.Marshal(struct {
+		Status   string     `json:"status"`
+		Messages [][]string `json:"messages"`
+	}{"error", [][]string{{"error", message}}})
+	return body
+}
+
+func fixtureResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
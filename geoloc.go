@@ -0,0 +1,123 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Geolocator fills in the location fields (CountryCode, Region, City,
+// Latitude, Longitude) of a PrefixInfo for an address. A Geolocator may also append BackendMeta.
+
+type Geolocator interface {
+	Geolocate(ctx context.Context, addr net.IP, out *PrefixInfo) error
+}
+
+// Geolocation is the Geolocator used by LookupRipestat and the local prefix
+// backends. Set it before any lookups; nil disables geolocation.
+var Geolocation Geolocator = RipestatGeolocator{}
+
+// geolocate fills in the location of a prefix answered locally, using the
+// configured Geolocation backend, if any. If geolocation fails, the result is
+// marked Partial, with the reason in Warnings; only the context's error is
+// returned.
+func geolocate(ctx context.Context, addr net.IP, out *PrefixInfo) error {
+	geolocator := Geolocation
+	if geolocator == nil {
+		return nil
+	}
+	if gerr := geolocator.Geolocate(ctx, addr, out); gerr != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		slog.Warn("geolocation lookup failed", "addr", addr, "err", gerr)
+		out.Partial = true
+		out.Warnings = append(out.Warnings, "geolocation failed: "+gerr.Error())
+	}
+	return nil
+}
+
+// Mean radius of the Earth in km, for great-circle distances
+const earthRadiusKm = 6371.0
+
+// DistanceFrom returns the great-circle distance in km from the given
+// coordinates (in decimal degrees) to the prefix's location, or false if the
+// prefix has no coordinates.
+func (info PrefixInfo) DistanceFrom(lat float64, lon float64) (float64, bool) {
+	if info.Latitude == nil || info.Longitude == nil {
+		return 0, false
+	}
+
+	// haversine formula
+	lat1, lon1 := lat*math.Pi/180, lon*math.Pi/180
+	lat2, lon2 := *info.Latitude*math.Pi/180, *info.Longitude*math.Pi/180
+	a := math.Pow(math.Sin((lat2-lat1)/2), 2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin((lon2-lon1)/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a)), true
+}
+
+// IPinfoGeolocator geolocates addresses using the IPinfo API, which provides
+// region and city as well as country. Token is an IPinfo access token; the
+// API can be used without one at a low rate limit.
+
+type IPinfoGeolocator struct {
+	Token string
+}
+
+const ipinfoURL = "https://ipinfo.io/"
+
+type ipinfoResponse struct {
+	Country string
+	Region  string
+	City    string
+	Loc     string
+}
+
+func (geolocator IPinfoGeolocator) Geolocate(ctx context.Context, addr net.IP, out *PrefixInfo) error {
+	apiurl := ipinfoURL + url.PathEscape(addr.String()) + "/json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiurl, nil)
+	if err != nil {
+		return err
+	}
+	if len(geolocator.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+geolocator.Token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("IPinfo request failed with status %s", resp.Status)
+	}
+
+	var doc ipinfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+
+	out.CountryCode = doc.Country
+	out.Region = doc.Region
+	out.City = doc.City
+
+	// coordinates come as "lat,lon"
+	if coords := strings.Split(doc.Loc, ","); len(coords) == 2 {
+		lat, laterr := strconv.ParseFloat(coords[0], 64)
+		lon, lonerr := strconv.ParseFloat(coords[1], 64)
+		if laterr == nil && lonerr == nil {
+			out.Latitude = &lat
+			out.Longitude = &lon
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package canid
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// Gob encoding of the caches, for compact binary backing stores. As with
+// JSON, only the entries are encoded.
+
+// gobPrefixInfo is a prefix entry as gob-encoded. Gob doesn't distinguish a
+// pointer to a zero value from a nil pointer, so the presence of each
+// optional number is encoded explicitly, to keep a Latitude, Longitude, or
+// DistanceKm of exactly 0.
+
+type gobPrefixInfo struct {
+	Info    PrefixInfo
+	Present uint8
+}
+
+// Bits of gobPrefixInfo.Present
+const (
+	gobLatitude uint8 = 1 << iota
+	gobLongitude
+	gobDistance
+)
+
+// zeroIfPresent returns a pointer to 0 for a number which was present as
+// 0, and otherwise the number as decoded.
+func zeroIfPresent(f *float64, present bool) *float64 {
+	if f == nil && present {
+		return new(float64)
+	}
+	return f
+}
+
+// GobEncode encodes the cache's entries while holding its lock, so the cache
+// can be dumped while it is in use.
+func (cache *PrefixCache) GobEncode() ([]byte, error) {
+	cache.lock.RLock()
+	data := make(map[string]gobPrefixInfo, len(cache.Data))
+	for key, info := range cache.Data {
+		var present uint8
+		if info.Latitude != nil {
+			present |= gobLatitude
+		}
+		if info.Longitude != nil {
+			present |= gobLongitude
+		}
+		if info.DistanceKm != nil {
+			present |= gobDistance
+		}
+		data[key] = gobPrefixInfo{info, present}
+	}
+	cache.lock.RUnlock()
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(data)
+	return buf.Bytes(), err
+}
+
+// GobDecode replaces the cache's entries with those encoded by GobEncode.
+func (cache *PrefixCache) GobDecode(b []byte) error {
+	encoded := make(map[string]gobPrefixInfo)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&encoded); err != nil {
+		return err
+	}
+	data := make(map[string]PrefixInfo, len(encoded))
+	for key, entry := range encoded {
+		info := entry.Info
+		info.Latitude = zeroIfPresent(info.Latitude, entry.Present&gobLatitude != 0)
+		info.Longitude = zeroIfPresent(info.Longitude, entry.Present&gobLongitude != 0)
+		info.DistanceKm = zeroIfPresent(info.DistanceKm, entry.Present&gobDistance != 0)
+		data[key] = info
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.Data = data
+	cache.index = prefixIndex{}
+	return nil
+}
+
+// GobEncode encodes the cache's entries while holding its lock, so the cache
+// can be dumped while it is in use.
+func (cache *AddressCache) GobEncode() ([]byte, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(cache.Data)
+	return buf.Bytes(), err
+}
+
+// GobDecode replaces the cache's entries with those encoded by GobEncode.
+func (cache *AddressCache) GobDecode(b []byte) error {
+	data := make(map[string]AddressInfo)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&data); err != nil {
+		return err
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.Data = data
+	return nil
+}
+
+// GobEncode encodes the cache's entries while holding its lock, so the cache
+// can be dumped while it is in use.
+func (cache *RecordCache) GobEncode() ([]byte, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(cache.Data)
+	return buf.Bytes(), err
+}
+
+// GobDecode replaces the cache's entries with those encoded by GobEncode.
+func (cache *RecordCache) GobDecode(b []byte) error {
+	data := make(map[string]RecordInfo)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&data); err != nil {
+		return err
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.Data = data
+	return nil
+}
@@ -0,0 +1,35 @@
+package canid
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrefixCacheGob(t *testing.T) {
+	zero, lat, lon := 0.0, 52.37, 4.89
+	cached := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := map[string]PrefixInfo{
+		// Null Island, on the equator and the prime meridian
+		"192.0.2.0/24":    {Prefix: "192.0.2.0/24", ASN: 64496, Latitude: &zero, Longitude: &zero, DistanceKm: &zero, Cached: cached},
+		"193.0.0.0/21":    {Prefix: "193.0.0.0/21", ASN: 3333, CountryCode: "NL", Latitude: &lat, Longitude: &lon, Cached: cached},
+		"2001:db8::/32":   {Prefix: "2001:db8::/32", Latitude: &zero, Longitude: &lon, Cached: cached},
+		"198.51.100.0/24": {Prefix: "198.51.100.0/24", ASN: 64497, Cached: cached},
+	}
+	cache := NewPrefixCache(3600, 1, nil)
+	cache.Data = entries
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cache); err != nil {
+		t.Fatal(err)
+	}
+	decoded := NewPrefixCache(3600, 1, nil)
+	if err := gob.NewDecoder(&buf).Decode(decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Data, entries) {
+		t.Errorf("decoded %+v, want %+v", decoded.Data, entries)
+	}
+}
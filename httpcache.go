@@ -0,0 +1,42 @@
+package canid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// writeCacheable writes a successful response body which downstream HTTP
+// caches may keep for ttl seconds, the remaining lifetime of the entries it
+// was built from, with an ETag derived from the body. If the request's
+// If-None-Match matches the ETag, it answers 304 Not Modified without a body
+// instead, so that clients revalidating unchanged data needn't fetch it again.
+func writeCacheable(w http.ResponseWriter, req *http.Request, body []byte, ttl int) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(ttl))
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
+
+// etagMatches returns true if an If-None-Match header lists the given ETag,
+// or is *. Weak ETags match their strong equivalents, as RFC 9110 requires
+// for If-None-Match.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
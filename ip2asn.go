@@ -0,0 +1,146 @@
+package canid
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// ip2asnRange is a range of addresses mapped to a prefix entry, for export
+// in ip2asn format.
+
+type ip2asnRange struct {
+	start, end *big.Int
+	info       PrefixInfo
+}
+
+var bigOne = big.NewInt(1)
+
+// prefixRange returns the first and last addresses of a prefix, as integers.
+func prefixRange(pfx net.IPNet) (*big.Int, *big.Int) {
+	last := make(net.IP, len(pfx.IP))
+	for i := range pfx.IP {
+		last[i] = pfx.IP[i] | ^pfx.Mask[i]
+	}
+	return new(big.Int).SetBytes(pfx.IP), new(big.Int).SetBytes(last)
+}
+
+// rangeAddress returns an integer as an address of the given length.
+func rangeAddress(n *big.Int, addrlen int) net.IP {
+	return n.FillBytes(make([]byte, addrlen))
+}
+
+// ip2asnFields returns the AS number, country, and AS description columns of
+// an entry, with the placeholders ip2asn uses for missing values.
+func ip2asnFields(info PrefixInfo) (int, string, string) {
+	country := info.CountryCode
+	if country == "" {
+		country = "None"
+	}
+	description := info.Holder
+	if description == "" {
+		description = info.ASName
+	}
+	if description == "" {
+		description = info.ASLabel
+	}
+	if info.ASN == 0 {
+		description = "Not routed"
+	} else if description == "" {
+		description = "Unknown"
+	}
+	return info.ASN, country, description
+}
+
+// flattenRanges turns the ranges of nested and disjoint prefixes, sorted by
+// start address and then by size, largest first, into disjoint ranges, each
+// mapped to the most specific prefix containing it.
+func flattenRanges(nested []ip2asnRange) []ip2asnRange {
+	out := make([]ip2asnRange, 0, len(nested))
+	emit := func(r ip2asnRange, from *big.Int, to *big.Int) {
+		if from.Cmp(to) <= 0 {
+			out = append(out, ip2asnRange{start: from, end: to, info: r.info})
+		}
+	}
+	var stack []ip2asnRange
+	var next *big.Int // first address not yet emitted
+	pop := func() {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		emit(top, next, top.end)
+		next = new(big.Int).Add(top.end, bigOne)
+	}
+	for _, r := range nested {
+		for len(stack) > 0 && stack[len(stack)-1].end.Cmp(r.start) < 0 {
+			pop()
+		}
+		if len(stack) > 0 {
+			emit(stack[len(stack)-1], next, new(big.Int).Sub(r.start, bigOne))
+		}
+		stack = append(stack, r)
+		next = r.start
+	}
+	for len(stack) > 0 {
+		pop()
+	}
+	return out
+}
+
+// WriteIP2ASN writes the cached prefixes in the tab-separated format of the
+// ip2asn-combined table published by iptoasn.com: one line per address range,
+// with the first and last address of the range, AS number, country code, and
+// AS description, IPv4 ranges first, each in ascending order. Nested prefixes
+// are split so that ranges don't overlap, each address mapping to its most
+// specific cached prefix; adjacent ranges with the same values are merged.
+func (cache *PrefixCache) WriteIP2ASN(out io.Writer) error {
+	var v4, v6 []ip2asnRange
+	cache.lock.RLock()
+	for key, info := range cache.Data {
+		pfx, ok := parsePrefixKey(key)
+		if !ok {
+			continue
+		}
+		start, end := prefixRange(pfx)
+		if len(pfx.Mask) == net.IPv4len {
+			v4 = append(v4, ip2asnRange{start, end, info})
+		} else {
+			v6 = append(v6, ip2asnRange{start, end, info})
+		}
+	}
+	cache.lock.RUnlock()
+
+	w := bufio.NewWriter(out)
+	for _, family := range []struct {
+		ranges  []ip2asnRange
+		addrlen int
+	}{{v4, net.IPv4len}, {v6, net.IPv6len}} {
+		nested := family.ranges
+		sort.Slice(nested, func(i, j int) bool {
+			if c := nested[i].start.Cmp(nested[j].start); c != 0 {
+				return c < 0
+			}
+			return nested[i].end.Cmp(nested[j].end) > 0
+		})
+		flat := flattenRanges(nested)
+		for i := 0; i < len(flat); i++ {
+			asn, country, description := ip2asnFields(flat[i].info)
+			start, end := flat[i].start, flat[i].end
+			for i+1 < len(flat) {
+				nasn, ncountry, ndescription := ip2asnFields(flat[i+1].info)
+				adjacent := new(big.Int).Add(end, bigOne).Cmp(flat[i+1].start) == 0
+				if !adjacent || nasn != asn || ncountry != country || ndescription != description {
+					break
+				}
+				i++
+				end = flat[i].end
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", rangeAddress(start, family.addrlen),
+				rangeAddress(end, family.addrlen), asn, country, strings.ReplaceAll(description, "\t", " "))
+		}
+	}
+	return w.Flush()
+}
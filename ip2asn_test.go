@@ -0,0 +1,101 @@
+package canid
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteIP2ASN(t *testing.T) {
+	a := PrefixInfo{ASN: 64496, CountryCode: "NL", Holder: "A"}
+	b := PrefixInfo{ASN: 64497, CountryCode: "DE", Holder: "B"}
+	c := PrefixInfo{ASN: 64498, ASName: "C"}
+	tests := []struct {
+		name     string
+		prefixes map[string]PrefixInfo
+		want     []string
+	}{
+		{"nested", map[string]PrefixInfo{
+			"10.0.0.0/8":  a,
+			"10.1.0.0/16": b,
+			"10.1.2.0/24": c,
+		}, []string{
+			"10.0.0.0\t10.0.255.255\t64496\tNL\tA",
+			"10.1.0.0\t10.1.1.255\t64497\tDE\tB",
+			"10.1.2.0\t10.1.2.255\t64498\tNone\tC",
+			"10.1.3.0\t10.1.255.255\t64497\tDE\tB",
+			"10.2.0.0\t10.255.255.255\t64496\tNL\tA",
+		}},
+		{"siblings covering their parent", map[string]PrefixInfo{
+			"192.0.2.0/24":   a,
+			"192.0.2.0/25":   b,
+			"192.0.2.128/25": c,
+		}, []string{
+			"192.0.2.0\t192.0.2.127\t64497\tDE\tB",
+			"192.0.2.128\t192.0.2.255\t64498\tNone\tC",
+		}},
+		{"siblings at the ends of their parent", map[string]PrefixInfo{
+			"192.0.2.0/24":   a,
+			"192.0.2.0/26":   b,
+			"192.0.2.192/26": c,
+		}, []string{
+			"192.0.2.0\t192.0.2.63\t64497\tDE\tB",
+			"192.0.2.64\t192.0.2.191\t64496\tNL\tA",
+			"192.0.2.192\t192.0.2.255\t64498\tNone\tC",
+		}},
+		{"adjacent", map[string]PrefixInfo{
+			"198.51.100.0/24":  a,
+			"198.51.101.0/24":  a,
+			"203.0.113.0/25":   a,
+			"203.0.113.128/25": b,
+			"203.0.114.0/24":   {ASN: 0},
+		}, []string{
+			"198.51.100.0\t198.51.101.255\t64496\tNL\tA",
+			"203.0.113.0\t203.0.113.127\t64496\tNL\tA",
+			"203.0.113.128\t203.0.113.255\t64497\tDE\tB",
+			"203.0.114.0\t203.0.114.255\t0\tNone\tNot routed",
+		}},
+		{"nested like their parent", map[string]PrefixInfo{
+			"100.64.0.0/10": a,
+			"100.64.1.0/24": a,
+		}, []string{
+			"100.64.0.0\t100.127.255.255\t64496\tNL\tA",
+		}},
+		{"IPv6", map[string]PrefixInfo{
+			"2001:db8::/32":   a,
+			"2001:db8:1::/48": b,
+			"2001:db8:2::/48": a,
+			"192.0.2.0/24":    c,
+		}, []string{
+			"192.0.2.0\t192.0.2.255\t64498\tNone\tC",
+			"2001:db8::\t2001:db8:0:ffff:ffff:ffff:ffff:ffff\t64496\tNL\tA",
+			"2001:db8:1::\t2001:db8:1:ffff:ffff:ffff:ffff:ffff\t64497\tDE\tB",
+			"2001:db8:2::\t2001:db8:ffff:ffff:ffff:ffff:ffff:ffff\t64496\tNL\tA",
+		}},
+		{"IPv6 siblings", map[string]PrefixInfo{
+			"2001:db8::/32":      a,
+			"2001:db8::/33":      b,
+			"2001:db8:8000::/33": b,
+		}, []string{
+			"2001:db8::\t2001:db8:ffff:ffff:ffff:ffff:ffff:ffff\t64497\tDE\tB",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := NewPrefixCache(3600, 1, nil)
+			defer cache.Close()
+			for prefix, info := range test.prefixes {
+				info.Prefix = prefix
+				cache.Data[prefix] = info
+			}
+			var out bytes.Buffer
+			if err := cache.WriteIP2ASN(&out); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Join(test.want, "\n") + "\n"
+			if out.String() != want {
+				t.Errorf("got\n%swant\n%s", out.String(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package canid
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultKeysLimit = 1000
+	maxKeysLimit     = 10000
+)
+
+// Keys returns the keys of all entries in the prefix cache, in sorted order.
+func (cache *PrefixCache) Keys() []string {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	out := make([]string, 0, len(cache.Data))
+	for key := range cache.Data {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Keys returns the keys of all entries in the address cache, in sorted order.
+func (cache *AddressCache) Keys() []string {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	out := make([]string, 0, len(cache.Data))
+	for key := range cache.Data {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Keys returns the keys of all entries in the record cache, in sorted order.
+func (cache *RecordCache) Keys() []string {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	out := make([]string, 0, len(cache.Data))
+	for key := range cache.Data {
+		out = append(out, key)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Entry returns the entry of the prefix cache with the given key, if any,
+// whether or not it has expired.
+func (cache *PrefixCache) Entry(key string) (PrefixInfo, bool) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	info, ok := cache.Data[key]
+	return info, ok
+}
+
+// Entry returns the entry of the address cache with the given key, if any,
+// whether or not it has expired.
+func (cache *AddressCache) Entry(key string) (AddressInfo, bool) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	info, ok := cache.Data[key]
+	return info, ok
+}
+
+// Entry returns the entry of the record cache with the given key, if any,
+// whether or not it has expired.
+func (cache *RecordCache) Entry(key string) (RecordInfo, bool) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	info, ok := cache.Data[key]
+	return info, ok
+}
+
+// KeysServer returns an HTTP handler listing the keys of the caches, in
+// sorted order, as prefix/<key>, address/<key>, and, for record caches,
+// <name>/<key>, e.g. mx/<key>. Results are paginated: the cursor parameter
+// resumes after the last key of the previous page, which is returned as
+// NextCursor (empty on the last page). Either of the prefix and address
+// caches may be nil.
+func KeysServer(prefixes *PrefixCache, addresses *AddressCache, records ...*RecordCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		limit, after, ok := pageParams(req)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		keys := make([]string, 0)
+		if prefixes != nil {
+			for _, key := range prefixes.Keys() {
+				keys = append(keys, "prefix/"+key)
+			}
+		}
+		if addresses != nil {
+			for _, key := range addresses.Keys() {
+				keys = append(keys, "address/"+key)
+			}
+		}
+		for _, cache := range records {
+			for _, key := range cache.Keys() {
+				keys = append(keys, cache.name+"/"+key)
+			}
+		}
+		sort.Strings(keys)
+
+		start, end, next := page(keys, limit, after)
+		keys_struct := struct {
+			Keys       []string
+			NextCursor string
+		}{keys[start:end], next}
+
+		keys_body, _ := json.Marshal(keys_struct)
+		w.Write(keys_body)
+	}
+}
+
+// pageParams returns the page size and cursor of a paginated request: at most
+// limit results (defaultKeysLimit if not given, capped at maxKeysLimit),
+// after the key encoded in cursor. It returns false if either is invalid.
+func pageParams(req *http.Request) (limit int, after string, ok bool) {
+	limit = defaultKeysLimit
+	if limitstr := req.URL.Query().Get("limit"); len(limitstr) > 0 {
+		var err error
+		limit, err = strconv.Atoi(limitstr)
+		if err != nil || limit < 1 {
+			return 0, "", false
+		}
+		if limit > maxKeysLimit {
+			limit = maxKeysLimit
+		}
+	}
+	cursor, err := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("cursor"))
+	if err != nil {
+		return 0, "", false
+	}
+	return limit, string(cursor), true
+}
+
+// page returns the bounds of the page of at most limit sorted keys following
+// the key after, and the cursor of the next page, empty on the last page.
+func page(keys []string, limit int, after string) (start int, end int, next string) {
+	start = sort.SearchStrings(keys, after)
+	if start < len(keys) && keys[start] == after {
+		start++
+	}
+	end = start + limit
+	if end > len(keys) {
+		end = len(keys)
+	}
+	if end < len(keys) {
+		next = base64.RawURLEncoding.EncodeToString([]byte(keys[end-1]))
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package canid
+
+import (
+	"context"
+	"sync"
+)
+
+// backendLimiter bounds the number of simultaneous pending requests to a
+// backend.
+
+type backendLimiter chan struct{}
+
+func newBackendLimiter(limit int) backendLimiter {
+	return make(backendLimiter, limit)
+}
+
+// acquire waits for a backend slot, giving up if the context is done first.
+// A slot acquired for a context which is already done is released
+// immediately, so cancelled requests never reach the backend.
+func (limiter backendLimiter) acquire(ctx context.Context) error {
+	select {
+	case limiter <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := ctx.Err(); err != nil {
+		limiter.release()
+		return err
+	}
+	return nil
+}
+
+func (limiter backendLimiter) release() {
+	<-limiter
+}
+
+// backendSlot is the backend slot of a lookup, which backend calls the
+// lookup makes can give up while they wait to be retried, so that waiting
+// doesn't hold up other lookups. Calls made concurrently by one lookup share
+// its slot: it is released when any of them waits, and taken again by the
+// first to retry.
+
+type backendSlot struct {
+	limiter backendLimiter
+	lock    sync.Mutex
+	held    bool
+}
+
+type backendSlotKey struct{}
+
+// withBackendSlot returns a context carrying a lookup's backend slot.
+func withBackendSlot(ctx context.Context, slot *backendSlot) context.Context {
+	return context.WithValue(ctx, backendSlotKey{}, slot)
+}
+
+// backendSlotFrom returns the backend slot carried by a context, or nil for
+// calls made outside a lookup.
+func backendSlotFrom(ctx context.Context) *backendSlot {
+	slot, _ := ctx.Value(backendSlotKey{}).(*backendSlot)
+	return slot
+}
+
+// take takes the slot, if it isn't already held, waiting for the limiter
+// and giving up if the context is done first.
+func (slot *backendSlot) take(ctx context.Context) error {
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	if slot.held {
+		return nil
+	}
+	if err := slot.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	slot.held = true
+	return nil
+}
+
+// release releases the slot, if it is held.
+func (slot *backendSlot) release() {
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	if slot.held {
+		slot.limiter.release()
+		slot.held = false
+	}
+}
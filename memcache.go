@@ -0,0 +1,129 @@
+package canid
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Read-only memcached text protocol front-end, for tools which can speak
+// memcached but not HTTP. Keys are of the form prefix/<address> or
+// address/<name>, and values are the JSON objects returned by the
+// corresponding HTTP resources.
+
+type MemcacheServer struct {
+	Prefixes  *PrefixCache
+	Addresses *AddressCache
+}
+
+// Serve accepts connections on the listener until it is closed.
+func (server *MemcacheServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go server.serveConn(conn)
+	}
+}
+
+func (server *MemcacheServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				slog.Warn("memcache connection failed", "client", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+			w.Flush()
+			continue
+		}
+
+		switch fields[0] {
+		case "get", "gets":
+			for _, key := range fields[1:] {
+				if value, ok := server.lookup(key); ok {
+					fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, len(value))
+					w.Write(value)
+					w.WriteString("\r\n")
+				}
+			}
+			w.WriteString("END\r\n")
+		case "set", "add", "replace", "append", "prepend", "cas":
+			// skip the data block so we stay in sync with the client
+			if len(fields) >= 5 {
+				if n, err := strconv.Atoi(fields[4]); err == nil {
+					r.Discard(n + 2)
+				}
+			}
+			w.WriteString("SERVER_ERROR read-only\r\n")
+		case "delete", "incr", "decr", "touch", "flush_all":
+			w.WriteString("SERVER_ERROR read-only\r\n")
+		case "version":
+			w.WriteString("VERSION canid\r\n")
+		case "quit":
+			w.Flush()
+			return
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		w.Flush()
+	}
+}
+
+// lookup returns the JSON value for a key, or false if the key is malformed,
+// refers to a disabled cache, or the lookup failed.
+func (server *MemcacheServer) lookup(key string) ([]byte, bool) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+
+	var out interface{}
+	switch parts[0] {
+	case "prefix":
+		ip := ParseAddress(parts[1])
+		if ip == nil || server.Prefixes == nil {
+			return nil, false
+		}
+		prefix_info, err := server.Prefixes.Lookup(ip)
+		if err != nil {
+			return nil, false
+		}
+		prefix_info.BackendMeta = nil
+		server.Prefixes.annotate(context.Background(), ip, &prefix_info)
+		server.Prefixes.transform(&prefix_info)
+		out = prefix_info
+	case "address":
+		if server.Addresses == nil {
+			return nil, false
+		}
+		addr_info := server.Addresses.Lookup(parts[1])
+		server.Addresses.annotate(context.Background(), &addr_info)
+		server.Addresses.transform(&addr_info)
+		out = addr_info
+	default:
+		return nil, false
+	}
+
+	body, err := json.Marshal(out)
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
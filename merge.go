@@ -0,0 +1,78 @@
+package canid
+
+import "net"
+
+// isPrefixKey returns true if a key is a prefix in CIDR notation, given by its
+// network address.
+func isPrefixKey(key string) bool {
+	ip, ipnet, err := net.ParseCIDR(key)
+	return err == nil && ip.Equal(ipnet.IP)
+}
+
+// Merge adds entries to the prefix cache, e.g. from another instance's dump,
+// keeping whichever of an added and a cached entry for the same key was
+// cached more recently. Entries whose key isn't their prefix are skipped, and
+// cache times in the future are taken as now, so that a dump can't place
+// entries where lookups wouldn't, or keep them from expiring.
+// Added entries are subject to the cache's capacity and admission policy, and
+// are published as new entries. It returns the number of entries added.
+func (cache *PrefixCache) Merge(entries map[string]PrefixInfo) int {
+	now := cache.now()
+	added := make(map[string]PrefixInfo)
+	cache.lock.Lock()
+	for key, info := range entries {
+		if !isPrefixKey(key) || info.Prefix != key {
+			continue
+		}
+		if info.Cached.After(now) {
+			info.Cached = now
+		}
+		if existing, ok := cache.Data[key]; ok && !info.Cached.After(existing.Cached) {
+			continue
+		}
+		if cache.store(key, info) {
+			added[key] = info
+		}
+	}
+	cache.lock.Unlock()
+
+	for key, info := range added {
+		cache.publishers.publish("prefix", key, info)
+		cache.callbacks.inserted("prefix", key, info)
+	}
+	return len(added)
+}
+
+// Merge adds entries to the address cache, e.g. from another instance's
+// dump, keeping whichever of an added and a cached entry for the same key was
+// cached more recently. Entries whose key doesn't match their name, query
+// type, and resolver are skipped, and cache times in the future are taken as
+// now, as for PrefixCache.Merge. Added entries are subject to the cache's
+// capacity and admission policy, and are published as new entries. It
+// returns the number of entries added.
+func (cache *AddressCache) Merge(entries map[string]AddressInfo) int {
+	now := cache.now()
+	added := make(map[string]AddressInfo)
+	cache.lock.Lock()
+	for key, info := range entries {
+		if NewAddressKey(info.Name, info.Type, info.Resolver).String() != key {
+			continue
+		}
+		if info.Cached.After(now) {
+			info.Cached = now
+		}
+		if existing, ok := cache.Data[key]; ok && !info.Cached.After(existing.Cached) {
+			continue
+		}
+		if cache.store(key, info) {
+			added[key] = info
+		}
+	}
+	cache.lock.Unlock()
+
+	for key, info := range added {
+		cache.publishers.publish("address", key, info)
+		cache.callbacks.inserted("address", key, info)
+	}
+	return len(added)
+}
@@ -0,0 +1,66 @@
+package canid
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrefixCacheMerge(t *testing.T) {
+	clock := newFakeClock()
+	cache := NewPrefixCache(3600, 1, nil)
+	cache.SetClock(clock)
+	old := clock.Now().Add(-time.Hour)
+	cache.Data["192.0.2.0/24"] = PrefixInfo{Prefix: "192.0.2.0/24", ASN: 1, Cached: old}
+
+	added := cache.Merge(map[string]PrefixInfo{
+		// newer than the cached entry: taken
+		"192.0.2.0/24": {Prefix: "192.0.2.0/24", ASN: 2, Cached: old.Add(time.Minute)},
+		// key doesn't match the entry's prefix
+		"198.51.100.0/24": {Prefix: "203.0.113.0/24", ASN: 3, Cached: old},
+		// not a canonical prefix
+		"203.0.113.1/24": {Prefix: "203.0.113.1/24", ASN: 4, Cached: old},
+		"bogus":          {Prefix: "bogus", ASN: 5, Cached: old},
+		// IPv6 prefixes within ::ffff:0:0/96 are keyed in IPv6 notation
+		"::ffff:192.0.2.0/120": {Prefix: "::ffff:192.0.2.0/120", ASN: 7, Cached: old},
+		// cached in the future: clamped to now
+		"2001:db8::/32": {Prefix: "2001:db8::/32", ASN: 6, Cached: clock.Now().Add(24 * time.Hour)},
+	})
+
+	if added != 3 {
+		t.Errorf("added %d entries, want 3", added)
+	}
+	if asn := cache.Data["192.0.2.0/24"].ASN; asn != 2 {
+		t.Errorf("newer entry not taken: ASN %d", asn)
+	}
+	for _, key := range []string{"198.51.100.0/24", "203.0.113.0/24", "203.0.113.1/24", "bogus"} {
+		if _, ok := cache.Data[key]; ok {
+			t.Errorf("invalid entry %s merged", key)
+		}
+	}
+	if cached := cache.Data["2001:db8::/32"].Cached; !cached.Equal(clock.Now()) {
+		t.Errorf("future cache time not clamped: %v", cached)
+	}
+	if info, err := cache.Lookup(ParseAddress("192.0.2.1")); err != nil || info.ASN != 2 {
+		t.Errorf("merged entry not found by lookup: %+v, %v", info, err)
+	}
+}
+
+func TestAddressCacheMerge(t *testing.T) {
+	clock := newFakeClock()
+	cache := NewAddressCache(3600, 1, nil)
+	cache.SetClock(clock)
+	key := NewAddressKey("example.com", QueryTypeA, SystemResolver)
+
+	added := cache.Merge(map[string]AddressInfo{
+		key.String():             {Name: "example.com", Type: QueryTypeA, Resolver: SystemResolver, Cached: clock.Now().Add(time.Hour)},
+		"example.net/A@system":   {Name: "example.org", Type: QueryTypeA, Resolver: SystemResolver, Cached: clock.Now()},
+		"Example.org/ANY@system": {Name: "example.org", Type: QueryTypeAny, Resolver: SystemResolver, Cached: clock.Now()},
+	})
+
+	if added != 1 {
+		t.Errorf("added %d entries, want 1", added)
+	}
+	if cached := cache.Data[key.String()].Cached; !cached.Equal(clock.Now()) {
+		t.Errorf("future cache time not clamped: %v", cached)
+	}
+}
@@ -0,0 +1,140 @@
+package canid
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Middleware for use with Server.Use
+
+// CORS returns middleware allowing cross-origin requests from the given
+// origin (or * for any), so that web pages served elsewhere can use canid's
+// resources. Preflight requests are answered directly.
+func CORS(origin string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if origin != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+			if req.Method == http.MethodOptions && len(req.Header.Get("Access-Control-Request-Method")) > 0 {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// Instance returns middleware identifying the instance answering each
+// request in an X-Canid-Instance header, so that answers can be traced to the
+// node which produced them in federated or hierarchical deployments.
+func Instance(id string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("X-Canid-Instance", id)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// DenyAdmin is middleware which answers requests for administrative
+// resources (purging, self-tests, backend debugging, cache management; see
+// IsAdminPath) with status 404, for instances exposed to untrusted clients.
+func DenyAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if IsAdminPath(req.URL.Path) {
+			http.NotFound(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Idle time after which a client's rate limit state is forgotten
+const rateLimitIdle = 10 * time.Minute
+
+// rateLimiter keeps a token bucket per client address.
+
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	lock    sync.Mutex
+	clients map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit returns middleware limiting each client address to rate requests
+// per second on average, with bursts of up to burst requests. Requests over
+// the limit are answered with status 429 and a Retry-After header, so that a
+// single client can't use up the backends' capacity for everyone. Health
+// checks are not limited.
+func RateLimit(rate float64, burst int) func(http.Handler) http.Handler {
+	limiter := &rateLimiter{rate: rate, burst: float64(burst), clients: make(map[string]*tokenBucket)}
+	if limiter.burst < 1 {
+		limiter.burst = 1
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/healthz" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			client, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				client = req.RemoteAddr
+			}
+			if wait, ok := limiter.allow(client, time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				w.WriteHeader(http.StatusTooManyRequests)
+				error_struct := struct{ Error string }{"rate limit exceeded"}
+				error_body, _ := json.Marshal(error_struct)
+				w.Write(error_body)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// allow takes a token from a client's bucket, or returns false and the time
+// until the next token if there is none.
+func (limiter *rateLimiter) allow(client string, now time.Time) (time.Duration, bool) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	// forget idle clients now and then, whose buckets would be full anyway
+	if now.Sub(limiter.swept) > rateLimitIdle {
+		for key, bucket := range limiter.clients {
+			if now.Sub(bucket.last) > rateLimitIdle {
+				delete(limiter.clients, key)
+			}
+		}
+		limiter.swept = now
+	}
+
+	bucket, ok := limiter.clients[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, last: now}
+		limiter.clients[client] = bucket
+	}
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
@@ -0,0 +1,289 @@
+package canid
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MRT record types and subtypes (RFC 6396, RFC 8050), and BGP path attribute
+// codes, used in reading RIB dumps
+const (
+	mrtTableDumpV2           = 13
+	mrtRIBIPv4Unicast        = 2
+	mrtRIBIPv6Unicast        = 4
+	mrtRIBIPv4UnicastAddPath = 8
+	mrtRIBIPv6UnicastAddPath = 10
+
+	bgpAttrExtendedLength = 0x10
+	bgpAttrASPath         = 2
+	bgpASSet              = 1
+	bgpASSequence         = 2
+)
+
+// Largest MRT record accepted; RIB records for a prefix seen by every peer of
+// a collector are well under this.
+const mrtMaxRecord = 16 << 20
+
+var errShortMRTRecord = errors.New("truncated MRT record")
+
+// MRTBackend is a PrefixBackend answering from a BGP routing table loaded
+// from an MRT RIB dump (TABLE_DUMP_V2, as published by RouteViews and RIPE
+// RIS), without asking any remote service: the prefix of an address is the
+// longest matching prefix in the table, and its ASN the origin AS announcing
+// it, the one seen by most peers if there are several. The table has no
+// location information; location fields are filled in by the configured
+// Geolocation backend, as for RIPEstat, and left empty without one.
+
+type MRTBackend struct {
+	Path     string
+	lock     sync.RWMutex
+	table    prefixIndex
+	modified time.Time
+}
+
+// NewMRTBackend loads a RIB dump, optionally compressed with bzip2 or gzip
+// (by file name extension).
+func NewMRTBackend(path string) (*MRTBackend, error) {
+	backend := &MRTBackend{Path: path}
+	if err := backend.Refresh(); err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+func (*MRTBackend) Name() string {
+	return "mrt"
+}
+
+// Refresh reloads the table from its file, if the file has been modified
+// since it was last loaded. The old table is used until the new one is
+// loaded, and kept if loading fails.
+func (backend *MRTBackend) Refresh() error {
+	stat, err := os.Stat(backend.Path)
+	if err != nil {
+		return err
+	}
+	backend.lock.RLock()
+	unchanged := stat.ModTime().Equal(backend.modified)
+	backend.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	infile, err := os.Open(backend.Path)
+	if err != nil {
+		return err
+	}
+	defer infile.Close()
+
+	var in io.Reader = infile
+	switch {
+	case strings.HasSuffix(backend.Path, ".bz2"):
+		in = bzip2.NewReader(infile)
+	case strings.HasSuffix(backend.Path, ".gz"):
+		if in, err = gzip.NewReader(infile); err != nil {
+			return fmt.Errorf("%s: %s", backend.Path, err.Error())
+		}
+	}
+
+	load_start := time.Now()
+	table, count, err := loadMRT(in)
+	if err != nil {
+		return fmt.Errorf("%s: %s", backend.Path, err.Error())
+	}
+	if count == 0 {
+		return fmt.Errorf("%s: no IPv4 or IPv6 unicast RIB entries", backend.Path)
+	}
+
+	backend.lock.Lock()
+	backend.table = table
+	backend.modified = stat.ModTime()
+	backend.lock.Unlock()
+	slog.Info("loaded MRT dump", "path", backend.Path, "prefixes", count, "duration", time.Since(load_start).Round(time.Millisecond).String())
+	return nil
+}
+
+func (backend *MRTBackend) Lookup(ctx context.Context, addr net.IP) (out PrefixInfo, err error) {
+	prefix, asn, ok := backend.Route(addr)
+	if !ok {
+		err = fmt.Errorf("no route to %s in %s", addr, backend.Path)
+		return
+	}
+	out.Prefix = prefix
+	out.ASN = asn
+	err = geolocate(ctx, addr, &out)
+	return
+}
+
+// loadMRT reads the IPv4 and IPv6 unicast RIB records of an MRT dump into a
+// trie per address family, mapping each prefix to its origin AS, and returns
+// the number of prefixes read. Other records are skipped.
+func loadMRT(in io.Reader) (table prefixIndex, count int, err error) {
+	table = prefixIndex{valid: true, v4: new(Trie), v6: new(Trie)}
+	reader := bufio.NewReaderSize(in, 1<<16)
+	header := make([]byte, 12)
+	var body []byte
+	for record := 1; ; record++ {
+		if _, err = io.ReadFull(reader, header); err == io.EOF {
+			return table, count, nil
+		} else if err != nil {
+			return
+		}
+		mrttype := binary.BigEndian.Uint16(header[4:6])
+		subtype := binary.BigEndian.Uint16(header[6:8])
+		length := binary.BigEndian.Uint32(header[8:12])
+		if length > mrtMaxRecord {
+			return table, count, fmt.Errorf("record %d: length %d too large", record, length)
+		}
+		if cap(body) < int(length) {
+			body = make([]byte, length)
+		}
+		body = body[:length]
+		if _, err = io.ReadFull(reader, body); err != nil {
+			return table, count, fmt.Errorf("record %d: %s", record, err.Error())
+		}
+
+		if mrttype != mrtTableDumpV2 {
+			continue
+		}
+		var trie *Trie
+		var addrlen int
+		addpath := false
+		switch subtype {
+		case mrtRIBIPv4Unicast, mrtRIBIPv4UnicastAddPath:
+			trie, addrlen = table.v4, net.IPv4len
+			addpath = subtype == mrtRIBIPv4UnicastAddPath
+		case mrtRIBIPv6Unicast, mrtRIBIPv6UnicastAddPath:
+			trie, addrlen = table.v6, net.IPv6len
+			addpath = subtype == mrtRIBIPv6UnicastAddPath
+		default:
+			continue
+		}
+
+		pfx, origin, ok, perr := parseRIBRecord(body, addrlen, addpath)
+		if perr != nil {
+			return table, count, fmt.Errorf("record %d: %s", record, perr.Error())
+		}
+		if ok {
+			trie.Add(pfx, origin)
+			count++
+		}
+	}
+}
+
+// parseRIBRecord parses a RIB record, returning its prefix and the origin AS
+// announcing it in most of its entries (the lowest, on a tie). It returns
+// false if no entry has an unambiguous origin.
+func parseRIBRecord(body []byte, addrlen int, addpath bool) (pfx net.IPNet, origin uint32, ok bool, err error) {
+	// sequence number, prefix length, prefix
+	if len(body) < 5 {
+		return pfx, 0, false, errShortMRTRecord
+	}
+	pfxlen := int(body[4])
+	if pfxlen > addrlen*8 {
+		return pfx, 0, false, fmt.Errorf("invalid prefix length %d", pfxlen)
+	}
+	pos := 5 + (pfxlen+7)/8
+	if len(body) < pos+2 {
+		return pfx, 0, false, errShortMRTRecord
+	}
+	ip := make(net.IP, addrlen)
+	copy(ip, body[5:pos])
+	mask := net.CIDRMask(pfxlen, addrlen*8)
+	pfx = net.IPNet{IP: ip.Mask(mask), Mask: mask}
+
+	// entries: peer index, originated time, path identifier with add-path,
+	// and attributes
+	entries := int(binary.BigEndian.Uint16(body[pos:]))
+	pos += 2
+	entryhdr := 6
+	if addpath {
+		entryhdr = 10
+	}
+	origins := make(map[uint32]int)
+	for i := 0; i < entries; i++ {
+		if len(body) < pos+entryhdr+2 {
+			return pfx, 0, false, errShortMRTRecord
+		}
+		pos += entryhdr
+		attrlen := int(binary.BigEndian.Uint16(body[pos:]))
+		pos += 2
+		if len(body) < pos+attrlen {
+			return pfx, 0, false, errShortMRTRecord
+		}
+		if asn, aok := originAS(body[pos : pos+attrlen]); aok {
+			origins[asn]++
+		}
+		pos += attrlen
+	}
+
+	best := 0
+	for asn, n := range origins {
+		if n > best || (n == best && asn < origin) {
+			origin, best = asn, n
+		}
+	}
+	return pfx, origin, best > 0, nil
+}
+
+// originAS returns the origin AS from the AS_PATH among BGP path attributes:
+// the last AS of the path, or the only AS of a final AS_SET. ASes are four
+// bytes long in TABLE_DUMP_V2 records.
+func originAS(attrs []byte) (uint32, bool) {
+	for len(attrs) >= 3 {
+		flags, code := attrs[0], attrs[1]
+		hdrlen, attrlen := 3, int(attrs[2])
+		if flags&bgpAttrExtendedLength != 0 {
+			if len(attrs) < 4 {
+				return 0, false
+			}
+			hdrlen, attrlen = 4, int(binary.BigEndian.Uint16(attrs[2:4]))
+		}
+		if len(attrs) < hdrlen+attrlen {
+			return 0, false
+		}
+		if code == bgpAttrASPath {
+			return pathOrigin(attrs[hdrlen : hdrlen+attrlen])
+		}
+		attrs = attrs[hdrlen+attrlen:]
+	}
+	return 0, false
+}
+
+func pathOrigin(path []byte) (origin uint32, ok bool) {
+	for len(path) >= 2 {
+		segtype, n := path[0], int(path[1])
+		if len(path) < 2+4*n {
+			return 0, false
+		}
+		switch segtype {
+		case bgpASSequence:
+			if n > 0 {
+				origin, ok = binary.BigEndian.Uint32(path[2+4*(n-1):]), true
+			}
+		case bgpASSet:
+			// aggregates with several origins have no single one
+			if n == 1 {
+				origin, ok = binary.BigEndian.Uint32(path[2:]), true
+			} else {
+				ok = false
+			}
+		}
+		// confederation segments are local to the neighbour AS, and don't
+		// change the origin
+		path = path[2+4*n:]
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package canid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Bodies of RIB records as dumped by a RIS collector, cut down to a few
+// entries each, with ORIGIN, AS_PATH and (in the first) NEXT_HOP attributes
+var testRIBRecords = map[string]string{
+	// 193.0.0.0/21, paths 25152 3333 and 3257 1299 3333
+	"v4": "0000002a15c10000000200036574d78000184001010040020a02020000624000" +
+		"000d05400304c000020100076574d78000154001010040020e020300000cb900" +
+		"00051300000d05",
+	// 198.51.100.0/24 with add-path identifiers, paths 64496 4200000001,
+	// 64497 4200000001 and 64498 64499
+	"addpath": "0000002b18c63364000300006574d7800000000100114001010040020a020200" +
+		"00fbf0fa56ea0100006574d7800000000200114001010040020a02020000fbf1" +
+		"fa56ea0100016574d7800000000300114001010040020a02020000fbf20000fb" +
+		"f3",
+	// 2001:db8::/32, path 6939 64500 in an extended-length attribute, and
+	// 6939 {64501,64502}
+	"v6": "0000002c2020010db8000200026574d7800012400101005002000a020200001b" +
+		"1b0000fbf400056574d780001740010100400210020100001b1b01020000fbf5" +
+		"0000fbf6",
+	// 203.0.113.0/24, paths 64509 {64520} and 64509 64511
+	"tie": "0000002d18cb0071000200006574d78000134001010040020c02010000fbfd01" +
+		"010000fc0800016574d78000114001010040020a02020000fbfd0000fbff",
+	// 192.0.2.0/24, path 64509 {64521,64522}
+	"no origin": "0000002e18c00002000100006574d78000174001010040021002010000fbfd01" +
+		"020000fc090000fc0a",
+}
+
+// testRIBRecord decodes a record body.
+func testRIBRecord(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := hex.DecodeString(testRIBRecords[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseRIBRecord(t *testing.T) {
+	tests := []struct {
+		record  string
+		addrlen int
+		addpath bool
+		prefix  string
+		origin  uint32
+		ok      bool
+	}{
+		{"v4", net.IPv4len, false, "193.0.0.0/21", 3333, true},
+		{"addpath", net.IPv4len, true, "198.51.100.0/24", 4200000001, true},
+		{"v6", net.IPv6len, false, "2001:db8::/32", 64500, true},
+		{"tie", net.IPv4len, false, "203.0.113.0/24", 64511, true},
+		{"no origin", net.IPv4len, false, "192.0.2.0/24", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.record, func(t *testing.T) {
+			body := testRIBRecord(t, test.record)
+			pfx, origin, ok, err := parseRIBRecord(body, test.addrlen, test.addpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pfx.String() != test.prefix || origin != test.origin || ok != test.ok {
+				t.Errorf("got %s AS%d %v, want %s AS%d %v", pfx.String(), origin, ok, test.prefix, test.origin, test.ok)
+			}
+
+			// every truncation is noticed, rather than read past or
+			// misparsed
+			for n := 0; n < len(body); n++ {
+				if _, _, _, err := parseRIBRecord(body[:n], test.addrlen, test.addpath); err != errShortMRTRecord {
+					t.Errorf("truncated to %d bytes: got error %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRIBRecordInvalid(t *testing.T) {
+	// the add-path record read without add-path takes path identifiers for
+	// attribute lengths
+	if _, _, _, err := parseRIBRecord(testRIBRecord(t, "addpath"), net.IPv4len, false); err == nil {
+		t.Error("add-path record parsed as plain")
+	}
+
+	// a prefix longer than the address
+	body := testRIBRecord(t, "v4")
+	body[4] = 33
+	if _, _, _, err := parseRIBRecord(body, net.IPv4len, false); err == nil || !strings.Contains(err.Error(), "prefix length 33") {
+		t.Errorf("got error %v, want invalid prefix length", err)
+	}
+}
+
+// testMRTRecord frames a record body with an MRT header.
+func testMRTRecord(mrttype uint16, subtype uint16, body []byte) []byte {
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header, 1767225600)
+	binary.BigEndian.PutUint16(header[4:], mrttype)
+	binary.BigEndian.PutUint16(header[6:], subtype)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(body)))
+	return append(header, body...)
+}
+
+func TestLoadMRT(t *testing.T) {
+	var dump bytes.Buffer
+	// a peer index table and a BGP4MP message, both skipped
+	dump.Write(testMRTRecord(mrtTableDumpV2, 1, []byte{0xc1, 0x00, 0x00, 0x01, 0, 0, 0, 0}))
+	dump.Write(testMRTRecord(16, 4, []byte{0, 0, 0, 0}))
+	dump.Write(testMRTRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, testRIBRecord(t, "v4")))
+	dump.Write(testMRTRecord(mrtTableDumpV2, mrtRIBIPv4UnicastAddPath, testRIBRecord(t, "addpath")))
+	dump.Write(testMRTRecord(mrtTableDumpV2, mrtRIBIPv6Unicast, testRIBRecord(t, "v6")))
+	dump.Write(testMRTRecord(mrtTableDumpV2, mrtRIBIPv4Unicast, testRIBRecord(t, "no origin")))
+
+	table, count, err := loadMRT(bytes.NewReader(dump.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("loaded %d prefixes, want 3", count)
+	}
+	backend := &MRTBackend{table: table}
+	tests := []struct {
+		addr   string
+		prefix string
+		asn    int
+		ok     bool
+	}{
+		{"193.0.7.1", "193.0.0.0/21", 3333, true},
+		{"198.51.100.1", "198.51.100.0/24", 4200000001, true},
+		{"2001:db8::1", "2001:db8::/32", 64500, true},
+		{"192.0.2.1", "", 0, false},
+	}
+	for _, test := range tests {
+		prefix, asn, ok := backend.Route(net.ParseIP(test.addr))
+		if prefix != test.prefix || asn != test.asn || ok != test.ok {
+			t.Errorf("%s: got %s AS%d %v, want %s AS%d %v", test.addr, prefix, asn, ok, test.prefix, test.asn, test.ok)
+		}
+	}
+
+	// a dump cut off in the middle of a record fails, naming the record
+	truncated := dump.Bytes()[:dump.Len()-10]
+	if _, _, err := loadMRT(bytes.NewReader(truncated)); err == nil || !strings.Contains(err.Error(), "record 6") {
+		t.Errorf("got error %v, want record 6 truncated", err)
+	}
+}
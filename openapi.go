@@ -0,0 +1,227 @@
+package canid
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// OpenAPI description of canid's public HTTP API. Operations are listed
+// here; their response schemas are generated from the data dictionary, so
+// always match the running version.
+
+// openAPIParam is a query parameter of an operation.
+
+type openAPIParam struct {
+	name        string
+	required    bool
+	description string
+}
+
+// openAPIOperation is a GET operation (or POST, if body is given) on a
+// resource, returning the given dictionary type, either alone or in a
+// container: an array, an object by cache name, or a page of Results with a
+// NextCursor.
+
+type openAPIOperation struct {
+	path        string
+	id          string
+	summary     string
+	params      []openAPIParam
+	body        string
+	response    string
+	container   string
+	description string
+}
+
+var openAPIPageParams = []openAPIParam{
+	{"cursor", false, "NextCursor of the previous page"},
+	{"limit", false, "Maximum number of results (default 1000, at most 10000)"},
+}
+
+const openAPIRecordDescription = "Resolver timeouts and failures are answered with status 504 and 502 respectively, with a RecordInfo describing the failure."
+
+var openAPIOperations = []openAPIOperation{
+	{path: "/prefix.json", id: "lookupPrefix", summary: "Look up the prefix of an address",
+		params:   []openAPIParam{{"addr", true, "IPv4 or IPv6 address"}, {"debug", false, "Include backend metadata if not empty"}},
+		response: "PrefixInfo"},
+	{path: "/prefixes.json", id: "lookupPrefixes", summary: "Look up the prefixes of many addresses",
+		body:     "JSON array of addresses, or one address per line",
+		response: "BulkPrefixResult", container: "array",
+		description: "With Accept: application/x-ndjson, results are streamed as newline-delimited JSON in order of completion."},
+	{path: "/address.json", id: "lookupAddress", summary: "Look up the addresses of a name",
+		params:      []openAPIParam{{"name", true, "Host name, or address for a PTR lookup"}, {"type", false, "Query type: ANY (default), A, AAAA, or PTR"}},
+		response:    "AddressInfo",
+		description: "Resolver timeouts and failures are answered with status 504 and 502 respectively, with an AddressInfo describing the failure."},
+	{path: "/mx.json", id: "lookupMX", summary: "Look up the mail exchangers of a name",
+		params:   []openAPIParam{{"name", true, "Host or domain name"}},
+		response: "RecordInfo", description: openAPIRecordDescription},
+	{path: "/ns.json", id: "lookupNS", summary: "Look up the name servers of a name",
+		params:   []openAPIParam{{"name", true, "Domain name"}},
+		response: "RecordInfo", description: openAPIRecordDescription},
+	{path: "/txt.json", id: "lookupTXT", summary: "Look up the texts of a name",
+		params:   []openAPIParam{{"name", true, "Host or domain name"}},
+		response: "RecordInfo", description: openAPIRecordDescription},
+	{path: "/verify.json", id: "verifyAddress", summary: "Verify the reverse DNS names of an address",
+		params:   []openAPIParam{{"addr", true, "IPv4 or IPv6 address"}},
+		response: "VerifyResult"},
+	{path: "/lookup.json", id: "lookup", summary: "Look up an address, name, or URL",
+		params:   []openAPIParam{{"q", true, "Address, host name, or URL"}},
+		response: "LookupResult"},
+	{path: "/stats.json", id: "stats", summary: "Report the statistics of both caches",
+		response: "CacheStats", container: "object"},
+	{path: "/cache/quality.json", id: "quality", summary: "Report the completeness and freshness of both caches",
+		response: "CacheQuality", container: "object"},
+	{path: "/cache/search.json", id: "search", summary: "Search the cached entries",
+		params:   append([]openAPIParam{{"q", true, "Space-separated asn:, country:, prefix:, or name: terms"}}, openAPIPageParams...),
+		response: "SearchResult", container: "page"},
+	{path: "/healthz", id: "health", summary: "Report whether the server is serving normally",
+		response: "HealthStatus"},
+}
+
+// openAPISchema returns the schema of a field type, or of the items of an
+// array or object, as given in the data dictionary.
+func openAPISchema(typename string, format string, items string, types map[string]bool) map[string]interface{} {
+	if types[typename] {
+		return map[string]interface{}{"$ref": "#/components/schemas/" + typename}
+	}
+	out := map[string]interface{}{"type": typename}
+	if len(format) > 0 {
+		out["format"] = format
+	}
+	switch typename {
+	case "array":
+		out["items"] = openAPISchema(items, "", "", types)
+	case "object":
+		if len(items) > 0 {
+			out["additionalProperties"] = openAPISchema(items, "", "", types)
+		}
+	}
+	return out
+}
+
+// OpenAPI returns an OpenAPI 3 document describing the public HTTP API.
+func OpenAPI() map[string]interface{} {
+	dictionary := DataDictionary()
+	types := make(map[string]bool)
+	for _, st := range dictionary {
+		types[st.Name] = true
+	}
+
+	schemas := make(map[string]interface{})
+	for _, st := range dictionary {
+		properties := make(map[string]interface{})
+		required := make([]string, 0)
+		for _, field := range st.Fields {
+			schema := openAPISchema(field.Type, field.Format, field.Items, types)
+			if len(field.Description) > 0 && schema["$ref"] == nil {
+				schema["description"] = field.Description
+			}
+			if field.Nullable {
+				schema["nullable"] = true
+			}
+			properties[field.Name] = schema
+			if !field.Optional {
+				required = append(required, field.Name)
+			}
+		}
+		schemas[st.Name] = map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		}
+	}
+	schemas["Error"] = map[string]interface{}{
+		"type":       "object",
+		"properties": map[string]interface{}{"Error": map[string]interface{}{"type": "string"}},
+	}
+
+	paths := make(map[string]interface{})
+	for _, op := range openAPIOperations {
+		params := make([]interface{}, 0, len(op.params))
+		for _, p := range op.params {
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          "query",
+				"required":    p.required,
+				"description": p.description,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		var schema interface{} = openAPISchema(op.response, "", "", types)
+		switch op.container {
+		case "array":
+			schema = map[string]interface{}{"type": "array", "items": schema}
+		case "object":
+			schema = map[string]interface{}{"type": "object", "additionalProperties": schema}
+		case "page":
+			schema = map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"Results":    map[string]interface{}{"type": "array", "items": schema},
+					"NextCursor": map[string]interface{}{"type": "string"},
+				},
+			}
+		}
+		operation := map[string]interface{}{
+			"operationId": op.id,
+			"summary":     op.summary,
+			"parameters":  params,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+				},
+				"400": map[string]interface{}{
+					"description": "Invalid request",
+					"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": openAPISchema("Error", "", "", map[string]bool{"Error": true})}},
+				},
+			},
+		}
+		if len(op.description) > 0 {
+			operation["description"] = op.description
+		}
+		if IsAdminPath(op.path) {
+			operation["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+			operation["responses"].(map[string]interface{})["401"] = map[string]interface{}{
+				"description": "Admin token required",
+			}
+		}
+		method := "get"
+		if len(op.body) > 0 {
+			method = "post"
+			operation["requestBody"] = map[string]interface{}{
+				"required":    true,
+				"description": op.body,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}},
+					"text/plain":       map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				},
+			}
+		}
+		paths[op.path] = map[string]interface{}{method: operation}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "canid",
+			"version": "1",
+			"description": "The caching additional network information daemon: prefix, AS, " +
+				"and location information for addresses, and addresses for names.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				// the -admin-token of administrative resources
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// OpenAPIServer returns the OpenAPI document describing the public HTTP API.
+func OpenAPIServer(w http.ResponseWriter, req *http.Request) {
+	openapi_body, _ := json.Marshal(OpenAPI())
+	w.Write(openapi_body)
+}
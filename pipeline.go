@@ -0,0 +1,129 @@
+package canid
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// lookupPipeline runs the miss path shared by all caches, in well-defined
+// stages: concurrent misses for the same key are deduplicated, then the
+// shared store is consulted, then the fetch waits for a backend slot, calls
+// the backend, and merges and caches the result. Concurrency limits,
+// cancellation, timings and counters are handled here, the same way for
+// every cache; the cache supplies the stages which differ.
+
+type lookupPipeline struct {
+	name      string
+	inflight  singleflight.Group
+	limiter   backendLimiter
+	stats     *cacheCounters
+	callbacks *CacheCallbacks
+}
+
+// lookupStages are the cache-specific stages of a lookup. shared and store
+// are optional.
+
+type lookupStages struct {
+	// shared returns the entry from the shared store, if there is one
+	shared func(ctx context.Context) (interface{}, bool)
+	// backend asks the backend; it is called holding a backend slot, which
+	// retries release while they wait
+	backend func(ctx context.Context) (interface{}, error)
+	// store merges a backend result into the cache, returning the entry to
+	// answer with
+	store func(ctx context.Context, result interface{}) (interface{}, error)
+}
+
+func newLookupPipeline(name string, limit int, stats *cacheCounters, callbacks *CacheCallbacks) *lookupPipeline {
+	p := new(lookupPipeline)
+	p.name = name
+	p.limiter = newBackendLimiter(limit)
+	p.stats = stats
+	p.callbacks = callbacks
+	return p
+}
+
+// fetch runs the stages for a key, sharing the result of any fetch already
+// in flight for the same key. It gives up and returns the context's error if
+// the context is done first.
+func (p *lookupPipeline) fetch(ctx context.Context, key string, stages lookupStages) (interface{}, error) {
+	for {
+		leader := false
+		ch := p.inflight.DoChan(key, func() (interface{}, error) {
+			leader = true
+			return p.run(ctx, key, stages)
+		})
+		select {
+		case res := <-ch:
+			if !leader {
+				p.stats.coalescedFetch()
+			}
+			// a shared fetch may have been cancelled by its original
+			// caller, or run out of its budget; if we're still interested
+			// and have budget left, try again
+			if res.Err != nil && !leader && ctx.Err() == nil &&
+				(errors.Is(res.Err, context.Canceled) || errors.Is(res.Err, context.DeadlineExceeded) ||
+					(errors.Is(res.Err, ErrBudgetExhausted) && !budgetExhausted(ctx))) {
+				continue
+			}
+			return res.Val, res.Err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// run runs the stages once for a query, without deduplication.
+func (p *lookupPipeline) run(ctx context.Context, query string, stages lookupStages) (interface{}, error) {
+	// another instance sharing the cache may already have it
+	if stages.shared != nil {
+		if shared, ok := stages.shared(ctx); ok {
+			return shared, nil
+		}
+	}
+
+	if !spendBudget(ctx) {
+		p.stats.budgetRefusal()
+		return nil, ErrBudgetExhausted
+	}
+
+	wait_start := time.Now()
+	slot := &backendSlot{limiter: p.limiter}
+	if err := slot.take(ctx); err != nil {
+		return nil, err
+	}
+	p.stats.timings.observe(TimingLimiterWait, wait_start)
+	backend_start := time.Now()
+	p.stats.backendCall()
+	result, err := stages.backend(withBackendSlot(withTimings(ctx, p.stats.timings), slot))
+	slot.release()
+	p.stats.timings.observe(TimingBackend, backend_start)
+	backend_latency := time.Since(backend_start)
+	if err != nil {
+		slog.Warn("backend lookup failed", "cache", p.name, "query", query, "backend_latency", backend_latency.Seconds(), "err", err)
+		p.stats.backendError()
+		p.callbacks.backendFailed(p.name, query, err)
+		return nil, err
+	}
+
+	slog.Debug("backend lookup", "cache", p.name, "query", query, "backend_latency", backend_latency.Seconds())
+
+	if stages.store == nil {
+		return result, nil
+	}
+	return stages.store(ctx, result)
+}
+
+// limited calls f holding a backend slot, for backend requests outside the
+// lookup path (e.g. self-tests), which must still respect the limit.
+func (p *lookupPipeline) limited(ctx context.Context, f func() error) error {
+	if err := p.limiter.acquire(ctx); err != nil {
+		return err
+	}
+	defer p.limiter.release()
+	return f()
+}
@@ -0,0 +1,44 @@
+package canid
+
+import (
+	"sort"
+	"strings"
+)
+
+// PolicyTags maps country codes to operator-defined groupings of countries
+// (e.g. EU, EEA, or a corporate region), so that consumers who make policy
+// decisions by region needn't maintain the mapping themselves.
+
+type PolicyTags struct {
+	byCountry map[string][]string
+}
+
+// NewPolicyTags creates policy tags from a map of tag names to the ISO 3166-1
+// alpha-2 country codes tagged with them. A country may have any number of
+// tags.
+func NewPolicyTags(groups map[string][]string) *PolicyTags {
+	tags := &PolicyTags{byCountry: make(map[string][]string)}
+	for tag, countries := range groups {
+		for _, cc := range countries {
+			cc = strings.ToUpper(strings.TrimSpace(cc))
+			tags.byCountry[cc] = append(tags.byCountry[cc], tag)
+		}
+	}
+	for _, countryTags := range tags.byCountry {
+		sort.Strings(countryTags)
+	}
+	return tags
+}
+
+// Tags returns the tags of a country, in alphabetical order, or nil if it has
+// none.
+func (tags *PolicyTags) Tags(cc string) []string {
+	return tags.byCountry[strings.ToUpper(cc)]
+}
+
+// Transform sets PolicyTags from CountryCode. Use it as a PrefixTransform.
+func (tags *PolicyTags) Transform(info *PrefixInfo) {
+	if countryTags := tags.Tags(info.CountryCode); len(countryTags) > 0 {
+		info.PolicyTags = append([]string(nil), countryTags...)
+	}
+}
@@ -1,11 +1,11 @@
 package canid
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 )
@@ -13,90 +13,383 @@ import (
 // Prefix information
 
 type PrefixInfo struct {
-	Prefix      string
-	ASN         int
-	CountryCode string
-	Cached      time.Time
+	Prefix      string        `source:"backend" doc:"Most specific announced prefix containing the address, in CIDR notation"`
+	ASN         int           `source:"backend" doc:"Origin AS number of the prefix, or 0 if unknown"`
+	ASName      string        `json:",omitempty" source:"asname" doc:"Name of the origin AS, e.g. GOOGLE"`
+	Holder      string        `json:",omitempty" source:"asname" doc:"Organization holding the origin AS"`
+	ASLabel     string        `json:",omitempty" source:"canid" doc:"Friendly label of the origin AS, e.g. Google, for well-known and operator-labelled ASes"`
+	RPKIStatus  string        `json:",omitempty" source:"rpki" doc:"RPKI route origin validation state of the prefix's announcement by its origin AS: valid, invalid, or not-found"`
+	CountryCode string        `source:"geoloc" doc:"ISO 3166-1 alpha-2 country code of the prefix's location, or the registry allocation's country for Team Cymru"`
+	PolicyTags  []string      `json:",omitempty" source:"canid" doc:"Operator-defined groupings (e.g. EU) containing CountryCode"`
+	Region      string        `json:",omitempty" source:"geoloc" doc:"Region (e.g. state or province) of the prefix's location"`
+	City        string        `json:",omitempty" source:"geoloc" doc:"City of the prefix's location"`
+	Latitude    *float64      `json:",omitempty" source:"geoloc" doc:"Latitude of the prefix's location, in decimal degrees"`
+	Longitude   *float64      `json:",omitempty" source:"geoloc" doc:"Longitude of the prefix's location, in decimal degrees"`
+	DistanceKm  *float64      `json:",omitempty" source:"canid" doc:"Great-circle distance from the configured vantage point to the prefix's location, in kilometres"`
+	Partial     bool          `json:",omitempty" source:"canid" doc:"True if some backend requests failed, so some fields are missing"`
+	Warnings    []string      `json:",omitempty" source:"canid" doc:"Reasons the result is partial"`
+	Reputation  []string      `json:",omitempty" source:"blocklist" doc:"Names of the blocklists listing the queried address"`
+	Special     string        `json:",omitempty" source:"canid" doc:"IANA special-purpose registry name of the block containing the address (e.g. Private-Use), if answered locally"`
+	Synthetic   bool          `json:",omitempty" source:"canid" doc:"True if the entry is a configured synthetic test entry, answered locally"`
+	Stale       bool          `json:",omitempty" source:"canid" doc:"True if the entry has expired, and is answered while it is looked up again in the background"`
+	Cached      time.Time     `source:"canid" doc:"Time the entry was fetched from the backend, in UTC"`
+	BackendMeta []BackendMeta `json:",omitempty" source:"backend" doc:"Metadata of the backend responses, only with the debug parameter"`
+}
+
+// Metadata about a backend response which contributed to a PrefixInfo, for
+// diagnosing discrepancies between canid and the backend.
+
+type BackendMeta struct {
+	DataCall       string `source:"backend" doc:"Name of the RIPEstat data call"`
+	DataCallStatus string `source:"backend" doc:"Status of the data call, e.g. supported or deprecated"`
+	Version        string `source:"backend" doc:"Version of the data call"`
+	QueryTime      string `source:"backend" doc:"Time the data call's data refers to"`
+	ServerID       string `source:"backend" doc:"Identifier of the RIPEstat server which answered"`
+	Cached         bool   `source:"backend" doc:"True if RIPEstat answered from its own cache"`
 }
 
 type PrefixCache struct {
-	Data            map[string]PrefixInfo
-	lock            sync.RWMutex
-	expiry          int
-	backend_limiter chan struct{}
+	Data       map[string]PrefixInfo
+	lock       sync.RWMutex
+	expiry     int
+	backend    PrefixBackend
+	pipeline   *lookupPipeline
+	clock      Clock
+	stats      cacheCounters
+	publishers publishers
+	callbacks  CacheCallbacks
+	capacity   int
+	eviction   EvictionPolicy
+	admission  AdmissionPolicy
+	vantage    *[2]float64
+	retries    retryQueue
+	index      prefixIndex
+	transforms []PrefixTransform
+	reputation *Reputation
+	shared     SharedStore
+	special    bool
+	synthetic  *prefixIndex
+	hits       *hitCounts
+	backfill   chan net.IP
+	stale      int
 }
 
-func NewPrefixCache(expiry int, concurrency_limit int) *PrefixCache {
+// NewPrefixCache creates a prefix cache which looks up missing entries using
+// the given backend.
+func NewPrefixCache(expiry int, concurrency_limit int, backend PrefixBackend) *PrefixCache {
 	c := new(PrefixCache)
+	c.backend = backend
+	c.clock = SystemClock{}
 	c.Data = make(map[string]PrefixInfo)
 	c.expiry = expiry
-	c.backend_limiter = make(chan struct{}, concurrency_limit)
+	c.stats = newCacheCounters(SystemClock{})
+	c.pipeline = newLookupPipeline("prefix", concurrency_limit, &c.stats, &c.callbacks)
 	return c
 }
 
 func (cache *PrefixCache) Lookup(addr net.IP) (out PrefixInfo, err error) {
-	// Determine starting prefix by guessing whether this is v6 or not
-	var prefixlen, addrbits int
-	if strings.Contains(addr.String(), ":") {
-		prefixlen = 48
-		addrbits = 128
-	} else {
-		prefixlen = 24
-		addrbits = 32
-	}
-
-	// Iterate through prefixes looking for a match
-	for i := prefixlen; i > 0; i-- {
-		mask := net.CIDRMask(i, addrbits)
-		net := net.IPNet{addr.Mask(mask), mask}
-		prefix := net.String()
-
-		cache.lock.RLock()
-		out, ok := cache.Data[prefix]
-		cache.lock.RUnlock()
-		if ok {
-			// check for expiry
-			if int(time.Since(out.Cached).Seconds()) > cache.expiry {
-				log.Printf("entry expired for prefix %s", prefix)
-				cache.lock.Lock()
-				delete(cache.Data, prefix)
-				cache.lock.Unlock()
-				break
-			} else {
-				log.Printf("cache hit! for prefix %s", prefix)
-				return out, nil
+	return cache.LookupContext(context.Background(), addr)
+}
+
+// LookupContext looks up an address, giving up and returning the context's
+// error if the context is done before the backend answers.
+func (cache *PrefixCache) LookupContext(ctx context.Context, addr net.IP) (out PrefixInfo, err error) {
+	// synthetic entries are answered as configured
+	if synthetic, ok := cache.syntheticPrefixInfo(addr); ok {
+		cache.stats.syntheticAnswer()
+		return synthetic, nil
+	}
+
+	// special-purpose addresses are never routed, so needn't be looked up
+	if cache.special {
+		if special, ok := specialPrefixInfo(addr, cache.now()); ok {
+			cache.stats.specialAnswer()
+			return special, nil
+		}
+	}
+
+	// Find the longest cached prefix containing the address
+	probe_start := time.Now()
+	cache.ensureIndex()
+	cache.lock.RLock()
+	prefix, ok := cache.findPrefix(addr)
+	if ok {
+		out, ok = cache.Data[prefix]
+	}
+	admission := cache.admission
+	cache.lock.RUnlock()
+	cache.stats.timings.observe(TimingCacheProbe, probe_start)
+	if ok {
+		if admission != nil {
+			admission.Record(prefix)
+		}
+		// check for expiry, keeping recently expired entries to answer
+		// while they are refreshed if serving stale entries
+		entry_age := age(cache.clock, out.Cached)
+		out.Stale = entry_age > cache.expiry && entry_age <= cache.expiry+cache.stale
+		if entry_age > cache.expiry && !out.Stale {
+			slog.Debug("entry expired", "cache", "prefix", "prefix", prefix)
+			cache.stats.expired()
+			cache.lock.Lock()
+			cache.remove(prefix)
+			cache.lock.Unlock()
+			cache.callbacks.expired("prefix", prefix, out)
+		} else {
+			slog.Debug("cache hit", "cache", "prefix", "addr", addr, "prefix", prefix, "cache_hit", true)
+			cache.stats.hit()
+			if cache.hits != nil {
+				cache.hits.record(prefix)
+			}
+			if cache.eviction != nil {
+				cache.eviction.Accessed(prefix)
+			}
+			if out.Stale {
+				cache.stats.staleAnswer()
+				cache.refreshStale(addr, prefix)
 			}
+			return out, nil
 		}
 	}
 
-	// Cache miss, go ask RIPE
-	cache.backend_limiter <- struct{}{}
-	out, err = LookupRipestat(addr)
-	_ = <-cache.backend_limiter
+	// Cache miss, go ask the backend, sharing any request already in flight
+	// for an address in the same block. The shared entry answers for this
+	// address too if its prefix covers it; otherwise, ask for ours alone.
+	slog.Debug("cache miss", "cache", "prefix", "addr", addr, "cache_hit", false)
+	cache.stats.miss()
+	fetched, err := cache.fetch(ctx, coalesceBlock(addr), addr)
+	if err == nil && !fetched.addr.Equal(addr) && !prefixCovers(fetched.info.Prefix, addr) {
+		fetched, err = cache.fetch(ctx, addr.String(), addr)
+	}
+	if err != nil {
+		return out, err
+	}
+	return fetched.info, nil
+}
+
+// prefixFetch is the entry fetched on a miss for an address, which misses
+// for other addresses sharing the fetch get as well.
+
+type prefixFetch struct {
+	addr net.IP
+	info PrefixInfo
+}
+
+// fetch looks up an address, sharing the fetch with concurrent misses under
+// the same key.
+func (cache *PrefixCache) fetch(ctx context.Context, key string, addr net.IP) (prefixFetch, error) {
+	res, err := cache.pipeline.fetch(ctx, key, lookupStages{
+		shared: func(ctx context.Context) (interface{}, bool) {
+			info, ok := cache.fetchShared(ctx, addr)
+			return prefixFetch{addr, info}, ok
+		},
+		backend: func(ctx context.Context) (interface{}, error) {
+			return cache.lookupBackend(ctx, addr)
+		},
+		store: func(ctx context.Context, result interface{}) (interface{}, error) {
+			return prefixFetch{addr, cache.storeFetched(addr, result.(PrefixInfo))}, nil
+		},
+	})
+	if err != nil {
+		return prefixFetch{}, err
+	}
+	return res.(prefixFetch), nil
+}
+
+// coalesceBlock returns the key under which misses for an address share a
+// fetch: its /24 or /48, the longest prefixes generally routed, so that
+// addresses in one block are almost always covered by the same prefix.
+func coalesceBlock(addr net.IP) string {
+	block := net.IPNet{IP: addr.To4(), Mask: net.CIDRMask(24, 32)}
+	if block.IP == nil {
+		block = net.IPNet{IP: addr.To16(), Mask: net.CIDRMask(48, 128)}
+	}
+	block.IP = block.IP.Mask(block.Mask)
+	return block.String()
+}
+
+// prefixCovers returns true if a prefix contains an address.
+func prefixCovers(prefix string, addr net.IP) bool {
+	pfx, ok := parsePrefixKey(prefix)
+	return ok && pfx.Contains(addr)
+}
+
+// lookupBackend asks the backend about an address, and fills in the origin
+// AS's name and the RPKI status of the announcement.
+func (cache *PrefixCache) lookupBackend(ctx context.Context, addr net.IP) (out PrefixInfo, err error) {
+	out, err = cache.backend.Lookup(ctx, addr)
 	if err != nil {
 		return
 	}
+	nameAS(ctx, &out)
+	validateRPKI(ctx, &out)
+	return
+}
 
-	// cache and return
-	out.Cached = time.Now().UTC()
+// storeFetched caches an entry fetched from the backend for an address,
+// returning the entry to answer with.
+func (cache *PrefixCache) storeFetched(addr net.IP, out PrefixInfo) PrefixInfo {
+	out.Cached = cache.now()
 	cache.lock.Lock()
-	cache.Data[out.Prefix] = out
+	// a concurrent miss for the same prefix may have beaten us to it; if so,
+	// keep its entry as the canonical one
+	if existing, ok := cache.Data[out.Prefix]; ok && age(cache.clock, existing.Cached) <= cache.expiry {
+		cache.lock.Unlock()
+		slog.Debug("duplicate fetch, keeping existing entry", "cache", "prefix", "prefix", out.Prefix)
+		cache.stats.duplicateFetch()
+		return existing
+	}
+	if cache.admission != nil {
+		cache.admission.Record(out.Prefix)
+	}
+	stored := cache.store(out.Prefix, out)
 	cache.lock.Unlock()
-	log.Printf("cached prefix %s -> %v", out.Prefix, out)
+	putShared(cache.shared, "prefix", out.Prefix, out, cache.expiry)
+	if !stored {
+		slog.Debug("not admitting entry", "cache", "prefix", "prefix", out.Prefix)
+		return out
+	}
+	slog.Debug("cached", "cache", "prefix", "prefix", out.Prefix, "asn", out.ASN, "country_code", out.CountryCode)
+	cache.publishers.publish("prefix", out.Prefix, out)
+	cache.callbacks.inserted("prefix", out.Prefix, out)
 
-	return
+	if incomplete(out) {
+		cache.scheduleRetry(addr, out.Prefix, 1)
+	}
+
+	return out
+}
+
+// replace replaces the entry for a prefix with a newly fetched one, which may
+// be for a different prefix.
+func (cache *PrefixCache) replace(prefix string, out PrefixInfo) {
+	out.Cached = cache.now()
+	cache.lock.Lock()
+	if _, ok := cache.Data[prefix]; ok && out.Prefix != prefix {
+		cache.remove(prefix)
+	}
+	stored := cache.store(out.Prefix, out)
+	cache.lock.Unlock()
+	putShared(cache.shared, "prefix", out.Prefix, out, cache.expiry)
+	if stored {
+		slog.Debug("replaced", "cache", "prefix", "prefix", out.Prefix, "asn", out.ASN, "country_code", out.CountryCode)
+		cache.publishers.publish("prefix", out.Prefix, out)
+		cache.callbacks.inserted("prefix", out.Prefix, out)
+	}
+}
+
+// store adds an entry to the cache, evicting entries as necessary to stay
+// within capacity. If the cache is full and the admission policy prefers the
+// entry that would be evicted, the new entry is not stored, and store returns
+// false. The caller must hold the write lock.
+func (cache *PrefixCache) store(key string, info PrefixInfo) bool {
+	_, exists := cache.Data[key]
+	if !exists && cache.eviction != nil && cache.admission != nil && len(cache.Data) >= cache.capacity {
+		if victim, ok := cache.eviction.Victim(); ok && !cache.admission.Admit(key, victim) {
+			cache.stats.rejected()
+			return false
+		}
+	}
+
+	cache.Data[key] = info
+	if !exists {
+		cache.indexPrefix(key)
+	}
+	if cache.eviction != nil {
+		if !exists {
+			cache.eviction.Added(key)
+		}
+		cache.evict()
+	}
+	return true
+}
+
+// remove deletes an entry from the cache. The caller must hold the write lock.
+func (cache *PrefixCache) remove(key string) {
+	if _, ok := cache.Data[key]; ok {
+		cache.unindexPrefix(key)
+	}
+	delete(cache.Data, key)
+	if cache.eviction != nil {
+		cache.eviction.Removed(key)
+	}
+}
+
+// evict removes entries chosen by the eviction policy until the cache is
+// within capacity. The caller must hold the write lock.
+func (cache *PrefixCache) evict() {
+	for len(cache.Data) > cache.capacity {
+		key, ok := cache.eviction.Victim()
+		if !ok {
+			break
+		}
+		slog.Debug("evicting", "cache", "prefix", "prefix", key)
+		entry := cache.Data[key]
+		cache.remove(key)
+		cache.stats.evicted()
+		cache.callbacks.evicted("prefix", key, entry)
+	}
+}
+
+// SetEviction limits the cache to the given number of entries, evicting
+// entries chosen by the given policy when it is full. Entries already in the
+// cache (e.g. loaded from a backing store) are registered with the policy,
+// and evicted if over capacity. A capacity of 0 removes the limit.
+func (cache *PrefixCache) SetEviction(capacity int, policy EvictionPolicy) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if capacity <= 0 {
+		cache.capacity = 0
+		cache.eviction = nil
+		cache.admission = nil
+		return
+	}
+	cache.capacity = capacity
+	cache.eviction = policy
+	cached := make(map[string]time.Time, len(cache.Data))
+	for key, info := range cache.Data {
+		cached[key] = info.Cached
+	}
+	registerEntries(policy, cached)
+	cache.evict()
+}
+
+// SetAdmission filters new entries through the given admission policy when
+// the cache is at capacity; see AdmissionPolicy. It has no effect unless a
+// capacity has been set with SetEviction. A nil policy admits every entry.
+func (cache *PrefixCache) SetAdmission(policy AdmissionPolicy) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.admission = policy
+}
+
+// SetVantage sets the location of the vantage point, in decimal degrees, from
+// which LookupServer computes DistanceKm. It must be called before the cache
+// is used.
+func (cache *PrefixCache) SetVantage(lat float64, lon float64) {
+	cache.vantage = &[2]float64{lat, lon}
+}
+
+// SetSpecialAddresses arranges for lookups of addresses in special-purpose
+// blocks (private, loopback, documentation, etc.) to be answered locally with
+// the block and its name in Special, without asking the backend or caching
+// them. It must be called before the cache is used.
+func (cache *PrefixCache) SetSpecialAddresses(enabled bool) {
+	cache.special = enabled
 }
 
 func (cache *PrefixCache) LookupServer(w http.ResponseWriter, req *http.Request) {
 
-	ip := net.ParseIP(req.URL.Query().Get("addr"))
+	ip := ParseAddress(req.URL.Query().Get("addr"))
 	if ip == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	prefix_info, err := cache.Lookup(ip)
-	if err != nil {
+	prefix_info, err := cache.LookupContext(req.Context(), ip)
+	if req.Context().Err() != nil {
+		// client went away, nobody to answer
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError) // FIXME not always a 500
 		error_struct := struct{ Error string }{err.Error()}
 		error_body, _ := json.Marshal(error_struct)
@@ -104,6 +397,106 @@ func (cache *PrefixCache) LookupServer(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	// distance depends on the vantage point, so is never cached
+	if cache.vantage != nil {
+		if distance, ok := prefix_info.DistanceFrom(cache.vantage[0], cache.vantage[1]); ok {
+			prefix_info.DistanceKm = &distance
+		}
+	}
+
+	// only return backend metadata when debugging
+	if len(req.URL.Query().Get("debug")) == 0 {
+		prefix_info.BackendMeta = nil
+	}
+
+	cache.annotate(req.Context(), ip, &prefix_info)
+	cache.transform(&prefix_info)
 	prefix_body, _ := json.Marshal(prefix_info)
-	w.Write(prefix_body)
+	writeCacheable(w, req, prefix_body, cache.ttl(prefix_info))
+
+	cache.backfillPTR(ip)
+}
+
+// AddPublisher arranges for every new entry in the cache to be passed to the
+// given publisher. It must be called before the cache is used.
+func (cache *PrefixCache) AddPublisher(publisher Publisher) {
+	cache.publishers = append(cache.publishers, publisher)
+}
+
+// SetClock replaces the clock used to timestamp and expire entries, and to
+// time statistics. It must be called before the cache is used.
+func (cache *PrefixCache) SetClock(clock Clock) {
+	cache.clock = clock
+	cache.stats.since = clock.Now().UTC()
+}
+
+// Clock returns the clock used to timestamp and expire entries.
+func (cache *PrefixCache) Clock() Clock {
+	return cache.clock
+}
+
+// now returns the current time according to the cache's clock, in UTC, for
+// timestamping entries.
+func (cache *PrefixCache) now() time.Time {
+	return cache.clock.Now().UTC()
+}
+
+// ttl returns the number of seconds until an entry expires, or 0 if it
+// already has.
+func (cache *PrefixCache) ttl(info PrefixInfo) int {
+	if ttl := cache.expiry - age(cache.clock, info.Cached); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// Stats returns a snapshot of the prefix cache's size and activity.
+func (cache *PrefixCache) Stats() CacheStats {
+	cache.lock.RLock()
+	entries := len(cache.Data)
+	cache.lock.RUnlock()
+	return cache.stats.snapshot("prefix", entries)
+}
+
+// MarshalJSON encodes the cache's entries while holding its lock, so the
+// cache can be dumped while it is in use.
+func (cache *PrefixCache) MarshalJSON() ([]byte, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return json.Marshal(struct {
+		Data map[string]PrefixInfo
+	}{cache.Data})
+}
+
+// Flush removes all entries from the prefix cache, as Purge, and from its
+// shared store and publishers keeping entries, returning the number of
+// entries removed from the cache.
+func (cache *PrefixCache) Flush() int {
+	n := cache.Purge()
+	forget(cache.shared, cache.publishers, "prefix", nil)
+	return n
+}
+
+// Purge removes all entries from the prefix cache, returning the number of
+// entries removed. The shared store and publishers are not affected.
+func (cache *PrefixCache) Purge() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	n := len(cache.Data)
+	if cache.eviction != nil {
+		for key := range cache.Data {
+			cache.eviction.Removed(key)
+		}
+	}
+	cache.Data = make(map[string]PrefixInfo)
+	cache.index = prefixIndex{}
+	return n
+}
+
+func (cache *PrefixCache) StatsServer(w http.ResponseWriter, req *http.Request) {
+	writeStats(w, cache.Stats())
+}
+
+func (cache *PrefixCache) PurgeServer(w http.ResponseWriter, req *http.Request) {
+	purgeServer(w, req, "prefix", cache.Flush)
 }
@@ -0,0 +1,86 @@
+package canid
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrefixCacheCoalescing(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var calls []string
+	cache := NewPrefixCache(3600, 4, backendFunc(func(ctx context.Context, addr net.IP) (PrefixInfo, error) {
+		lock.Lock()
+		calls = append(calls, addr.String())
+		first := len(calls) == 1
+		lock.Unlock()
+		if first {
+			close(started)
+			<-release
+		}
+		// the /24 is split into two /25s with different origins
+		if addr.To4()[3] < 128 {
+			return PrefixInfo{Prefix: "192.0.2.0/25", ASN: 64496}, nil
+		}
+		return PrefixInfo{Prefix: "192.0.2.128/25", ASN: 64497}, nil
+	}))
+	defer cache.Close()
+	cache.SetClock(newFakeClock())
+
+	addrs := []string{"192.0.2.1", "192.0.2.2", "192.0.2.200"}
+	results := make([]PrefixInfo, len(addrs))
+	var wg sync.WaitGroup
+	lookup := func(i int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			info, err := cache.Lookup(testAddr(t, addrs[i]))
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = info
+		}()
+	}
+	lookup(0)
+	<-started
+	lookup(1)
+	lookup(2)
+	// let the other misses join the fetch in flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// 192.0.2.2 is covered by the shared entry, 192.0.2.200 isn't, so is
+	// looked up on its own
+	if len(calls) != 2 || calls[1] != "192.0.2.200" {
+		t.Errorf("backend called for %v, want 192.0.2.1 and 192.0.2.200", calls)
+	}
+	want := []string{"192.0.2.0/25", "192.0.2.0/25", "192.0.2.128/25"}
+	for i, info := range results {
+		if info.Prefix != want[i] {
+			t.Errorf("%s: answered %s, want %s", addrs[i], info.Prefix, want[i])
+		}
+	}
+	if stats := cache.Stats(); stats.CoalescedFetches != 2 {
+		t.Errorf("%d coalesced fetches, want 2", stats.CoalescedFetches)
+	}
+}
+
+func TestCoalesceBlock(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":         "192.0.2.0/24",
+		"192.0.2.255":       "192.0.2.0/24",
+		"::ffff:192.0.2.1":  "192.0.2.0/24",
+		"2001:db8:1:2::1":   "2001:db8:1::/48",
+		"2001:db8:1:ffff::": "2001:db8:1::/48",
+	}
+	for addr, want := range tests {
+		if block := coalesceBlock(net.ParseIP(addr)); block != want {
+			t.Errorf("%s: block %s, want %s", addr, block, want)
+		}
+	}
+}
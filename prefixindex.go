@@ -0,0 +1,100 @@
+package canid
+
+import "net"
+
+// prefixIndex holds a trie per address family mapping cached prefixes to
+// their keys in the cache data, for longest-prefix matching. The index is
+// built from the cache data on first use, since the data may have been
+// loaded from a backing store.
+
+type prefixIndex struct {
+	valid bool
+	v4    *Trie
+	v6    *Trie
+}
+
+// trieFor returns the trie for an address or prefix, and the address in the
+// form that trie is keyed on (4 bytes for IPv4, 16 for IPv6).
+func (index *prefixIndex) trieFor(addr net.IP) (*Trie, net.IP) {
+	if addr4 := addr.To4(); addr4 != nil {
+		return index.v4, addr4
+	}
+	return index.v6, addr.To16()
+}
+
+// trieForPrefix returns the trie for a prefix, and the prefix in the form
+// that trie is keyed on. The address family is that of the mask, not the
+// address, since IPv6 prefixes within ::ffff:0:0/96 have addresses which
+// look like IPv4 ones, but IPv6 prefix lengths.
+func (index *prefixIndex) trieForPrefix(pfx net.IPNet) (*Trie, net.IPNet) {
+	if len(pfx.Mask) == net.IPv4len {
+		return index.v4, net.IPNet{IP: pfx.IP.To4(), Mask: pfx.Mask}
+	}
+	return index.v6, net.IPNet{IP: pfx.IP.To16(), Mask: pfx.Mask}
+}
+
+// parsePrefixKey parses a cache key as a prefix, normalizing IPv4 prefixes
+// to 4-byte form.
+func parsePrefixKey(key string) (net.IPNet, bool) {
+	_, ipnet, err := net.ParseCIDR(key)
+	if err != nil {
+		return net.IPNet{}, false
+	}
+	return *ipnet, true
+}
+
+// indexPrefix adds a key to the index. The caller must hold the write lock.
+func (cache *PrefixCache) indexPrefix(key string) {
+	if !cache.index.valid {
+		return
+	}
+	if pfx, ok := parsePrefixKey(key); ok {
+		trie, pfx := cache.index.trieForPrefix(pfx)
+		trie.Add(pfx, key)
+	}
+}
+
+// unindexPrefix removes a key from the index. The caller must hold the write
+// lock.
+func (cache *PrefixCache) unindexPrefix(key string) {
+	if !cache.index.valid {
+		return
+	}
+	if pfx, ok := parsePrefixKey(key); ok {
+		trie, pfx := cache.index.trieForPrefix(pfx)
+		trie.Remove(pfx)
+	}
+}
+
+// ensureIndex builds the index from the cache data if necessary.
+func (cache *PrefixCache) ensureIndex() {
+	cache.lock.RLock()
+	valid := cache.index.valid
+	cache.lock.RUnlock()
+	if valid {
+		return
+	}
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if !cache.index.valid {
+		cache.index = prefixIndex{valid: true, v4: new(Trie), v6: new(Trie)}
+		for key := range cache.Data {
+			cache.indexPrefix(key)
+		}
+	}
+}
+
+// findPrefix returns the key of the longest cached prefix containing an
+// address. The caller must hold the read lock, and have called ensureIndex.
+func (cache *PrefixCache) findPrefix(addr net.IP) (string, bool) {
+	trie, ip := cache.index.trieFor(addr)
+	if ip == nil {
+		return "", false
+	}
+	_, data, ok := trie.Find(ip)
+	if !ok {
+		return "", false
+	}
+	return data.(string), true
+}
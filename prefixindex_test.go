@@ -0,0 +1,84 @@
+package canid
+
+import (
+	"net"
+	"testing"
+)
+
+// testFindPrefix returns the key of the longest cached prefix containing an
+// address, as a lookup would find it.
+func testFindPrefix(t *testing.T, cache *PrefixCache, addr string) string {
+	t.Helper()
+	cache.ensureIndex()
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	key, _ := cache.findPrefix(testAddr(t, addr))
+	return key
+}
+
+func TestPrefixIndexFamilies(t *testing.T) {
+	prefixes := []string{
+		"192.0.2.0/24",
+		"2001:db8:100::/56",
+		"2001:db8::/32",
+		// an IPv6 prefix within ::ffff:0:0/96, whose address looks like
+		// IPv4 but whose mask is an IPv6 one
+		"::ffff:198.51.100.0/120",
+	}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.0/24"},
+		{"::ffff:192.0.2.1", "192.0.2.0/24"},
+		{"2001:db8:100:ff::1", "2001:db8:100::/56"},
+		{"2001:db8:101::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		// addresses in ::ffff:0:0/96 are looked up as IPv4, so the IPv6
+		// prefix doesn't shadow or answer for them
+		{"198.51.100.1", ""},
+	}
+
+	// indexed when the index is built from loaded data, and when stored
+	// into an already built index
+	loaded := NewPrefixCache(3600, 1, nil)
+	stored := NewPrefixCache(3600, 1, nil)
+	stored.ensureIndex()
+	for _, key := range prefixes {
+		loaded.Data[key] = PrefixInfo{Prefix: key}
+		stored.lock.Lock()
+		stored.store(key, PrefixInfo{Prefix: key})
+		stored.lock.Unlock()
+	}
+
+	for name, cache := range map[string]*PrefixCache{"loaded": loaded, "stored": stored} {
+		t.Run(name, func(t *testing.T) {
+			for _, test := range tests {
+				if got := testFindPrefix(t, cache, test.addr); got != test.want {
+					t.Errorf("%s: found %q, want %q", test.addr, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefixIndexRemove(t *testing.T) {
+	cache := NewPrefixCache(3600, 1, nil)
+	for _, key := range []string{"2001:db8::/32", "2001:db8:100::/56", "::ffff:198.51.100.0/120"} {
+		cache.Data[key] = PrefixInfo{Prefix: key}
+	}
+	cache.ensureIndex()
+
+	if n := cache.Remove("2001:db8:100::/56", "::ffff:198.51.100.0/120"); n != 2 {
+		t.Errorf("removed %d entries, want 2", n)
+	}
+	if got := testFindPrefix(t, cache, "2001:db8:100::1"); got != "2001:db8::/32" {
+		t.Errorf("found %q after removing the /56, want 2001:db8::/32", got)
+	}
+	if _, data, ok := cache.index.v6.Find(net.ParseIP("::ffff:198.51.100.1").To16()); ok {
+		t.Errorf("found %v in the IPv6 trie after removing it", data)
+	}
+	if cache.index.v4.sub[0] != nil || cache.index.v4.sub[1] != nil {
+		t.Error("IPv4 trie not empty")
+	}
+}
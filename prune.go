@@ -0,0 +1,89 @@
+package canid
+
+import (
+	"net"
+	"time"
+)
+
+// PrunePolicy selects cache entries to remove with Prune.
+
+type PrunePolicy struct {
+	// Remove entries cached longer ago than this, if positive
+	OlderThan time.Duration
+	// Remove entries for special-purpose (private, loopback, documentation)
+	// addresses: prefix entries for special-purpose prefixes, and address
+	// entries whose addresses, or PTR query address, are all special-purpose
+	DropPrivate bool
+	// Remove entries with no information: prefix entries with neither an
+	// origin AS nor a country code, and address entries with neither
+	// addresses nor names
+	DropEmpty bool
+}
+
+// older returns true if an entry cached at the given time is older than the
+// policy allows.
+func (policy PrunePolicy) older(now time.Time, cached time.Time) bool {
+	return policy.OlderThan > 0 && now.Sub(cached) > policy.OlderThan
+}
+
+// allSpecial returns true if there are addresses, and all of them are
+// special-purpose.
+func allSpecial(addrs []net.IP) bool {
+	for _, addr := range addrs {
+		if _, _, ok := SpecialPurpose(addr); !ok {
+			return false
+		}
+	}
+	return len(addrs) > 0
+}
+
+// Prune removes the prefix cache entries selected by the policy, returning
+// the number of entries removed.
+func (cache *PrefixCache) Prune(policy PrunePolicy) int {
+	now := cache.now()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	n := 0
+	for key, info := range cache.Data {
+		drop := policy.older(now, info.Cached)
+		if policy.DropPrivate {
+			pfx, ok := parsePrefixKey(key)
+			drop = drop || len(info.Special) > 0 || (ok && allSpecial([]net.IP{pfx.IP}))
+		}
+		if policy.DropEmpty && info.ASN == 0 && info.CountryCode == "" {
+			drop = true
+		}
+		if drop {
+			cache.remove(key)
+			n++
+		}
+	}
+	return n
+}
+
+// Prune removes the address cache entries selected by the policy, returning
+// the number of entries removed.
+func (cache *AddressCache) Prune(policy PrunePolicy) int {
+	now := cache.now()
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	n := 0
+	for key, info := range cache.Data {
+		drop := policy.older(now, info.Cached)
+		if policy.DropPrivate {
+			if info.Type == QueryTypePTR {
+				drop = drop || allSpecial([]net.IP{net.ParseIP(info.Name)})
+			} else {
+				drop = drop || allSpecial(info.Addresses)
+			}
+		}
+		if policy.DropEmpty && len(info.Addresses) == 0 && len(info.Names) == 0 {
+			drop = true
+		}
+		if drop {
+			cache.remove(key)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,45 @@
+package canid
+
+// CacheEvent describes an entry newly added to, refreshed in, or removed from
+// a cache.
+
+type CacheEvent struct {
+	Cache string
+	Key   string
+	Entry interface{}
+}
+
+// Publisher receives an event for every entry added to a cache. Publish is
+// called synchronously on the lookup path, so implementations which do I/O
+// should not block.
+
+type Publisher interface {
+	Publish(event CacheEvent)
+}
+
+// Deleter is a Publisher keeping the entries published to it, such as a
+// backing store written through, which can remove them again. Delete is
+// called when entries are removed from a cache on request (not when they
+// expire or are evicted), with every entry of the cache removed if keys is
+// nil.
+
+type Deleter interface {
+	Publisher
+	Delete(cache string, keys []string)
+}
+
+type publishers []Publisher
+
+func (p publishers) publish(cache string, key string, entry interface{}) {
+	for _, publisher := range p {
+		publisher.Publish(CacheEvent{cache, key, entry})
+	}
+}
+
+func (p publishers) delete(cache string, keys []string) {
+	for _, publisher := range p {
+		if deleter, ok := publisher.(Deleter); ok {
+			deleter.Delete(cache, keys)
+		}
+	}
+}
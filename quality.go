@@ -0,0 +1,132 @@
+package canid
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// CacheQuality summarizes the completeness and freshness of a cache's
+// entries, for operators to alert on.
+
+type CacheQuality struct {
+	Cache            string   `source:"canid" doc:"Cache name: prefix or address"`
+	Entries          int      `source:"canid" doc:"Number of entries currently cached"`
+	Score            float64  `source:"canid" doc:"Fraction of entries which are both complete and fresh; 1 for an empty cache"`
+	MissingASN       *float64 `json:",omitempty" source:"canid" doc:"Fraction of prefix entries without an origin AS"`
+	MissingCountry   *float64 `json:",omitempty" source:"canid" doc:"Fraction of prefix entries without a country code"`
+	Failed           *float64 `json:",omitempty" source:"canid" doc:"Fraction of address entries for failed lookups"`
+	Stale            float64  `source:"canid" doc:"Fraction of entries past their expiry, which will be looked up again when next used"`
+	MedianAgeSeconds float64  `source:"canid" doc:"Median time since entries were fetched, in seconds"`
+}
+
+// qualityCounts accumulates entries for a CacheQuality.
+
+type qualityCounts struct {
+	entries  int
+	stale    int
+	unusable int
+	ages     []float64
+}
+
+// add counts an entry of the given age, which is complete unless it has any
+// of the given faults.
+func (q *qualityCounts) add(age float64, stale bool, faults ...bool) {
+	q.entries++
+	q.ages = append(q.ages, age)
+	incomplete := false
+	for _, fault := range faults {
+		incomplete = incomplete || fault
+	}
+	if stale {
+		q.stale++
+	}
+	if incomplete || stale {
+		q.unusable++
+	}
+}
+
+func (q *qualityCounts) fraction(n int) float64 {
+	if q.entries == 0 {
+		return 0
+	}
+	return float64(n) / float64(q.entries)
+}
+
+func (q *qualityCounts) quality(name string) CacheQuality {
+	out := CacheQuality{Cache: name, Entries: q.entries, Score: 1}
+	if q.entries == 0 {
+		return out
+	}
+	out.Score = 1 - q.fraction(q.unusable)
+	out.Stale = q.fraction(q.stale)
+	sort.Float64s(q.ages)
+	if n := len(q.ages); n%2 == 1 {
+		out.MedianAgeSeconds = q.ages[n/2]
+	} else {
+		out.MedianAgeSeconds = (q.ages[n/2-1] + q.ages[n/2]) / 2
+	}
+	return out
+}
+
+// Quality returns the completeness and freshness of the prefix cache's
+// entries. An entry is complete if it has an origin AS and a country code.
+func (cache *PrefixCache) Quality() CacheQuality {
+	var q qualityCounts
+	var noasn, nocountry int
+	cache.lock.RLock()
+	for _, info := range cache.Data {
+		entry_age := age(cache.clock, info.Cached)
+		q.add(float64(entry_age), entry_age > cache.expiry, info.ASN == 0, info.CountryCode == "")
+		if info.ASN == 0 {
+			noasn++
+		}
+		if info.CountryCode == "" {
+			nocountry++
+		}
+	}
+	cache.lock.RUnlock()
+
+	out := q.quality("prefix")
+	missing_asn, missing_country := q.fraction(noasn), q.fraction(nocountry)
+	out.MissingASN, out.MissingCountry = &missing_asn, &missing_country
+	return out
+}
+
+// Quality returns the completeness and freshness of the address cache's
+// entries. An entry is complete unless it is for a failed lookup.
+func (cache *AddressCache) Quality() CacheQuality {
+	var q qualityCounts
+	var failed int
+	cache.lock.RLock()
+	for _, info := range cache.Data {
+		entry_age := age(cache.clock, info.Cached)
+		q.add(float64(entry_age), entry_age > cache.entryExpiry(info), info.Error != "")
+		if info.Error != "" {
+			failed++
+		}
+	}
+	cache.lock.RUnlock()
+
+	out := q.quality("address")
+	failed_fraction := q.fraction(failed)
+	out.Failed = &failed_fraction
+	return out
+}
+
+// QualityServer returns an HTTP handler reporting the quality of both
+// caches, as a JSON object with a CacheQuality object per cache. Either cache
+// may be nil.
+func QualityServer(prefixes *PrefixCache, addresses *AddressCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		out := make(map[string]CacheQuality)
+		if prefixes != nil {
+			out["prefix"] = prefixes.Quality()
+		}
+		if addresses != nil {
+			out["address"] = addresses.Quality()
+		}
+		quality_body, _ := json.Marshal(out)
+		w.Write(quality_body)
+	}
+}
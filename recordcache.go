@@ -0,0 +1,462 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query types supported by record caches
+const (
+	QueryTypeMX  = "MX"
+	QueryTypeNS  = "NS"
+	QueryTypeTXT = "TXT"
+)
+
+// MXRecord is a mail exchanger of a name.
+
+type MXRecord struct {
+	Host string `source:"dns" doc:"Name of the mail exchanger, without a trailing dot"`
+	Pref uint16 `source:"dns" doc:"Preference of the mail exchanger; lower is preferred"`
+}
+
+// RecordInfo is an entry in a record cache: the records of one type for a
+// name. Only the field for the cache's type is set.
+
+type RecordInfo struct {
+	Name     string     `source:"canid" doc:"Name looked up, lowercased without a trailing dot"`
+	Type     string     `source:"canid" doc:"Record type: MX, NS, or TXT"`
+	Resolver string     `source:"canid" doc:"Resolver used for the lookup"`
+	MX       []MXRecord `json:",omitempty" source:"dns" doc:"Mail exchangers of the name, in order of preference, for MX lookups"`
+	NS       []string   `json:",omitempty" source:"dns" doc:"Name servers of the name, in ascending order, for NS lookups"`
+	TXT      []string   `json:",omitempty" source:"dns" doc:"Texts of the name, each record's strings concatenated, in ascending order, for TXT lookups"`
+	Error    string     `json:",omitempty" source:"canid" doc:"Class of lookup failure: NXDOMAIN, TIMEOUT, or SERVFAIL"`
+	TTL      int        `json:",omitempty" source:"dns" doc:"Lowest TTL of the records of the answer, or negative TTL of a nonexistent name, in seconds, if the resolver gave one; the entry expires after it, unless the cache expiry is shorter"`
+	Cached   time.Time  `source:"canid" doc:"Time the entry was looked up, in UTC"`
+}
+
+// RecordCache caches DNS records of one type (MX, NS, or TXT) by name, for
+// clients using canid as a general source of DNS metadata. It works like the
+// address cache, but without precaching or annotation: entries are keyed by
+// name and resolver, expire with the TTLs of their records where known,
+// negative answers are cached the same way, and the cache may be limited in
+// size with an eviction and admission policy.
+
+type RecordCache struct {
+	Data       map[string]RecordInfo
+	lock       sync.RWMutex
+	qtype      string
+	name       string
+	expiry     int
+	pipeline   *lookupPipeline
+	clock      Clock
+	stats      cacheCounters
+	publishers publishers
+	capacity   int
+	eviction   EvictionPolicy
+	admission  AdmissionPolicy
+	resolver   *DNSResolver
+}
+
+// NewRecordCache creates a cache for records of the given type, named for
+// the type in lowercase in statistics and logs.
+func NewRecordCache(qtype string, expiry int, concurrency_limit int) (*RecordCache, error) {
+	qtype = strings.ToUpper(qtype)
+	switch qtype {
+	case QueryTypeMX, QueryTypeNS, QueryTypeTXT:
+	default:
+		return nil, fmt.Errorf("unsupported record type %s", qtype)
+	}
+	c := new(RecordCache)
+	c.Data = make(map[string]RecordInfo)
+	c.qtype = qtype
+	c.name = strings.ToLower(qtype)
+	c.expiry = expiry
+	c.stats = newCacheCounters(SystemClock{})
+	c.pipeline = newLookupPipeline(c.name, concurrency_limit, &c.stats, new(CacheCallbacks))
+	c.clock = SystemClock{}
+	c.resolver = &DNSResolver{Name: SystemResolver, Resolver: net.DefaultResolver}
+	return c, nil
+}
+
+// Type returns the record type of the cache.
+func (cache *RecordCache) Type() string {
+	return cache.qtype
+}
+
+// Name returns the name of the cache in statistics and logs: its record type
+// in lowercase.
+func (cache *RecordCache) Name() string {
+	return cache.name
+}
+
+// SetResolver replaces the host's default resolver with the given one for
+// all lookups. It must be called before the cache is used.
+func (cache *RecordCache) SetResolver(resolver *DNSResolver) {
+	cache.resolver = resolver
+}
+
+// SetClock replaces the clock used to timestamp and expire entries, and to
+// time statistics. It must be called before the cache is used.
+func (cache *RecordCache) SetClock(clock Clock) {
+	cache.clock = clock
+	cache.stats.since = clock.Now().UTC()
+}
+
+// Clock returns the clock used to timestamp and expire entries.
+func (cache *RecordCache) Clock() Clock {
+	return cache.clock
+}
+
+// Lookup looks up the records of the cache's type for a name.
+func (cache *RecordCache) Lookup(name string) (out RecordInfo) {
+	out, _ = cache.LookupContext(context.Background(), name)
+	return
+}
+
+// LookupContext looks up the records of the cache's type for a name,
+// returning the context's error if the context is done before the resolver
+// answers.
+func (cache *RecordCache) LookupContext(ctx context.Context, name string) (out RecordInfo, err error) {
+	key := NewAddressKey(name, cache.qtype, cache.resolver.Name)
+
+	var ok bool
+	probe_start := time.Now()
+	cache.lock.RLock()
+	out, ok = cache.Data[key.String()]
+	if cache.admission != nil {
+		cache.admission.Record(key.String())
+	}
+	cache.lock.RUnlock()
+	cache.stats.timings.observe(TimingCacheProbe, probe_start)
+	if ok {
+		if age(cache.clock, out.Cached) > cache.entryExpiry(out) {
+			slog.Debug("entry expired", "cache", cache.name, "name", key.String())
+			cache.stats.expired()
+			cache.lock.Lock()
+			cache.remove(key.String())
+			cache.lock.Unlock()
+		} else {
+			slog.Debug("cache hit", "cache", cache.name, "name", key.String(), "cache_hit", true)
+			cache.stats.hit()
+			if cache.eviction != nil {
+				cache.eviction.Accessed(key.String())
+			}
+			return
+		}
+	}
+
+	slog.Debug("cache miss", "cache", cache.name, "name", key.String(), "cache_hit", false)
+	cache.stats.miss()
+	res, err := cache.pipeline.fetch(ctx, key.String(), lookupStages{
+		backend: func(ctx context.Context) (interface{}, error) {
+			return cache.resolve(ctx, key)
+		},
+		store: func(ctx context.Context, result interface{}) (interface{}, error) {
+			return cache.storeFetched(key.String(), result.(RecordInfo)), nil
+		},
+	})
+	if err != nil {
+		return out, err
+	}
+	return res.(RecordInfo), nil
+}
+
+// resolve asks the resolver about a key. Resolver failures are classified in
+// Error rather than returned; it returns an error only if the context is done.
+func (cache *RecordCache) resolve(ctx context.Context, key AddressKey) (out RecordInfo, err error) {
+	out.Name = key.Name
+	out.Type = key.Type
+	out.Resolver = key.Resolver
+	var answer dnsAnswer
+	var lerr error
+	lookup_ctx := ctx
+	if cache.resolver.Timeout > 0 {
+		var cancel context.CancelFunc
+		lookup_ctx, cancel = context.WithTimeout(ctx, cache.resolver.Timeout)
+		defer cancel()
+	}
+	if cache.resolver.dial != nil {
+		// direct queries, which give TTLs
+		answer, lerr = cache.resolver.lookup(lookup_ctx, key.Type, key.Name)
+		out.TTL = answer.ttl
+	} else {
+		answer, lerr = cache.resolver.lookupRecords(lookup_ctx, key.Type, key.Name)
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if lerr != nil {
+		out.Error = classifyDNSError(lerr)
+		slog.Debug("resolution failed", "name", key.String(), "error", out.Error, "err", lerr)
+		return
+	}
+
+	switch key.Type {
+	case QueryTypeMX:
+		out.MX = make([]MXRecord, len(answer.mx))
+		for i, mx := range answer.mx {
+			out.MX[i] = MXRecord{Host: strings.TrimSuffix(mx.Host, "."), Pref: mx.Pref}
+		}
+		sort.Slice(out.MX, func(i, j int) bool {
+			if out.MX[i].Pref != out.MX[j].Pref {
+				return out.MX[i].Pref < out.MX[j].Pref
+			}
+			return out.MX[i].Host < out.MX[j].Host
+		})
+	case QueryTypeNS:
+		out.NS = make([]string, len(answer.names))
+		for i := range answer.names {
+			out.NS[i] = strings.TrimSuffix(answer.names[i], ".")
+		}
+		sort.Strings(out.NS)
+	case QueryTypeTXT:
+		out.TXT = answer.texts
+		sort.Strings(out.TXT)
+	}
+	return
+}
+
+// lookupRecords resolves the MX, NS, or TXT records of a name through the
+// resolver's net.Resolver, which gives no TTLs.
+func (resolver *DNSResolver) lookupRecords(ctx context.Context, qtype string, name string) (out dnsAnswer, err error) {
+	switch qtype {
+	case QueryTypeMX:
+		var mxs []*net.MX
+		mxs, err = resolver.Resolver.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			out.mx = append(out.mx, MXRecord{Host: mx.Host, Pref: mx.Pref})
+		}
+	case QueryTypeNS:
+		var nss []*net.NS
+		nss, err = resolver.Resolver.LookupNS(ctx, name)
+		for _, ns := range nss {
+			out.names = append(out.names, ns.Host)
+		}
+	case QueryTypeTXT:
+		out.texts, err = resolver.Resolver.LookupTXT(ctx, name)
+	default:
+		err = fmt.Errorf("unsupported record type %s", qtype)
+	}
+	return
+}
+
+// storeFetched caches an entry fetched from the resolver unless the server
+// failed, returning the entry to answer with.
+func (cache *RecordCache) storeFetched(key string, out RecordInfo) RecordInfo {
+	out.Cached = cache.now()
+	if out.Error == DNSErrorServFail || out.Error == DNSErrorTimeout {
+		cache.stats.backendError()
+	}
+	if out.Error == DNSErrorServFail {
+		return out
+	}
+	cache.lock.Lock()
+	if existing, ok := cache.Data[key]; ok && age(cache.clock, existing.Cached) <= cache.entryExpiry(existing) {
+		cache.lock.Unlock()
+		slog.Debug("duplicate fetch, keeping existing entry", "cache", cache.name, "name", key)
+		cache.stats.duplicateFetch()
+		return existing
+	}
+	stored := cache.store(key, out)
+	cache.lock.Unlock()
+	if !stored {
+		slog.Debug("not admitting entry", "cache", cache.name, "name", key)
+		return out
+	}
+	slog.Debug("cached", "cache", cache.name, "name", key, "error", out.Error)
+	cache.publishers.publish(cache.name, key, out)
+	return out
+}
+
+// store adds an entry to the cache, evicting entries as necessary to stay
+// within capacity, as AddressCache.store. The caller must hold the write
+// lock.
+func (cache *RecordCache) store(key string, info RecordInfo) bool {
+	_, exists := cache.Data[key]
+	if !exists && cache.eviction != nil && cache.admission != nil && len(cache.Data) >= cache.capacity {
+		if victim, ok := cache.eviction.Victim(); ok && !cache.admission.Admit(key, victim) {
+			cache.stats.rejected()
+			return false
+		}
+	}
+
+	cache.Data[key] = info
+	if cache.eviction != nil {
+		if !exists {
+			cache.eviction.Added(key)
+		}
+		cache.evict()
+	}
+	return true
+}
+
+// remove deletes an entry from the cache. The caller must hold the write lock.
+func (cache *RecordCache) remove(key string) {
+	delete(cache.Data, key)
+	if cache.eviction != nil {
+		cache.eviction.Removed(key)
+	}
+}
+
+// evict removes entries chosen by the eviction policy until the cache is
+// within capacity. The caller must hold the write lock.
+func (cache *RecordCache) evict() {
+	for len(cache.Data) > cache.capacity {
+		key, ok := cache.eviction.Victim()
+		if !ok {
+			break
+		}
+		slog.Debug("evicting", "cache", cache.name, "name", key)
+		cache.remove(key)
+		cache.stats.evicted()
+	}
+}
+
+// SetEviction limits the cache to the given number of entries, evicting
+// entries chosen by the given policy when it is full, as
+// AddressCache.SetEviction. A capacity of 0 removes the limit.
+func (cache *RecordCache) SetEviction(capacity int, policy EvictionPolicy) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if capacity <= 0 {
+		cache.capacity = 0
+		cache.eviction = nil
+		cache.admission = nil
+		return
+	}
+	cache.capacity = capacity
+	cache.eviction = policy
+	cached := make(map[string]time.Time, len(cache.Data))
+	for key, info := range cache.Data {
+		cached[key] = info.Cached
+	}
+	registerEntries(policy, cached)
+	cache.evict()
+}
+
+// SetAdmission filters new entries through the given admission policy when
+// the cache is at capacity; see AdmissionPolicy. It has no effect unless a
+// capacity has been set with SetEviction. A nil policy admits every entry.
+func (cache *RecordCache) SetAdmission(policy AdmissionPolicy) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.admission = policy
+}
+
+// AddPublisher arranges for every new entry in the cache to be passed to the
+// given publisher, as from the cache named by Name. It must be called before
+// the cache is used.
+func (cache *RecordCache) AddPublisher(publisher Publisher) {
+	cache.publishers = append(cache.publishers, publisher)
+}
+
+// entryExpiry returns the expiry in seconds for a given entry, taking
+// negative caching and the TTL of its records into account.
+func (cache *RecordCache) entryExpiry(info RecordInfo) int {
+	return dnsEntryExpiry(cache.expiry, info.Error, info.TTL)
+}
+
+// ttl returns the number of seconds until an entry expires, or 0 if it
+// already has.
+func (cache *RecordCache) ttl(info RecordInfo) int {
+	if ttl := cache.entryExpiry(info) - age(cache.clock, info.Cached); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// now returns the current time according to the cache's clock, in UTC, for
+// timestamping entries.
+func (cache *RecordCache) now() time.Time {
+	return cache.clock.Now().UTC()
+}
+
+func (cache *RecordCache) LookupServer(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	record_info, err := cache.LookupContext(req.Context(), name)
+	if req.Context().Err() != nil {
+		// client went away, nobody to answer
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		error_struct := struct{ Error string }{err.Error()}
+		error_body, _ := json.Marshal(error_struct)
+		w.Write(error_body)
+		return
+	}
+	record_body, _ := json.Marshal(record_info)
+
+	// nonexistent names are a valid answer; other failures are the backend's
+	switch record_info.Error {
+	case DNSErrorTimeout:
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case DNSErrorServFail:
+		w.WriteHeader(http.StatusBadGateway)
+	default:
+		writeCacheable(w, req, record_body, cache.ttl(record_info))
+		return
+	}
+	w.Write(record_body)
+}
+
+// Stats returns a snapshot of the record cache's size and activity.
+func (cache *RecordCache) Stats() CacheStats {
+	cache.lock.RLock()
+	entries := len(cache.Data)
+	cache.lock.RUnlock()
+	return cache.stats.snapshot(cache.name, entries)
+}
+
+// MarshalJSON encodes the cache's entries while holding its lock, so the
+// cache can be dumped while it is in use.
+func (cache *RecordCache) MarshalJSON() ([]byte, error) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return json.Marshal(struct {
+		Data map[string]RecordInfo
+	}{cache.Data})
+}
+
+// Flush removes all entries from the cache, as Purge, and from publishers
+// keeping entries, returning the number of entries removed from the cache.
+func (cache *RecordCache) Flush() int {
+	n := cache.Purge()
+	forget(nil, cache.publishers, cache.name, nil)
+	return n
+}
+
+// Purge removes all entries from the cache, returning the number of entries
+// removed. Publishers are not affected.
+func (cache *RecordCache) Purge() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	n := len(cache.Data)
+	if cache.eviction != nil {
+		for key := range cache.Data {
+			cache.eviction.Removed(key)
+		}
+	}
+	cache.Data = make(map[string]RecordInfo)
+	return n
+}
+
+func (cache *RecordCache) StatsServer(w http.ResponseWriter, req *http.Request) {
+	writeStats(w, cache.Stats())
+}
+
+func (cache *RecordCache) PurgeServer(w http.ResponseWriter, req *http.Request) {
+	purgeServer(w, req, cache.name, cache.Flush)
+}
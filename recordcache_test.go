@@ -0,0 +1,162 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testResolver stands in for a resolver in tests, failing every query at
+// once, so that lookups missing the cache never reach the network.
+var testResolver = &DNSResolver{Name: "test", Resolver: &net.Resolver{PreferGo: true, Dial: testDialDNS}, dial: testDialDNS}
+
+func testDialDNS(ctx context.Context, network string, address string) (net.Conn, error) {
+	return nil, errors.New("no DNS in tests")
+}
+
+// testRecordCache returns an MX cache on a fake clock, holding entries for
+// the given names, cached in order, as if looked up through testResolver.
+func testRecordCache(t *testing.T, names ...string) *RecordCache {
+	t.Helper()
+	cache, err := NewRecordCache(QueryTypeMX, 3600, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetClock(newFakeClock())
+	cache.SetResolver(testResolver)
+	for _, name := range names {
+		testStoreRecord(cache, name)
+	}
+	return cache
+}
+
+// testStoreRecord caches an answer for a name as if looked up, a second
+// after the previous one.
+func testStoreRecord(cache *RecordCache, name string) {
+	cache.clock.(*fakeClock).advance(time.Second)
+	key := NewAddressKey(name, cache.Type(), testResolver.Name)
+	cache.storeFetched(key.String(), RecordInfo{
+		Name:     key.Name,
+		Type:     key.Type,
+		Resolver: key.Resolver,
+		MX:       []MXRecord{{Host: "mx." + key.Name, Pref: 10}},
+	})
+}
+
+func testRecordKey(name string) string {
+	return NewAddressKey(name, QueryTypeMX, testResolver.Name).String()
+}
+
+func TestRecordCacheEviction(t *testing.T) {
+	cache := testRecordCache(t, "a.example", "b.example", "c.example")
+	policy, err := NewEvictionPolicy(EvictLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// entries already cached are evicted to fit
+	cache.SetEviction(2, policy)
+	if n := len(cache.Data); n != 2 {
+		t.Fatalf("%d entries after limiting to 2", n)
+	}
+	if _, ok := cache.Entry(testRecordKey("a.example")); ok {
+		t.Error("least recently used entry kept")
+	}
+
+	// a hit makes b.example the most recently used
+	if info := cache.Lookup("b.example"); len(info.MX) != 1 {
+		t.Fatalf("cached entry not found: %+v", info)
+	}
+	testStoreRecord(cache, "d.example")
+	if _, ok := cache.Entry(testRecordKey("c.example")); ok {
+		t.Error("least recently used entry kept")
+	}
+	for _, name := range []string{"b.example", "d.example"} {
+		if _, ok := cache.Entry(testRecordKey(name)); !ok {
+			t.Errorf("%s evicted", name)
+		}
+	}
+	if stats := cache.Stats(); stats.Evictions != 2 || stats.Entries != 2 {
+		t.Errorf("%d evictions with %d entries, want 2 with 2", stats.Evictions, stats.Entries)
+	}
+
+	// purged entries are no longer eviction candidates
+	if n := cache.Purge(); n != 2 {
+		t.Errorf("purged %d entries, want 2", n)
+	}
+	testStoreRecord(cache, "e.example")
+	testStoreRecord(cache, "f.example")
+	if n := len(cache.Data); n != 2 {
+		t.Errorf("%d entries after purge and refill, want 2", n)
+	}
+}
+
+func TestRecordCacheAdmission(t *testing.T) {
+	cache := testRecordCache(t)
+	policy, _ := NewEvictionPolicy(EvictLRU)
+	cache.SetEviction(1, policy)
+	admission, err := NewAdmissionPolicy(AdmitTinyLFU, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetAdmission(admission)
+
+	// a.example is looked up often, b.example once
+	for i := 0; i < 3; i++ {
+		cache.admission.Record(testRecordKey("a.example"))
+	}
+	testStoreRecord(cache, "a.example")
+	cache.admission.Record(testRecordKey("b.example"))
+	testStoreRecord(cache, "b.example")
+	if _, ok := cache.Entry(testRecordKey("a.example")); !ok {
+		t.Error("frequently used entry evicted for a one-off")
+	}
+	if stats := cache.Stats(); stats.Rejections != 1 {
+		t.Errorf("%d rejections, want 1", stats.Rejections)
+	}
+}
+
+func TestRecordCacheResources(t *testing.T) {
+	cache := testRecordCache(t, "example.com", "example.net")
+	s := NewServer()
+	s.HandleCaches(nil, nil, cache)
+	get := func(method string, path string, v interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, w.Code)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	var keys struct{ Keys []string }
+	get(http.MethodGet, "/cache/keys.json", &keys)
+	if len(keys.Keys) != 2 || keys.Keys[0] != "mx/"+testRecordKey("example.com") {
+		t.Errorf("keys %v", keys.Keys)
+	}
+
+	var search struct{ Results []SearchResult }
+	get(http.MethodGet, "/cache/search.json?q=name:com", &search)
+	if len(search.Results) != 1 || search.Results[0].Record == nil || search.Results[0].Record.Name != "example.com" {
+		t.Errorf("search results %+v", search.Results)
+	}
+
+	var stats map[string]CacheStats
+	get(http.MethodGet, "/stats.json", &stats)
+	if stats["mx"].Entries != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	var flush struct{ Purged map[string]int }
+	get(http.MethodPost, "/cache/flush", &flush)
+	if flush.Purged["mx"] != 2 || len(cache.Data) != 0 {
+		t.Errorf("purged %v, %d entries left", flush.Purged, len(cache.Data))
+	}
+}
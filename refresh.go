@@ -0,0 +1,93 @@
+package canid
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+)
+
+// hitCounts counts cache hits per prefix since the last refresh.
+
+type hitCounts struct {
+	lock   sync.Mutex
+	counts map[string]uint64
+}
+
+func (h *hitCounts) record(key string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.counts == nil {
+		h.counts = make(map[string]uint64)
+	}
+	h.counts[key]++
+}
+
+// take returns the counts so far, and starts counting afresh.
+func (h *hitCounts) take() map[string]uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	counts := h.counts
+	h.counts = nil
+	return counts
+}
+
+// TrackHits counts hits per prefix, for RefreshHot. It must be called before
+// the cache is used.
+func (cache *PrefixCache) TrackHits() {
+	cache.hits = new(hitCounts)
+}
+
+// RefreshHot looks up again up to n of the entries hit most often since the
+// last call which will expire within the given number of seconds, and
+// replaces them, so that popular prefixes are never missed when they expire.
+// Hit counts are reset on each call. It does nothing unless TrackHits was
+// called.
+func (cache *PrefixCache) RefreshHot(ctx context.Context, n int, within int) {
+	if cache.hits == nil {
+		return
+	}
+	counts := cache.hits.take()
+
+	// hot entries which are about to expire, hottest first
+	keys := make([]string, 0)
+	cache.lock.RLock()
+	for key := range counts {
+		if info, ok := cache.Data[key]; ok && age(cache.clock, info.Cached) > cache.expiry-within {
+			keys = append(keys, key)
+		}
+	}
+	cache.lock.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return counts[keys[i]] > counts[keys[j]] })
+	if n < len(keys) {
+		keys = keys[:n]
+	}
+
+	for _, key := range keys {
+		addr, _, err := net.ParseCIDR(key)
+		if err != nil {
+			continue
+		}
+		res, err := cache.pipeline.run(ctx, addr.String(), lookupStages{
+			backend: func(ctx context.Context) (interface{}, error) {
+				return cache.lookupBackend(ctx, addr)
+			},
+		})
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			slog.Warn("refresh failed", "prefix", key, "err", err)
+			continue
+		}
+		// keep a complete entry until it expires rather than replace it with
+		// an incomplete one
+		out := res.(PrefixInfo)
+		if incomplete(out) {
+			continue
+		}
+		cache.stats.refreshed()
+		slog.Debug("refreshing", "prefix", key, "hits", counts[key])
+		cache.replace(key, out)
+	}
+}
@@ -0,0 +1,272 @@
+package canid
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocklist reports whether an address is listed on a blocklist or
+// reputation feed. Implementations must be safe for concurrent use.
+
+type Blocklist interface {
+	Name() string
+	Listed(ctx context.Context, addr net.IP) (bool, error)
+}
+
+// Reputation checks addresses against a set of blocklists, for annotating
+// responses. Results depend on the address queried, not only its prefix, so
+// are added to responses rather than cached with entries.
+
+type Reputation struct {
+	lists []Blocklist
+}
+
+func NewReputation(lists ...Blocklist) *Reputation {
+	return &Reputation{lists: lists}
+}
+
+// Check returns the names of the blocklists an address is listed on, in the
+// order the lists were given. Lists which fail to answer are logged and
+// treated as not listing the address.
+func (r *Reputation) Check(ctx context.Context, addr net.IP) []string {
+	var out []string
+	for _, list := range r.lists {
+		listed, err := list.Listed(ctx, addr)
+		if err != nil {
+			slog.Warn("reputation check failed", "addr", addr, "list", list.Name(), "err", err)
+			continue
+		}
+		if listed {
+			out = append(out, list.Name())
+		}
+	}
+	return out
+}
+
+// Refresh reloads all blocklists which support it (those with a Refresh
+// method, such as FileBlocklist). Failures are logged, and leave the
+// previous contents of the list in place.
+func (r *Reputation) Refresh() {
+	for _, list := range r.lists {
+		if refresher, ok := list.(interface{ Refresh() error }); ok {
+			if err := refresher.Refresh(); err != nil {
+				slog.Warn("unable to refresh blocklist", "list", list.Name(), "err", err)
+			}
+		}
+	}
+}
+
+// FileBlocklist is a local blocklist, loaded from a file with one address or
+// prefix per line. Blank lines and text after a # are ignored.
+
+type FileBlocklist struct {
+	Path  string
+	lock  sync.RWMutex
+	index prefixIndex
+}
+
+// NewFileBlocklist loads a blocklist from a file.
+func NewFileBlocklist(path string) (*FileBlocklist, error) {
+	list := &FileBlocklist{Path: path}
+	if err := list.Refresh(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Name returns the file's base name.
+func (list *FileBlocklist) Name() string {
+	return filepath.Base(list.Path)
+}
+
+// Refresh reloads the blocklist from its file.
+func (list *FileBlocklist) Refresh() error {
+	infile, err := os.Open(list.Path)
+	if err != nil {
+		return err
+	}
+	defer infile.Close()
+
+	index, err := loadBlocklist(infile)
+	if err != nil {
+		return fmt.Errorf("%s: %s", list.Path, err.Error())
+	}
+
+	list.lock.Lock()
+	list.index = index
+	list.lock.Unlock()
+	slog.Info("loaded blocklist", "path", list.Path)
+	return nil
+}
+
+func loadBlocklist(in io.Reader) (index prefixIndex, err error) {
+	index = prefixIndex{valid: true, v4: new(Trie), v6: new(Trie)}
+	scanner := bufio.NewScanner(in)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		// bare addresses are host prefixes
+		if !strings.Contains(line, "/") {
+			if ip := net.ParseIP(line); ip != nil && ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
+		}
+		pfx, ok := parsePrefixKey(line)
+		if !ok {
+			return index, fmt.Errorf("invalid address or prefix on line %d", lineno)
+		}
+		trie, pfx := index.trieForPrefix(pfx)
+		trie.Add(pfx, true)
+	}
+	return index, scanner.Err()
+}
+
+func (list *FileBlocklist) Listed(ctx context.Context, addr net.IP) (bool, error) {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+	if !list.index.valid {
+		return false, nil
+	}
+	trie, ip := list.index.trieFor(addr)
+	_, _, ok := trie.Find(ip)
+	return ok, nil
+}
+
+// Expiry for DNSBL results
+const dnsblExpiry = 10 * time.Minute
+
+// DNSBL is a DNS-based blocklist: an address is listed if the reversed
+// address under the zone resolves.
+
+type DNSBL struct {
+	Zone  string
+	lock  sync.Mutex
+	cache map[string]dnsblEntry
+	clock Clock
+}
+
+type dnsblEntry struct {
+	listed  bool
+	expires time.Time
+}
+
+func NewDNSBL(zone string) *DNSBL {
+	return &DNSBL{Zone: strings.TrimSuffix(zone, "."), cache: make(map[string]dnsblEntry), clock: SystemClock{}}
+}
+
+// SetClock replaces the clock used to expire cached results. It must be
+// called before the blocklist is used.
+func (list *DNSBL) SetClock(clock Clock) {
+	list.clock = clock
+}
+
+// Name returns the DNSBL's zone.
+func (list *DNSBL) Name() string {
+	return list.Zone
+}
+
+// dnsblName returns the name to query for an address: reversed octets for
+// IPv4, reversed nibbles for IPv6.
+func dnsblName(addr net.IP, zone string) string {
+	var labels []string
+	if addr4 := addr.To4(); addr4 != nil {
+		for i := len(addr4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%d", addr4[i]))
+		}
+	} else {
+		addr16 := addr.To16()
+		for i := len(addr16) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", addr16[i]&0xf), fmt.Sprintf("%x", addr16[i]>>4))
+		}
+	}
+	return strings.Join(labels, ".") + "." + zone
+}
+
+func (list *DNSBL) Listed(ctx context.Context, addr net.IP) (bool, error) {
+	name := dnsblName(addr, list.Zone)
+
+	list.lock.Lock()
+	entry, ok := list.cache[name]
+	list.lock.Unlock()
+	if ok && list.clock.Now().Before(entry.expires) {
+		return entry.listed, nil
+	}
+
+	listed := true
+	if _, err := net.DefaultResolver.LookupHost(ctx, name); err != nil {
+		if dnserr, ok := err.(*net.DNSError); !ok || !dnserr.IsNotFound {
+			return false, err
+		}
+		listed = false
+	}
+
+	list.lock.Lock()
+	// drop expired entries while we're here, so the cache doesn't grow
+	// without bound
+	now := list.clock.Now()
+	for key, old := range list.cache {
+		if now.After(old.expires) {
+			delete(list.cache, key)
+		}
+	}
+	list.cache[name] = dnsblEntry{listed, now.Add(dnsblExpiry)}
+	list.lock.Unlock()
+	return listed, nil
+}
+
+// SetReputation arranges for prefix information responses to be annotated
+// with the blocklists the queried address is listed on, in Reputation. It
+// must be called before the cache is used.
+func (cache *PrefixCache) SetReputation(reputation *Reputation) {
+	cache.reputation = reputation
+}
+
+// SetReputation arranges for address information responses to be annotated
+// with the blocklists each address is listed on, in Reputation. It must be
+// called before the cache is used.
+func (cache *AddressCache) SetReputation(reputation *Reputation) {
+	cache.reputation = reputation
+}
+
+// annotate adds reputation information for the queried address to a prefix
+// information response.
+func (cache *PrefixCache) annotate(ctx context.Context, addr net.IP, info *PrefixInfo) {
+	if cache.reputation != nil {
+		info.Reputation = cache.reputation.Check(ctx, addr)
+	}
+}
+
+// annotate adds reputation information for each address to an address
+// information response.
+func (cache *AddressCache) annotate(ctx context.Context, info *AddressInfo) {
+	if cache.reputation == nil {
+		return
+	}
+	reputation := make(map[string][]string)
+	for _, addr := range info.Addresses {
+		if listed := cache.reputation.Check(ctx, addr); len(listed) > 0 {
+			reputation[addr.String()] = listed
+		}
+	}
+	if len(reputation) > 0 {
+		info.Reputation = reputation
+	}
+}
@@ -0,0 +1,245 @@
+package canid
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Default ports of DNS servers, by transport
+var dnsDefaultPorts = map[string]string{
+	"udp": "53",
+	"tcp": "53",
+	"tls": "853",
+}
+
+// Largest DNS message, as limited by the length prefix on stream transports
+const maxDNSMessage = 65535
+
+// dohClient is the client for DNS over HTTPS requests. It is separate from
+// HTTPClient, since the resolver isn't a backend: it neither uses the backend
+// proxy nor is answered from fixtures.
+var dohClient = &http.Client{}
+
+// Specification of the resolver using the first name server of the host's
+// resolver configuration directly, rather than through the system resolver
+const ResolvConfResolver = "resolv.conf"
+
+// Host resolver configuration, read for ResolvConfResolver
+const resolvConfPath = "/etc/resolv.conf"
+
+// DNSResolver answers the address cache's DNS queries. Its name identifies it
+// in cache keys and in the Resolver of each entry, so that entries from
+// different resolvers are kept apart. Resolvers for a given server query it
+// directly, so that the cache learns the TTLs of the answers; the system
+// resolver doesn't reveal them.
+
+type DNSResolver struct {
+	Name     string
+	Resolver *net.Resolver
+	// Limit on each lookup, including retries; 0 for the resolver's own
+	Timeout time.Duration
+	// Connects to the server for direct queries; nil for the system resolver
+	dial func(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// NewDNSResolver returns a resolver for a specification: system (or empty)
+// for the host's default resolver, resolv.conf for the first name server in
+// /etc/resolv.conf, or a DNS server given as host[:port] or
+// udp://host[:port] (plain DNS, falling back to TCP for truncated answers),
+// tcp://host[:port] (plain DNS over TCP only), tls://host[:port] (DNS over
+// TLS), or an https:// URL (DNS over HTTPS, RFC 8484). The resolver's name is
+// the specification with default transport and port filled in.
+func NewDNSResolver(spec string, timeout time.Duration) (*DNSResolver, error) {
+	if len(spec) == 0 || spec == SystemResolver {
+		return &DNSResolver{Name: SystemResolver, Resolver: net.DefaultResolver, Timeout: timeout}, nil
+	}
+	if spec == ResolvConfResolver {
+		server, err := resolvConfServer(resolvConfPath)
+		if err != nil {
+			return nil, err
+		}
+		spec = server
+	}
+
+	if strings.HasPrefix(spec, "https://") {
+		if _, err := url.Parse(spec); err != nil {
+			return nil, fmt.Errorf("invalid DNS over HTTPS URL %s: %s", spec, err.Error())
+		}
+		dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return &dohConn{url: spec, ctx: ctx}, nil
+		}
+		return &DNSResolver{Name: spec, Resolver: &net.Resolver{PreferGo: true, Dial: dial}, Timeout: timeout, dial: dial}, nil
+	}
+
+	transport, server, ok := strings.Cut(spec, "://")
+	if !ok {
+		transport, server = "udp", spec
+	}
+	port, ok := dnsDefaultPorts[transport]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DNS transport %s", transport)
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+	}
+	host, _, _ := net.SplitHostPort(server)
+	if len(host) == 0 {
+		return nil, fmt.Errorf("no DNS server in %s", spec)
+	}
+
+	// the Go resolver dials the servers of resolv.conf; dial ours instead
+	dialer := new(net.Dialer)
+	var dial func(ctx context.Context, network string, address string) (net.Conn, error)
+	switch transport {
+	case "udp":
+		dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		}
+	case "tcp":
+		dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", server)
+		}
+	case "tls":
+		tlsdialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}
+		dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return tlsdialer.DialContext(ctx, "tcp", server)
+		}
+	}
+	return &DNSResolver{Name: transport + "://" + server, Resolver: &net.Resolver{PreferGo: true, Dial: dial}, Timeout: timeout, dial: dial}, nil
+}
+
+// resolvConfServer returns the first name server in a resolver
+// configuration file.
+func resolvConfServer(path string) (string, error) {
+	conf, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(conf), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("no nameserver in %s", path)
+}
+
+// dohConn is a connection to a DNS over HTTPS server, as dialed by the Go
+// resolver. Since it isn't a net.PacketConn, the resolver writes messages to
+// it with the length prefix of stream transports; each is sent as an HTTP
+// request, and its answer read back with the same prefix.
+
+type dohConn struct {
+	url      string
+	ctx      context.Context
+	deadline time.Time
+	request  bytes.Buffer
+	response bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.request.Write(b)
+	for c.request.Len() >= 2 {
+		msglen := int(binary.BigEndian.Uint16(c.request.Bytes()))
+		if c.request.Len() < 2+msglen {
+			break
+		}
+		c.request.Next(2)
+		answer, err := c.exchange(c.request.Next(msglen))
+		if err != nil {
+			return 0, err
+		}
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(answer)))
+		c.response.Write(prefix[:])
+		c.response.Write(answer)
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.response.Read(b)
+}
+
+// exchange sends a DNS message to the server in a POST request, and returns
+// the answer.
+func (c *dohConn) exchange(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", c.url, resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) > maxDNSMessage {
+		return nil, fmt.Errorf("%s returned an oversized answer", c.url)
+	}
+	return answer, nil
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+// dohAddr is the address of a DNS over HTTPS server: its URL.
+
+type dohAddr string
+
+func (addr dohAddr) Network() string {
+	return "https"
+}
+
+func (addr dohAddr) String() string {
+	return string(addr)
+}
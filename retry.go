@@ -0,0 +1,140 @@
+package canid
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Retry schedule for incomplete prefix entries: the first retry happens after
+// retryBaseDelay, and the delay doubles with each attempt, up to
+// retryMaxAttempts. At most retryQueueLimit entries wait for retry at once;
+// further incomplete entries are left as they are until they expire.
+const (
+	retryBaseDelay   = 30 * time.Second
+	retryMaxAttempts = 5
+	retryQueueLimit  = 1024
+	retryPollPeriod  = time.Second
+)
+
+type retryItem struct {
+	addr    net.IP
+	attempt int
+	due     time.Time
+}
+
+// retryQueue holds incomplete prefix entries awaiting another backend
+// lookup, keyed by prefix.
+
+type retryQueue struct {
+	lock   sync.Mutex
+	items  map[string]*retryItem
+	start  sync.Once
+	stop   chan struct{}
+	closed bool
+}
+
+// incomplete returns true if an entry is missing fields because a backend
+// request failed. An ASN of 0 or an empty country code is a valid answer for
+// unrouted or ungeolocated prefixes, and is not retried.
+func incomplete(info PrefixInfo) bool {
+	return info.Partial
+}
+
+// scheduleRetry queues an incomplete entry for retry, starting the retry
+// worker if necessary. It does nothing if the entry has already had all its
+// attempts, if the queue is full, or if the cache has been closed.
+func (cache *PrefixCache) scheduleRetry(addr net.IP, prefix string, attempt int) {
+	if attempt > retryMaxAttempts {
+		slog.Info("giving up on completing prefix", "prefix", prefix, "attempts", retryMaxAttempts)
+		return
+	}
+
+	q := &cache.retries
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.start.Do(func() {
+		q.items = make(map[string]*retryItem)
+		q.stop = make(chan struct{})
+		go cache.runRetries()
+	})
+
+	if _, ok := q.items[prefix]; !ok && len(q.items) >= retryQueueLimit {
+		slog.Warn("retry queue full, not retrying prefix", "prefix", prefix)
+		return
+	}
+	delay := retryBaseDelay << uint(attempt-1)
+	q.items[prefix] = &retryItem{addr, attempt, cache.clock.Now().Add(delay)}
+	slog.Debug("retrying incomplete prefix", "prefix", prefix, "delay", delay.String(), "attempt", attempt)
+}
+
+func (cache *PrefixCache) runRetries() {
+	q := &cache.retries
+	ticker := time.NewTicker(retryPollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.stop:
+			return
+		}
+
+		// collect due items
+		now := cache.clock.Now()
+		due := make(map[string]*retryItem)
+		q.lock.Lock()
+		for prefix, item := range q.items {
+			if now.After(item.due) {
+				due[prefix] = item
+				delete(q.items, prefix)
+			}
+		}
+		q.lock.Unlock()
+
+		for prefix, item := range due {
+			cache.retry(prefix, item)
+		}
+	}
+}
+
+// Close stops the cache's background work: entries waiting for retry are
+// abandoned, and incomplete entries are no longer retried. The cache remains
+// usable for lookups.
+func (cache *PrefixCache) Close() {
+	q := &cache.retries
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	if q.stop != nil {
+		close(q.stop)
+	}
+}
+
+// retry looks up an incomplete entry again, and replaces it if the new
+// result is complete; otherwise, it schedules another attempt.
+func (cache *PrefixCache) retry(prefix string, item *retryItem) {
+	res, err := cache.pipeline.run(context.Background(), item.addr.String(), lookupStages{
+		backend: func(ctx context.Context) (interface{}, error) {
+			return cache.lookupBackend(ctx, item.addr)
+		},
+	})
+	if err != nil {
+		cache.scheduleRetry(item.addr, prefix, item.attempt+1)
+		return
+	}
+	out := res.(PrefixInfo)
+	if incomplete(out) {
+		cache.scheduleRetry(item.addr, prefix, item.attempt+1)
+		return
+	}
+
+	cache.replace(prefix, out)
+}
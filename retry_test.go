@@ -0,0 +1,46 @@
+package canid
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// backendFunc adapts a function to a PrefixBackend.
+type backendFunc func(ctx context.Context, addr net.IP) (PrefixInfo, error)
+
+func (f backendFunc) Lookup(ctx context.Context, addr net.IP) (PrefixInfo, error) {
+	return f(ctx, addr)
+}
+
+func TestRetryOnlyPartial(t *testing.T) {
+	tests := []struct {
+		name  string
+		info  PrefixInfo
+		retry bool
+	}{
+		{"complete", PrefixInfo{Prefix: "192.0.2.0/24", ASN: 64496, CountryCode: "NL"}, false},
+		{"unrouted", PrefixInfo{Prefix: "192.0.2.0/24", ASN: 0}, false},
+		{"no country", PrefixInfo{Prefix: "192.0.2.0/24", ASN: 64496}, false},
+		{"partial", PrefixInfo{Prefix: "192.0.2.0/24", ASN: 64496, Partial: true}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := NewPrefixCache(3600, 1, backendFunc(func(ctx context.Context, addr net.IP) (PrefixInfo, error) {
+				return test.info, nil
+			}))
+			defer cache.Close()
+			cache.SetClock(newFakeClock())
+
+			if _, err := cache.Lookup(testAddr(t, "192.0.2.1")); err != nil {
+				t.Fatal(err)
+			}
+			cache.retries.lock.Lock()
+			_, queued := cache.retries.items[test.info.Prefix]
+			cache.retries.lock.Unlock()
+			if queued != test.retry {
+				t.Errorf("queued for retry: %v, want %v", queued, test.retry)
+			}
+		})
+	}
+}
@@ -1,27 +1,41 @@
 package canid
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 // Structure partially covering the output of RIPEstat's prefix overview and
 // geolocation API calls, for decoding JSON reponses from RIPEstat.
 
 type RipeStatResponse struct {
-	Status string
-	Data   struct {
+	Status           string
+	Version          string
+	Data_Call_Name   string
+	Data_Call_Status string
+	Server_ID        string
+	Cached           bool
+	Data             struct {
+		Query_Time       string
 		Resource         string
 		Is_Less_Specific bool
 		ASNs             []struct {
 			ASN int
 		}
 		Locations []struct {
-			Country string
+			Country   string
+			City      string
+			Latitude  *float64
+			Longitude *float64
 		}
 		Block struct {
 			Resource string
@@ -29,35 +43,95 @@ type RipeStatResponse struct {
 	}
 }
 
-const ripeStatPrefixURL = "https://stat.ripe.net/data/prefix-overview/data.json"
-const ripeStatGeolocURL = "https://stat.ripe.net/data/geoloc/data.json"
-
-func callRipestat(apiurl string, addr net.IP, out *PrefixInfo) error {
+const ripeStatDataURL = "https://stat.ripe.net/data/"
+const ripeStatPrefixCall = "prefix-overview"
+const ripeStatGeolocCall = "geoloc"
+const ripeStatRPKICall = "rpki-validation"
 
-	// construct a query string and add it to the URL
+// fetchRipestat calls a RIPEstat data call for an address and returns the raw
+// response body.
+func fetchRipestat(ctx context.Context, dataCall string, addr net.IP) ([]byte, error) {
 	v := make(url.Values)
 	v.Add("resource", addr.String())
-	fullUrl, err := url.Parse(apiurl)
+	return fetchRipestatQuery(ctx, dataCall, v)
+}
+
+// fetchRipestatQuery calls a RIPEstat data call with the given parameters and
+// returns the raw response body, retrying failed calls as RipestatRetry
+// allows.
+func fetchRipestatQuery(ctx context.Context, dataCall string, v url.Values) (body []byte, err error) {
+	err = RipestatRetry.do(ctx, "ripestat "+dataCall, func() (err error) {
+		body, err = fetchRipestatOnce(ctx, dataCall, v)
+		return
+	})
+	return
+}
+
+// fetchRipestatOnce makes a single call for fetchRipestatQuery. Responses with
+// a server error status are errors; others, including RIPEstat's error
+// responses, are returned for the caller to interpret.
+func fetchRipestatOnce(ctx context.Context, dataCall string, v url.Values) ([]byte, error) {
+
+	// add the query string to the URL
+	fullUrl, err := url.Parse(ripeStatDataURL + url.PathEscape(dataCall) + "/data.json")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	fullUrl.RawQuery = v.Encode()
 
-	log.Printf("calling ripestat %s", fullUrl.String())
+	slog.Debug("calling ripestat", "url", fullUrl.String())
 
-	resp, err := http.Get(fullUrl.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return nil, newErrServerStatus(resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// RipestatRaw calls the named RIPEstat data call (e.g. prefix-overview or
+// geoloc) for an address, and returns the raw JSON response.
+func RipestatRaw(ctx context.Context, dataCall string, addr net.IP) ([]byte, error) {
+	return fetchRipestat(ctx, dataCall, addr)
+}
+
+func callRipestat(ctx context.Context, dataCall string, addr net.IP, out *PrefixInfo) error {
+
+	body, err := fetchRipestat(ctx, dataCall, addr)
 	if err != nil {
 		return err
 	}
 
+	// look for changes in the fields we rely on before decoding
+	checkRipestatSchema(dataCall, body)
+
 	// and now we have a response, parse it
 	var doc RipeStatResponse
-	dec := json.NewDecoder(resp.Body)
-	err = dec.Decode(&doc)
+	parse_start := time.Now()
+	err = json.Unmarshal(body, &doc)
+	observeTiming(ctx, TimingParse, parse_start)
 	if err != nil {
 		return err
 	}
 
+	// record metadata for debugging
+	out.BackendMeta = append(out.BackendMeta, BackendMeta{
+		DataCall:       doc.Data_Call_Name,
+		DataCallStatus: doc.Data_Call_Status,
+		Version:        doc.Version,
+		QueryTime:      doc.Data.Query_Time,
+		ServerID:       doc.Server_ID,
+		Cached:         doc.Cached,
+	})
+
 	// don't even bother if the server told us to go away
 	if doc.Status != "ok" {
 		return errors.New("RIPEstat request failed with status " + doc.Status)
@@ -79,19 +153,101 @@ func callRipestat(apiurl string, addr net.IP, out *PrefixInfo) error {
 		break
 	}
 
-	// get the first country code, if present
+	// get the first country code and city, if present
 	for _, location := range doc.Data.Locations {
 		out.CountryCode = location.Country
+		out.City = location.City
+		out.Latitude = location.Latitude
+		out.Longitude = location.Longitude
 		break
 	}
 
 	return nil
 }
 
+// RipestatGeolocator geolocates addresses using RIPEstat's geolocation API.
+
+type RipestatGeolocator struct{}
+
+func (RipestatGeolocator) Geolocate(ctx context.Context, addr net.IP, out *PrefixInfo) error {
+	return callRipestat(ctx, ripeStatGeolocCall, addr, out)
+}
+
+// RipestatBackend is a PrefixBackend using LookupRipestat.
+
+type RipestatBackend struct{}
+
+func (RipestatBackend) Name() string {
+	return "ripestat"
+}
+
+func (RipestatBackend) Lookup(ctx context.Context, addr net.IP) (PrefixInfo, error) {
+	return LookupRipestatContext(ctx, addr)
+}
+
+// LookupRaw returns the raw RIPEstat responses for an address, keyed by data
+// call: prefix-overview, and geoloc if RIPEstat is the Geolocation backend.
+func (RipestatBackend) LookupRaw(ctx context.Context, addr net.IP) (map[string]json.RawMessage, error) {
+	calls := []string{ripeStatPrefixCall}
+	if _, ok := Geolocation.(RipestatGeolocator); ok {
+		calls = append(calls, ripeStatGeolocCall)
+	}
+
+	out := make(map[string]json.RawMessage)
+	for _, call := range calls {
+		body, err := fetchRipestat(ctx, call, addr)
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(body) {
+			// keep whatever we got, for the humans
+			body, _ = json.Marshal(string(body))
+		}
+		out[call] = body
+	}
+	return out, nil
+}
+
+// LookupRipestat calls the prefix overview API and the configured Geolocation
+// backend concurrently, and merges the results. Only a prefix overview
+// failure is an error; without geolocation, the location fields are left
+// empty. If geolocation fails, the result is marked Partial, with the reason
+// in Warnings.
 func LookupRipestat(addr net.IP) (out PrefixInfo, err error) {
-	err = callRipestat(ripeStatPrefixURL, addr, &out)
-	if err == nil {
-		callRipestat(ripeStatGeolocURL, addr, &out)
+	return LookupRipestatContext(context.Background(), addr)
+}
+
+// LookupRipestatContext is LookupRipestat, giving up and returning the
+// context's error if the context is done before RIPEstat answers.
+func LookupRipestatContext(ctx context.Context, addr net.IP) (out PrefixInfo, err error) {
+	var geoloc PrefixInfo
+	g, gctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		return callRipestat(gctx, ripeStatPrefixCall, addr, &out)
+	})
+	if geolocator := Geolocation; geolocator != nil {
+		g.Go(func() error {
+			if gerr := geolocator.Geolocate(gctx, addr, &geoloc); gerr != nil {
+				slog.Warn("geolocation lookup failed", "addr", addr, "err", gerr)
+				geoloc.Partial = true
+				geoloc.Warnings = append(geoloc.Warnings, "geolocation failed: "+gerr.Error())
+			}
+			return nil
+		})
 	}
+
+	if err = g.Wait(); err != nil {
+		return
+	}
+
+	out.CountryCode = geoloc.CountryCode
+	out.Region = geoloc.Region
+	out.City = geoloc.City
+	out.Latitude = geoloc.Latitude
+	out.Longitude = geoloc.Longitude
+	out.Partial = geoloc.Partial
+	out.Warnings = append(out.Warnings, geoloc.Warnings...)
+	out.BackendMeta = append(out.BackendMeta, geoloc.BackendMeta...)
 	return
 }
@@ -0,0 +1,335 @@
+package canid
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// URL of the RIPE RIS Live streaming endpoint, which sends BGP messages seen
+// by the RIS route collectors as JSON, one per line
+const RISLiveURL = "https://ris-live.ripe.net/v1/stream/?format=json&client=canid"
+
+// Delays before reconnecting to the feed after a failure, doubling up to the
+// maximum
+const (
+	liveRetryMin = 1 * time.Second
+	liveRetryMax = 5 * time.Minute
+)
+
+// Default time the table must stream without interruption before it is
+// taken to have converged
+const DefaultLiveWarmup = 6 * time.Hour
+
+// LiveRoutes is a prefix to origin AS table kept up to date from a stream of
+// BGP updates from RIPE RIS Live. Since the stream carries only changes, the
+// table holds the prefixes announced since it was started, and not yet
+// withdrawn by every peer which announced them. It is taken to have
+// converged once it has streamed for Warmup without interruption.
+
+type LiveRoutes struct {
+	URL     string
+	Warmup  time.Duration
+	lock    sync.RWMutex
+	index   prefixIndex
+	routes  map[string]*liveRoute
+	updates uint64
+	clock   Clock
+	// start of the current stream, zero while not streaming
+	since time.Time
+}
+
+// liveRoute is the origin AS of a prefix's latest announcement, and the peers
+// (by collector and address) announcing it.
+
+type liveRoute struct {
+	origin uint32
+	peers  map[string]bool
+}
+
+// risMessage is a message on the RIS Live stream, either bare or wrapped as
+// over the WebSocket interface.
+
+type risMessage struct {
+	Type          string
+	Data          *risMessage
+	Host          string
+	Peer          string
+	Path          []json.RawMessage
+	Announcements []struct {
+		Prefixes []string
+	}
+	Withdrawals []string
+}
+
+// NewLiveRoutes creates an empty table, to be kept up to date from the RIS
+// Live stream at the given URL (e.g. RISLiveURL, with further parameters to
+// select collectors or peers) by Run.
+func NewLiveRoutes(url string) *LiveRoutes {
+	routes := new(LiveRoutes)
+	routes.URL = url
+	routes.Warmup = DefaultLiveWarmup
+	routes.index = prefixIndex{valid: true, v4: new(Trie), v6: new(Trie)}
+	routes.routes = make(map[string]*liveRoute)
+	routes.clock = SystemClock{}
+	return routes
+}
+
+// Converged returns true if the table has streamed updates without
+// interruption for at least Warmup, so that prefixes which change at all
+// have likely been announced since.
+func (routes *LiveRoutes) Converged() bool {
+	routes.lock.RLock()
+	defer routes.lock.RUnlock()
+	return !routes.since.IsZero() && routes.clock.Now().Sub(routes.since) >= routes.Warmup
+}
+
+// streaming records the start of a stream, or its end if started is false.
+func (routes *LiveRoutes) streaming(started bool) {
+	routes.lock.Lock()
+	defer routes.lock.Unlock()
+	if started {
+		routes.since = routes.clock.Now()
+	} else {
+		routes.since = time.Time{}
+	}
+}
+
+// Run streams updates into the table until the context is done, reconnecting
+// with increasing delays whenever the stream fails.
+func (routes *LiveRoutes) Run(ctx context.Context) {
+	delay := liveRetryMin
+	for {
+		start := time.Now()
+		err := routes.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		// a stream which ran for a while was fine; start backing off afresh
+		if time.Since(start) > liveRetryMax {
+			delay = liveRetryMin
+		}
+		slog.Warn("RIS Live stream failed, reconnecting", "delay", delay.String(), "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > liveRetryMax {
+			delay = liveRetryMax
+		}
+	}
+}
+
+// stream reads updates from a single connection to the feed, until it fails.
+func (routes *LiveRoutes) stream(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, routes.URL, nil)
+	if err != nil {
+		return err
+	}
+	// the stream never ends, so mustn't be subject to the backend timeout
+	client := &http.Client{Transport: HTTPClient.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", routes.URL, resp.Status)
+	}
+	slog.Info("streaming BGP updates", "url", routes.URL)
+	// updates missed while disconnected may leave the table out of date
+	routes.streaming(true)
+	defer routes.streaming(false)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		var msg risMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		if msg.Data != nil {
+			msg = *msg.Data
+		}
+		if msg.Type == "UPDATE" {
+			routes.update(msg)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s closed the stream", routes.URL)
+}
+
+// update applies the announcements and withdrawals of an UPDATE message.
+func (routes *LiveRoutes) update(msg risMessage) {
+	peer := msg.Host + "/" + msg.Peer
+	origin, ok := pathOriginAS(msg.Path)
+
+	routes.lock.Lock()
+	defer routes.lock.Unlock()
+	routes.updates++
+	for _, prefix := range msg.Withdrawals {
+		routes.withdraw(prefix, peer)
+	}
+	if !ok {
+		return
+	}
+	for _, announcement := range msg.Announcements {
+		for _, prefix := range announcement.Prefixes {
+			routes.announce(prefix, peer, origin)
+		}
+	}
+}
+
+// announce records a peer announcing a prefix with the given origin. The
+// caller must hold the write lock.
+func (routes *LiveRoutes) announce(prefix string, peer string, origin uint32) {
+	pfx, ok := parsePrefixKey(prefix)
+	if !ok {
+		return
+	}
+	key := pfx.String()
+	route, ok := routes.routes[key]
+	if !ok {
+		route = &liveRoute{peers: make(map[string]bool)}
+		routes.routes[key] = route
+		trie, pfx := routes.index.trieForPrefix(pfx)
+		trie.Add(pfx, route)
+	}
+	route.origin = origin
+	route.peers[peer] = true
+}
+
+// withdraw records a peer withdrawing a prefix, removing the prefix once no
+// peer announces it. The caller must hold the write lock.
+func (routes *LiveRoutes) withdraw(prefix string, peer string) {
+	pfx, ok := parsePrefixKey(prefix)
+	if !ok {
+		return
+	}
+	key := pfx.String()
+	route, ok := routes.routes[key]
+	if !ok {
+		return
+	}
+	delete(route.peers, peer)
+	if len(route.peers) == 0 {
+		delete(routes.routes, key)
+		trie, pfx := routes.index.trieForPrefix(pfx)
+		trie.Remove(pfx)
+	}
+}
+
+// find returns the longest prefix in the table containing an address, and
+// its origin AS.
+func (routes *LiveRoutes) find(addr net.IP) (string, uint32, bool) {
+	routes.lock.RLock()
+	defer routes.lock.RUnlock()
+	trie, ip := routes.index.trieFor(addr)
+	pfx, data, ok := trie.Find(ip)
+	if !ok {
+		return "", 0, false
+	}
+	return pfx.String(), data.(*liveRoute).origin, true
+}
+
+// Len returns the number of prefixes in the table, and the number of updates
+// applied to it.
+func (routes *LiveRoutes) Len() (int, uint64) {
+	routes.lock.RLock()
+	defer routes.lock.RUnlock()
+	return len(routes.routes), routes.updates
+}
+
+// pathOriginAS returns the origin AS of an AS path as given by RIS Live: the
+// last element, if it is an AS number or an AS set of one.
+func pathOriginAS(path []json.RawMessage) (uint32, bool) {
+	if len(path) == 0 {
+		return 0, false
+	}
+	var origin uint32
+	if json.Unmarshal(path[len(path)-1], &origin) == nil {
+		return origin, true
+	}
+	var set []uint32
+	if json.Unmarshal(path[len(path)-1], &set) == nil && len(set) == 1 {
+		return set[0], true
+	}
+	return 0, false
+}
+
+// LiveBackend is a PrefixBackend answering from a LiveRoutes table where it
+// has a prefix containing the address, and from the fallback backend
+// otherwise. Answers from the table are geolocated by the configured
+// Geolocation backend.
+//
+// Since the table holds only prefixes announced since it was started, it
+// may lack a more specific prefix than the one it has for an address. If the
+// fallback has a local routing table (an MRTBackend), the live table is
+// layered over it: the longest matching prefix of either answers, the live
+// one on a tie, since its origin is fresher. Otherwise the live table
+// answers only once it has converged (see LiveRoutes.Converged), and all
+// lookups go to the fallback until then.
+
+type LiveBackend struct {
+	Routes   *LiveRoutes
+	Fallback PrefixBackend
+}
+
+// routeTable is a backend with a local routing table, which can be searched
+// without cost.
+
+type routeTable interface {
+	Route(addr net.IP) (string, int, bool)
+}
+
+func (backend LiveBackend) Name() string {
+	return "ris-live+" + backendName(backend.Fallback)
+}
+
+func (backend LiveBackend) Lookup(ctx context.Context, addr net.IP) (out PrefixInfo, err error) {
+	prefix, origin, ok := backend.Routes.find(addr)
+	if table, local := backend.Fallback.(routeTable); local {
+		if base, _, found := table.Route(addr); found && (!ok || prefixBits(base) > prefixBits(prefix)) {
+			ok = false
+		}
+	} else if !backend.Routes.Converged() {
+		ok = false
+	}
+	if !ok {
+		return backend.Fallback.Lookup(ctx, addr)
+	}
+	out.Prefix = prefix
+	out.ASN = int(origin)
+	err = geolocate(ctx, addr, &out)
+	return
+}
+
+// prefixBits returns the length of a prefix in CIDR notation, or -1 if it is
+// invalid.
+func prefixBits(prefix string) int {
+	pfx, ok := parsePrefixKey(prefix)
+	if !ok {
+		return -1
+	}
+	ones, _ := pfx.Mask.Size()
+	return ones
+}
+
+// LiveStreamURL returns the RIS Live stream URL restricted to the given
+// route collector (e.g. rrc00), or for all collectors if host is empty.
+func LiveStreamURL(host string) string {
+	if len(host) == 0 {
+		return RISLiveURL
+	}
+	return RISLiveURL + "&host=" + url.QueryEscape(host)
+}
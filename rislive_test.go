@@ -0,0 +1,124 @@
+package canid
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// testLiveRoutes returns a table on a fake clock holding the given prefixes,
+// each announced by one peer with origin AS 64496.
+func testLiveRoutes(t *testing.T, prefixes ...string) (*LiveRoutes, *fakeClock) {
+	t.Helper()
+	routes := NewLiveRoutes("")
+	clock := newFakeClock()
+	routes.clock = clock
+	routes.lock.Lock()
+	for _, prefix := range prefixes {
+		routes.announce(prefix, "rrc00/192.0.2.254", 64496)
+	}
+	routes.lock.Unlock()
+	return routes, clock
+}
+
+// testMRTBackend returns an MRT backend whose table holds the given prefixes,
+// with origin AS 64497.
+func testMRTBackend(t *testing.T, prefixes ...string) *MRTBackend {
+	t.Helper()
+	backend := &MRTBackend{table: prefixIndex{valid: true, v4: new(Trie), v6: new(Trie)}}
+	for _, prefix := range prefixes {
+		trie, pfx := backend.table.trieForPrefix(testPrefix(t, prefix))
+		trie.Add(pfx, uint32(64497))
+	}
+	return backend
+}
+
+// withoutGeolocation disables geolocation for the duration of a test.
+func withoutGeolocation(t *testing.T) {
+	geolocation := Geolocation
+	Geolocation = nil
+	t.Cleanup(func() { Geolocation = geolocation })
+}
+
+func TestLiveBackendLayeredOverMRT(t *testing.T) {
+	withoutGeolocation(t)
+	routes, _ := testLiveRoutes(t, "192.0.2.0/24", "198.51.100.0/22", "2001:db8::/32")
+	backend := LiveBackend{
+		Routes:   routes,
+		Fallback: testMRTBackend(t, "192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8:1::/48"),
+	}
+
+	tests := []struct {
+		addr   string
+		prefix string
+		asn    int
+	}{
+		// same prefix: the live origin is fresher
+		{"192.0.2.1", "192.0.2.0/24", 64496},
+		// the MRT table has a more specific prefix than the live one
+		{"198.51.100.1", "198.51.100.0/24", 64497},
+		{"2001:db8:1::1", "2001:db8:1::/48", 64497},
+		// the live prefix is the more specific, or the only one
+		{"198.51.101.1", "198.51.100.0/22", 64496},
+		{"2001:db8:2::1", "2001:db8::/32", 64496},
+		// only the MRT table has it
+		{"203.0.113.1", "203.0.113.0/24", 64497},
+	}
+	for _, test := range tests {
+		info, err := backend.Lookup(context.Background(), net.ParseIP(test.addr))
+		if err != nil {
+			t.Errorf("%s: %v", test.addr, err)
+			continue
+		}
+		if info.Prefix != test.prefix || info.ASN != test.asn {
+			t.Errorf("%s: got %s AS%d, want %s AS%d", test.addr, info.Prefix, info.ASN, test.prefix, test.asn)
+		}
+	}
+}
+
+func TestLiveBackendWarmup(t *testing.T) {
+	withoutGeolocation(t)
+	routes, clock := testLiveRoutes(t, "192.0.2.0/24")
+	routes.Warmup = time.Hour
+	fallbacks := 0
+	backend := LiveBackend{
+		Routes: routes,
+		Fallback: backendFunc(func(ctx context.Context, addr net.IP) (PrefixInfo, error) {
+			fallbacks++
+			return PrefixInfo{Prefix: "192.0.2.0/25", ASN: 64497}, nil
+		}),
+	}
+	lookup := func() PrefixInfo {
+		t.Helper()
+		info, err := backend.Lookup(context.Background(), net.ParseIP("192.0.2.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	if info := lookup(); info.Prefix != "192.0.2.0/25" || fallbacks != 1 {
+		t.Errorf("answered %s before streaming", info.Prefix)
+	}
+	routes.streaming(true)
+	clock.advance(time.Hour - time.Second)
+	if info := lookup(); info.Prefix != "192.0.2.0/25" || fallbacks != 2 {
+		t.Errorf("answered %s before the warm-up", info.Prefix)
+	}
+	clock.advance(time.Second)
+	if info := lookup(); info.Prefix != "192.0.2.0/24" || info.ASN != 64496 || fallbacks != 2 {
+		t.Errorf("answered %s AS%d after the warm-up, want the live table's", info.Prefix, info.ASN)
+	}
+
+	// a reconnected stream warms up afresh
+	routes.streaming(false)
+	routes.streaming(true)
+	if info := lookup(); info.Prefix != "192.0.2.0/25" || fallbacks != 3 {
+		t.Errorf("answered %s after reconnecting", info.Prefix)
+	}
+	clock.advance(time.Hour)
+	if !routes.Converged() {
+		t.Error("not converged after warming up again")
+	}
+}
@@ -0,0 +1,141 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RPKI route origin validation states, stored in PrefixInfo.RPKIStatus
+const (
+	RPKIValid    = "valid"
+	RPKIInvalid  = "invalid"
+	RPKINotFound = "not-found"
+)
+
+// RPKIValidator determines the RPKI route origin validation state of an
+// announcement of a prefix by an AS: one of the RPKI constants.
+
+type RPKIValidator interface {
+	Validate(ctx context.Context, asn int, prefix string) (string, error)
+}
+
+// RPKIValidation is the RPKIValidator used to fill in RPKIStatus for new
+// prefix cache entries, whatever the prefix backend. Set it before any
+// lookups; nil (the default) disables validation.
+var RPKIValidation RPKIValidator
+
+// validateRPKI fills in the RPKI status of an entry, if validation is
+// enabled and the entry has an origin AS. If validation fails, the entry is
+// marked Partial, with the reason in Warnings.
+func validateRPKI(ctx context.Context, out *PrefixInfo) {
+	validator := RPKIValidation
+	if validator == nil || out.ASN == 0 || len(out.Prefix) == 0 {
+		return
+	}
+	status, err := validator.Validate(ctx, out.ASN, out.Prefix)
+	if err != nil {
+		slog.Warn("RPKI validation failed", "asn", out.ASN, "prefix", out.Prefix, "err", err)
+		out.Partial = true
+		out.Warnings = append(out.Warnings, "RPKI validation failed: "+err.Error())
+		return
+	}
+	out.RPKIStatus = status
+}
+
+// RipestatRPKIValidator validates announcements using RIPEstat's RPKI
+// validation API.
+
+type RipestatRPKIValidator struct{}
+
+func (RipestatRPKIValidator) Validate(ctx context.Context, asn int, prefix string) (string, error) {
+	v := make(url.Values)
+	v.Add("resource", strconv.Itoa(asn))
+	v.Add("prefix", prefix)
+	body, err := fetchRipestatQuery(ctx, ripeStatRPKICall, v)
+	if err != nil {
+		return "", err
+	}
+
+	checkRipestatSchema(ripeStatRPKICall, body)
+
+	var doc struct {
+		Status string
+		Data   struct {
+			Status string
+		}
+	}
+	parse_start := time.Now()
+	err = json.Unmarshal(body, &doc)
+	observeTiming(ctx, TimingParse, parse_start)
+	if err != nil {
+		return "", err
+	}
+	if doc.Status != "ok" {
+		return "", errors.New("RIPEstat request failed with status " + doc.Status)
+	}
+
+	// RIPEstat distinguishes kinds of invalid, and calls not-found unknown
+	switch {
+	case doc.Data.Status == RPKIValid:
+		return RPKIValid, nil
+	case strings.HasPrefix(doc.Data.Status, RPKIInvalid):
+		return RPKIInvalid, nil
+	case doc.Data.Status == "unknown" || doc.Data.Status == RPKINotFound:
+		return RPKINotFound, nil
+	default:
+		return "", fmt.Errorf("unknown RIPEstat RPKI status %s", doc.Data.Status)
+	}
+}
+
+// RoutinatorValidator validates announcements using the HTTP API of a local
+// relying party such as Routinator, at URL (e.g. http://localhost:8323/),
+// which serves /api/v1/validity/<asn>/<prefix>.
+
+type RoutinatorValidator struct {
+	URL string
+}
+
+func (validator RoutinatorValidator) Validate(ctx context.Context, asn int, prefix string) (string, error) {
+	apiurl := strings.TrimSuffix(validator.URL, "/") + "/api/v1/validity/AS" + strconv.Itoa(asn) + "/" + prefix
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiurl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("RPKI validity request failed with status %s", resp.Status)
+	}
+
+	var doc struct {
+		Validated_Route struct {
+			Validity struct {
+				State string
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", err
+	}
+
+	switch state := doc.Validated_Route.Validity.State; state {
+	case RPKIValid, RPKIInvalid, RPKINotFound:
+		return state, nil
+	default:
+		return "", fmt.Errorf("unknown RPKI state %s", state)
+	}
+}
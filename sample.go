@@ -0,0 +1,56 @@
+package canid
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"net"
+)
+
+// Sample re-queries the backend for up to n randomly chosen entries in the
+// prefix cache, without modifying the cache, and counts how many disagree
+// with the backend's current answer on ASN or country code. The counters are
+// exposed through Stats, as a signal of how quickly cached data drifts.
+func (cache *PrefixCache) Sample(ctx context.Context, n int) {
+	keys := cache.Keys()
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	if n < len(keys) {
+		keys = keys[:n]
+	}
+
+	for _, key := range keys {
+		cache.lock.RLock()
+		cached, ok := cache.Data[key]
+		cache.lock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		addr, _, err := net.ParseCIDR(key)
+		if err != nil {
+			continue
+		}
+
+		var current PrefixInfo
+		err = cache.pipeline.limited(ctx, func() (err error) {
+			current, err = cache.backend.Lookup(ctx, addr)
+			return
+		})
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			slog.Warn("sampling failed", "prefix", key, "err", err)
+			continue
+		}
+
+		cache.stats.sampled()
+		if current.ASN != cached.ASN {
+			slog.Info("sampled prefix ASN changed", "prefix", key, "cached_asn", cached.ASN, "current_asn", current.ASN)
+			cache.stats.asnDisagreement()
+		}
+		if current.CountryCode != cached.CountryCode {
+			slog.Info("sampled prefix country changed", "prefix", key, "cached_country_code", cached.CountryCode, "current_country_code", current.CountryCode)
+			cache.stats.countryDisagreement()
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package canid
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Fields of RIPEstat responses canid relies on, per data call, as
+// dot-separated paths. A response missing one of these indicates that the
+// upstream schema has changed in a way that breaks canid's data.
+var ripeStatRequiredFields = map[string][]string{
+	ripeStatPrefixCall:     {"status", "data.resource", "data.is_less_specific", "data.asns", "data.block"},
+	ripeStatGeolocCall:     {"status", "data.locations"},
+	ripeStatRPKICall:       {"status", "data.status"},
+	ripeStatASOverviewCall: {"status", "data.holder"},
+}
+
+// ripestatSchema tracks the fields seen in responses to each data call. The
+// first response to each call establishes the baseline; fields appearing
+// after that are reported as new.
+
+type ripestatSchema struct {
+	lock          sync.Mutex
+	seen          map[string]map[string]bool
+	missingFields uint64
+	newFields     uint64
+}
+
+var ripestatSchemaTracker = ripestatSchema{seen: make(map[string]map[string]bool)}
+
+// SchemaDriftStats counts changes observed in the fields of backend
+// responses since startup.
+
+type SchemaDriftStats struct {
+	MissingFields uint64
+	NewFields     uint64
+	SeenFields    map[string][]string
+}
+
+// fieldPaths returns the top-level keys of a response, and the keys of its
+// data object prefixed with "data.".
+func fieldPaths(doc map[string]interface{}) []string {
+	out := make([]string, 0, len(doc))
+	for key, value := range doc {
+		out = append(out, key)
+		if key == "data" {
+			if data, ok := value.(map[string]interface{}); ok {
+				for datakey := range data {
+					out = append(out, "data."+datakey)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// checkRipestatSchema compares the fields in a RIPEstat response against the
+// fields canid relies on and the fields seen before, logging and counting
+// any differences.
+func checkRipestatSchema(dataCall string, body []byte) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		// the real decode will report this
+		return
+	}
+
+	// error responses legitimately lack data; don't count them
+	if status, _ := doc["status"].(string); status != "ok" {
+		return
+	}
+
+	paths := fieldPaths(doc)
+	present := make(map[string]bool)
+	for _, path := range paths {
+		present[path] = true
+	}
+
+	t := &ripestatSchemaTracker
+	for _, path := range ripeStatRequiredFields[dataCall] {
+		if !present[path] {
+			slog.Warn("schema drift: RIPEstat response lacks required field", "data_call", dataCall, "field", path)
+			atomic.AddUint64(&t.missingFields, 1)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	seen, baseline := t.seen[dataCall]
+	if !baseline {
+		seen = make(map[string]bool)
+		t.seen[dataCall] = seen
+	}
+	for _, path := range paths {
+		if !seen[path] {
+			if baseline {
+				slog.Info("schema drift: RIPEstat response has new field", "data_call", dataCall, "field", path)
+				atomic.AddUint64(&t.newFields, 1)
+			}
+			seen[path] = true
+		}
+	}
+}
+
+// RipestatSchemaDrift returns counts of missing and new fields observed in
+// RIPEstat responses, together with all fields seen per data call.
+func RipestatSchemaDrift() (out SchemaDriftStats) {
+	t := &ripestatSchemaTracker
+	out.MissingFields = atomic.LoadUint64(&t.missingFields)
+	out.NewFields = atomic.LoadUint64(&t.newFields)
+	out.SeenFields = make(map[string][]string)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for dataCall, seen := range t.seen {
+		fields := make([]string, 0, len(seen))
+		for field := range seen {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		out.SeenFields[dataCall] = fields
+	}
+	return
+}
+
+func RipestatSchemaDriftServer(w http.ResponseWriter, req *http.Request) {
+	drift_body, _ := json.Marshal(RipestatSchemaDrift())
+	w.Write(drift_body)
+}
@@ -0,0 +1,203 @@
+package canid
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SearchResult is a cached entry matching a search.
+
+type SearchResult struct {
+	Key     string       `source:"canid" doc:"Key of the entry, as listed by /cache/keys.json"`
+	Prefix  *PrefixInfo  `json:",omitempty" source:"canid" doc:"The entry, if it is in the prefix cache"`
+	Address *AddressInfo `json:",omitempty" source:"canid" doc:"The entry, if it is in the address cache"`
+	Record  *RecordInfo  `json:",omitempty" source:"canid" doc:"The entry, if it is in a record cache"`
+}
+
+// SearchQuery selects cached entries: prefix entries by origin AS, country
+// code, and a substring of the prefix, and address and record entries by a
+// suffix of the name (or, for PTR entries, of any of the names the address
+// maps to). An entry matches if it matches every criterion given.
+
+type SearchQuery struct {
+	ASN         int
+	CountryCode string
+	Prefix      string
+	NameSuffix  string
+}
+
+// ParseSearchQuery parses a query of space-separated field:value terms, with
+// fields asn (with or without an AS prefix), country, prefix, and name. Prefix
+// terms (asn, country, and prefix) and name terms cannot be combined, since
+// they select entries of different caches.
+func ParseSearchQuery(q string) (query SearchQuery, err error) {
+	terms := strings.Fields(q)
+	if len(terms) == 0 {
+		return query, fmt.Errorf("empty search query")
+	}
+	for _, term := range terms {
+		field, value, ok := strings.Cut(term, ":")
+		if !ok || len(value) == 0 {
+			return query, fmt.Errorf("search term %s is not field:value", term)
+		}
+		switch strings.ToLower(field) {
+		case "asn":
+			asn, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(value), "AS"))
+			if err != nil || asn <= 0 {
+				return query, fmt.Errorf("invalid ASN %s", value)
+			}
+			query.ASN = asn
+		case "country":
+			query.CountryCode = strings.ToUpper(value)
+		case "prefix":
+			query.Prefix = value
+		case "name":
+			query.NameSuffix = strings.TrimSuffix(strings.ToLower(value), ".")
+		default:
+			return query, fmt.Errorf("unknown search field %s", field)
+		}
+	}
+	if query.forPrefixes() && query.forAddresses() {
+		return query, fmt.Errorf("name cannot be combined with asn, country, or prefix")
+	}
+	return query, nil
+}
+
+func (query SearchQuery) forPrefixes() bool {
+	return query.ASN != 0 || len(query.CountryCode) > 0 || len(query.Prefix) > 0
+}
+
+func (query SearchQuery) forAddresses() bool {
+	return len(query.NameSuffix) > 0
+}
+
+func (query SearchQuery) matchPrefix(info PrefixInfo) bool {
+	return (query.ASN == 0 || info.ASN == query.ASN) &&
+		(len(query.CountryCode) == 0 || strings.ToUpper(info.CountryCode) == query.CountryCode) &&
+		strings.Contains(info.Prefix, query.Prefix)
+}
+
+func (query SearchQuery) matchAddress(info AddressInfo) bool {
+	if strings.HasSuffix(info.Name, query.NameSuffix) {
+		return true
+	}
+	for _, name := range info.Names {
+		if strings.HasSuffix(strings.TrimSuffix(strings.ToLower(name), "."), query.NameSuffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Search returns the entries of the prefix cache matching a query, by key.
+func (cache *PrefixCache) Search(query SearchQuery) map[string]PrefixInfo {
+	out := make(map[string]PrefixInfo)
+	if !query.forPrefixes() {
+		return out
+	}
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	for key, info := range cache.Data {
+		if query.matchPrefix(info) {
+			out[key] = info
+		}
+	}
+	return out
+}
+
+// Search returns the entries of the record cache matching a query, by key.
+func (cache *RecordCache) Search(query SearchQuery) map[string]RecordInfo {
+	out := make(map[string]RecordInfo)
+	if !query.forAddresses() {
+		return out
+	}
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	for key, info := range cache.Data {
+		if strings.HasSuffix(info.Name, query.NameSuffix) {
+			out[key] = info
+		}
+	}
+	return out
+}
+
+// Search returns the entries of the address cache matching a query, by key.
+func (cache *AddressCache) Search(query SearchQuery) map[string]AddressInfo {
+	out := make(map[string]AddressInfo)
+	if !query.forAddresses() {
+		return out
+	}
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	for key, info := range cache.Data {
+		if query.matchAddress(info) {
+			out[key] = info
+		}
+	}
+	return out
+}
+
+// SearchServer returns an HTTP handler for the q parameter, a query as parsed
+// by ParseSearchQuery, listing the matching entries of the caches as
+// SearchResults in order of their keys, prefixed as by KeysServer. Results
+// are paginated as by KeysServer. Either of the prefix and address caches may
+// be nil.
+func SearchServer(prefixes *PrefixCache, addresses *AddressCache, records ...*RecordCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		query, err := ParseSearchQuery(req.URL.Query().Get("q"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			error_struct := struct{ Error string }{err.Error()}
+			error_body, _ := json.Marshal(error_struct)
+			w.Write(error_body)
+			return
+		}
+		limit, after, ok := pageParams(req)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		results := make(map[string]SearchResult)
+		if prefixes != nil {
+			for key, info := range prefixes.Search(query) {
+				info := info
+				info.BackendMeta = nil
+				results["prefix/"+key] = SearchResult{Key: "prefix/" + key, Prefix: &info}
+			}
+		}
+		if addresses != nil {
+			for key, info := range addresses.Search(query) {
+				info := info
+				results["address/"+key] = SearchResult{Key: "address/" + key, Address: &info}
+			}
+		}
+		for _, cache := range records {
+			for key, info := range cache.Search(query) {
+				info := info
+				results[cache.name+"/"+key] = SearchResult{Key: cache.name + "/" + key, Record: &info}
+			}
+		}
+		keys := make([]string, 0, len(results))
+		for key := range results {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		start, end, next := page(keys, limit, after)
+		search_struct := struct {
+			Results    []SearchResult
+			NextCursor string
+		}{make([]SearchResult, 0, end-start), next}
+		for _, key := range keys[start:end] {
+			search_struct.Results = append(search_struct.Results, results[key])
+		}
+
+		search_body, _ := json.Marshal(search_struct)
+		w.Write(search_body)
+	}
+}
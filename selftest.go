@@ -0,0 +1,81 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Known queries used to check that each backend is reachable and answering.
+const (
+	SelfTestAddress = "193.0.0.1"
+	SelfTestName    = "stat.ripe.net"
+)
+
+// SelfTestResult reports the outcome of a single known lookup against a
+// backend, bypassing the cache.
+
+type SelfTestResult struct {
+	Backend      string
+	Query        string
+	OK           bool
+	Error        string `json:",omitempty"`
+	Milliseconds int64
+}
+
+func selfTest(backend string, query string, lookup func() error) (out SelfTestResult) {
+	out.Backend = backend
+	out.Query = query
+	start := time.Now()
+	err := lookup()
+	out.Milliseconds = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		out.Error = err.Error()
+	} else {
+		out.OK = true
+	}
+	return
+}
+
+// SelfTestServer returns an HTTP handler which runs the given self-tests and
+// returns their results as a JSON array. It returns a 503 if any test fails.
+func SelfTestServer(tests ...func() SelfTestResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		results := make([]SelfTestResult, 0, len(tests))
+		status := http.StatusOK
+		for _, test := range tests {
+			result := test()
+			if !result.OK {
+				status = http.StatusServiceUnavailable
+			}
+			results = append(results, result)
+		}
+
+		results_body, _ := json.Marshal(results)
+		w.WriteHeader(status)
+		w.Write(results_body)
+	}
+}
+
+// SelfTest looks up a known address via the backend without touching the
+// cache.
+func (cache *PrefixCache) SelfTest() SelfTestResult {
+	return selfTest(backendName(cache.backend), SelfTestAddress, func() error {
+		return cache.pipeline.limited(context.Background(), func() error {
+			_, err := cache.backend.Lookup(context.Background(), net.ParseIP(SelfTestAddress))
+			return err
+		})
+	})
+}
+
+// SelfTest looks up a known name via DNS without touching the cache.
+func (cache *AddressCache) SelfTest() SelfTestResult {
+	return selfTest("dns", SelfTestName, func() error {
+		return cache.pipeline.limited(context.Background(), func() error {
+			_, err := net.LookupIP(SelfTestName)
+			return err
+		})
+	})
+}
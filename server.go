@@ -0,0 +1,125 @@
+package canid
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// Server routes HTTP requests to canid's resources and to any additional
+// endpoints registered by embedders, passing every request through the same
+// middleware chain.
+
+type Server struct {
+	mux        *http.ServeMux
+	middleware []func(http.Handler) http.Handler
+	drained    int32
+}
+
+// Health states reported by HealthServer
+const (
+	HealthOK      = "OK"
+	HealthDrained = "Drained"
+)
+
+// HealthStatus is the response of the /healthz resource.
+
+type HealthStatus struct {
+	Status string `source:"canid" doc:"OK while serving normally, Drained once shutdown has begun"`
+}
+
+func NewServer() *Server {
+	s := new(Server)
+	s.mux = http.NewServeMux()
+	return s
+}
+
+// Use adds a middleware to the chain. Middleware added first sees requests
+// first. Middleware applies to all endpoints, whenever they were registered.
+func (s *Server) Use(middleware func(http.Handler) http.Handler) {
+	s.middleware = append(s.middleware, middleware)
+}
+
+// Handle registers a handler for the given pattern, as http.ServeMux.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers a handler function for the given pattern, as
+// http.ServeMux.
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// HandleCaches registers canid's standard resources for the given caches,
+// including those of record caches (see HandleRecords). Either of the prefix
+// and address caches may be nil.
+func (s *Server) HandleCaches(prefixes *PrefixCache, addresses *AddressCache, records ...*RecordCache) {
+	selftests := make([]func() SelfTestResult, 0)
+	if prefixes != nil {
+		s.HandleFunc("/prefix.json", prefixes.LookupServer)
+		s.HandleFunc("/prefixes.json", prefixes.BulkLookupServer)
+		s.HandleFunc("/stats/prefix.json", prefixes.StatsServer)
+		s.HandleFunc("/admin/purge/prefix", prefixes.PurgeServer)
+		s.HandleFunc("/cache/prefix", prefixes.RemoveServer)
+		s.HandleFunc("/admin/debug/backend.json", prefixes.DebugBackendServer)
+		selftests = append(selftests, prefixes.SelfTest)
+	}
+	if addresses != nil {
+		s.HandleFunc("/address.json", addresses.LookupServer)
+		s.HandleFunc("/verify.json", addresses.VerifyServer)
+		s.HandleFunc("/stats/address.json", addresses.StatsServer)
+		s.HandleFunc("/admin/purge/address", addresses.PurgeServer)
+		s.HandleFunc("/cache/address", addresses.RemoveServer)
+		selftests = append(selftests, addresses.SelfTest)
+	}
+	s.HandleFunc("/admin/selftest", SelfTestServer(selftests...))
+	s.HandleFunc("/lookup.json", LookupServer(prefixes, addresses))
+	s.HandleFunc("/schema.json", DataDictionaryServer)
+	s.HandleFunc("/openapi.json", OpenAPIServer)
+	s.HandleFunc("/stats.json", StatsServer(prefixes, addresses, records...))
+	s.HandleFunc("/healthz", s.HealthServer)
+	s.HandleFunc("/cache/keys.json", KeysServer(prefixes, addresses, records...))
+	s.HandleFunc("/cache/search.json", SearchServer(prefixes, addresses, records...))
+	s.HandleFunc("/cache/quality.json", QualityServer(prefixes, addresses))
+	s.HandleFunc("/cache/flush", FlushServer(prefixes, addresses, records...))
+	s.HandleRecords(records...)
+}
+
+// HandleRecords registers the lookup, statistics, and purge resources of
+// record caches, by record type: e.g. /mx.json, /stats/mx.json, and
+// /admin/purge/mx for an MX cache.
+func (s *Server) HandleRecords(caches ...*RecordCache) {
+	for _, cache := range caches {
+		s.HandleFunc("/"+cache.name+".json", cache.LookupServer)
+		s.HandleFunc("/stats/"+cache.name+".json", cache.StatsServer)
+		s.HandleFunc("/admin/purge/"+cache.name, cache.PurgeServer)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var handler http.Handler = s.mux
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+	handler.ServeHTTP(w, req)
+}
+
+// Drain marks the server as draining before shutdown: it keeps serving
+// requests, but HealthServer reports it as Drained, so that load balancers
+// stop sending it new requests.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.drained, 1)
+}
+
+// HealthServer reports whether the server is serving normally (status 200)
+// or draining (status 503).
+func (s *Server) HealthServer(w http.ResponseWriter, req *http.Request) {
+	health_struct := HealthStatus{HealthOK}
+	if atomic.LoadInt32(&s.drained) != 0 {
+		health_struct.Status = HealthDrained
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	health_body, _ := json.Marshal(health_struct)
+	w.Write(health_body)
+}
@@ -0,0 +1,147 @@
+package canid
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// SharedStore holds encoded cache entries outside a single cache, so that
+// several canid instances (e.g. behind a load balancer) can share one cache.
+// Each cache still keeps its entries in memory: on a miss, it asks the shared
+// store before the backend, and writes entries it fetches from the backend
+// through to the store. Implementations must be safe for concurrent use.
+
+type SharedStore interface {
+	// Get returns the entries stored under the given keys in a cache, in
+	// the same order, with nil for keys not in the store.
+	Get(ctx context.Context, cache string, keys []string) ([][]byte, error)
+	// Put stores an entry in a cache, to be dropped after the given time.
+	Put(ctx context.Context, cache string, key string, value []byte, expiry time.Duration) error
+	// Delete removes the entries stored under the given keys in a cache, or
+	// every entry of the cache if keys is nil.
+	Delete(ctx context.Context, cache string, keys []string) error
+}
+
+// putShared writes an entry through to a shared store, if any, logging any
+// failure; the entry stays cached locally regardless.
+func putShared(store SharedStore, cache string, key string, entry interface{}, expiry int) {
+	if store == nil {
+		return
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("error encoding entry for shared store", "cache", cache, "key", key, "err", err)
+		return
+	}
+	if err := store.Put(context.Background(), cache, key, value, time.Duration(expiry)*time.Second); err != nil {
+		slog.Warn("error writing entry to shared store", "cache", cache, "key", key, "err", err)
+	}
+}
+
+// forget removes entries removed from a cache on request from its shared
+// store and from publishers keeping entries (see Deleter), so that they
+// aren't loaded back from there; every entry of the cache if keys is nil.
+// Failures are logged.
+func forget(store SharedStore, publishers publishers, cache string, keys []string) {
+	if store != nil {
+		if err := store.Delete(context.Background(), cache, keys); err != nil {
+			slog.Warn("error deleting entries from shared store", "cache", cache, "keys", len(keys), "err", err)
+		}
+	}
+	publishers.delete(cache, keys)
+}
+
+// sharedPrefixKeys returns the keys of every prefix containing an address,
+// longest first, as they would appear in the prefix cache.
+func sharedPrefixKeys(addr net.IP) []string {
+	ip, bits := addr.To4(), 32
+	if ip == nil {
+		ip, bits = addr.To16(), 128
+	}
+	if ip == nil {
+		return nil
+	}
+	keys := make([]string, 0, bits+1)
+	for length := bits; length >= 0; length-- {
+		mask := net.CIDRMask(length, bits)
+		keys = append(keys, (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String())
+	}
+	return keys
+}
+
+// SetSharedStore shares the cache's entries with other caches through the
+// given store. It must be called before the cache is used.
+func (cache *PrefixCache) SetSharedStore(store SharedStore) {
+	cache.shared = store
+}
+
+// fetchShared looks up the longest prefix containing an address in the
+// shared store, and caches it locally if found and not expired.
+func (cache *PrefixCache) fetchShared(ctx context.Context, addr net.IP) (out PrefixInfo, ok bool) {
+	if cache.shared == nil {
+		return
+	}
+	keys := sharedPrefixKeys(addr)
+	values, err := cache.shared.Get(ctx, "prefix", keys)
+	if err != nil {
+		slog.Warn("error reading prefixes from shared store", "addr", addr, "err", err)
+		return
+	}
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		if err := json.Unmarshal(value, &out); err != nil {
+			slog.Warn("error decoding entry from shared store", "cache", "prefix", "key", keys[i], "err", err)
+			continue
+		}
+		if age(cache.clock, out.Cached) > cache.expiry {
+			continue
+		}
+		cache.stats.sharedHit()
+		cache.lock.Lock()
+		cache.store(out.Prefix, out)
+		cache.lock.Unlock()
+		slog.Debug("shared hit", "cache", "prefix", "addr", addr, "prefix", out.Prefix, "cache_hit", true)
+		return out, true
+	}
+	return PrefixInfo{}, false
+}
+
+// SetSharedStore shares the cache's entries with other caches through the
+// given store. It must be called before the cache is used.
+func (cache *AddressCache) SetSharedStore(store SharedStore) {
+	cache.shared = store
+}
+
+// fetchShared looks up a key in the shared store, and caches it locally if
+// found and not expired.
+func (cache *AddressCache) fetchShared(ctx context.Context, key AddressKey) (out AddressInfo, ok bool) {
+	if cache.shared == nil {
+		return
+	}
+	values, err := cache.shared.Get(ctx, "address", []string{key.String()})
+	if err != nil {
+		slog.Warn("error reading entry from shared store", "cache", "address", "name", key.String(), "err", err)
+		return
+	}
+	if len(values) == 0 || values[0] == nil {
+		return
+	}
+	if err := json.Unmarshal(values[0], &out); err != nil {
+		slog.Warn("error decoding entry from shared store", "cache", "address", "name", key.String(), "err", err)
+		return AddressInfo{}, false
+	}
+	if age(cache.clock, out.Cached) > cache.entryExpiry(out) {
+		return AddressInfo{}, false
+	}
+	cache.stats.sharedHit()
+	cache.lock.Lock()
+	cache.store(key.String(), out)
+	cache.lock.Unlock()
+	slog.Debug("shared hit", "cache", "address", "name", key.String(), "cache_hit", true)
+	return out, true
+}
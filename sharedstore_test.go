@@ -0,0 +1,176 @@
+package canid
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStore is a SharedStore in a map, ignoring expiry.
+
+type testStore struct {
+	lock sync.Mutex
+	data map[string][]byte
+}
+
+func (s *testStore) Get(ctx context.Context, cache string, keys []string) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out := make([][]byte, len(keys))
+	for i, key := range keys {
+		out[i] = s.data[cache+"/"+key]
+	}
+	return out, nil
+}
+
+func (s *testStore) Put(ctx context.Context, cache string, key string, value []byte, expiry time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data[cache+"/"+key] = value
+	return nil
+}
+
+func TestSharedStorePrefixes(t *testing.T) {
+	store := &testStore{data: make(map[string][]byte)}
+	clock := newFakeClock()
+	backendCalls := 0
+	backend := backendFunc(func(ctx context.Context, addr net.IP) (PrefixInfo, error) {
+		backendCalls++
+		return PrefixInfo{Prefix: "192.0.2.0/24", ASN: 64496}, nil
+	})
+
+	first := NewPrefixCache(3600, 1, backend)
+	first.SetClock(clock)
+	first.SetSharedStore(store)
+	if _, err := first.Lookup(testAddr(t, "192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance finds the entry in the shared store, for any address
+	// in the prefix
+	second := NewPrefixCache(3600, 1, backend)
+	second.SetClock(clock)
+	second.SetSharedStore(store)
+	out, err := second.Lookup(testAddr(t, "192.0.2.200"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Prefix != "192.0.2.0/24" || backendCalls != 1 {
+		t.Errorf("got %s after %d backend calls, want 192.0.2.0/24 from the shared store", out.Prefix, backendCalls)
+	}
+
+	// but not once it has expired according to the cache's clock
+	clock.advance(2 * time.Hour)
+	third := NewPrefixCache(3600, 1, backend)
+	third.SetClock(clock)
+	third.SetSharedStore(store)
+	if _, err := third.Lookup(testAddr(t, "192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if backendCalls != 2 {
+		t.Errorf("expired shared entry used: %d backend calls, want 2", backendCalls)
+	}
+}
+
+func (s *testStore) Delete(ctx context.Context, cache string, keys []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.data {
+		if keys == nil && strings.HasPrefix(key, cache+"/") {
+			delete(s.data, key)
+		}
+	}
+	for _, key := range keys {
+		delete(s.data, cache+"/"+key)
+	}
+	return nil
+}
+
+// testDeleter is a Deleter keeping published keys, as a backing store.
+
+type testDeleter struct {
+	keys map[string]bool
+}
+
+func (d *testDeleter) Publish(event CacheEvent) {
+	d.keys[event.Cache+"/"+event.Key] = true
+}
+
+func (d *testDeleter) Delete(cache string, keys []string) {
+	for key := range d.keys {
+		if keys == nil && strings.HasPrefix(key, cache+"/") {
+			delete(d.keys, key)
+		}
+	}
+	for _, key := range keys {
+		delete(d.keys, cache+"/"+key)
+	}
+}
+
+func TestSharedStoreRemove(t *testing.T) {
+	store := &testStore{data: make(map[string][]byte)}
+	deleter := &testDeleter{keys: make(map[string]bool)}
+	backendCalls := 0
+	prefixes := NewPrefixCache(3600, 1, backendFunc(func(ctx context.Context, addr net.IP) (PrefixInfo, error) {
+		backendCalls++
+		return PrefixInfo{Prefix: "192.0.2.0/24", ASN: 64496}, nil
+	}))
+	prefixes.SetClock(newFakeClock())
+	prefixes.SetSharedStore(store)
+	prefixes.AddPublisher(deleter)
+	addresses := NewAddressCache(3600, 1, prefixes)
+	addresses.SetSharedStore(store)
+	addresses.AddPublisher(deleter)
+	s := NewServer()
+	s.HandleCaches(prefixes, addresses)
+	request := func(method string, path string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d", method, path, w.Code)
+		}
+	}
+	lookup := func(wantCalls int) {
+		t.Helper()
+		if _, err := prefixes.Lookup(testAddr(t, "192.0.2.1")); err != nil {
+			t.Fatal(err)
+		}
+		if backendCalls != wantCalls {
+			t.Errorf("%d backend calls, want %d", backendCalls, wantCalls)
+		}
+	}
+
+	lookup(1)
+	if store.data["prefix/192.0.2.0/24"] == nil || !deleter.keys["prefix/192.0.2.0/24"] {
+		t.Fatal("entry not written through")
+	}
+
+	// a removed entry isn't loaded back from the store
+	request(http.MethodDelete, "/cache/prefix?prefix=192.0.2.0/24")
+	if store.data["prefix/192.0.2.0/24"] != nil || deleter.keys["prefix/192.0.2.0/24"] {
+		t.Error("removed entry kept in store")
+	}
+	lookup(2)
+
+	// nor are flushed ones, including those only in the store
+	store.Put(context.Background(), "prefix", "198.51.100.0/24", []byte(`{"Prefix":"198.51.100.0/24"}`), time.Hour)
+	request(http.MethodPost, "/cache/flush")
+	if len(store.data) != 0 || len(deleter.keys) != 0 {
+		t.Errorf("flushed entries kept in store: %v, %v", store.data, deleter.keys)
+	}
+	lookup(3)
+
+	// a name's entries stored by another instance are removed too
+	key := NewAddressKey("example.com", QueryTypeA, SystemResolver).String()
+	store.Put(context.Background(), "address", key, []byte(`{"Name":"example.com"}`), time.Hour)
+	request(http.MethodDelete, "/cache/address?name=example.com")
+	if store.data["address/"+key] != nil {
+		t.Error("removed name kept in store")
+	}
+}
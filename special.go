@@ -0,0 +1,68 @@
+package canid
+
+import (
+	"net"
+	"time"
+)
+
+// Special-purpose address blocks from the IANA IPv4 and IPv6 special-purpose
+// address registries, which are not routed on the public Internet, so there
+// is no point asking a backend about them. More specific blocks come first.
+var specialBlocks = []struct {
+	prefix string
+	name   string
+}{
+	{"192.0.0.0/29", "IPv4 Service Continuity Prefix"},
+	{"192.0.0.0/24", "IETF Protocol Assignments"},
+	{"192.0.2.0/24", "Documentation (TEST-NET-1)"},
+	{"198.51.100.0/24", "Documentation (TEST-NET-2)"},
+	{"203.0.113.0/24", "Documentation (TEST-NET-3)"},
+	{"0.0.0.0/8", "This network"},
+	{"10.0.0.0/8", "Private-Use"},
+	{"100.64.0.0/10", "Shared Address Space"},
+	{"127.0.0.0/8", "Loopback"},
+	{"169.254.0.0/16", "Link Local"},
+	{"172.16.0.0/12", "Private-Use"},
+	{"192.168.0.0/16", "Private-Use"},
+	{"198.18.0.0/15", "Benchmarking"},
+	{"240.0.0.0/4", "Reserved"},
+	{"::1/128", "Loopback Address"},
+	{"::/128", "Unspecified Address"},
+	{"64:ff9b:1::/48", "IPv4-IPv6 Translation"},
+	{"100::/64", "Discard-Only Address Block"},
+	{"2001:db8::/32", "Documentation"},
+	{"2001::/23", "IETF Protocol Assignments"},
+	{"fc00::/7", "Unique-Local"},
+	{"fe80::/10", "Link-Local Unicast"},
+	{"ff00::/8", "Multicast"},
+	{"224.0.0.0/4", "Multicast"},
+}
+
+var specialNets []*net.IPNet
+
+func init() {
+	specialNets = make([]*net.IPNet, len(specialBlocks))
+	for i, block := range specialBlocks {
+		_, specialNets[i], _ = net.ParseCIDR(block.prefix)
+	}
+}
+
+// SpecialPurpose returns the special-purpose block containing an address, and
+// its name in the IANA registry, e.g. 10.0.0.0/8 and Private-Use. It returns
+// false for globally routable addresses.
+func SpecialPurpose(addr net.IP) (prefix string, name string, ok bool) {
+	for i, block := range specialNets {
+		if block.Contains(addr) {
+			return specialBlocks[i].prefix, specialBlocks[i].name, true
+		}
+	}
+	return "", "", false
+}
+
+// specialPrefixInfo returns prefix information for an address in a
+// special-purpose block, without an origin AS or location.
+func specialPrefixInfo(addr net.IP, now time.Time) (out PrefixInfo, ok bool) {
+	out.Prefix, out.Special, ok = SpecialPurpose(addr)
+	out.Cached = now
+	return
+}
@@ -0,0 +1,45 @@
+package canid
+
+import (
+	"context"
+	"log/slog"
+	"net"
+)
+
+// SetServeStale arranges for entries which expired up to the given number of
+// seconds ago to be answered, marked Stale, instead of waiting for the
+// backend, while they are looked up again in the background. Older entries
+// are expired as usual. It must be called before the cache is used.
+func (cache *PrefixCache) SetServeStale(within int) {
+	cache.stale = within
+}
+
+// refreshStale looks up the address of a stale hit again in the background,
+// unless a refresh of its entry is already in flight, and replaces the entry.
+// If the lookup fails, the entry is answered stale until it is too old.
+func (cache *PrefixCache) refreshStale(addr net.IP, prefix string) {
+	go func() {
+		// keyed by prefix, so that hits for other addresses in it share the
+		// refresh, but not with misses, which are keyed by address block
+		_, err := cache.pipeline.fetch(context.Background(), "stale "+prefix, lookupStages{
+			shared: func(ctx context.Context) (interface{}, bool) {
+				return cache.fetchShared(ctx, addr)
+			},
+			backend: func(ctx context.Context) (interface{}, error) {
+				return cache.lookupBackend(ctx, addr)
+			},
+			store: func(ctx context.Context, result interface{}) (interface{}, error) {
+				out := result.(PrefixInfo)
+				slog.Debug("refreshed stale entry", "cache", "prefix", "prefix", prefix)
+				cache.replace(prefix, out)
+				if incomplete(out) {
+					cache.scheduleRetry(addr, out.Prefix, 1)
+				}
+				return out, nil
+			},
+		})
+		if err != nil {
+			slog.Warn("stale refresh failed", "prefix", prefix, "err", err)
+		}
+	}()
+}
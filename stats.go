@@ -0,0 +1,241 @@
+package canid
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats summarizes the contents and activity of a single cache.
+
+type CacheStats struct {
+	Cache         string `source:"canid" doc:"Cache name: prefix or address"`
+	Entries       int    `source:"canid" doc:"Number of entries currently cached"`
+	Hits          uint64 `source:"canid" doc:"Lookups answered from the cache"`
+	Misses        uint64 `source:"canid" doc:"Lookups passed to the backend"`
+	Expirations   uint64 `source:"canid" doc:"Entries removed on lookup because they expired"`
+	Evictions     uint64 `source:"canid" doc:"Entries removed to stay within capacity"`
+	Rejections    uint64 `source:"canid" doc:"New entries not admitted to a full cache"`
+	BackendCalls  uint64 `source:"canid" doc:"Backend lookups made, including retries"`
+	BackendErrors uint64 `source:"canid" doc:"Backend lookups which failed"`
+
+	DuplicateFetches uint64 `source:"canid" doc:"Backend lookups for entries a concurrent miss had already cached"`
+
+	HitRate float64   `source:"canid" doc:"Fraction of cache lookups which were hits, Hits / (Hits + Misses); 0 before any lookup"`
+	Since   time.Time `source:"canid" doc:"Time counting started, when the cache was created, in UTC"`
+
+	CoalescedFetches uint64 `json:",omitempty" source:"canid" doc:"Misses which shared the backend lookup of a concurrent miss"`
+	SharedHits       uint64 `json:",omitempty" source:"canid" doc:"Misses answered from the shared store rather than the backend"`
+	SpecialAnswers   uint64 `json:",omitempty" source:"canid" doc:"Lookups of special-purpose addresses answered without the cache or backend"`
+	SyntheticAnswers uint64 `json:",omitempty" source:"canid" doc:"Lookups answered from synthetic test entries"`
+	Refreshes        uint64 `json:",omitempty" source:"canid" doc:"Frequently hit entries refreshed before they expired"`
+	StaleAnswers     uint64 `json:",omitempty" source:"canid" doc:"Hits answered with an expired entry while it was refreshed in the background"`
+	BudgetRefusals   uint64 `json:",omitempty" source:"canid" doc:"Misses not passed to the backend because their request's backend call budget was used up"`
+
+	// Drift sampling results; see PrefixCache.Sample
+	Samples              uint64 `json:",omitempty" source:"canid" doc:"Cached prefixes re-queried to measure drift"`
+	ASNDisagreements     uint64 `json:",omitempty" source:"canid" doc:"Samples whose ASN differed from the cached entry"`
+	CountryDisagreements uint64 `json:",omitempty" source:"canid" doc:"Samples whose country code differed from the cached entry"`
+
+	Timings map[string]LatencyHistogram `json:",omitempty" source:"canid" doc:"Time spent in each stage of lookups, by stage name"`
+}
+
+// Counters for cache activity, updated atomically.
+
+type cacheCounters struct {
+	hits          uint64
+	misses        uint64
+	expirations   uint64
+	evictions     uint64
+	rejections    uint64
+	backendCalls  uint64
+	backendErrors uint64
+
+	duplicateFetches uint64
+	coalescedFetches uint64
+	sharedHits       uint64
+	specialAnswers   uint64
+	syntheticAnswers uint64
+	refreshes        uint64
+	staleAnswers     uint64
+	budgetRefusals   uint64
+
+	samples              uint64
+	asnDisagreements     uint64
+	countryDisagreements uint64
+
+	timings lookupTimings
+	since   time.Time
+}
+
+// newCacheCounters returns counters starting now according to a clock.
+func newCacheCounters(clock Clock) cacheCounters {
+	return cacheCounters{timings: newLookupTimings(), since: clock.Now().UTC()}
+}
+
+func (c *cacheCounters) hit() {
+	atomic.AddUint64(&c.hits, 1)
+}
+
+func (c *cacheCounters) miss() {
+	atomic.AddUint64(&c.misses, 1)
+}
+
+func (c *cacheCounters) expired() {
+	atomic.AddUint64(&c.expirations, 1)
+}
+
+func (c *cacheCounters) evicted() {
+	atomic.AddUint64(&c.evictions, 1)
+}
+
+func (c *cacheCounters) rejected() {
+	atomic.AddUint64(&c.rejections, 1)
+}
+
+func (c *cacheCounters) backendCall() {
+	atomic.AddUint64(&c.backendCalls, 1)
+}
+
+func (c *cacheCounters) backendError() {
+	atomic.AddUint64(&c.backendErrors, 1)
+}
+
+func (c *cacheCounters) duplicateFetch() {
+	atomic.AddUint64(&c.duplicateFetches, 1)
+}
+
+func (c *cacheCounters) coalescedFetch() {
+	atomic.AddUint64(&c.coalescedFetches, 1)
+}
+
+func (c *cacheCounters) sharedHit() {
+	atomic.AddUint64(&c.sharedHits, 1)
+}
+
+func (c *cacheCounters) specialAnswer() {
+	atomic.AddUint64(&c.specialAnswers, 1)
+}
+
+func (c *cacheCounters) syntheticAnswer() {
+	atomic.AddUint64(&c.syntheticAnswers, 1)
+}
+
+func (c *cacheCounters) refreshed() {
+	atomic.AddUint64(&c.refreshes, 1)
+}
+
+func (c *cacheCounters) staleAnswer() {
+	atomic.AddUint64(&c.staleAnswers, 1)
+}
+
+func (c *cacheCounters) budgetRefusal() {
+	atomic.AddUint64(&c.budgetRefusals, 1)
+}
+
+func (c *cacheCounters) sampled() {
+	atomic.AddUint64(&c.samples, 1)
+}
+
+func (c *cacheCounters) asnDisagreement() {
+	atomic.AddUint64(&c.asnDisagreements, 1)
+}
+
+func (c *cacheCounters) countryDisagreement() {
+	atomic.AddUint64(&c.countryDisagreements, 1)
+}
+
+func (c *cacheCounters) snapshot(name string, entries int) CacheStats {
+	hits, misses := atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+	hit_rate := 0.0
+	if hits+misses > 0 {
+		hit_rate = float64(hits) / float64(hits+misses)
+	}
+	return CacheStats{
+		Cache:         name,
+		Entries:       entries,
+		Hits:          hits,
+		Misses:        misses,
+		HitRate:       hit_rate,
+		Since:         c.since,
+		Expirations:   atomic.LoadUint64(&c.expirations),
+		Evictions:     atomic.LoadUint64(&c.evictions),
+		Rejections:    atomic.LoadUint64(&c.rejections),
+		BackendCalls:  atomic.LoadUint64(&c.backendCalls),
+		BackendErrors: atomic.LoadUint64(&c.backendErrors),
+
+		DuplicateFetches: atomic.LoadUint64(&c.duplicateFetches),
+		CoalescedFetches: atomic.LoadUint64(&c.coalescedFetches),
+		SharedHits:       atomic.LoadUint64(&c.sharedHits),
+		SpecialAnswers:   atomic.LoadUint64(&c.specialAnswers),
+		SyntheticAnswers: atomic.LoadUint64(&c.syntheticAnswers),
+		Refreshes:        atomic.LoadUint64(&c.refreshes),
+		StaleAnswers:     atomic.LoadUint64(&c.staleAnswers),
+		BudgetRefusals:   atomic.LoadUint64(&c.budgetRefusals),
+
+		Samples:              atomic.LoadUint64(&c.samples),
+		ASNDisagreements:     atomic.LoadUint64(&c.asnDisagreements),
+		CountryDisagreements: atomic.LoadUint64(&c.countryDisagreements),
+
+		Timings: c.timings.snapshot(),
+	}
+}
+
+// PublishExpvars publishes the statistics of the given caches as the expvar
+// variable canid, an object with a CacheStats object per cache, for serving
+// with expvar.Handler. Either of the prefix and address caches may be nil. It
+// must be called at most once.
+func PublishExpvars(prefixes *PrefixCache, addresses *AddressCache, records ...*RecordCache) {
+	expvar.Publish("canid", expvar.Func(func() interface{} {
+		return allStats(prefixes, addresses, records...)
+	}))
+}
+
+// allStats returns the statistics of the given caches, keyed by cache name.
+// Either of the prefix and address caches may be nil.
+func allStats(prefixes *PrefixCache, addresses *AddressCache, records ...*RecordCache) map[string]CacheStats {
+	out := make(map[string]CacheStats)
+	if prefixes != nil {
+		out["prefix"] = prefixes.Stats()
+	}
+	if addresses != nil {
+		out["address"] = addresses.Stats()
+	}
+	for _, cache := range records {
+		out[cache.name] = cache.Stats()
+	}
+	return out
+}
+
+// StatsServer returns an HTTP handler reporting the statistics of the caches
+// since startup, as a JSON object with a CacheStats object per cache. Either
+// of the prefix and address caches may be nil.
+func StatsServer(prefixes *PrefixCache, addresses *AddressCache, records ...*RecordCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		stats_body, _ := json.Marshal(allStats(prefixes, addresses, records...))
+		w.Write(stats_body)
+	}
+}
+
+func writeStats(w http.ResponseWriter, stats CacheStats) {
+	stats_body, _ := json.Marshal(stats)
+	w.Write(stats_body)
+}
+
+// purgeServer writes the number of entries removed by a purge, rejecting
+// anything but POST.
+func purgeServer(w http.ResponseWriter, req *http.Request, name string, purge func() int) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	purge_struct := struct {
+		Cache  string
+		Purged int
+	}{name, purge()}
+	purge_body, _ := json.Marshal(purge_struct)
+	w.Write(purge_body)
+}
@@ -0,0 +1,22 @@
+package canid
+
+import "testing"
+
+func TestStatsSinceClock(t *testing.T) {
+	clock := newFakeClock()
+	prefixes := NewPrefixCache(3600, 1, nil)
+	prefixes.SetClock(clock)
+	addresses := NewAddressCache(3600, 1, prefixes)
+	addresses.SetClock(clock)
+	records, err := NewRecordCache(QueryTypeMX, 3600, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records.SetClock(clock)
+
+	for _, stats := range []CacheStats{prefixes.Stats(), addresses.Stats(), records.Stats()} {
+		if !stats.Since.Equal(clock.Now()) {
+			t.Errorf("%s: counting since %s, want %s", stats.Cache, stats.Since, clock.Now())
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package canid
+
+import (
+	"fmt"
+	"net"
+)
+
+// SetSyntheticEntries configures fixed entries, each for a prefix (or a single
+// address, as a host prefix) with the given ASN and country code, which are
+// answered locally for any address they contain, ahead of everything else,
+// without ever asking the backend or caching them. They give external
+// monitoring an entry which is always available, to check the path through
+// the API without depending on, or using up, the backends. It must be called
+// before the cache is used.
+func (cache *PrefixCache) SetSyntheticEntries(entries []PrefixInfo) error {
+	index := prefixIndex{valid: true, v4: new(Trie), v6: new(Trie)}
+	for _, entry := range entries {
+		pfx, ok := parsePrefixKey(entry.Prefix)
+		if !ok {
+			ip := net.ParseIP(entry.Prefix)
+			if ip == nil {
+				return fmt.Errorf("invalid synthetic prefix %s", entry.Prefix)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				pfx = net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+			} else {
+				pfx = net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+			}
+		}
+		entry.Prefix = pfx.String()
+		entry.Synthetic = true
+		trie, pfx := index.trieForPrefix(pfx)
+		trie.Add(pfx, entry)
+	}
+	cache.synthetic = &index
+	return nil
+}
+
+// syntheticPrefixInfo returns the synthetic entry containing an address, if
+// any.
+func (cache *PrefixCache) syntheticPrefixInfo(addr net.IP) (out PrefixInfo, ok bool) {
+	if cache.synthetic == nil {
+		return
+	}
+	trie, ip := cache.synthetic.trieFor(addr)
+	_, entry, ok := trie.Find(ip)
+	if !ok {
+		return
+	}
+	out = entry.(PrefixInfo)
+	out.Cached = cache.now()
+	return out, true
+}
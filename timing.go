@@ -0,0 +1,114 @@
+package canid
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets, in milliseconds. Samples
+// above the last bound are counted in a final, unbounded bucket.
+var latencyBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// Lookup stages with timing histograms
+const (
+	TimingCacheProbe  = "CacheProbe"
+	TimingLimiterWait = "LimiterWait"
+	TimingBackend     = "Backend"
+	TimingParse       = "Parse"
+	TimingPrecache    = "Precache"
+)
+
+var timingStages = []string{TimingCacheProbe, TimingLimiterWait, TimingBackend, TimingParse, TimingPrecache}
+
+// LatencyHistogram summarizes the time spent in one stage of a lookup.
+// Counts[i] is the number of samples no greater than Buckets[i] milliseconds
+// and greater than Buckets[i-1]; the final count is for samples greater than
+// the last bucket.
+
+type LatencyHistogram struct {
+	Buckets         []float64 `source:"canid" doc:"Upper bounds of the buckets, in milliseconds"`
+	Counts          []uint64  `source:"canid" doc:"Samples per bucket, with a final count for samples above the last bound"`
+	Count           uint64    `source:"canid" doc:"Total number of samples"`
+	SumMilliseconds float64   `source:"canid" doc:"Total time of all samples, in milliseconds"`
+}
+
+// Latency histogram, updated atomically.
+
+type latencyHistogram struct {
+	counts [14]uint64 // len(latencyBuckets) + 1
+	count  uint64
+	sum    uint64 // microseconds
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+	i := 0
+	for i < len(latencyBuckets) && ms > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d/time.Microsecond))
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	out := LatencyHistogram{
+		Buckets: latencyBuckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Count:   atomic.LoadUint64(&h.count),
+	}
+	for i := range h.counts {
+		out.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	out.SumMilliseconds = float64(atomic.LoadUint64(&h.sum)) / 1000
+	return out
+}
+
+// Timing histograms for each lookup stage of a cache.
+
+type lookupTimings struct {
+	stages map[string]*latencyHistogram
+}
+
+func newLookupTimings() lookupTimings {
+	t := lookupTimings{stages: make(map[string]*latencyHistogram)}
+	for _, stage := range timingStages {
+		t.stages[stage] = new(latencyHistogram)
+	}
+	return t
+}
+
+// observe records the time since start for a lookup stage.
+func (t lookupTimings) observe(stage string, start time.Time) {
+	if h := t.stages[stage]; h != nil {
+		h.observe(time.Since(start))
+	}
+}
+
+// snapshot returns histograms for all stages with at least one sample.
+func (t lookupTimings) snapshot() map[string]LatencyHistogram {
+	out := make(map[string]LatencyHistogram)
+	for stage, h := range t.stages {
+		if s := h.snapshot(); s.Count > 0 {
+			out[stage] = s
+		}
+	}
+	return out
+}
+
+type timingsKey struct{}
+
+// withTimings returns a context carrying a cache's timings, so that backends
+// can report the time spent in stages the cache can't see, such as parsing.
+func withTimings(ctx context.Context, t lookupTimings) context.Context {
+	return context.WithValue(ctx, timingsKey{}, t)
+}
+
+// observeTiming records the time since start for a lookup stage, in the
+// timings carried by the context, if any.
+func observeTiming(ctx context.Context, stage string, start time.Time) {
+	if t, ok := ctx.Value(timingsKey{}).(lookupTimings); ok {
+		t.observe(stage, start)
+	}
+}
@@ -0,0 +1,39 @@
+package canid
+
+// PrefixTransform modifies prefix information just before it is returned to
+// a client, e.g. to redact fields on a public instance. It is applied to a
+// copy of the cached entry, so must replace rather than modify in place any
+// slices or pointed-to values it changes.
+
+type PrefixTransform func(info *PrefixInfo)
+
+// AddressTransform modifies address information just before it is returned
+// to a client, as PrefixTransform.
+
+type AddressTransform func(info *AddressInfo)
+
+// AddTransform arranges for every prefix information response to be passed
+// through the given transform, after any added earlier. It must be called
+// before the cache is used.
+func (cache *PrefixCache) AddTransform(transform PrefixTransform) {
+	cache.transforms = append(cache.transforms, transform)
+}
+
+func (cache *PrefixCache) transform(info *PrefixInfo) {
+	for _, transform := range cache.transforms {
+		transform(info)
+	}
+}
+
+// AddTransform arranges for every address information response to be passed
+// through the given transform, after any added earlier. It must be called
+// before the cache is used.
+func (cache *AddressCache) AddTransform(transform AddressTransform) {
+	cache.transforms = append(cache.transforms, transform)
+}
+
+func (cache *AddressCache) transform(info *AddressInfo) {
+	for _, transform := range cache.transforms {
+		transform(info)
+	}
+}
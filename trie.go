@@ -4,68 +4,62 @@ import (
 	"net"
 )
 
-// Trie for storing fast lookups of information by prefix.
-// Not yet tested or integrated with canid.
+// Binary trie for storing fast lookups of information by prefix, keyed on
+// the bits of the masked address. Addresses and prefixes of different
+// lengths (IPv4 and IPv6) must be kept in separate tries.
 
 type Trie struct {
 	sub  [2]*Trie
 	data interface{}
 }
 
-// Return the prefix and data associated with a given IP address in the trie
-func (t *Trie) Find(addr net.IP) (pfx net.IPNet, data interface{}, ok bool) {
+var addrmasks = [8]byte{0x80, 0x40, 0x20, 0x10, 0x08, 0x04, 0x02, 0x01}
+
+// bit returns the value (0 or 1) of bit i of an address
+func bit(addr []byte, i int) int {
+	if addr[i/8]&addrmasks[i%8] == 0 {
+		return 0
+	}
+	return 1
+}
 
-	addrmasks := [8]byte{0x80, 0x40, 0x20, 0x10, 0x08, 0x04, 0x02, 0x01}
-	netmask := make([]byte, len(addr))
+// Return the longest prefix and associated data in the trie containing a
+// given IP address
+func (t *Trie) Find(addr net.IP) (pfx net.IPNet, data interface{}, ok bool) {
 	current := t
+	pfxlen := 0
 
-	// and iterate
-	for pfxlen := 0; pfxlen < (len(addr) * 8); pfxlen++ {
-		// return data if the current trie node is a leaf
+	for i := 0; current != nil; i++ {
+		// remember the longest prefix with data so far
 		if current.data != nil {
-			cnetmask := net.IPMask(netmask)
-			return net.IPNet{addr.Mask(cnetmask), cnetmask}, current.data, true
-		}
-
-		// otherwise determine whether to go right or left
-		var branch int
-		if addr[pfxlen/8]&addrmasks[pfxlen%8] == 0 {
-			branch = 0
-		} else {
-			branch = 1
+			data, ok, pfxlen = current.data, true, i
 		}
 
-		current = current.sub[branch]
-
-		// stop searching if nil
-		if current == nil {
+		// stop at the end of the address
+		if i == len(addr)*8 {
 			break
 		}
 
-		// and move to the next bit
-		netmask[pfxlen/8] |= addrmasks[pfxlen%8]
+		current = current.sub[bit(addr, i)]
 	}
 
-	return net.IPNet{}, nil, false
-}
+	if !ok {
+		return net.IPNet{}, nil, false
+	}
 
-// Add a prefix to the trie and associate some data with it
+	mask := net.CIDRMask(pfxlen, len(addr)*8)
+	return net.IPNet{IP: addr.Mask(mask), Mask: mask}, data, true
+}
 
+// Add a prefix to the trie and associate some data with it, replacing any
+// data already associated with the prefix
 func (t *Trie) Add(pfx net.IPNet, data interface{}) {
-	addrmasks := [8]byte{0x80, 0x40, 0x20, 0x10, 0x08, 0x04, 0x02, 0x01}
-
+	ones, _ := pfx.Mask.Size()
 	current := t
-	subidx := 0
 
 	// first search to the bottom of the trie, creating nodes as necessary
-	for i := 0; pfx.Mask[i/8]&addrmasks[i%8] > 0; i++ {
-
-		if pfx.IP[i/8]&addrmasks[i%8] == 0 {
-			subidx = 0
-		} else {
-			subidx = 1
-		}
-
+	for i := 0; i < ones; i++ {
+		subidx := bit(pfx.IP, i)
 		if current.sub[subidx] == nil {
 			current.sub[subidx] = new(Trie)
 		}
@@ -74,5 +68,37 @@ func (t *Trie) Add(pfx net.IPNet, data interface{}) {
 
 	/* now add data */
 	current.data = data
+}
+
+// Remove a prefix from the trie, pruning nodes which no longer lead to any
+// data. Returns false if the prefix was not in the trie.
+func (t *Trie) Remove(pfx net.IPNet) bool {
+	ones, _ := pfx.Mask.Size()
+
+	// find the node, remembering the path to it
+	path := make([]*Trie, 0, ones+1)
+	current := t
+	for i := 0; i < ones; i++ {
+		path = append(path, current)
+		current = current.sub[bit(pfx.IP, i)]
+		if current == nil {
+			return false
+		}
+	}
+
+	if current.data == nil {
+		return false
+	}
+	current.data = nil
+
+	// prune empty leaves back up the path
+	for i := ones - 1; i >= 0; i-- {
+		if current.data != nil || current.sub[0] != nil || current.sub[1] != nil {
+			break
+		}
+		path[i].sub[bit(pfx.IP, i)] = nil
+		current = path[i]
+	}
 
+	return true
 }
@@ -0,0 +1,165 @@
+package canid
+
+import (
+	"net"
+	"testing"
+)
+
+// testPrefix parses a prefix, failing the test if it is invalid.
+func testPrefix(t *testing.T, s string) net.IPNet {
+	t.Helper()
+	_, pfx, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *pfx
+}
+
+// testAddr parses an address in the form tries are keyed on: 4 bytes for
+// IPv4, including IPv4-mapped IPv6 addresses, and 16 for IPv6.
+func testAddr(t *testing.T, s string) net.IP {
+	t.Helper()
+	addr := net.ParseIP(s)
+	if addr == nil {
+		t.Fatalf("invalid address %s", s)
+	}
+	if addr4 := addr.To4(); addr4 != nil {
+		return addr4
+	}
+	return addr
+}
+
+// testTrie returns a trie holding each of the given prefixes, with the
+// prefix as data.
+func testTrie(t *testing.T, prefixes ...string) *Trie {
+	trie := new(Trie)
+	for _, s := range prefixes {
+		trie.Add(testPrefix(t, s), s)
+	}
+	return trie
+}
+
+func TestTrieFind(t *testing.T) {
+	v4 := testTrie(t, "0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "10.1.2.3/32", "192.0.2.0/24")
+	v6 := testTrie(t, "::/0", "2001:db8::/32", "2001:db8:1::/48", "2001:db8:1:2::/64", "2001:db8:1:2::1/128")
+
+	tests := []struct {
+		trie *Trie
+		addr string
+		want string
+	}{
+		{v4, "10.1.2.3", "10.1.2.3/32"},
+		{v4, "10.1.2.4", "10.1.2.0/24"},
+		{v4, "10.1.3.1", "10.1.0.0/16"},
+		{v4, "10.2.0.1", "10.0.0.0/8"},
+		{v4, "11.0.0.1", "0.0.0.0/0"},
+		{v4, "192.0.2.255", "192.0.2.0/24"},
+		{v4, "192.0.3.0", "0.0.0.0/0"},
+		// IPv4-mapped IPv6 addresses are found in the IPv4 trie
+		{v4, "::ffff:10.1.2.3", "10.1.2.3/32"},
+		{v4, "::ffff:10.1.9.9", "10.1.0.0/16"},
+		{v6, "2001:db8:1:2::1", "2001:db8:1:2::1/128"},
+		{v6, "2001:db8:1:2::2", "2001:db8:1:2::/64"},
+		{v6, "2001:db8:1:3::1", "2001:db8:1::/48"},
+		{v6, "2001:db8:2::1", "2001:db8::/32"},
+		{v6, "2001:db9::1", "::/0"},
+	}
+	for _, test := range tests {
+		pfx, data, ok := test.trie.Find(testAddr(t, test.addr))
+		if !ok {
+			t.Errorf("%s: not found, want %s", test.addr, test.want)
+			continue
+		}
+		if data.(string) != test.want || pfx.String() != test.want {
+			t.Errorf("%s: found %s (%v), want %s", test.addr, pfx.String(), data, test.want)
+		}
+	}
+}
+
+func TestTrieFindMissing(t *testing.T) {
+	tests := []struct {
+		trie *Trie
+		addr string
+	}{
+		{new(Trie), "10.0.0.1"},
+		{testTrie(t, "10.0.0.0/8"), "11.0.0.1"},
+		{testTrie(t, "10.1.2.3/32"), "10.1.2.2"},
+		{testTrie(t, "2001:db8::/32"), "2001:db9::1"},
+		{testTrie(t, "2001:db8::1/128"), "2001:db8::2"},
+	}
+	for _, test := range tests {
+		if pfx, _, ok := test.trie.Find(testAddr(t, test.addr)); ok {
+			t.Errorf("%s: found %s, want nothing", test.addr, pfx.String())
+		}
+	}
+}
+
+func TestTrieAddReplaces(t *testing.T) {
+	trie := testTrie(t, "10.0.0.0/8")
+	trie.Add(testPrefix(t, "10.0.0.0/8"), "replaced")
+	if _, data, ok := trie.Find(testAddr(t, "10.0.0.1")); !ok || data.(string) != "replaced" {
+		t.Errorf("found %v, want replaced", data)
+	}
+}
+
+func TestTrieRemove(t *testing.T) {
+	tests := []struct {
+		name    string
+		trie    []string
+		remove  string
+		removed bool
+		// longest match of each address after removal, or "" for none
+		finds map[string]string
+	}{
+		{"leaf", []string{"10.0.0.0/8", "10.1.0.0/16"}, "10.1.0.0/16", true,
+			map[string]string{"10.1.0.1": "10.0.0.0/8"}},
+		{"interior node", []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24"}, "10.1.0.0/16", true,
+			map[string]string{"10.1.2.1": "10.1.2.0/24", "10.1.3.1": "10.0.0.0/8"}},
+		{"root of nested", []string{"10.0.0.0/8", "10.1.0.0/16"}, "10.0.0.0/8", true,
+			map[string]string{"10.1.0.1": "10.1.0.0/16", "10.2.0.1": ""}},
+		{"default route", []string{"0.0.0.0/0", "10.0.0.0/8"}, "0.0.0.0/0", true,
+			map[string]string{"10.0.0.1": "10.0.0.0/8", "11.0.0.1": ""}},
+		{"host route", []string{"10.1.2.0/24", "10.1.2.3/32"}, "10.1.2.3/32", true,
+			map[string]string{"10.1.2.3": "10.1.2.0/24"}},
+		{"v6 interior node", []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db8:1:2::/64"}, "2001:db8:1::/48", true,
+			map[string]string{"2001:db8:1:2::1": "2001:db8:1:2::/64", "2001:db8:1:3::1": "2001:db8::/32"}},
+		{"v6 host route", []string{"::/0", "2001:db8::1/128"}, "2001:db8::1/128", true,
+			map[string]string{"2001:db8::1": "::/0"}},
+		{"path without data", []string{"10.1.2.0/24"}, "10.1.0.0/16", false,
+			map[string]string{"10.1.2.1": "10.1.2.0/24"}},
+		{"absent", []string{"10.0.0.0/8"}, "11.0.0.0/8", false,
+			map[string]string{"10.0.0.1": "10.0.0.0/8"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trie := testTrie(t, test.trie...)
+			if removed := trie.Remove(testPrefix(t, test.remove)); removed != test.removed {
+				t.Errorf("Remove returned %v, want %v", removed, test.removed)
+			}
+			for addr, want := range test.finds {
+				_, data, ok := trie.Find(testAddr(t, addr))
+				if want == "" && ok {
+					t.Errorf("%s: found %v, want nothing", addr, data)
+				} else if want != "" && (!ok || data.(string) != want) {
+					t.Errorf("%s: found %v, want %s", addr, data, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrieRemovePrunes(t *testing.T) {
+	trie := testTrie(t, "10.1.2.0/24", "10.1.2.3/32")
+	trie.Remove(testPrefix(t, "10.1.2.3/32"))
+	trie.Remove(testPrefix(t, "10.1.2.0/24"))
+	if trie.sub[0] != nil || trie.sub[1] != nil {
+		t.Error("empty nodes left after removing every prefix")
+	}
+
+	// an interior node with data below it is kept
+	trie = testTrie(t, "10.0.0.0/8", "10.1.0.0/16")
+	trie.Remove(testPrefix(t, "10.0.0.0/8"))
+	if trie.sub[0] == nil {
+		t.Error("path to remaining prefix pruned")
+	}
+}